@@ -40,6 +40,7 @@ log_error(const char *file, const char *function, int line, const char *msg, int
 int
 db_close(DB *dbp) {
     int ret;
+    index_detach(dbp);
     if ((ret = dbp->close(dbp, 0)) != 0) {
         LOG_ERROR("close", ret);
     }
@@ -64,6 +65,10 @@ db_get(DB *dbp, DB_TXN *txn, char *_key, unsigned int keylen, char **_data, unsi
     data.flags = DB_DBT_REALLOC;
     data.data = *_data;
 
+    // DB_RMW表示接下来要写入，和db_put一样先对表加锁，保证加锁的顺序一致
+    if ((flags & DB_RMW) && (ret = index_sync(dbp, txn)) != 0) {
+        return ret;
+    }
     ret = dbp->get(dbp, txn, &key, &data, flags);
     if (ret == 0) {
         *_data = data.data;
@@ -77,6 +82,83 @@ db_get(DB *dbp, DB_TXN *txn, char *_key, unsigned int keylen, char **_data, unsi
     return ret;
 }
 
+int
+db_get_partial(DB *dbp, DB_TXN *txn, char *_key, unsigned int keylen, char **_data, unsigned int *datalen, unsigned int doff, unsigned int dlen, unsigned int flags) {
+    DBT key, data;
+    int ret;
+
+    memset(&key, 0, sizeof key);
+    memset(&data, 0, sizeof data);
+
+    key.data = _key;
+    key.size = keylen;
+
+    // 只读取[doff, doff + dlen)范围内的数据，超出记录长度的部分不返回
+    data.flags = DB_DBT_REALLOC | DB_DBT_PARTIAL;
+    data.data = *_data;
+    data.doff = doff;
+    data.dlen = dlen;
+
+    ret = dbp->get(dbp, txn, &key, &data, flags);
+    if (ret == 0) {
+        *_data = data.data;
+        *datalen = data.size;
+    } else if (ret == DB_NOTFOUND) {
+        *datalen = 0;
+    } else {
+        LOG_ERROR("get|partial", ret);
+    }
+    return ret;
+}
+
+int
+db_get_size(DB *dbp, DB_TXN *txn, char *_key, unsigned int keylen, unsigned int *datalen, unsigned int flags) {
+    DBT key, data;
+    int ret;
+
+    memset(&key, 0, sizeof key);
+    memset(&data, 0, sizeof data);
+
+    key.data = _key;
+    key.size = keylen;
+
+    // 缓冲区长度为0，bdb返回DB_BUFFER_SMALL并在size中给出记录长度，不会复制数据
+    data.flags = DB_DBT_USERMEM;
+    data.data = NULL;
+    data.ulen = 0;
+
+    ret = dbp->get(dbp, txn, &key, &data, flags);
+    if (ret == 0 || ret == DB_BUFFER_SMALL) {
+        *datalen = data.size;
+        ret = 0;
+    } else if (ret == DB_NOTFOUND) {
+        *datalen = 0;
+    } else {
+        LOG_ERROR("get|size", ret);
+    }
+    return ret;
+}
+
+int
+db_del(DB *dbp, DB_TXN *txn, char *_key, unsigned int keylen, unsigned int flags) {
+    DBT key;
+    int ret;
+
+    memset(&key, 0, sizeof key);
+
+    key.data = _key;
+    key.size = keylen;
+
+    if ((ret = index_sync(dbp, txn)) != 0) {
+        return ret;
+    }
+    ret = dbp->del(dbp, txn, &key, flags);
+    if (ret != 0 && ret != DB_NOTFOUND) {
+        LOG_ERROR("del", ret);
+    }
+    return ret;
+}
+
 int
 txn_begin(DB_ENV *dbenv, DB_TXN **txn, unsigned int flags) {
     int ret;
@@ -84,6 +166,18 @@ txn_begin(DB_ENV *dbenv, DB_TXN **txn, unsigned int flags) {
     if (ret) {
         LOG_ERROR("txn_begin", ret);
     }
+    return ret;
+}
+
+/* txn_begin_child 子事务提交后合并到parent，出错时只回滚子事务 */
+int
+txn_begin_child(DB_ENV *dbenv, DB_TXN *parent, DB_TXN **txn, unsigned int flags) {
+    int ret;
+    ret = dbenv->txn_begin(dbenv, parent, txn, flags);
+    if (ret) {
+        LOG_ERROR("txn_begin|child", ret);
+    }
+    return ret;
 }
 
 int
@@ -93,6 +187,7 @@ txn_abort(DB_TXN *txn) {
     if (ret) {
         LOG_ERROR("abort", ret);
     }
+    return ret;
 }
 
 int
@@ -102,6 +197,7 @@ txn_commit(DB_TXN *txn) {
     if (ret) {
         LOG_ERROR("commit", ret);
     }
+    return ret;
 }
 
 int
@@ -159,10 +255,120 @@ db_put(DB *dbp, DB_TXN *txn, char *_key, unsigned int keylen, char *_data, unsig
     data.data = _data;
     data.size = datalen;
 
+    if ((ret = index_sync(dbp, txn)) != 0) {
+        return ret;
+    }
     ret = dbp->put(dbp, txn, &key, &data, flags);
     return ret;
 }
 
+int
+db_put_partial(DB *dbp, DB_TXN *txn, char *_key, unsigned int keylen, char *_data, unsigned int datalen, unsigned int doff, unsigned int dlen, unsigned int flags) {
+    DBT key, data;
+    int ret;
+
+    memset(&key, 0, sizeof key);
+    memset(&data, 0, sizeof data);
+
+    key.data = _key;
+    key.size = keylen;
+
+    // 用datalen字节替换[doff, doff + dlen)，记录不存在或长度不足时bdb会用0填充
+    data.flags = DB_DBT_PARTIAL;
+    data.data = _data;
+    data.size = datalen;
+    data.doff = doff;
+    data.dlen = dlen;
+
+    if ((ret = index_sync(dbp, txn)) != 0) {
+        return ret;
+    }
+    ret = dbp->put(dbp, txn, &key, &data, flags);
+    return ret;
+}
+
+int
+db_cursor(DB *dbp, DB_TXN *txn, DBC **cur, unsigned int flags) {
+    int ret;
+
+    ret = dbp->cursor(dbp, txn, cur, flags);
+    if (ret) {
+        LOG_ERROR("cursor", ret);
+    }
+    return ret;
+}
+
+int
+cursor_get(DBC *cur, char **_key, unsigned int *keylen, char **_data, unsigned int *datalen, unsigned int flags) {
+    DBT key, data;
+    int ret;
+
+    memset(&key, 0, sizeof key);
+    memset(&data, 0, sizeof data);
+
+    // DB_SET_RANGE等操作需要传入key，所以key的缓冲区也必须是malloc分配的
+    key.flags = DB_DBT_REALLOC;
+    key.data = *_key;
+    key.size = *keylen;
+
+    data.flags = DB_DBT_REALLOC;
+    data.data = *_data;
+
+    ret = cur->get(cur, &key, &data, flags);
+    if (ret == 0) {
+        *_key = key.data;
+        *keylen = key.size;
+        *_data = data.data;
+        *datalen = data.size;
+    } else if (ret != DB_NOTFOUND) {
+        LOG_ERROR("get|cursor", ret);
+    }
+    return ret;
+}
+
+// cursor_pget 读取索引游标，返回索引key和主表key，不读取主表数据
+int
+cursor_pget(DBC *cur, char **_skey, unsigned int *skeylen, char **_pkey, unsigned int *pkeylen, unsigned int flags) {
+    DBT skey, pkey, data;
+    int ret;
+
+    memset(&skey, 0, sizeof skey);
+    memset(&pkey, 0, sizeof pkey);
+    memset(&data, 0, sizeof data);
+
+    skey.flags = DB_DBT_REALLOC;
+    skey.data = *_skey;
+    skey.size = *skeylen;
+
+    pkey.flags = DB_DBT_REALLOC;
+    pkey.data = *_pkey;
+
+    data.flags = DB_DBT_PARTIAL;
+    data.dlen = 0;
+
+    ret = cur->pget(cur, &skey, &pkey, &data, flags);
+    if (ret == 0) {
+        *_skey = skey.data;
+        *skeylen = skey.size;
+        *_pkey = pkey.data;
+        *pkeylen = pkey.size;
+    } else if (ret != DB_NOTFOUND) {
+        LOG_ERROR("pget|cursor", ret);
+    }
+    return ret;
+}
+
+int
+cursor_close(DBC *cur) {
+    int ret;
+
+    ret = cur->close(cur);
+    if (ret) {
+        LOG_ERROR("close|cursor", ret);
+    }
+    return ret;
+}
+
 struct msgpack_reader_ctx {
     char *buf;
     int pos;
@@ -292,7 +498,7 @@ expire_key_compare(DB *db, const DBT *a, const DBT *b, size_t *locp) {
 }
 
 int
-get_db(DB_ENV *dbenv, SHARED_DATA *shared_data, const char *name, int dbtype, DB **out) {
+open_db(DB_ENV *dbenv, SHARED_DATA *shared_data, const char *name, int dbtype, unsigned int dbflags, DB **out) {
     DB *dbp;
     int ret, ret2;
 	u_int32_t flags;
@@ -329,6 +535,13 @@ get_db(DB_ENV *dbenv, SHARED_DATA *shared_data, const char *name, int dbtype, DB
             return ret;
         }
     }
+    if (dbflags && (ret = dbp->set_flags(dbp, dbflags)) != 0) {
+        LOG_ERROR("set_flags", ret);
+        if ((ret2 = dbp->close(dbp, 0)) != 0) {
+            LOG_ERROR("close", ret2);
+        }
+        return ret;
+    }
     if ((ret = dbp->open(dbp, NULL, name, NULL, dbtype, flags, 0)) != 0) {
         LOG_ERROR("open", ret);
         if ((ret2 = dbp->close(dbp, 0)) != 0) {
@@ -341,6 +554,22 @@ get_db(DB_ENV *dbenv, SHARED_DATA *shared_data, const char *name, int dbtype, DB
     return 0;
 }
 
+// get_db 打开表并挂载表上的二级索引
+int
+get_db(DB_ENV *dbenv, SHARED_DATA *shared_data, const char *name, int dbtype, DB **out) {
+    int ret;
+
+    if ((ret = open_db(dbenv, shared_data, name, dbtype, 0, out)) != 0) {
+        return ret;
+    }
+    if ((ret = index_attach(dbenv, shared_data, *out, name)) != 0) {
+        LOG_ERROR("index_attach", ret);
+        db_close(*out);
+        *out = NULL;
+    }
+    return ret;
+}
+
 #define DEFAULT_TABLE "__default"
 void
 split_key(char *_key, int keylen, char **table, int *tablelen, char **name, int *namelen) {
@@ -378,3 +607,69 @@ split_key(char *_key, int keylen, char **table, int *tablelen, char **name, int
 	}
 }
 
+/*
+ * env_set_flush 和配置文件中的flush含义一样:
+ * 0: DB_TXN_NOSYNC, 1: 每次提交都写盘, 2: DB_TXN_WRITE_NOSYNC
+ */
+int
+env_set_flush(DB_ENV *dbenv, int flush) {
+    int ret;
+    if ((ret = dbenv->set_flags(dbenv, DB_TXN_NOSYNC, flush == 0)) != 0) {
+        LOG_ERROR("set_flags|nosync", ret);
+        return ret;
+    }
+    if ((ret = dbenv->set_flags(dbenv, DB_TXN_WRITE_NOSYNC, flush == 2)) != 0) {
+        LOG_ERROR("set_flags|write_nosync", ret);
+        return ret;
+    }
+    return 0;
+}
+
+int
+env_get_flush(DB_ENV *dbenv, int *flush) {
+    u_int32_t flags;
+    int ret;
+    if ((ret = dbenv->get_flags(dbenv, &flags)) != 0) {
+        LOG_ERROR("get_flags", ret);
+        return ret;
+    }
+    if (flags & DB_TXN_NOSYNC) {
+        *flush = 0;
+    } else if (flags & DB_TXN_WRITE_NOSYNC) {
+        *flush = 2;
+    } else {
+        *flush = 1;
+    }
+    return 0;
+}
+
+int
+env_set_timeout(DB_ENV *dbenv, unsigned int usec, unsigned int which) {
+    int ret;
+    if ((ret = dbenv->set_timeout(dbenv, usec, which)) != 0) {
+        LOG_ERROR("set_timeout", ret);
+    }
+    return ret;
+}
+
+/* env_checkpoint 退出前强制checkpoint，下次启动时不需要恢复太多的日志 */
+int
+env_checkpoint(DB_ENV *dbenv) {
+    int ret;
+    if ((ret = dbenv->txn_checkpoint(dbenv, 0, 0, DB_FORCE)) != 0) {
+        LOG_ERROR("txn_checkpoint", ret);
+    }
+    return ret;
+}
+
+int
+env_get_timeout(DB_ENV *dbenv, unsigned int *usec, unsigned int which) {
+    db_timeout_t timeout;
+    int ret;
+    if ((ret = dbenv->get_timeout(dbenv, &timeout, which)) != 0) {
+        LOG_ERROR("get_timeout", ret);
+        return ret;
+    }
+    *usec = timeout;
+    return 0;
+}
@@ -13,8 +13,9 @@ import (
 /*
 #cgo CFLAGS: -O2
 #cgo CXXFLAGS: -O2 -std=c++11
-#cgo LDFLAGS: -l:libdb.a
+#cgo LDFLAGS: -l:libdb.a -lcrypto
 #include <stdlib.h>
+#include <string.h>
 #include <errno.h>
 #include "bdb.h"
 */
@@ -34,6 +35,21 @@ const (
 
 	DB_NOOVERWRITE = C.DB_NOOVERWRITE
 	DB_RMW         = C.DB_RMW
+
+	DB_FIRST     = C.DB_FIRST
+	DB_LAST      = C.DB_LAST
+	DB_NEXT      = C.DB_NEXT
+	DB_PREV      = C.DB_PREV
+	DB_SET       = C.DB_SET
+	DB_SET_RANGE = C.DB_SET_RANGE
+
+	DB_SET_LOCK_TIMEOUT = C.DB_SET_LOCK_TIMEOUT
+	DB_SET_TXN_TIMEOUT  = C.DB_SET_TXN_TIMEOUT
+
+	INDEX_JSON    = C.INDEX_FORMAT_JSON
+	INDEX_MSGPACK = C.INDEX_FORMAT_MSGPACK
+	INDEX_STRING  = C.INDEX_TYPE_STRING
+	INDEX_NUMBER  = C.INDEX_TYPE_NUMBER
 )
 
 type BdbConfig struct {
@@ -49,11 +65,20 @@ type BdbConfig struct {
 	RemotePeer      string
 	Verbose         bool
 	Flush           int
+	// RepSecret 非repmgr模式下站点之间的共享密钥，配置后连接需要认证并加密，所有站点必须一样
+	RepSecret string
+
+	// 以下参数也可以通过CONFIG SET修改，0表示使用默认值
+	LockTimeout        int // 毫秒
+	TxnTimeout         int // 毫秒
+	CheckpointInterval int // 秒
+	ExpireBatch        int
 }
 
 type DbEnv struct {
 	env         *C.DB_ENV
 	shared_data *C.SHARED_DATA
+	home        string
 	waitStop    sync.WaitGroup
 	waitExit    sync.WaitGroup
 	waitReady   sync.WaitGroup
@@ -64,21 +89,44 @@ type Db struct {
 	db   *C.DB
 }
 
+type IndexInfo struct {
+	Name   string
+	Format int
+	Type   int
+	Path   string
+}
+
+type StatItem struct {
+	Section string
+	Name    string
+	Value   int64
+}
+
 type Txn struct {
 	txn *C.DB_TXN
 }
 
+type Cursor struct {
+	cur     *C.DBC
+	keybuf  *C.char
+	keylen  C.uint
+	databuf *C.char
+}
+
 var (
-	ErrNotReady = errors.New("not_ready")
-	ErrNotExist = errors.New("not_exist")
-	ErrDeadLock = errors.New("dead_lock")
-	ErrRepDead  = errors.New("rep_dead")
-	ErrLockout  = errors.New("lockout")
-	ErrAccess   = errors.New("access")
-	ErrInval    = errors.New("inval")
-	ErrNotFound = errors.New("not_found")
-	ErrKeyExist = errors.New("key_exist")
-	ErrUnknown  = errors.New("unknown")
+	ErrNotReady   = errors.New("not_ready")
+	ErrNotExist   = errors.New("not_exist")
+	ErrDeadLock   = errors.New("dead_lock")
+	ErrNotGranted = errors.New("lock_not_granted")
+	ErrRepDead    = errors.New("rep_dead")
+	ErrLockout    = errors.New("lockout")
+	ErrAccess     = errors.New("access")
+	ErrInval      = errors.New("inval")
+	ErrNotFound   = errors.New("not_found")
+	ErrKeyExist   = errors.New("key_exist")
+	ErrUnknown    = errors.New("unknown")
+
+	ErrTooManyIndex = errors.New("too_many_index")
 )
 
 func Start(config BdbConfig) *DbEnv {
@@ -133,7 +181,20 @@ func Start(config BdbConfig) *DbEnv {
 		args = append(args, "-v")
 	}
 
+	if config.RepSecret != "" {
+		if config.RepMgr {
+			log.Error("bdb|repsecret_ignored_with_repmgr")
+		} else {
+			secret := C.CString(config.RepSecret)
+			C.rep_set_secret(secret, C.int(len(config.RepSecret)))
+			C.free(unsafe.Pointer(secret))
+		}
+	} else if !config.RepMgr {
+		log.Info("bdb|replication_without_repsecret")
+	}
+
 	dbenv := new(DbEnv)
+	dbenv.home = config.HomeDir
 	dbenv.waitStop.Add(1)
 	dbenv.waitExit.Add(1)
 	dbenv.waitReady.Add(1)
@@ -159,6 +220,23 @@ func Start(config BdbConfig) *DbEnv {
 		dbenv.waitExit.Done()
 	}()
 	dbenv.waitReady.Wait()
+
+	if config.LockTimeout > 0 {
+		if err := dbenv.SetTimeout(DB_SET_LOCK_TIMEOUT, uint32(config.LockTimeout)*1000); err != nil {
+			log.Error("bdb|SetTimeout|lock|%s", err.Error())
+		}
+	}
+	if config.TxnTimeout > 0 {
+		if err := dbenv.SetTimeout(DB_SET_TXN_TIMEOUT, uint32(config.TxnTimeout)*1000); err != nil {
+			log.Error("bdb|SetTimeout|txn|%s", err.Error())
+		}
+	}
+	if config.CheckpointInterval > 0 {
+		SetCheckpointInterval(config.CheckpointInterval)
+	}
+	if config.ExpireBatch > 0 {
+		SetExpireBatch(config.ExpireBatch)
+	}
 	return dbenv
 }
 
@@ -193,6 +271,8 @@ func ResultToError(r C.int) error {
 		return nil
 	case C.DB_LOCK_DEADLOCK:
 		return ErrDeadLock
+	case C.DB_LOCK_NOTGRANTED:
+		return ErrNotGranted
 	case C.DB_REP_HANDLE_DEAD:
 		return ErrRepDead
 	case C.DB_REP_LOCKOUT:
@@ -249,11 +329,107 @@ func (dbenv *DbEnv) GetDb(name string, dbtype int) (*Db, error) {
 	}
 }
 
+// Checkpoint 立即做一次checkpoint
+func (dbenv *DbEnv) Checkpoint() error {
+	return ResultToError(C.env_checkpoint(dbenv.env))
+}
+
 func (dbenv *DbEnv) Exit() {
 	dbenv.waitStop.Done()
 	dbenv.waitExit.Wait()
 }
 
+// IsMaster 当前节点是否为主节点
+func (dbenv *DbEnv) IsMaster() bool {
+	return dbenv.shared_data.is_master != 0
+}
+
+// Home 数据库环境所在的目录
+func (dbenv *DbEnv) Home() string {
+	return dbenv.home
+}
+
+// Stat 取得bdb环境的统计信息，按分类排列
+func (dbenv *DbEnv) Stat() []StatItem {
+	var items [128]C.struct_stat_item
+	n := int(C.env_stat(dbenv.env, dbenv.shared_data, &items[0], C.int(len(items))))
+	r := make([]StatItem, n)
+	for i := 0; i < n; i++ {
+		r[i] = StatItem{
+			Section: C.GoString(items[i].section),
+			Name:    C.GoString(items[i].name),
+			Value:   int64(items[i].value),
+		}
+	}
+	return r
+}
+
+// ExpireBacklog 已经到期还没有被删除的记录数，最多统计到limit
+func (dbenv *DbEnv) ExpireBacklog(limit uint32) (uint32, error) {
+	var count C.uint
+	ret := C.expire_backlog(dbenv.env, dbenv.shared_data, C.uint(limit), &count)
+	if err := ResultToError(ret); err != nil {
+		return 0, err
+	}
+	return uint32(count), nil
+}
+
+// SetFlush 修改提交时的写盘方式，含义和BdbConfig.Flush一样
+func (dbenv *DbEnv) SetFlush(flush int) error {
+	return ResultToError(C.env_set_flush(dbenv.env, C.int(flush)))
+}
+
+func (dbenv *DbEnv) GetFlush() (int, error) {
+	var flush C.int
+	if err := ResultToError(C.env_get_flush(dbenv.env, &flush)); err != nil {
+		return 0, err
+	}
+	return int(flush), nil
+}
+
+// SetTimeout which为DB_SET_LOCK_TIMEOUT或DB_SET_TXN_TIMEOUT，单位微秒，0表示不超时
+func (dbenv *DbEnv) SetTimeout(which int, usec uint32) error {
+	return ResultToError(C.env_set_timeout(dbenv.env, C.uint(usec), C.uint(which)))
+}
+
+func (dbenv *DbEnv) GetTimeout(which int) (uint32, error) {
+	var usec C.uint
+	if err := ResultToError(C.env_get_timeout(dbenv.env, &usec, C.uint(which))); err != nil {
+		return 0, err
+	}
+	return uint32(usec), nil
+}
+
+// SetCheckpointInterval 两次checkpoint之间的秒数
+func SetCheckpointInterval(sec int) {
+	C.checkpoint_interval = C.int(sec)
+}
+
+func CheckpointInterval() int {
+	return int(C.checkpoint_interval)
+}
+
+// SetExpireBatch 过期线程每轮最多检查的记录数
+func SetExpireBatch(n int) {
+	C.expire_batch_size = C.int(n)
+}
+
+func ExpireBatch() int {
+	return int(C.expire_batch_size)
+}
+
+// Count 统计表中的记录数，会遍历整个表
+func (dbenv *DbEnv) Count(table string) (uint64, error) {
+	cname := C.CString(table + ".db")
+	defer C.free(unsafe.Pointer(cname))
+	var count C.ulonglong
+	ret := C.db_count(dbenv.env, dbenv.shared_data, cname, &count)
+	if err := ResultToError(ret); err != nil {
+		return 0, err
+	}
+	return uint64(count), nil
+}
+
 func (dbenv *DbEnv) Begin(flags uint32) (*Txn, error) {
 	txn := new(Txn)
 	ret := C.txn_begin(dbenv.env, &txn.txn, C.uint(flags))
@@ -264,6 +440,16 @@ func (dbenv *DbEnv) Begin(flags uint32) (*Txn, error) {
 	}
 }
 
+// BeginChild 在parent中开始一个子事务
+func (dbenv *DbEnv) BeginChild(parent *Txn, flags uint32) (*Txn, error) {
+	txn := new(Txn)
+	ret := C.txn_begin_child(dbenv.env, parent.txn, &txn.txn, C.uint(flags))
+	if err := ResultToError(ret); err != nil {
+		return nil, err
+	}
+	return txn, nil
+}
+
 func (txn *Txn) Commit() error {
 	ret := C.txn_commit(txn.txn)
 	return ResultToError(ret)
@@ -293,12 +479,16 @@ func (db *Db) Set(_txn *Txn, key []byte, value []byte, flags uint32) error {
 	if _txn != nil {
 		txn = _txn.txn
 	}
+	var data *C.char = nil
+	if len(value) != 0 {
+		data = (*C.char)(unsafe.Pointer(&value[0]))
+	}
 	ret := C.db_put(
 		db.db,
 		txn,
 		(*C.char)(unsafe.Pointer(&key[0])),
 		C.uint(len(key)),
-		(*C.char)(unsafe.Pointer(&value[0])),
+		data,
 		C.uint(len(value)),
 		C.uint(flags),
 	)
@@ -337,6 +527,95 @@ func (db *Db) Get(_txn *Txn, key []byte, getbuff *uintptr, flags uint32) ([]byte
 	return nil, err
 }
 
+func (db *Db) GetPartial(_txn *Txn, key []byte, off uint32, length uint32, getbuff *uintptr, flags uint32) ([]byte, error) {
+	var data *C.char = (*C.char)(unsafe.Pointer(*getbuff))
+	var datalen C.uint
+
+	var txn *C.DB_TXN = nil
+	if _txn != nil {
+		txn = _txn.txn
+	}
+
+	ret := C.db_get_partial(
+		db.db,
+		txn,
+		(*C.char)(unsafe.Pointer(&key[0])),
+		C.uint(len(key)),
+		&data,
+		&datalen,
+		C.uint(off),
+		C.uint(length),
+		C.uint(flags),
+	)
+	err := ResultToError(ret)
+	if err == nil {
+		*getbuff = uintptr(unsafe.Pointer(data))
+		if data == nil || datalen == 0 {
+			return []byte{}, nil
+		} else {
+			return C.GoBytes(unsafe.Pointer(data), C.int(datalen)), nil
+		}
+	}
+	return nil, err
+}
+
+func (db *Db) SetPartial(_txn *Txn, key []byte, off uint32, length uint32, value []byte, flags uint32) error {
+	var txn *C.DB_TXN = nil
+	if _txn != nil {
+		txn = _txn.txn
+	}
+	var data *C.char = nil
+	if len(value) != 0 {
+		data = (*C.char)(unsafe.Pointer(&value[0]))
+	}
+	ret := C.db_put_partial(
+		db.db,
+		txn,
+		(*C.char)(unsafe.Pointer(&key[0])),
+		C.uint(len(key)),
+		data,
+		C.uint(len(value)),
+		C.uint(off),
+		C.uint(length),
+		C.uint(flags),
+	)
+	return ResultToError(ret)
+}
+
+func (db *Db) Size(_txn *Txn, key []byte, flags uint32) (uint32, error) {
+	var datalen C.uint
+
+	var txn *C.DB_TXN = nil
+	if _txn != nil {
+		txn = _txn.txn
+	}
+
+	ret := C.db_get_size(
+		db.db,
+		txn,
+		(*C.char)(unsafe.Pointer(&key[0])),
+		C.uint(len(key)),
+		&datalen,
+		C.uint(flags),
+	)
+	return uint32(datalen), ResultToError(ret)
+}
+
+func (db *Db) Del(_txn *Txn, key []byte, flags uint32) error {
+	var txn *C.DB_TXN = nil
+	if _txn != nil {
+		txn = _txn.txn
+	}
+	ret := C.db_del(
+		db.db,
+		txn,
+		(*C.char)(unsafe.Pointer(&key[0])),
+		C.uint(len(key)),
+		C.uint(flags),
+	)
+	return ResultToError(ret)
+}
+
 func (db *Db) Close() {
 	ret := C.db_close(db.db)
 	if ret == 0 {
@@ -365,3 +644,164 @@ func (db *Db) Close() {
 		}
 	}()
 }
+
+func (db *Db) Cursor(_txn *Txn, flags uint32) (*Cursor, error) {
+	var txn *C.DB_TXN = nil
+	if _txn != nil {
+		txn = _txn.txn
+	}
+	cur := new(Cursor)
+	ret := C.db_cursor(db.db, txn, &cur.cur, C.uint(flags))
+	if err := ResultToError(ret); err != nil {
+		return nil, err
+	}
+	return cur, nil
+}
+
+// Get 按照flags移动游标，key只在DB_SET/DB_SET_RANGE时使用
+func (cur *Cursor) Get(key []byte, flags uint32) ([]byte, []byte, error) {
+	if key != nil {
+		cur.keybuf = (*C.char)(C.realloc(unsafe.Pointer(cur.keybuf), C.size_t(len(key)+1)))
+		if len(key) != 0 {
+			C.memcpy(unsafe.Pointer(cur.keybuf), unsafe.Pointer(&key[0]), C.size_t(len(key)))
+		}
+		cur.keylen = C.uint(len(key))
+	}
+	var datalen C.uint
+	ret := C.cursor_get(cur.cur, &cur.keybuf, &cur.keylen, &cur.databuf, &datalen, C.uint(flags))
+	if err := ResultToError(ret); err != nil {
+		return nil, nil, err
+	}
+	k := C.GoBytes(unsafe.Pointer(cur.keybuf), C.int(cur.keylen))
+	v := C.GoBytes(unsafe.Pointer(cur.databuf), C.int(datalen))
+	return k, v, nil
+}
+
+func (cur *Cursor) Close() error {
+	ret := C.cursor_close(cur.cur)
+	if cur.keybuf != nil {
+		C.free(unsafe.Pointer(cur.keybuf))
+	}
+	if cur.databuf != nil {
+		C.free(unsafe.Pointer(cur.databuf))
+	}
+	return ResultToError(ret)
+}
+
+// PGet 读取索引游标，返回索引key和主表key
+func (cur *Cursor) PGet(key []byte, flags uint32) ([]byte, []byte, error) {
+	if key != nil {
+		cur.keybuf = (*C.char)(C.realloc(unsafe.Pointer(cur.keybuf), C.size_t(len(key)+1)))
+		if len(key) != 0 {
+			C.memcpy(unsafe.Pointer(cur.keybuf), unsafe.Pointer(&key[0]), C.size_t(len(key)))
+		}
+		cur.keylen = C.uint(len(key))
+	}
+	var pkeylen C.uint
+	ret := C.cursor_pget(cur.cur, &cur.keybuf, &cur.keylen, &cur.databuf, &pkeylen, C.uint(flags))
+	if err := ResultToError(ret); err != nil {
+		return nil, nil, err
+	}
+	skey := C.GoBytes(unsafe.Pointer(cur.keybuf), C.int(cur.keylen))
+	pkey := C.GoBytes(unsafe.Pointer(cur.databuf), C.int(pkeylen))
+	return skey, pkey, nil
+}
+
+// IndexCursor 在表的索引name上打开游标，同时返回索引的类型，索引不存在时返回ErrNotExist
+func (db *Db) IndexCursor(_txn *Txn, name string, flags uint32) (*Cursor, int, error) {
+	var txn *C.DB_TXN = nil
+	if _txn != nil {
+		txn = _txn.txn
+	}
+	cname := C.CString(name)
+	defer C.free(unsafe.Pointer(cname))
+	cur := new(Cursor)
+	var typ C.int
+	ret := C.index_cursor(db.db, txn, cname, &cur.cur, &typ, C.uint(flags))
+	if err := ResultToError(ret); err != nil {
+		return nil, 0, err
+	}
+	return cur, int(typ), nil
+}
+
+// CreateIndex 在table上创建索引，已有的数据会在同一个事务内写入索引
+func (dbenv *DbEnv) CreateIndex(table string, name string, format int, typ int, path string) error {
+	indexes, err := dbenv.ListIndex(table)
+	if err != nil {
+		return err
+	}
+	if len(indexes) >= C.INDEX_MAX {
+		return ErrTooManyIndex
+	}
+	ctable := C.CString(table)
+	defer C.free(unsafe.Pointer(ctable))
+	cname := C.CString(name)
+	defer C.free(unsafe.Pointer(cname))
+	cpath := C.CString(path)
+	defer C.free(unsafe.Pointer(cpath))
+	ret := C.index_create(dbenv.env, dbenv.shared_data, ctable, cname, C.int(format), C.int(typ), cpath)
+	return ResultToError(ret)
+}
+
+// DropIndex 删除table上的索引，索引文件由PurgeIndex删除
+func (dbenv *DbEnv) DropIndex(table string, name string) error {
+	ctable := C.CString(table)
+	defer C.free(unsafe.Pointer(ctable))
+	cname := C.CString(name)
+	defer C.free(unsafe.Pointer(cname))
+	ret := C.index_drop(dbenv.env, dbenv.shared_data, ctable, cname)
+	return ResultToError(ret)
+}
+
+// PurgeIndex 删除已经删除的索引留下的文件，还有句柄打开着索引时返回ErrNotGranted
+func (dbenv *DbEnv) PurgeIndex() error {
+	ret := C.index_purge(dbenv.env, dbenv.shared_data)
+	return ResultToError(ret)
+}
+
+// ListIndex 返回table上定义的索引
+func (dbenv *DbEnv) ListIndex(table string) ([]IndexInfo, error) {
+	db, err := dbenv.GetDb("__index", DBTYPE_UNKNOWN)
+	if err == ErrNotExist {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+	cur, err := db.Cursor(nil, DB_READ_COMMITTED)
+	if err != nil {
+		return nil, err
+	}
+	defer cur.Close()
+
+	prefix := append([]byte(table), 0)
+	var indexes []IndexInfo
+	k, v, err := cur.Get(prefix, DB_SET_RANGE)
+	for ; err == nil; k, v, err = cur.Get(nil, DB_NEXT) {
+		if len(k) <= len(prefix) || string(k[:len(prefix)]) != string(prefix) {
+			break
+		}
+		if len(v) < 3 {
+			continue
+		}
+		info := IndexInfo{Name: string(k[len(prefix):]), Format: int(v[0]), Type: int(v[1])}
+		for i := 2; i < len(v); i++ {
+			if v[i] == 0 {
+				info.Path = string(v[i+1:])
+				break
+			}
+		}
+		indexes = append(indexes, info)
+	}
+	if err != nil && err != ErrNotFound {
+		return nil, err
+	}
+	return indexes, nil
+}
+
+// EncodeIndexNumber 与索引中数值的编码方式相同，用于构造查询范围
+func EncodeIndexNumber(v float64) []byte {
+	var out [8]byte
+	C.index_encode_number(C.double(v), (*C.uchar)(unsafe.Pointer(&out[0])))
+	return out[:]
+}
@@ -22,9 +22,14 @@ void log_error(const char *file, const char *function, int line, const char *msg
 
 int start_base(int argc, char *argv[], int flush, void *ptr);
 int start_mgr(int argc, char *argv[], int flush, void *ptr);
+int rep_set_secret(const char *secret, int len);
 
 int db_get(DB *dbp, DB_TXN *txn, char *_key, unsigned int keylen, char **_data, unsigned int *datalen, unsigned int flags);
 int db_put(DB *dbp, DB_TXN *txn, char *_key, unsigned int keylen, char *_data, unsigned int datalen, unsigned int flags);
+int db_get_partial(DB *dbp, DB_TXN *txn, char *_key, unsigned int keylen, char **_data, unsigned int *datalen, unsigned int doff, unsigned int dlen, unsigned int flags);
+int db_put_partial(DB *dbp, DB_TXN *txn, char *_key, unsigned int keylen, char *_data, unsigned int datalen, unsigned int doff, unsigned int dlen, unsigned int flags);
+int db_get_size(DB *dbp, DB_TXN *txn, char *_key, unsigned int keylen, unsigned int *datalen, unsigned int flags);
+int db_del(DB *dbp, DB_TXN *txn, char *_key, unsigned int keylen, unsigned int flags);
 int db_set_expire(
         DB *expire_db,
         DB *index_db,
@@ -37,12 +42,63 @@ int db_set_expire(
         );
 int db_close(DB *dbp);
 
+int db_cursor(DB *dbp, DB_TXN *txn, DBC **cur, unsigned int flags);
+int cursor_get(DBC *cur, char **_key, unsigned int *keylen, char **_data, unsigned int *datalen, unsigned int flags);
+int cursor_pget(DBC *cur, char **_skey, unsigned int *skeylen, char **_pkey, unsigned int *pkeylen, unsigned int flags);
+int cursor_close(DBC *cur);
+
+int open_db(DB_ENV *dbenv, SHARED_DATA *shared_data, const char *name, int dbtype, unsigned int dbflags, DB **out);
 int get_db(DB_ENV *dbenv, SHARED_DATA *shared_data, const char *name, int dbtype, DB **out);
 int is_finished(SHARED_DATA *shared_data);
 
+#define INDEX_FORMAT_JSON    1
+#define INDEX_FORMAT_MSGPACK 2
+#define INDEX_TYPE_STRING    1
+#define INDEX_TYPE_NUMBER    2
+#define INDEX_MAX            16
+#define INDEX_NAME_MAX       64
+
+int index_attach(DB_ENV *dbenv, SHARED_DATA *shared_data, DB *primary, const char *file);
+void index_detach(DB *primary);
+int index_sync(DB *primary, DB_TXN *txn);
+void index_refresh(DB *primary);
+int index_create(DB_ENV *dbenv, SHARED_DATA *shared_data, const char *table, const char *name, int format, int type, const char *path);
+int index_drop(DB_ENV *dbenv, SHARED_DATA *shared_data, const char *table, const char *name);
+int index_purge(DB_ENV *dbenv, SHARED_DATA *shared_data);
+int index_cursor(DB *primary, DB_TXN *txn, const char *name, DBC **cur, int *type, unsigned int flags);
+void index_encode_number(double d, unsigned char *out);
+
+struct stat_item {
+    const char *section;
+    const char *name;
+    long long value;
+};
+
+struct expire_stat {
+    unsigned long long scanned;
+    unsigned long long expired;
+    time_t last_run;
+    time_t last_due;
+};
+
+int env_stat(DB_ENV *dbenv, SHARED_DATA *shared_data, struct stat_item *items, int max);
+int db_count(DB_ENV *dbenv, SHARED_DATA *shared_data, const char *name, unsigned long long *count);
+void expire_get_stat(struct expire_stat *out);
+int expire_backlog(DB_ENV *dbenv, SHARED_DATA *shared_data, unsigned int limit, unsigned int *count);
+
+extern volatile int checkpoint_interval;
+extern volatile int expire_batch_size;
+
+int env_set_flush(DB_ENV *dbenv, int flush);
+int env_get_flush(DB_ENV *dbenv, int *flush);
+int env_set_timeout(DB_ENV *dbenv, unsigned int usec, unsigned int which);
+int env_get_timeout(DB_ENV *dbenv, unsigned int *usec, unsigned int which);
+int env_checkpoint(DB_ENV *dbenv);
+
 void split_key(char *_key, int keylen, char **table, int *tablelen, char **name, int *namelen);
 
 int txn_begin(DB_ENV *dbenv, DB_TXN **txn, unsigned int flags);
+int txn_begin_child(DB_ENV *dbenv, DB_TXN *parent, DB_TXN **txn, unsigned int flags);
 int txn_abort(DB_TXN *txn);
 int txn_commit(DB_TXN *txn);
 
@@ -31,6 +31,12 @@ void dbmap_del(dbmap_t dbmap, const char *table) {
     }
 }
 
+void dbmap_foreach(dbmap_t dbmap, void (*fn)(DB *db)) {
+    for (auto &it : *static_cast<_dbmap*>(dbmap)) {
+        fn(it.second);
+    }
+}
+
 void dbmap_destroy(dbmap_t dbmap) {
     for (auto &it : *static_cast<_dbmap*>(dbmap)) {
         db_close(it.second);
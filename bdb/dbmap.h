@@ -11,6 +11,7 @@ dbmap_t dbmap_create();
 DB * dbmap_find(dbmap_t dbmap, const char *table);
 void dbmap_add(dbmap_t dbmap, const char *table, DB *db);
 void dbmap_del(dbmap_t dbmap, const char *table);
+void dbmap_foreach(dbmap_t dbmap, void (*fn)(DB *db));
 void dbmap_destroy(dbmap_t dbmap);
 
 #ifdef __cplusplus
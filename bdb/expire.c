@@ -1,3 +1,4 @@
+#include <stdint.h>
 #include <string.h>
 #include <stdlib.h>
 #include <db.h>
@@ -10,10 +11,77 @@ struct expire_ctx {
     DB_ENV *dbenv;
     SHARED_DATA *shared_data;
     char *data_buff;
-    DB *expire_db, *expire_index_db;
+    DB *expire_db, *expire_index_db, *version_db;
     dbmap_t dbmap;
 };
 
+/* 每轮最多检查的记录数，可以通过CONFIG SET修改 */
+volatile int expire_batch_size = 1000;
+
+/* 过期线程的进度，INFO命令读取 */
+static volatile struct expire_stat expire_stats;
+
+void
+expire_get_stat(struct expire_stat *out) {
+    out->scanned = expire_stats.scanned;
+    out->expired = expire_stats.expired;
+    out->last_run = expire_stats.last_run;
+    out->last_due = expire_stats.last_due;
+}
+
+/*
+ * expire_backlog 统计已经到期但还没有被删除的记录数，最多统计到limit
+ */
+int
+expire_backlog(DB_ENV *dbenv, SHARED_DATA *shared_data, unsigned int limit, unsigned int *count) {
+    DB *expire_db;
+    DBC *cur;
+    DBT key, data;
+    struct expire_key keydata;
+    time_t now;
+    int ret, ret2;
+
+    *count = 0;
+    if ((ret = open_db(dbenv, shared_data, "__expire.db", DB_UNKNOWN, 0, &expire_db)) != 0) {
+        return ret;
+    }
+    if ((ret = expire_db->cursor(expire_db, NULL, &cur, DB_READ_UNCOMMITTED)) != 0) {
+        LOG_ERROR("cursor", ret);
+        goto end;
+    }
+    memset(&key, 0, sizeof key);
+    memset(&data, 0, sizeof data);
+    key.flags = DB_DBT_USERMEM;
+    key.ulen = sizeof keydata;
+    key.data = &keydata;
+    data.flags = DB_DBT_PARTIAL;
+
+    time(&now);
+    while (*count < limit) {
+        ret = cur->get(cur, &key, &data, DB_NEXT);
+        if (ret == DB_NOTFOUND) {
+            ret = 0;
+            break;
+        }
+        if (ret) {
+            LOG_ERROR("get|cursor", ret);
+            break;
+        }
+        if (keydata.t > now) {
+            break;
+        }
+        ++*count;
+    }
+    if ((ret2 = cur->close(cur)) != 0) {
+        LOG_ERROR("close|cur", ret2);
+    }
+end:
+    if ((ret2 = expire_db->close(expire_db, 0)) != 0) {
+        LOG_ERROR("close", ret2);
+    }
+    return ret;
+}
+
 static DB *
 must_open_db(struct expire_ctx *ctx, const char *name, int type) {
     DB *db;
@@ -50,6 +118,46 @@ get_target_db(struct expire_ctx *ctx, const char *table, DB **db) {
     return 0;
 }
 
+/*
+ * expire_bump_version 删除过期的key时把__version中的版本号加1，和删除在同一个事务内，
+ * 否则key过期后重新写入，CAS会把新的值当成原来的值。格式和server/version.go相同
+ */
+static int
+expire_bump_version(struct expire_ctx *ctx, DB_TXN *txn, void *_key, unsigned int keylen) {
+    DBT key, data;
+    unsigned char buf[8];
+    uint64_t version = 0;
+    int i, ret;
+
+    memset(&key, 0, sizeof key);
+    memset(&data, 0, sizeof data);
+    key.data = _key;
+    key.size = keylen;
+    data.data = buf;
+    data.ulen = sizeof buf;
+    data.flags = DB_DBT_USERMEM;
+    ret = ctx->version_db->get(ctx->version_db, txn, &key, &data, DB_RMW);
+    if (ret == 0 && data.size == sizeof buf) {
+        for (i = 0; i < 8; ++i) {
+            version = version << 8 | buf[i];
+        }
+    } else if (ret && ret != DB_NOTFOUND) {
+        LOG_ERROR("get|version", ret);
+        return ret;
+    }
+    ++version;
+    for (i = 7; i >= 0; --i) {
+        buf[i] = version;
+        version >>= 8;
+    }
+    data.size = sizeof buf;
+    ret = ctx->version_db->put(ctx->version_db, txn, &key, &data, 0);
+    if (ret) {
+        LOG_ERROR("put|version", ret);
+    }
+    return ret;
+}
+
 static int
 expire_check_one(struct expire_ctx *ctx, DB_TXN *parent_txn, DBT *key, DBT *data) {
     struct expire_key _indexdata;
@@ -105,16 +213,31 @@ expire_check_one(struct expire_ctx *ctx, DB_TXN *parent_txn, DBT *key, DBT *data
     memset(&delkey, 0, sizeof delkey);
     delkey.data = name;
     delkey.size = namelen;
+    // 和worker的写入一样，删除前确认挂载的索引是最新的
+    if ((ret = index_sync(target_db, txn)) != 0) {
+        LOG_ERROR("index_sync", ret);
+        goto abort;
+    }
     ret = target_db->del(target_db, txn, &delkey, 0);
-    if (ret == 0 || ret == DB_NOTFOUND) {
+    if (ret == DB_NOTFOUND) {
         goto commit;
-    } else {
+    } else if (ret) {
         LOG_ERROR("del|target", ret);
         if (ret == DB_REP_HANDLE_DEAD) {
             dbmap_del(ctx->dbmap, table);
         }
         goto abort;
     }
+    // split_key把':'改成了'\0'，恢复成完整的key，和worker写入版本号时使用的key相同
+    if (table == data->data) {
+        ((char*)data->data)[tablelen] = ':';
+    }
+    // 和worker一样先锁数据再锁版本号
+    if ((ret = expire_bump_version(ctx, txn, data->data, data->size)) != 0) {
+        goto abort;
+    }
+    ++expire_stats.expired;
+    goto commit;
 
 abort:
     ret2 = txn->abort(txn);
@@ -166,13 +289,14 @@ restart:
     data.data = ctx->data_buff;
 
     time(&now);
+    expire_stats.last_run = now;
     for (;;) {
         ret = 0;
         ++count;
         if (ctx->shared_data->app_finished == 1) {
             goto end;
         }
-        if (count > 1000) {
+        if (count > expire_batch_size) {
             ret = DB_NOTFOUND;
             goto end;
         }
@@ -204,6 +328,8 @@ restart:
         buf[sizeof buf - 1] = 0;
         Debug(buf);
 
+        ++expire_stats.scanned;
+        expire_stats.last_due = keydata.t;
         ret = expire_check_one(ctx, txn, &key, &data);
         if (ret) {
             LOG_ERROR("expire_check_one", ret);
@@ -255,6 +381,7 @@ expire_thread(void *args) {
 	ctx.shared_data = ((supthr_args *)args)->shared;
     ctx.expire_db = NULL;
     ctx.expire_index_db = NULL;
+    ctx.version_db = NULL;
     ctx.dbmap = dbmap_create();
 
     for (;;) {
@@ -262,6 +389,8 @@ expire_thread(void *args) {
         if (ctx.shared_data->app_finished == 1) {
             break;
         }
+        // 关闭已经删除的索引，否则IDX.DROP无法删除索引文件
+        dbmap_foreach(ctx.dbmap, index_refresh);
         if (!ctx.shared_data->is_master) {
             continue;
         }
@@ -271,6 +400,9 @@ expire_thread(void *args) {
         if (ctx.expire_index_db == NULL) {
             ctx.expire_index_db = must_open_db(&ctx, "__expire.index.db", DB_BTREE);
         }
+        if (ctx.version_db == NULL) {
+            ctx.version_db = must_open_db(&ctx, "__version.db", DB_BTREE);
+        }
         if (ctx.shared_data->app_finished == 1) {
             break;
         }
@@ -290,6 +422,13 @@ expire_thread(void *args) {
                 }
                 ctx.expire_index_db = NULL;
             }
+            if (ctx.version_db) {
+                ret = ctx.version_db->close(ctx.version_db, 0);
+                if (ret) {
+                    LOG_ERROR("close|version", ret);
+                }
+                ctx.version_db = NULL;
+            }
         }
     }
 
@@ -303,5 +442,8 @@ expire_thread(void *args) {
     if (ctx.expire_index_db) {
         db_close(ctx.expire_index_db);
     }
+    if (ctx.version_db) {
+        db_close(ctx.version_db);
+    }
     return EXIT_SUCCESS;
 }
@@ -0,0 +1,1259 @@
+#include <errno.h>
+#include <stdlib.h>
+#include <string.h>
+#include <stdbool.h>
+#include <stdint.h>
+#include <db.h>
+#include "rep_common.h"
+#include "bdb.h"
+#include "cmp.h"
+
+/*
+ * 二级索引
+ *
+ * 索引定义保存在__index.db中:
+ *   key:   table + '\0' + index name
+ *   value: format(1字节) + type(1字节) + 索引文件名 + '\0' + 字段路径
+ * 同一个库中还保存每个表的索引版本和待删除的索引文件:
+ *   key: '\0' + table,        value: 版本(4字节大端)，创建/删除索引时在同一个事务内加1
+ *   key: '\0' + '\0' + 文件名, value: 空，索引删除后等所有句柄关闭再删除文件
+ * 索引本身是一个DB_DUPSORT的btree，通过DB->associate挂在主表上，
+ * 主表的写入和索引的更新在同一个事务内完成。
+ * associate不会持久化，所以每次打开主表(get_db)都要重新挂载索引，
+ * 主表句柄的app_private保存挂载的索引，索引句柄的app_private保存索引定义。
+ *
+ * __index.db通过复制同步到所有节点，每个句柄记录挂载时的版本。
+ * 写入主表前(index_sync)在写事务中对表加读锁并读取版本，版本不同时重新挂载；
+ * 创建/删除索引时对表加写锁，等待正在写入的事务结束，提交前新的写入也会等待。
+ */
+
+#define INDEX_DB "__index.db"
+#define INDEX_TABLE_MAX 255
+#define INDEX_LOCK_PREFIX "__index:"
+
+struct index_def {
+    int format;
+    int type;
+    int pathlen;
+    char path[1];
+};
+
+struct index_item {
+    char name[INDEX_NAME_MAX + 1];
+    DB *db;
+};
+
+struct index_set {
+    DB_ENV *dbenv;
+    SHARED_DATA *shared_data;
+    DB *idxdb;
+    uint32_t version;
+    int tablelen;
+    char table[INDEX_TABLE_MAX + 1];
+    int count;
+    struct index_item items[INDEX_MAX];
+};
+
+// is_system_db 系统表上不挂载索引，__default和SELECT使用的__db<n>是用户数据
+static bool
+is_system_db(const char *file) {
+    if (strncmp(file, "__", 2) != 0) {
+        return false;
+    }
+    if (strcmp(file, "__default.db") == 0) {
+        return false;
+    }
+    return !(strncmp(file, "__db", 4) == 0 && file[4] >= '0' && file[4] <= '9');
+}
+
+/* ---- JSON ---- */
+
+static const char *
+json_ws(const char *p, const char *end) {
+    while (p < end && (*p == ' ' || *p == '\t' || *p == '\n' || *p == '\r')) {
+        ++p;
+    }
+    return p;
+}
+
+static const char *
+json_skip_string(const char *p, const char *end) {
+    for (++p; p < end; ++p) {
+        if (*p == '\\') {
+            ++p;
+        } else if (*p == '"') {
+            return p + 1;
+        }
+    }
+    return NULL;
+}
+
+static const char *
+json_skip(const char *p, const char *end) {
+    int depth = 0;
+
+    if (p >= end) {
+        return NULL;
+    }
+    if (*p == '"') {
+        return json_skip_string(p, end);
+    }
+    if (*p != '{' && *p != '[') {
+        while (p < end && *p != ',' && *p != '}' && *p != ']' &&
+                *p != ' ' && *p != '\t' && *p != '\n' && *p != '\r') {
+            ++p;
+        }
+        return p;
+    }
+    while (p < end) {
+        if (*p == '"') {
+            p = json_skip_string(p, end);
+            if (p == NULL) {
+                return NULL;
+            }
+            continue;
+        }
+        if (*p == '{' || *p == '[') {
+            ++depth;
+        } else if (*p == '}' || *p == ']') {
+            if (--depth == 0) {
+                return p + 1;
+            }
+        }
+        ++p;
+    }
+    return NULL;
+}
+
+static int
+parse_index(const char *seg, int seglen) {
+    int i, idx = 0;
+
+    if (seglen == 0 || seglen > 9) {
+        return -1;
+    }
+    for (i = 0; i < seglen; ++i) {
+        if (seg[i] < '0' || seg[i] > '9') {
+            return -1;
+        }
+        idx = idx * 10 + (seg[i] - '0');
+    }
+    return idx;
+}
+
+// json_member 在对象或数组p中查找seg，找到时返回值的起始位置
+static const char *
+json_member(const char *p, const char *end, const char *seg, int seglen) {
+    const char *k, *q;
+    int i, idx;
+
+    if (p >= end) {
+        return NULL;
+    }
+    if (*p == '{') {
+        p = json_ws(p + 1, end);
+        while (p < end && *p == '"') {
+            k = p + 1;
+            q = json_skip_string(p, end);
+            if (q == NULL) {
+                return NULL;
+            }
+            p = json_ws(q, end);
+            if (p >= end || *p != ':') {
+                return NULL;
+            }
+            p = json_ws(p + 1, end);
+            if (q - 1 - k == seglen && memcmp(k, seg, seglen) == 0) {
+                return p;
+            }
+            p = json_skip(p, end);
+            if (p == NULL) {
+                return NULL;
+            }
+            p = json_ws(p, end);
+            if (p >= end || *p != ',') {
+                return NULL;
+            }
+            p = json_ws(p + 1, end);
+        }
+        return NULL;
+    }
+    if (*p == '[') {
+        idx = parse_index(seg, seglen);
+        if (idx < 0) {
+            return NULL;
+        }
+        p = json_ws(p + 1, end);
+        for (i = 0; p < end && *p != ']'; ++i) {
+            if (i == idx) {
+                return p;
+            }
+            p = json_skip(p, end);
+            if (p == NULL) {
+                return NULL;
+            }
+            p = json_ws(p, end);
+            if (p >= end || *p != ',') {
+                return NULL;
+            }
+            p = json_ws(p + 1, end);
+        }
+    }
+    return NULL;
+}
+
+static int
+hex_value(const char *p) {
+    int i, c, v = 0;
+
+    for (i = 0; i < 4; ++i) {
+        c = p[i];
+        if (c >= '0' && c <= '9') {
+            v = v * 16 + c - '0';
+        } else if (c >= 'a' && c <= 'f') {
+            v = v * 16 + c - 'a' + 10;
+        } else if (c >= 'A' && c <= 'F') {
+            v = v * 16 + c - 'A' + 10;
+        } else {
+            return -1;
+        }
+    }
+    return v;
+}
+
+static int
+utf8_encode(unsigned int c, char *out) {
+    if (c < 0x80) {
+        out[0] = c;
+        return 1;
+    } else if (c < 0x800) {
+        out[0] = 0xc0 | (c >> 6);
+        out[1] = 0x80 | (c & 0x3f);
+        return 2;
+    } else if (c < 0x10000) {
+        out[0] = 0xe0 | (c >> 12);
+        out[1] = 0x80 | ((c >> 6) & 0x3f);
+        out[2] = 0x80 | (c & 0x3f);
+        return 3;
+    }
+    out[0] = 0xf0 | (c >> 18);
+    out[1] = 0x80 | ((c >> 12) & 0x3f);
+    out[2] = 0x80 | ((c >> 6) & 0x3f);
+    out[3] = 0x80 | (c & 0x3f);
+    return 4;
+}
+
+// json_unescape 把JSON字符串(不含引号)解码到out，out的长度不小于end-p
+static int
+json_unescape(const char *p, const char *end, char *out) {
+    char *o = out;
+    int c, c2;
+
+    while (p < end) {
+        if (*p != '\\') {
+            *o++ = *p++;
+            continue;
+        }
+        if (++p >= end) {
+            return -1;
+        }
+        switch (*p++) {
+            case '"': *o++ = '"'; break;
+            case '\\': *o++ = '\\'; break;
+            case '/': *o++ = '/'; break;
+            case 'b': *o++ = '\b'; break;
+            case 'f': *o++ = '\f'; break;
+            case 'n': *o++ = '\n'; break;
+            case 'r': *o++ = '\r'; break;
+            case 't': *o++ = '\t'; break;
+            case 'u':
+                if (end - p < 4 || (c = hex_value(p)) < 0) {
+                    return -1;
+                }
+                p += 4;
+                if (c >= 0xd800 && c < 0xdc00 && end - p >= 6 && p[0] == '\\' && p[1] == 'u') {
+                    c2 = hex_value(p + 2);
+                    if (c2 >= 0xdc00 && c2 < 0xe000) {
+                        c = 0x10000 + ((c - 0xd800) << 10) + (c2 - 0xdc00);
+                        p += 6;
+                    }
+                }
+                o += utf8_encode(c, o);
+                break;
+            default:
+                return -1;
+        }
+    }
+    return o - out;
+}
+
+static int
+json_extract(const struct index_def *def, const char *p, const char *end, char **out, int *outlen, double *num) {
+    const char *seg, *segend, *pathend, *q;
+    char buf[64];
+    char *e;
+    int n;
+
+    p = json_ws(p, end);
+    seg = def->path;
+    pathend = def->path + def->pathlen;
+    while (seg < pathend) {
+        segend = memchr(seg, '.', pathend - seg);
+        if (segend == NULL) {
+            segend = pathend;
+        }
+        p = json_member(p, end, seg, segend - seg);
+        if (p == NULL) {
+            return DB_DONOTINDEX;
+        }
+        seg = segend + 1;
+    }
+    if (p >= end) {
+        return DB_DONOTINDEX;
+    }
+    if (def->type == INDEX_TYPE_STRING) {
+        if (*p != '"' || (q = json_skip_string(p, end)) == NULL) {
+            return DB_DONOTINDEX;
+        }
+        *out = malloc(q - p);
+        if (*out == NULL) {
+            return ENOMEM;
+        }
+        n = json_unescape(p + 1, q - 1, *out);
+        if (n < 0) {
+            free(*out);
+            return DB_DONOTINDEX;
+        }
+        *outlen = n;
+        return 0;
+    }
+    if (*p != '-' && (*p < '0' || *p > '9')) {
+        return DB_DONOTINDEX;
+    }
+    q = json_skip(p, end);
+    if (q == NULL || q - p >= sizeof buf) {
+        return DB_DONOTINDEX;
+    }
+    memcpy(buf, p, q - p);
+    buf[q - p] = 0;
+    *num = strtod(buf, &e);
+    if (*e != 0) {
+        return DB_DONOTINDEX;
+    }
+    return 0;
+}
+
+/* ---- msgpack ---- */
+
+struct index_reader {
+    const char *buf;
+    uint32_t pos;
+    uint32_t len;
+};
+
+static bool
+index_reader_read(cmp_ctx_t *ctx, void *data, size_t limit) {
+    struct index_reader *reader = (struct index_reader*)ctx->buf;
+    if (reader->pos + limit > reader->len) {
+        return false;
+    }
+    memcpy(data, reader->buf + reader->pos, limit);
+    reader->pos += limit;
+    return true;
+}
+
+static bool
+index_reader_skip(cmp_ctx_t *ctx, uint32_t n) {
+    struct index_reader *reader = (struct index_reader*)ctx->buf;
+    if (reader->pos + n > reader->len) {
+        return false;
+    }
+    reader->pos += n;
+    return true;
+}
+
+static bool msgpack_skip(cmp_ctx_t *ctx);
+
+// msgpack_skip_payload 跳过已经读取了头部的对象
+static bool
+msgpack_skip_payload(cmp_ctx_t *ctx, cmp_object_t *obj) {
+    uint32_t i;
+
+    switch (obj->type) {
+        case CMP_TYPE_FIXSTR:
+        case CMP_TYPE_STR8:
+        case CMP_TYPE_STR16:
+        case CMP_TYPE_STR32:
+            return index_reader_skip(ctx, obj->as.str_size);
+        case CMP_TYPE_BIN8:
+        case CMP_TYPE_BIN16:
+        case CMP_TYPE_BIN32:
+            return index_reader_skip(ctx, obj->as.bin_size);
+        case CMP_TYPE_FIXEXT1:
+        case CMP_TYPE_FIXEXT2:
+        case CMP_TYPE_FIXEXT4:
+        case CMP_TYPE_FIXEXT8:
+        case CMP_TYPE_FIXEXT16:
+        case CMP_TYPE_EXT8:
+        case CMP_TYPE_EXT16:
+        case CMP_TYPE_EXT32:
+            return index_reader_skip(ctx, obj->as.ext.size);
+        case CMP_TYPE_FIXARRAY:
+        case CMP_TYPE_ARRAY16:
+        case CMP_TYPE_ARRAY32:
+            for (i = 0; i < obj->as.array_size; ++i) {
+                if (!msgpack_skip(ctx)) {
+                    return false;
+                }
+            }
+            return true;
+        case CMP_TYPE_FIXMAP:
+        case CMP_TYPE_MAP16:
+        case CMP_TYPE_MAP32:
+            for (i = 0; i < obj->as.map_size; ++i) {
+                if (!msgpack_skip(ctx) || !msgpack_skip(ctx)) {
+                    return false;
+                }
+            }
+            return true;
+        default:
+            return true;
+    }
+}
+
+static bool
+msgpack_skip(cmp_ctx_t *ctx) {
+    cmp_object_t obj;
+
+    if (!cmp_read_object(ctx, &obj)) {
+        return false;
+    }
+    return msgpack_skip_payload(ctx, &obj);
+}
+
+static bool
+is_msgpack_str(cmp_object_t *obj) {
+    return obj->type == CMP_TYPE_FIXSTR || obj->type == CMP_TYPE_STR8 ||
+        obj->type == CMP_TYPE_STR16 || obj->type == CMP_TYPE_STR32;
+}
+
+// msgpack_member 在map或数组中查找seg，找到时reader停在值的起始位置
+static bool
+msgpack_member(cmp_ctx_t *ctx, const char *seg, int seglen) {
+    struct index_reader *reader = (struct index_reader*)ctx->buf;
+    cmp_object_t obj, key;
+    uint32_t i;
+    int idx;
+
+    if (!cmp_read_object(ctx, &obj)) {
+        return false;
+    }
+    switch (obj.type) {
+        case CMP_TYPE_FIXMAP:
+        case CMP_TYPE_MAP16:
+        case CMP_TYPE_MAP32:
+            for (i = 0; i < obj.as.map_size; ++i) {
+                if (!cmp_read_object(ctx, &key)) {
+                    return false;
+                }
+                if (is_msgpack_str(&key) && key.as.str_size == seglen &&
+                        reader->pos + seglen <= reader->len &&
+                        memcmp(reader->buf + reader->pos, seg, seglen) == 0) {
+                    reader->pos += seglen;
+                    return true;
+                }
+                if (!msgpack_skip_payload(ctx, &key) || !msgpack_skip(ctx)) {
+                    return false;
+                }
+            }
+            return false;
+        case CMP_TYPE_FIXARRAY:
+        case CMP_TYPE_ARRAY16:
+        case CMP_TYPE_ARRAY32:
+            idx = parse_index(seg, seglen);
+            if (idx < 0 || idx >= obj.as.array_size) {
+                return false;
+            }
+            for (i = 0; i < idx; ++i) {
+                if (!msgpack_skip(ctx)) {
+                    return false;
+                }
+            }
+            return true;
+        default:
+            return false;
+    }
+}
+
+static int
+msgpack_extract(const struct index_def *def, const char *p, uint32_t len, char **out, int *outlen, double *num) {
+    struct index_reader reader;
+    cmp_ctx_t ctx;
+    cmp_object_t obj;
+    const char *seg, *segend, *pathend;
+
+    reader.buf = p;
+    reader.pos = 0;
+    reader.len = len;
+    cmp_init(&ctx, &reader, index_reader_read, NULL);
+
+    seg = def->path;
+    pathend = def->path + def->pathlen;
+    while (seg < pathend) {
+        segend = memchr(seg, '.', pathend - seg);
+        if (segend == NULL) {
+            segend = pathend;
+        }
+        if (!msgpack_member(&ctx, seg, segend - seg)) {
+            return DB_DONOTINDEX;
+        }
+        seg = segend + 1;
+    }
+    if (!cmp_read_object(&ctx, &obj)) {
+        return DB_DONOTINDEX;
+    }
+    if (def->type == INDEX_TYPE_STRING) {
+        if (!is_msgpack_str(&obj) || reader.pos + obj.as.str_size > reader.len) {
+            return DB_DONOTINDEX;
+        }
+        *out = malloc(obj.as.str_size + 1);
+        if (*out == NULL) {
+            return ENOMEM;
+        }
+        memcpy(*out, reader.buf + reader.pos, obj.as.str_size);
+        *outlen = obj.as.str_size;
+        return 0;
+    }
+    switch (obj.type) {
+        case CMP_TYPE_POSITIVE_FIXNUM:
+        case CMP_TYPE_UINT8: *num = obj.as.u8; break;
+        case CMP_TYPE_UINT16: *num = obj.as.u16; break;
+        case CMP_TYPE_UINT32: *num = obj.as.u32; break;
+        case CMP_TYPE_UINT64: *num = obj.as.u64; break;
+        case CMP_TYPE_NEGATIVE_FIXNUM:
+        case CMP_TYPE_SINT8: *num = obj.as.s8; break;
+        case CMP_TYPE_SINT16: *num = obj.as.s16; break;
+        case CMP_TYPE_SINT32: *num = obj.as.s32; break;
+        case CMP_TYPE_SINT64: *num = obj.as.s64; break;
+        case CMP_TYPE_FLOAT: *num = obj.as.flt; break;
+        case CMP_TYPE_DOUBLE: *num = obj.as.dbl; break;
+        default: return DB_DONOTINDEX;
+    }
+    return 0;
+}
+
+/* ---- callback ---- */
+
+// index_encode_number 把double编码为8字节，按字节比较的顺序和数值顺序一致
+void
+index_encode_number(double d, unsigned char *out) {
+    uint64_t u;
+    int i;
+
+    if (d == 0) {
+        d = 0; // -0和0编码相同
+    }
+    memcpy(&u, &d, sizeof u);
+    if (u >> 63) {
+        u = ~u;
+    } else {
+        u |= (uint64_t)1 << 63;
+    }
+    for (i = 0; i < 8; ++i) {
+        out[i] = (unsigned char)(u >> (56 - 8 * i));
+    }
+}
+
+static int
+index_callback(DB *secondary, const DBT *key, const DBT *data, DBT *result) {
+    struct index_def *def = (struct index_def*)secondary->app_private;
+    char *out = NULL;
+    int outlen = 0, ret;
+    double num = 0;
+
+    if (def->format == INDEX_FORMAT_MSGPACK) {
+        ret = msgpack_extract(def, data->data, data->size, &out, &outlen, &num);
+    } else {
+        ret = json_extract(def, data->data, (const char*)data->data + data->size, &out, &outlen, &num);
+    }
+    if (ret) {
+        return ret;
+    }
+    if (def->type == INDEX_TYPE_NUMBER) {
+        out = malloc(8);
+        if (out == NULL) {
+            return ENOMEM;
+        }
+        index_encode_number(num, (unsigned char*)out);
+        outlen = 8;
+    }
+    memset(result, 0, sizeof *result);
+    result->data = out;
+    result->size = outlen;
+    result->flags = DB_DBT_APPMALLOC;
+    return 0;
+}
+
+/* ---- 索引管理 ---- */
+
+static struct index_def *
+index_def_new(int format, int type, const char *path, int pathlen) {
+    struct index_def *def;
+
+    def = malloc(sizeof *def + pathlen);
+    if (def == NULL) {
+        return NULL;
+    }
+    def->format = format;
+    def->type = type;
+    def->pathlen = pathlen;
+    memcpy(def->path, path, pathlen);
+    def->path[pathlen] = 0;
+    return def;
+}
+
+static void
+index_close_secondary(DB *secondary) {
+    int ret;
+
+    free(secondary->app_private);
+    secondary->app_private = NULL;
+    if ((ret = secondary->close(secondary, 0)) != 0) {
+        LOG_ERROR("close|secondary", ret);
+    }
+}
+
+// index_close_all 关闭挂载的所有索引，索引句柄关闭后和主表的关联也就解除了
+static void
+index_close_all(struct index_set *set) {
+    int i;
+
+    for (i = 0; i < set->count; ++i) {
+        index_close_secondary(set->items[i].db);
+    }
+    set->count = 0;
+}
+
+// index_detach 关闭主表上挂载的所有索引，关闭主表前调用
+void
+index_detach(DB *primary) {
+    struct index_set *set = (struct index_set*)primary->app_private;
+    int ret;
+
+    if (set == NULL) {
+        return;
+    }
+    index_close_all(set);
+    if (set->idxdb != NULL && (ret = set->idxdb->close(set->idxdb, 0)) != 0) {
+        LOG_ERROR("close|index", ret);
+    }
+    free(set);
+    primary->app_private = NULL;
+}
+
+static int
+index_key(const char *table, const char *name, char *buf, int size) {
+    int tablelen = strlen(table), namelen = strlen(name);
+
+    if (tablelen + 1 + namelen > size) {
+        return -1;
+    }
+    memcpy(buf, table, tablelen);
+    buf[tablelen] = 0;
+    memcpy(buf + tablelen + 1, name, namelen);
+    return tablelen + 1 + namelen;
+}
+
+// index_lock 在txn中对表加锁，写入主表时加读锁，创建和删除索引时加写锁，事务结束时释放
+static int
+index_lock(DB_ENV *dbenv, DB_TXN *txn, const char *table, int tablelen, db_lockmode_t mode) {
+    DB_LOCK lock;
+    DBT obj;
+    char buf[sizeof INDEX_LOCK_PREFIX + INDEX_TABLE_MAX];
+    int ret;
+
+    if (tablelen > INDEX_TABLE_MAX) {
+        return EINVAL;
+    }
+    memcpy(buf, INDEX_LOCK_PREFIX, sizeof INDEX_LOCK_PREFIX - 1);
+    memcpy(buf + sizeof INDEX_LOCK_PREFIX - 1, table, tablelen);
+    memset(&obj, 0, sizeof obj);
+    obj.data = buf;
+    obj.size = sizeof INDEX_LOCK_PREFIX - 1 + tablelen;
+    ret = dbenv->lock_get(dbenv, txn->id(txn), 0, &obj, mode, &lock);
+    if (ret && ret != DB_LOCK_DEADLOCK && ret != DB_LOCK_NOTGRANTED) {
+        LOG_ERROR("lock_get", ret);
+    }
+    return ret;
+}
+
+// index_version 读取表的索引版本，没有创建过索引时为0
+static int
+index_version(DB *idxdb, DB_TXN *txn, const char *table, int tablelen, unsigned int flags, uint32_t *version) {
+    DBT key, data;
+    char keybuf[1 + INDEX_TABLE_MAX];
+    unsigned char buf[4];
+    int ret;
+
+    if (tablelen > INDEX_TABLE_MAX) {
+        return EINVAL;
+    }
+    keybuf[0] = 0;
+    memcpy(keybuf + 1, table, tablelen);
+    memset(&key, 0, sizeof key);
+    memset(&data, 0, sizeof data);
+    key.data = keybuf;
+    key.size = 1 + tablelen;
+    data.data = buf;
+    data.ulen = sizeof buf;
+    data.flags = DB_DBT_USERMEM;
+    ret = idxdb->get(idxdb, txn, &key, &data, flags);
+    if (ret == DB_NOTFOUND) {
+        *version = 0;
+        return 0;
+    }
+    if (ret) {
+        if (ret != DB_LOCK_DEADLOCK && ret != DB_LOCK_NOTGRANTED) {
+            LOG_ERROR("get|version", ret);
+        }
+        return ret;
+    }
+    if (data.size != sizeof buf) {
+        LOG_ERROR("bad_version", EINVAL);
+        return EINVAL;
+    }
+    *version = (uint32_t)buf[0] << 24 | (uint32_t)buf[1] << 16 | (uint32_t)buf[2] << 8 | buf[3];
+    return 0;
+}
+
+// index_bump_version 创建和删除索引时在同一个事务内调用，调用前已经对表加了写锁
+static int
+index_bump_version(DB *idxdb, DB_TXN *txn, const char *table, int tablelen, uint32_t *version) {
+    DBT key, data;
+    char keybuf[1 + INDEX_TABLE_MAX];
+    unsigned char buf[4];
+    int ret;
+
+    if ((ret = index_version(idxdb, txn, table, tablelen, DB_RMW, version)) != 0) {
+        return ret;
+    }
+    ++*version;
+    buf[0] = *version >> 24;
+    buf[1] = *version >> 16;
+    buf[2] = *version >> 8;
+    buf[3] = *version;
+    keybuf[0] = 0;
+    memcpy(keybuf + 1, table, tablelen);
+    memset(&key, 0, sizeof key);
+    memset(&data, 0, sizeof data);
+    key.data = keybuf;
+    key.size = 1 + tablelen;
+    data.data = buf;
+    data.size = sizeof buf;
+    if ((ret = idxdb->put(idxdb, txn, &key, &data, 0)) != 0) {
+        LOG_ERROR("put|version", ret);
+    }
+    return ret;
+}
+
+// index_load 读取表的版本和索引定义并挂载到primary上。
+// txn为NULL时读取已经提交的数据，否则和txn中的写入使用同一个版本
+static int
+index_load(struct index_set *set, DB *primary, DB_TXN *txn) {
+    struct index_def *def;
+    DB *secondary;
+    DBC *cur;
+    DBT key, data;
+    char prefix[INDEX_TABLE_MAX + 1];
+    const char *v, *vend, *path;
+    unsigned int flags = txn == NULL ? DB_READ_COMMITTED : 0;
+    uint32_t version;
+    int prefixlen, ret, ret2;
+
+    if ((ret = index_version(set->idxdb, txn, set->table, set->tablelen, flags, &version)) != 0) {
+        return ret;
+    }
+    // prefix = table + '\0'
+    memcpy(prefix, set->table, set->tablelen);
+    prefix[set->tablelen] = 0;
+    prefixlen = set->tablelen + 1;
+
+    if ((ret = set->idxdb->cursor(set->idxdb, txn, &cur, flags)) != 0) {
+        LOG_ERROR("cursor|index", ret);
+        return ret;
+    }
+    memset(&key, 0, sizeof key);
+    memset(&data, 0, sizeof data);
+    key.data = prefix;
+    key.size = prefixlen;
+    key.flags = DB_DBT_MALLOC;
+    data.flags = DB_DBT_MALLOC;
+    for (ret = cur->get(cur, &key, &data, DB_SET_RANGE); ret == 0; ret = cur->get(cur, &key, &data, DB_NEXT)) {
+        if (key.size <= prefixlen || memcmp(key.data, prefix, prefixlen) != 0) {
+            ret = DB_NOTFOUND;
+            break;
+        }
+        v = data.data;
+        vend = v + data.size;
+        path = data.size > 2 ? memchr(v + 2, 0, data.size - 2) : NULL;
+        if (path == NULL || key.size - prefixlen > INDEX_NAME_MAX || set->count >= INDEX_MAX) {
+            LOG_ERROR("bad_index", EINVAL);
+            ret = EINVAL;
+            break;
+        }
+        ++path;
+        def = index_def_new(v[0], v[1], path, vend - path);
+        if (def == NULL) {
+            ret = ENOMEM;
+            break;
+        }
+        ret = open_db(set->dbenv, set->shared_data, v + 2, DB_UNKNOWN, 0, &secondary);
+        if (ret) {
+            LOG_ERROR("open|secondary", ret);
+            free(def);
+            break;
+        }
+        secondary->app_private = def;
+        ret = primary->associate(primary, NULL, secondary, index_callback, 0);
+        if (ret) {
+            LOG_ERROR("associate", ret);
+            index_close_secondary(secondary);
+            break;
+        }
+        memcpy(set->items[set->count].name, (char*)key.data + prefixlen, key.size - prefixlen);
+        set->items[set->count].name[key.size - prefixlen] = 0;
+        set->items[set->count].db = secondary;
+        set->count++;
+        free(key.data);
+        free(data.data);
+        key.data = NULL;
+        data.data = NULL;
+    }
+    if (key.data != prefix) {
+        free(key.data);
+    }
+    free(data.data);
+    if (ret == DB_NOTFOUND) {
+        ret = 0;
+    }
+    if ((ret2 = cur->close(cur)) != 0) {
+        LOG_ERROR("close|cursor", ret2);
+        if (ret == 0) {
+            ret = ret2;
+        }
+    }
+    if (ret == 0) {
+        set->version = version;
+    } else {
+        index_close_all(set);
+    }
+    return ret;
+}
+
+// index_attach 读取table上定义的索引并挂载到primary上
+int
+index_attach(DB_ENV *dbenv, SHARED_DATA *shared_data, DB *primary, const char *file) {
+    struct index_set *set;
+    int ret, filelen;
+
+    if (is_system_db(file)) {
+        return 0;
+    }
+    filelen = strlen(file);
+    if (filelen < 3 || filelen - 3 > INDEX_TABLE_MAX) {
+        return EINVAL;
+    }
+    set = calloc(1, sizeof *set);
+    if (set == NULL) {
+        return ENOMEM;
+    }
+    set->dbenv = dbenv;
+    set->shared_data = shared_data;
+    set->tablelen = filelen - 3;
+    memcpy(set->table, file, set->tablelen);
+    set->table[set->tablelen] = 0;
+    primary->app_private = set;
+
+    // 主节点上没有__index.db时创建，之后每次写入都要在事务中读取表的版本。
+    // 副本上可能还没有同步过来，由index_sync在切换为主节点后打开
+    ret = open_db(dbenv, shared_data, INDEX_DB, DB_BTREE, 0, &set->idxdb);
+    if (ret == ENOENT) {
+        return 0;
+    } else if (ret) {
+        LOG_ERROR("open|index", ret);
+        index_detach(primary);
+        return ret;
+    }
+    if ((ret = index_load(set, primary, NULL)) != 0) {
+        index_detach(primary);
+    }
+    return ret;
+}
+
+// index_open 打开__index.db，副本上attach时可能还没有同步过来
+static int
+index_open(struct index_set *set) {
+    int ret;
+
+    if (set->idxdb != NULL) {
+        return 0;
+    }
+    ret = open_db(set->dbenv, set->shared_data, INDEX_DB, DB_UNKNOWN, 0, &set->idxdb);
+    if (ret && ret != ENOENT) {
+        LOG_ERROR("open|index", ret);
+    }
+    return ret;
+}
+
+// index_sync 写入主表之前在写事务中调用: 对表加读锁，再读取表的版本，
+// 和句柄上的版本不同时说明其他线程或者原来的主节点创建或删除了索引，重新挂载
+int
+index_sync(DB *primary, DB_TXN *txn) {
+    struct index_set *set = (struct index_set*)primary->app_private;
+    uint32_t version;
+    int ret;
+
+    if (set == NULL || txn == NULL) {
+        return 0;
+    }
+    if ((ret = index_lock(set->dbenv, txn, set->table, set->tablelen, DB_LOCK_READ)) != 0) {
+        return ret;
+    }
+    if ((ret = index_open(set)) != 0) {
+        return ret == ENOENT ? 0 : ret;
+    }
+    if ((ret = index_version(set->idxdb, txn, set->table, set->tablelen, 0, &version)) != 0) {
+        return ret;
+    }
+    if (version == set->version) {
+        return 0;
+    }
+    index_close_all(set);
+    return index_load(set, primary, txn);
+}
+
+// index_refresh 不在事务中检查表的版本，重新挂载索引。
+// 不在写事务中的查询和过期线程调用，索引文件在所有句柄都关闭后才能删除
+void
+index_refresh(DB *primary) {
+    struct index_set *set = (struct index_set*)primary->app_private;
+    uint32_t version;
+    int ret;
+
+    if (set == NULL || index_open(set) != 0) {
+        return;
+    }
+    if (index_version(set->idxdb, NULL, set->table, set->tablelen, DB_READ_COMMITTED, &version) != 0 ||
+            version == set->version) {
+        return;
+    }
+    index_close_all(set);
+    if ((ret = index_load(set, primary, NULL)) != 0) {
+        LOG_ERROR("index_load", ret);
+    }
+}
+
+// index_create 创建索引，并用主表中已有的数据填充索引
+int
+index_create(DB_ENV *dbenv, SHARED_DATA *shared_data, const char *table, const char *name, int format, int type, const char *path) {
+    struct index_def *def;
+    DB *idxdb, *primary = NULL, *secondary = NULL;
+    DB_TXN *txn = NULL;
+    DBT key, data;
+    char keybuf[512], valbuf[1024], file[512], primaryfile[512];
+    int keylen, tablelen, filelen, pathlen, ret, ret2;
+    uint32_t version;
+
+    tablelen = strlen(table);
+    keylen = index_key(table, name, keybuf, sizeof keybuf);
+    if (keylen < 0 || tablelen > INDEX_TABLE_MAX || strlen(name) > INDEX_NAME_MAX) {
+        return EINVAL;
+    }
+    pathlen = strlen(path);
+
+    if ((ret = open_db(dbenv, shared_data, INDEX_DB, DB_BTREE, 0, &idxdb)) != 0) {
+        LOG_ERROR("open|index", ret);
+        return ret;
+    }
+    snprintf(primaryfile, sizeof primaryfile, "%s.db", table);
+    primaryfile[sizeof primaryfile - 1] = 0;
+    if ((ret = open_db(dbenv, shared_data, primaryfile, DB_BTREE, 0, &primary)) != 0) {
+        LOG_ERROR("open|primary", ret);
+        goto close;
+    }
+
+    // 写锁等待正在写入这个表的事务结束，提交之前新的写入都会等待
+    if ((ret = dbenv->txn_begin(dbenv, NULL, &txn, 0)) != 0) {
+        LOG_ERROR("txn_begin", ret);
+        txn = NULL;
+        goto close;
+    }
+    if ((ret = index_lock(dbenv, txn, table, tablelen, DB_LOCK_WRITE)) != 0) {
+        goto close;
+    }
+    if ((ret = index_bump_version(idxdb, txn, table, tablelen, &version)) != 0) {
+        goto close;
+    }
+    // 文件名中包含版本，删除后再创建同名的索引时不会和还没有删除的文件冲突
+    snprintf(file, sizeof file, "%s.idx.%s.%x.db", table, name, version);
+    file[sizeof file - 1] = 0;
+    filelen = strlen(file);
+    if (2 + filelen + 1 + pathlen > sizeof valbuf) {
+        ret = EINVAL;
+        goto close;
+    }
+    valbuf[0] = format;
+    valbuf[1] = type;
+    memcpy(valbuf + 2, file, filelen + 1);
+    memcpy(valbuf + 2 + filelen + 1, path, pathlen);
+
+    if ((ret = open_db(dbenv, shared_data, file, DB_BTREE, DB_DUP | DB_DUPSORT, &secondary)) != 0) {
+        LOG_ERROR("open|secondary", ret);
+        secondary = NULL;
+        goto close;
+    }
+    def = index_def_new(format, type, path, pathlen);
+    if (def == NULL) {
+        ret = ENOMEM;
+        goto close;
+    }
+    secondary->app_private = def;
+
+    memset(&key, 0, sizeof key);
+    memset(&data, 0, sizeof data);
+    key.data = keybuf;
+    key.size = keylen;
+    data.data = valbuf;
+    data.size = 2 + filelen + 1 + pathlen;
+    ret = idxdb->put(idxdb, txn, &key, &data, DB_NOOVERWRITE);
+    if (ret == 0) {
+        ret = primary->associate(primary, txn, secondary, index_callback, DB_CREATE);
+        if (ret) {
+            LOG_ERROR("associate", ret);
+        }
+    } else if (ret != DB_KEYEXIST) {
+        LOG_ERROR("put|index", ret);
+    }
+
+close:
+    if (txn != NULL) {
+        if (ret) {
+            if ((ret2 = txn->abort(txn)) != 0) {
+                LOG_ERROR("abort", ret2);
+            }
+        } else if ((ret = txn->commit(txn, 0)) != 0) {
+            LOG_ERROR("commit", ret);
+        }
+    }
+    if (secondary != NULL) {
+        index_close_secondary(secondary);
+        if (ret && (ret2 = dbenv->dbremove(dbenv, NULL, file, NULL, DB_AUTO_COMMIT)) != 0) {
+            LOG_ERROR("dbremove", ret2);
+        }
+    }
+    if (primary != NULL && (ret2 = primary->close(primary, 0)) != 0) {
+        LOG_ERROR("close|primary", ret2);
+    }
+    if ((ret2 = idxdb->close(idxdb, 0)) != 0) {
+        LOG_ERROR("close|index", ret2);
+    }
+    return ret;
+}
+
+// index_drop 删除索引定义，并把索引文件记录为待删除。
+// 其他线程关闭了索引句柄之后由index_purge删除文件
+int
+index_drop(DB_ENV *dbenv, SHARED_DATA *shared_data, const char *table, const char *name) {
+    DB *idxdb;
+    DB_TXN *txn;
+    DBT key, data;
+    char keybuf[512], file[512];
+    int keylen, tablelen, filelen, ret, ret2;
+    uint32_t version;
+
+    tablelen = strlen(table);
+    keylen = index_key(table, name, keybuf, sizeof keybuf);
+    if (keylen < 0 || tablelen > INDEX_TABLE_MAX) {
+        return EINVAL;
+    }
+    if ((ret = open_db(dbenv, shared_data, INDEX_DB, DB_BTREE, 0, &idxdb)) != 0) {
+        LOG_ERROR("open|index", ret);
+        return ret;
+    }
+    if ((ret = dbenv->txn_begin(dbenv, NULL, &txn, 0)) != 0) {
+        LOG_ERROR("txn_begin", ret);
+        goto close;
+    }
+    if ((ret = index_lock(dbenv, txn, table, tablelen, DB_LOCK_WRITE)) != 0) {
+        goto abort;
+    }
+    memset(&key, 0, sizeof key);
+    memset(&data, 0, sizeof data);
+    key.data = keybuf;
+    key.size = keylen;
+    data.flags = DB_DBT_MALLOC;
+    ret = idxdb->get(idxdb, txn, &key, &data, DB_RMW);
+    if (ret) {
+        if (ret != DB_NOTFOUND) {
+            LOG_ERROR("get|index", ret);
+        }
+        goto abort;
+    }
+    if (data.size > 2 && memchr((char*)data.data + 2, 0, data.size - 2) != NULL) {
+        // 待删除的文件: '\0' + '\0' + file
+        file[0] = 0;
+        file[1] = 0;
+        snprintf(file + 2, sizeof file - 2, "%s", (char*)data.data + 2);
+        filelen = 2 + strlen(file + 2);
+    } else {
+        filelen = 0;
+    }
+    free(data.data);
+    if ((ret = idxdb->del(idxdb, txn, &key, 0)) != 0) {
+        LOG_ERROR("del|index", ret);
+        goto abort;
+    }
+    if ((ret = index_bump_version(idxdb, txn, table, tablelen, &version)) != 0) {
+        goto abort;
+    }
+    if (filelen > 2) {
+        memset(&key, 0, sizeof key);
+        memset(&data, 0, sizeof data);
+        key.data = file;
+        key.size = filelen;
+        if ((ret = idxdb->put(idxdb, txn, &key, &data, 0)) != 0) {
+            LOG_ERROR("put|purge", ret);
+            goto abort;
+        }
+    }
+    if ((ret = txn->commit(txn, 0)) != 0) {
+        LOG_ERROR("commit", ret);
+    }
+    goto close;
+
+abort:
+    if ((ret2 = txn->abort(txn)) != 0) {
+        LOG_ERROR("abort", ret2);
+    }
+close:
+    if ((ret2 = idxdb->close(idxdb, 0)) != 0) {
+        LOG_ERROR("close|index", ret2);
+    }
+    return ret;
+}
+
+// index_purge 删除所有待删除的索引文件。
+// 还有句柄打开着索引时不等待，返回DB_LOCK_NOTGRANTED，记录保留到下次删除
+int
+index_purge(DB_ENV *dbenv, SHARED_DATA *shared_data) {
+    DB *idxdb;
+    DB_TXN *txn;
+    DBC *cur;
+    DBT key, data;
+    char keybuf[2], file[512];
+    int ret, ret2;
+
+    ret = open_db(dbenv, shared_data, INDEX_DB, DB_UNKNOWN, 0, &idxdb);
+    if (ret == ENOENT) {
+        return 0;
+    } else if (ret) {
+        LOG_ERROR("open|index", ret);
+        return ret;
+    }
+    for (;;) {
+        if ((ret = dbenv->txn_begin(dbenv, NULL, &txn, DB_TXN_NOWAIT)) != 0) {
+            LOG_ERROR("txn_begin", ret);
+            break;
+        }
+        if ((ret = idxdb->cursor(idxdb, txn, &cur, 0)) != 0) {
+            LOG_ERROR("cursor|index", ret);
+            goto abort;
+        }
+        keybuf[0] = 0;
+        keybuf[1] = 0;
+        memset(&key, 0, sizeof key);
+        memset(&data, 0, sizeof data);
+        key.data = keybuf;
+        key.size = sizeof keybuf;
+        key.flags = DB_DBT_MALLOC;
+        data.flags = DB_DBT_PARTIAL;
+        ret = cur->get(cur, &key, &data, DB_SET_RANGE);
+        if (ret == 0) {
+            if (key.size > 2 && key.size - 2 < sizeof file &&
+                    ((char*)key.data)[0] == 0 && ((char*)key.data)[1] == 0) {
+                memcpy(file, (char*)key.data + 2, key.size - 2);
+                file[key.size - 2] = 0;
+            } else {
+                ret = DB_NOTFOUND;
+            }
+            if (ret == 0) {
+                ret = cur->del(cur, 0);
+            }
+            free(key.data);
+        }
+        if ((ret2 = cur->close(cur)) != 0) {
+            LOG_ERROR("close|cursor", ret2);
+            if (ret == 0) {
+                ret = ret2;
+            }
+        }
+        if (ret) {
+            if (ret == DB_NOTFOUND) { // 没有待删除的文件了
+                ret = 0;
+            } else if (ret != DB_LOCK_NOTGRANTED) {
+                LOG_ERROR("get|purge", ret);
+            }
+            goto abort;
+        }
+        ret = dbenv->dbremove(dbenv, txn, file, NULL, 0);
+        if (ret == ENOENT) {
+            ret = 0;
+        } else if (ret) {
+            if (ret != DB_LOCK_NOTGRANTED) {
+                LOG_ERROR("dbremove", ret);
+            }
+            goto abort;
+        }
+        if ((ret = txn->commit(txn, 0)) != 0) {
+            LOG_ERROR("commit", ret);
+            break;
+        }
+        continue;
+abort:
+        if ((ret2 = txn->abort(txn)) != 0) {
+            LOG_ERROR("abort", ret2);
+        }
+        break;
+    }
+    if ((ret2 = idxdb->close(idxdb, 0)) != 0) {
+        LOG_ERROR("close|index", ret2);
+    }
+    return ret;
+}
+
+// index_cursor 在primary挂载的名为name的索引上打开游标，type返回索引的类型
+int
+index_cursor(DB *primary, DB_TXN *txn, const char *name, DBC **cur, int *type, unsigned int flags) {
+    struct index_set *set = (struct index_set*)primary->app_private;
+    int i, ret;
+
+    if (set == NULL) {
+        return ENOENT;
+    }
+    if (txn == NULL) {
+        index_refresh(primary);
+    } else if ((ret = index_sync(primary, txn)) != 0) {
+        return ret;
+    }
+    for (i = 0; i < set->count; ++i) {
+        if (strcmp(set->items[i].name, name) == 0) {
+            *type = ((struct index_def*)set->items[i].db->app_private)->type;
+            ret = set->items[i].db->cursor(set->items[i].db, txn, cur, flags);
+            if (ret) {
+                LOG_ERROR("cursor|secondary", ret);
+            }
+            return ret;
+        }
+    }
+    return ENOENT;
+}
@@ -26,6 +26,7 @@ extern unsigned short myport;
 
 struct __member;	typedef struct __member member_t;
 struct __machtab;	typedef struct __machtab machtab_t;
+struct __rep_cipher;	typedef struct __rep_cipher rep_cipher_t;
 
 /* Arguments for the connect_all thread. */
 typedef struct {
@@ -103,12 +104,14 @@ void *connect_thread __P((void *));
 int   doclient __P((DB_ENV *, const char *, machtab_t *));
 int   domaster __P((DB_ENV *, const char *));
 socket_t   get_accepted_socket __P((const char *, int));
-socket_t   get_connected_socket
-	__P((machtab_t *, const char *, const char *, int, int *, int *));
-int   get_next_message __P((socket_t, DBT *, DBT *));
+socket_t   get_connected_socket __P((machtab_t *,
+	const char *, const char *, int, int *, int *, rep_cipher_t **));
+int   get_next_message __P((socket_t, rep_cipher_t *, DBT *, DBT *));
 socket_t   listen_socket_init __P((const char *, int, machtab_t *));
 socket_t   listen_socket_accept
 	__P((machtab_t *, const char *, socket_t, int *));
+int   listen_socket_admit
+	__P((machtab_t *, socket_t, int, int *, rep_cipher_t **));
 int   machtab_destroy __P((machtab_t *));
 int   machtab_getinfo __P((machtab_t *, int, u_int32_t *, int *));
 int   machtab_init __P((machtab_t **, int));
@@ -117,4 +120,11 @@ int   machtab_rem __P((machtab_t *, int, int));
 int   quote_send __P((DB_ENV *, const DBT *, const DBT *, const DB_LSN *,
     int, u_int32_t));
 
+/* rep_secure.c: 配置了共享密钥时站点之间的认证和加密 */
+int   rep_secure_enabled __P((void));
+int   rep_handshake __P((socket_t, int, rep_cipher_t **, rep_cipher_t **));
+void  rep_cipher_free __P((rep_cipher_t *));
+int   rep_send_frame __P((socket_t, rep_cipher_t *, const DBT *, const DBT *));
+int   rep_recv_frame __P((socket_t, rep_cipher_t *, DBT *, DBT *));
+
 #endif /* !_EX_REPQUOTE_H_ */
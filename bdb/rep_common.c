@@ -499,6 +499,9 @@ usage(is_repmgr, progname)
 	exit(EXIT_FAILURE);
 }
 
+/* 两次checkpoint之间的秒数，可以通过CONFIG SET修改 */
+volatile int checkpoint_interval = 60;
+
 /*
  * This is a very simple thread that performs checkpoints at a fixed
  * time interval.  For a master site, the time interval is one minute
@@ -536,7 +539,7 @@ checkpoint_thread(args)
 		 * application has finished.  When application has finished,
 		 * terminate this thread.
 		 */
-		for (i = 0; i < 60; i++) {
+		for (i = 0; i < checkpoint_interval; i++) {
 			sleep(1);
 			if (shared->app_finished == 1) {
 				if (pfinfo != NULL)
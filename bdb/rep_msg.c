@@ -20,6 +20,19 @@ static int   connect_site __P((DB_ENV *, machtab_t *,
 		 const char *, repsite_t *, int *, thread_t *));
 static void *elect_thread __P((void *));
 static void *hm_loop __P((void *));
+static void *site_loop __P((void *));
+
+/* connect_thread中每个接入连接的线程的状态 */
+#define	SITE_JOINED	0	/* 没有线程或者已经join */
+#define	SITE_RUNNING	1	/* 已经通过握手 */
+#define	SITE_EXITED	2	/* 线程已经退出，可以join之后重新使用 */
+#define	SITE_HANDSHAKE	3	/* 正在握手 */
+
+/*
+ * 同时进行握手的连接数，超过时直接关闭新的连接。
+ * 连上之后不发送握手数据的连接最多占用这么多线程，其他的留给已经通过握手的站点
+ */
+#define	MAX_HANDSHAKES	4
 
 typedef struct {
 	DB_ENV *dbenv;
@@ -31,8 +44,11 @@ typedef struct {
 	const char *progname;
 	const char *home;
 	socket_t fd;
+	rep_cipher_t *rx;	/* 接收方向的密钥，由hm_loop释放 */
 	u_int32_t eid;
 	machtab_t *tab;
+	int host;		/* 接入的连接在site_loop中握手时使用 */
+	volatile int *state;	/* 接入的连接的线程状态，SITE_* */
 } hm_loop_args;
 
 /*
@@ -58,6 +74,7 @@ hm_loop(args)
 	int eid, n, nsites, nsites_allocd;
 	int already_open, r, ret, t_ret;
 	socket_t fd;
+	rep_cipher_t *rx;
 	void *status;
 
 	ea = NULL;
@@ -68,6 +85,7 @@ hm_loop(args)
 	ha = (hm_loop_args *)args;
 	dbenv = ha->dbenv;
 	fd = ha->fd;
+	rx = ha->rx;
 	home = ha->home;
 	eid = ha->eid;
 	progname = ha->progname;
@@ -79,7 +97,7 @@ hm_loop(args)
 	memset(&control, 0, sizeof(DBT));
 
 	for (ret = 0; ret == 0;) {
-		if ((ret = get_next_message(fd, &rec, &control)) != 0) {
+		if ((ret = get_next_message(fd, rx, &rec, &control)) != 0) {
 			if (app->shared_data.app_finished) {
 				ret = 0;
 				goto netclose;
@@ -243,13 +261,43 @@ netclose:
 		free(site_thrs);
 	}
 
+	rep_cipher_free(rx);
 	return ((void *)(uintptr_t)ret);
 }
 
+/*
+ * site_loop --
+ *	Thread for one accepted connection.  The handshake runs here rather
+ *	than in the accept loop, so a site that connects and then stalls
+ *	only ties up its own thread.  Once admitted it becomes an hm_loop.
+ */
+static void *
+site_loop(args)
+	void *args;
+{
+	hm_loop_args *ha;
+	volatile int *state;
+	int eid;
+	void *ret;
+
+	ha = (hm_loop_args *)args;
+	state = ha->state;
+	if (listen_socket_admit(ha->tab, ha->fd, ha->host, &eid, &ha->rx) != 0) {
+		free(ha);
+		*state = SITE_EXITED;
+		return ((void *)EXIT_FAILURE);
+	}
+	ha->eid = eid;
+	*state = SITE_RUNNING;
+	ret = hm_loop(ha);
+	*state = SITE_EXITED;
+	return (ret);
+}
+
 /*
  * This is a generic thread that spawns a thread to listen for connections
  * on a socket and then spawns off child threads to handle each new
- * connection.
+ * connection.  Slots of threads that have exited are reused.
  */
 void *
 connect_thread(args)
@@ -262,12 +310,13 @@ connect_thread(args)
 	connect_args *cargs;
 	machtab_t *machtab;
 	thread_t hm_thrs[MAX_THREADS];
+	volatile int state[MAX_THREADS];
 	void *status;
-	int i, eid, port, ret;
+	int i, n, host, pending, port, ret;
 	socket_t fd, ns;
 
 	ha = NULL;
-	i = 0;
+	n = 0;
 	cargs = (connect_args *)args;
 	dbenv = cargs->dbenv;
 	home = cargs->home;
@@ -285,16 +334,41 @@ connect_thread(args)
 		goto err;
 	}
 
-	for (i = 0; i < MAX_THREADS; i++) {
+	for (;;) {
 		if ((ns = listen_socket_accept(machtab,
-		    progname, fd, &eid)) == SOCKET_CREATION_FAILURE) {
+		    progname, fd, &host)) == SOCKET_CREATION_FAILURE) {
 			if (app->shared_data.app_finished)
 				ret = 0;
 			else
 				ret = errno;
 			goto err;
 		}
+		/* 连接太多时只拒绝这一个连接，继续接受之后的连接 */
+		for (i = 0, pending = 0; i < n; i++)
+			if (state[i] == SITE_HANDSHAKE)
+				pending++;
+		if (pending >= MAX_HANDSHAKES) {
+			closesocket(ns);
+			dbenv->errx(dbenv, "Too many pending handshakes");
+			continue;
+		}
+		for (i = 0; i < n &&
+		    (state[i] == SITE_RUNNING || state[i] == SITE_HANDSHAKE); i++)
+			;
+		if (i == n) {
+			if (n == MAX_THREADS) {
+				closesocket(ns);
+				dbenv->errx(dbenv, "Too many threads");
+				continue;
+			}
+			state[n++] = SITE_JOINED;
+		} else if (state[i] == SITE_EXITED) {
+			if (thread_join(hm_thrs[i], &status) != 0)
+				dbenv->errx(dbenv, "can't join site thread");
+			state[i] = SITE_JOINED;
+		}
 		if ((ha = calloc(sizeof(hm_loop_args), 1)) == NULL) {
+			closesocket(ns);
 			dbenv->errx(dbenv, "can't allocate memory");
 			ret = errno;
 			goto err;
@@ -302,25 +376,27 @@ connect_thread(args)
 		ha->progname = progname;
 		ha->home = home;
 		ha->fd = ns;
-		ha->eid = eid;
+		ha->host = host;
+		ha->state = &state[i];
 		ha->tab = machtab;
 		ha->dbenv = dbenv;
+		state[i] = SITE_HANDSHAKE;
 		if ((ret = thread_create(&hm_thrs[i], NULL,
-		    hm_loop, (void *)ha)) != 0) {
+		    site_loop, (void *)ha)) != 0) {
+			state[i] = SITE_JOINED;
+			free(ha);
+			closesocket(ns);
 			dbenv->errx(dbenv, "can't create thread for site");
 			goto err;
 		}
 		ha = NULL;
 	}
 
-	/* If we fell out, we ended up with too many threads. */
-	dbenv->errx(dbenv, "Too many threads");
-	ret = ENOMEM;
-
 err:
 	/* Do not return until all threads have exited. */
-	while (--i >= 0)
-		if (thread_join(hm_thrs[i], &status) != 0)
+	for (i = 0; i < n; i++)
+		if (state[i] != SITE_JOINED &&
+		    thread_join(hm_thrs[i], &status) != 0)
 			dbenv->errx(dbenv, "can't join site thread");
 
 	return (ret == 0 ? (void *)EXIT_SUCCESS : (void *)EXIT_FAILURE);
@@ -432,9 +508,10 @@ connect_site(dbenv, machtab, progname, site, is_open, hm_thrp)
 	int eid, ret;
 	socket_t s;
 	hm_loop_args *ha;
+	rep_cipher_t *rx;
 
 	if ((s = get_connected_socket(machtab, progname,
-	    site->host, site->port, is_open, &eid)) < 0)
+	    site->host, site->port, is_open, &eid, &rx)) < 0)
 		return (DB_REP_UNAVAIL);
 
 	if (*is_open)
@@ -448,6 +525,7 @@ connect_site(dbenv, machtab, progname, site, is_open, hm_thrp)
 
 	ha->progname = progname;
 	ha->fd = s;
+	ha->rx = rx;
 	ha->eid = eid;
 	ha->tab = machtab;
 	ha->dbenv = dbenv;
@@ -461,7 +539,7 @@ connect_site(dbenv, machtab, progname, site, is_open, hm_thrp)
 	return (0);
 
 err1:	free(ha);
-err:
+err:	rep_cipher_free(rx);
 	return (ret);
 }
 
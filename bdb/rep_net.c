@@ -23,7 +23,8 @@
 #include "queue.h"		/* !!!: for the LIST_XXX macros. */
 #endif
 
-int machtab_add __P((machtab_t *, socket_t, u_int32_t, int, int *));
+int machtab_add __P((machtab_t *,
+    socket_t, u_int32_t, int, rep_cipher_t *, int *));
 #ifdef DIAGNOSTIC
 void machtab_print __P((machtab_t *));
 #endif
@@ -79,13 +80,15 @@ struct __member {
 	int port;		/* Port number. */
 	int eid;		/* Application-specific machine id. */
 	socket_t fd;		/* File descriptor for the socket. */
+	rep_cipher_t *tx;	/* 发送方向的密钥，没有共享密钥时为NULL */
 	LIST_ENTRY(__member) links;
 				/* For linked list of all members we know of. */
 };
 
 static int quote_send_broadcast __P((machtab_t *,
     const DBT *, const DBT *, u_int32_t));
-static int quote_send_one __P((const DBT *, const DBT *, socket_t, u_int32_t));
+static int quote_send_one __P((const DBT *,
+    const DBT *, socket_t, rep_cipher_t *, u_int32_t));
 
 /*
  * machtab_init --
@@ -125,14 +128,16 @@ machtab_init(machtabp, nsites)
 /*
  * machtab_add --
  *	Add a file descriptor to the table of machines, returning
- *  a new machine ID.
+ *  a new machine ID.  The table takes ownership of tx unless EEXIST
+ *  is returned.
  */
 int
-machtab_add(machtab, fd, hostaddr, port, idp)
+machtab_add(machtab, fd, hostaddr, port, tx, idp)
 	machtab_t *machtab;
 	socket_t fd;
 	u_int32_t hostaddr;
 	int port, *idp;
+	rep_cipher_t *tx;
 {
 	int ret;
 	member_t *m, *member;
@@ -144,6 +149,7 @@ machtab_add(machtab, fd, hostaddr, port, idp)
 	}
 
 	member->fd = fd;
+	member->tx = tx;
 	member->hostaddr = hostaddr;
 	member->port = port;
 
@@ -249,6 +255,7 @@ machtab_rem(machtab, eid, lock)
 			found = 1;
 			LIST_REMOVE(member, links);
 			(void)closesocket(member->fd);
+			rep_cipher_free(member->tx);
 			free(member);
 			machtab->current--;
 			break;
@@ -293,6 +300,7 @@ int machtab_destroy(machtab)
 		LIST_REMOVE(member, links);
 		shutdown(member->fd, SHUT_RDWR);
 		(void)closesocket(member->fd);
+		rep_cipher_free(member->tx);
 		free(member);
 		machtab->current--;
 	}
@@ -403,24 +411,24 @@ err:	closesocket(s);
 /*
  * listen_socket_accept --
  *	Accept a connection on a socket.  This is essentially just a wrapper
- *	for accept(3).
+ *	for accept(3).  *hostp is the address of the remote site; the
+ *	connection is not usable until listen_socket_admit succeeds, which
+ *	the caller runs in the connection's own thread so that a slow or
+ *	silent site can't hold up the accept loop.
  */
 socket_t
-listen_socket_accept(machtab, progname, s, eidp)
+listen_socket_accept(machtab, progname, s, hostp)
 	machtab_t *machtab;
 	const char *progname;
 	socket_t s;
-	int *eidp;
+	int *hostp;
 {
 	struct sockaddr_in si;
 	socklen_t si_len;
-	int host, ret;
 	socket_t ns;
-	u_int16_t port;
 
 	COMPQUIET(progname, NULL);
 
-accept_wait:
 	memset(&si, 0, sizeof(si));
 	si_len = sizeof(si);
 	ns = accept(s, (struct sockaddr *)&si, &si_len);
@@ -429,28 +437,74 @@ accept_wait:
 			fprintf(stderr, "can't accept incoming connection\n");
 		return ns;
 	}
-	host = ntohl(si.sin_addr.s_addr);
+	*hostp = ntohl(si.sin_addr.s_addr);
+	return (ns);
+}
+
+/*
+ * listen_socket_admit --
+ *	Finish setting up a connection returned by listen_socket_accept.
+ *	With a shared secret configured, the remote site must pass
+ *	rep_handshake before it is added to the machtab.  *rxp is the
+ *	receive side cipher for get_next_message, NULL without a secret.
+ *	On failure the socket is closed and non-zero is returned.
+ */
+int
+listen_socket_admit(machtab, ns, host, eidp, rxp)
+	machtab_t *machtab;
+	socket_t ns;
+	int host;
+	int *eidp;
+	rep_cipher_t **rxp;
+{
+	int ret;
+	u_int16_t port;
+	rep_cipher_t *tx, *rx;
+	DBT prec, pcontrol;
+
+	tx = rx = NULL;
 
 	/*
 	 * Sites send their listening port when connections are first
 	 * established, as it will be different from the outgoing port
-	 * for this connection.
+	 * for this connection.  With a secret it comes in the first
+	 * encrypted frame.
 	 */
-	if (readn(ns, &port, 2) != 2)
+	if (rep_secure_enabled()) {
+		if (rep_handshake(ns, 0, &tx, &rx) != 0) {
+			fprintf(stderr,
+			    "rejected replication site %x: handshake failed\n",
+			    host);
+			ret = EACCES;
+			goto err;
+		}
+		memset(&prec, 0, sizeof(DBT));
+		memset(&pcontrol, 0, sizeof(DBT));
+		ret = get_next_message(ns, rx, &prec, &pcontrol);
+		if (ret == 0 && prec.size == 2)
+			memcpy(&port, prec.data, 2);
+		free(prec.data);
+		free(pcontrol.data);
+		if (ret == 0 && prec.size != 2)
+			ret = EINVAL;
+		if (ret != 0)
+			goto err;
+	} else if (readn(ns, &port, 2) != 2) {
+		ret = EIO;
 		goto err;
+	}
 	port = ntohs(port);
 
-	ret = machtab_add(machtab, ns, host, port, eidp);
-	if (ret == EEXIST) {
-		closesocket(ns);
-		goto accept_wait;
-	} else if (ret != 0)
+	if ((ret = machtab_add(machtab, ns, host, port, tx, eidp)) != 0)
 		goto err;
 	printf("Connected to host %x port %d, eid = %d\n", host, port, *eidp);
-	return (ns);
+	*rxp = rx;
+	return (0);
 
-err:	closesocket(ns);
-	return SOCKET_CREATION_FAILURE;
+err:	rep_cipher_free(tx);
+	rep_cipher_free(rx);
+	closesocket(ns);
+	return (ret);
 }
 
 /*
@@ -460,12 +514,15 @@ err:	closesocket(ns);
  *	Add this connection to the machtab.  If we already have a connection
  *	open to this machine, then don't create another one, return the eid
  *	of the connection (in *eidp) and set is_open to 1.  Return 0.
+ *	The handshake is done before the site goes into the machtab, so
+ *	quote_send never writes to a connection that has no keys yet.
  */
 socket_t
-get_connected_socket(machtab, progname, remotehost, port, is_open, eidp)
+get_connected_socket(machtab, progname, remotehost, port, is_open, eidp, rxp)
 	machtab_t *machtab;
 	const char *progname, *remotehost;
 	int port, *is_open, *eidp;
+	rep_cipher_t **rxp;
 {
 	int ret;
 	socket_t s;
@@ -473,8 +530,11 @@ get_connected_socket(machtab, progname, remotehost, port, is_open, eidp)
 	struct sockaddr_in si;
 	u_int32_t addr;
 	u_int16_t nport;
+	rep_cipher_t *tx, *rx;
+	DBT prec, pcontrol;
 
 	*is_open = 0;
+	*rxp = tx = rx = NULL;
 
 	if ((hp = gethostbyname(remotehost)) == NULL) {
 		fprintf(stderr, "%s: host not found: %s\n", progname,
@@ -489,22 +549,13 @@ get_connected_socket(machtab, progname, remotehost, port, is_open, eidp)
 	memset(&si, 0, sizeof(si));
 	memcpy((char *)&si.sin_addr, hp->h_addr, hp->h_length);
 	addr = ntohl(si.sin_addr.s_addr);
-	ret = machtab_add(machtab, s, addr, port, eidp);
-	if (ret == EEXIST) {
-		*is_open = 1;
-		closesocket(s);
-		return (0);
-	} else if (ret != 0) {
-		closesocket(s);
-		return (-1);
-	}
 
 	si.sin_family = AF_INET;
 	si.sin_port = htons((unsigned short)port);
 	if (connect(s, (struct sockaddr *)&si, sizeof(si)) < 0) {
 		fprintf(stderr, "%s: connection failed: %s\n",
 		    progname, strerror(net_errno));
-		(void)machtab_rem(machtab, *eidp, 1);
+		closesocket(s);
 		return (-1);
 	}
 
@@ -514,12 +565,38 @@ get_connected_socket(machtab, progname, remotehost, port, is_open, eidp)
 	 * its machtab.
 	 */
 	nport = htons(myport);
-	ssize_t r = writesocket(s, &nport, 2);
-    if (r == -1) {
-        return r;
-    }
+	if (rep_secure_enabled()) {
+		if (rep_handshake(s, 1, &tx, &rx) != 0) {
+			fprintf(stderr, "%s: replication handshake with %s:%d failed\n",
+			    progname, remotehost, port);
+			goto err;
+		}
+		memset(&prec, 0, sizeof(DBT));
+		memset(&pcontrol, 0, sizeof(DBT));
+		prec.data = &nport;
+		prec.size = 2;
+		if (rep_send_frame(s, tx, &prec, &pcontrol) != 0)
+			goto err;
+	} else if (writesocket(s, &nport, 2) != 2)
+		goto err;
 
+	ret = machtab_add(machtab, s, addr, port, tx, eidp);
+	if (ret == EEXIST) {
+		*is_open = 1;
+		rep_cipher_free(tx);
+		rep_cipher_free(rx);
+		closesocket(s);
+		return (0);
+	} else if (ret != 0)
+		goto err;
+
+	*rxp = rx;
 	return (s);
+
+err:	rep_cipher_free(tx);
+	rep_cipher_free(rx);
+	closesocket(s);
+	return (-1);
 }
 
 /*
@@ -531,14 +608,19 @@ get_connected_socket(machtab, progname, remotehost, port, is_open, eidp)
  * the resulting DBTs are manually dispatched to DB_ENV->rep_process_message().
  */
 int
-get_next_message(fd, rec, control)
+get_next_message(fd, rx, rec, control)
 	socket_t fd;
+	rep_cipher_t *rx;
 	DBT *rec, *control;
 {
 	size_t nr;
 	u_int32_t rsize, csize;
 	u_int8_t *recbuf, *controlbuf;
 
+	/* 配置了共享密钥时每条消息是一个加密的帧，见rep_secure.c */
+	if (rx != NULL)
+		return (rep_recv_frame(fd, rx, rec, control));
+
 	/*
 	 * The protocol we use on the wire is dead simple:
 	 *
@@ -648,6 +730,7 @@ quote_send(dbenv, control, rec, lsnp, eid, flags)
 	socket_t fd;
 	machtab_t *machtab;
 	member_t *m;
+	rep_cipher_t *tx;
 
 	COMPQUIET(lsnp, NULL);
 	machtab =
@@ -671,10 +754,12 @@ quote_send(dbenv, control, rec, lsnp, eid, flags)
 	}
 
 	fd = 0;
+	tx = NULL;
 	for (m = LIST_FIRST(&machtab->machlist); m != NULL;
 	    m = LIST_NEXT(m, links)) {
 		if (m->eid == eid) {
 			fd = m->fd;
+			tx = m->tx;
 			break;
 		}
 	}
@@ -685,7 +770,7 @@ quote_send(dbenv, control, rec, lsnp, eid, flags)
 		return (DB_REP_UNAVAIL);
 	}
 
-	if ((ret = quote_send_one(rec, control, fd, flags)) != 0)
+	if ((ret = quote_send_one(rec, control, fd, tx, flags)) != 0)
 		fprintf(stderr, "socket write error in send() function\n");
 
 	if ((t_ret = mutex_unlock(&machtab->mtmutex)) != 0) {
@@ -720,7 +805,7 @@ quote_send_broadcast(machtab, rec, control, flags)
 	sent = 0;
 	for (m = LIST_FIRST(&machtab->machlist); m != NULL; m = next) {
 		next = LIST_NEXT(m, links);
-		if ((ret = quote_send_one(rec, control, m->fd, flags)) != 0) {
+		if ((ret = quote_send_one(rec, control, m->fd, m->tx, flags)) != 0) {
 			fprintf(stderr, "socket write error in broadcast\n");
 			(void)machtab_rem(machtab, m->eid, 0);
 		} else
@@ -746,9 +831,10 @@ quote_send_broadcast(machtab, rec, control, flags)
  * intersperse writes that are part of two single messages.
  */
 static int
-quote_send_one(rec, control, fd, flags)
+quote_send_one(rec, control, fd, tx, flags)
 	const DBT *rec, *control;
 	socket_t fd;
+	rep_cipher_t *tx;
 	u_int32_t flags;
 
 {
@@ -758,6 +844,9 @@ quote_send_one(rec, control, fd, flags)
 
 	COMPQUIET(flags, 0);
 
+	if (tx != NULL)
+		return (rep_send_frame(fd, tx, rec, control));
+
 	/*
 	 * The protocol is simply: write rec->size, write rec->data,
 	 * write control->size, write control->data.
@@ -0,0 +1,407 @@
+/*
+ * 非repmgr模式下站点之间连接的认证和加密。
+ *
+ * 配置了共享密钥后，每个连接先做一次握手，双方都证明自己知道密钥:
+ *
+ *	发起方 -> 接受方: "BDBR" | 版本 | nonce_c(32)
+ *	接受方 -> 发起方: nonce_s(32) | HMAC(secret, "server" | nonce_c | nonce_s)
+ *	发起方 -> 接受方: HMAC(secret, "client" | nonce_c | nonce_s)
+ *
+ * 两个方向分别用HMAC(secret, "c2s"/"s2c" | nonce_c | nonce_s)作为AES-256-GCM的密钥，
+ * 之后的每条消息是一帧:
+ *
+ *	4字节	- 密文加tag的长度，网络字节序，同时作为AAD
+ *	密文	- rec->size(4) | rec->data | control->size(4) | control->data
+ *	16字节	- GCM tag
+ *
+ * nonce为每个方向从0开始递增的序号，被截断、重放或者修改的帧都会解密失败，连接随之关闭。
+ */
+
+#include <sys/types.h>
+#include <sys/time.h>
+#include <errno.h>
+#include <stdio.h>
+#include <stdlib.h>
+#include <string.h>
+
+#include <openssl/crypto.h>
+#include <openssl/evp.h>
+#include <openssl/hmac.h>
+#include <openssl/rand.h>
+
+#include <db.h>
+#include "rep_base.h"
+
+#define	REP_MAGIC		"BDBR"
+#define	REP_VERSION		1
+#define	REP_NONCE_LEN		32
+#define	REP_MAC_LEN		32
+#define	REP_KEY_LEN		32
+#define	REP_IV_LEN		12
+#define	REP_TAG_LEN		16
+#define	REP_MAX_FRAME		(512 * 1024 * 1024)
+#define	REP_HANDSHAKE_TIMEOUT	5
+
+struct __rep_cipher {
+	EVP_CIPHER_CTX *ctx;
+	unsigned char key[REP_KEY_LEN];
+	u_int64_t seq;
+	unsigned char *buf;
+	size_t bufsize;
+};
+
+static unsigned char *rep_secret;
+static size_t rep_secret_len;
+
+ssize_t readn __P((socket_t, void *, size_t));
+
+/*
+ * rep_set_secret --
+ *	设置共享密钥，必须在start_base之前调用，len为0时不加密。
+ */
+int
+rep_set_secret(secret, len)
+	const char *secret;
+	int len;
+{
+	if (rep_secret != NULL) {
+		OPENSSL_cleanse(rep_secret, rep_secret_len);
+		free(rep_secret);
+		rep_secret = NULL;
+		rep_secret_len = 0;
+	}
+	if (len <= 0)
+		return (0);
+	if ((rep_secret = malloc(len)) == NULL)
+		return (ENOMEM);
+	memcpy(rep_secret, secret, len);
+	rep_secret_len = len;
+	return (0);
+}
+
+int
+rep_secure_enabled()
+{
+	return (rep_secret != NULL);
+}
+
+static int
+writen(fd, vptr, n)
+	socket_t fd;
+	const void *vptr;
+	size_t n;
+{
+	const char *ptr;
+	ssize_t nw;
+
+	for (ptr = vptr; n > 0; ptr += nw, n -= nw)
+		if ((nw = writesocket(fd, ptr, n)) < 0) {
+			if (net_errno == EINTR) {
+				nw = 0;
+				continue;
+			}
+			return (-1);
+		}
+	return (0);
+}
+
+/* rep_mac HMAC-SHA256(secret, label | nonce_c | nonce_s) */
+static void
+rep_mac(label, nonce_c, nonce_s, out)
+	const char *label;
+	const unsigned char *nonce_c, *nonce_s;
+	unsigned char *out;
+{
+	unsigned char msg[16 + 2 * REP_NONCE_LEN];
+	size_t len;
+	unsigned int outlen;
+
+	len = strlen(label);
+	memcpy(msg, label, len);
+	memcpy(msg + len, nonce_c, REP_NONCE_LEN);
+	memcpy(msg + len + REP_NONCE_LEN, nonce_s, REP_NONCE_LEN);
+	outlen = REP_MAC_LEN;
+	HMAC(EVP_sha256(), rep_secret, (int)rep_secret_len,
+	    msg, len + 2 * REP_NONCE_LEN, out, &outlen);
+}
+
+static rep_cipher_t *
+rep_cipher_new(label, nonce_c, nonce_s)
+	const char *label;
+	const unsigned char *nonce_c, *nonce_s;
+{
+	rep_cipher_t *c;
+
+	if ((c = calloc(1, sizeof(rep_cipher_t))) == NULL)
+		return (NULL);
+	if ((c->ctx = EVP_CIPHER_CTX_new()) == NULL) {
+		free(c);
+		return (NULL);
+	}
+	rep_mac(label, nonce_c, nonce_s, c->key);
+	return (c);
+}
+
+void
+rep_cipher_free(c)
+	rep_cipher_t *c;
+{
+	if (c == NULL)
+		return;
+	EVP_CIPHER_CTX_free(c->ctx);
+	OPENSSL_cleanse(c->key, sizeof(c->key));
+	free(c->buf);
+	free(c);
+}
+
+static void
+set_recv_timeout(fd, sec)
+	socket_t fd;
+	int sec;
+{
+	struct timeval tv;
+
+	tv.tv_sec = sec;
+	tv.tv_usec = 0;
+	setsockopt(fd, SOL_SOCKET, SO_RCVTIMEO, (const char *)&tv, sizeof(tv));
+}
+
+/*
+ * rep_handshake --
+ *	用共享密钥互相认证并生成两个方向的密钥，is_client表示是发起连接的一方。
+ *	认证失败返回EACCES。
+ */
+int
+rep_handshake(fd, is_client, txp, rxp)
+	socket_t fd;
+	int is_client;
+	rep_cipher_t **txp, **rxp;
+{
+	unsigned char hello[4 + 1 + REP_NONCE_LEN];
+	unsigned char nonce_c[REP_NONCE_LEN], nonce_s[REP_NONCE_LEN];
+	unsigned char mac[REP_MAC_LEN], expect[REP_MAC_LEN];
+	unsigned char reply[REP_NONCE_LEN + REP_MAC_LEN];
+	rep_cipher_t *c2s, *s2c;
+	int ret;
+
+	*txp = *rxp = NULL;
+	ret = EACCES;
+	set_recv_timeout(fd, REP_HANDSHAKE_TIMEOUT);
+	if (is_client) {
+		if (RAND_bytes(nonce_c, REP_NONCE_LEN) != 1)
+			goto err;
+		memcpy(hello, REP_MAGIC, 4);
+		hello[4] = REP_VERSION;
+		memcpy(hello + 5, nonce_c, REP_NONCE_LEN);
+		if (writen(fd, hello, sizeof(hello)) != 0)
+			goto err;
+		if (readn(fd, reply, sizeof(reply)) != sizeof(reply))
+			goto err;
+		memcpy(nonce_s, reply, REP_NONCE_LEN);
+		rep_mac("server", nonce_c, nonce_s, expect);
+		if (CRYPTO_memcmp(expect, reply + REP_NONCE_LEN, REP_MAC_LEN) != 0) {
+			fprintf(stderr, "replication handshake: bad server proof\n");
+			goto err;
+		}
+		rep_mac("client", nonce_c, nonce_s, mac);
+		if (writen(fd, mac, sizeof(mac)) != 0)
+			goto err;
+	} else {
+		if (readn(fd, hello, sizeof(hello)) != sizeof(hello))
+			goto err;
+		if (memcmp(hello, REP_MAGIC, 4) != 0 || hello[4] != REP_VERSION) {
+			fprintf(stderr, "replication handshake: bad hello\n");
+			goto err;
+		}
+		memcpy(nonce_c, hello + 5, REP_NONCE_LEN);
+		if (RAND_bytes(nonce_s, REP_NONCE_LEN) != 1)
+			goto err;
+		memcpy(reply, nonce_s, REP_NONCE_LEN);
+		rep_mac("server", nonce_c, nonce_s, reply + REP_NONCE_LEN);
+		if (writen(fd, reply, sizeof(reply)) != 0)
+			goto err;
+		if (readn(fd, mac, sizeof(mac)) != sizeof(mac))
+			goto err;
+		rep_mac("client", nonce_c, nonce_s, expect);
+		if (CRYPTO_memcmp(expect, mac, REP_MAC_LEN) != 0) {
+			fprintf(stderr, "replication handshake: bad client proof\n");
+			goto err;
+		}
+	}
+
+	c2s = rep_cipher_new("c2s", nonce_c, nonce_s);
+	s2c = rep_cipher_new("s2c", nonce_c, nonce_s);
+	if (c2s == NULL || s2c == NULL) {
+		rep_cipher_free(c2s);
+		rep_cipher_free(s2c);
+		ret = ENOMEM;
+		goto err;
+	}
+	*txp = is_client ? c2s : s2c;
+	*rxp = is_client ? s2c : c2s;
+	ret = 0;
+
+err:	set_recv_timeout(fd, 0);
+	OPENSSL_cleanse(expect, sizeof(expect));
+	OPENSSL_cleanse(mac, sizeof(mac));
+	return (ret);
+}
+
+static int
+rep_cipher_reserve(c, size)
+	rep_cipher_t *c;
+	size_t size;
+{
+	unsigned char *buf;
+
+	if (c->bufsize >= size)
+		return (0);
+	if ((buf = realloc(c->buf, size)) == NULL)
+		return (ENOMEM);
+	c->buf = buf;
+	c->bufsize = size;
+	return (0);
+}
+
+static void
+rep_cipher_iv(c, iv)
+	rep_cipher_t *c;
+	unsigned char *iv;
+{
+	int i;
+
+	memset(iv, 0, REP_IV_LEN);
+	for (i = 0; i < 8; i++)
+		iv[REP_IV_LEN - 1 - i] = (unsigned char)(c->seq >> (8 * i));
+}
+
+/*
+ * rep_send_frame --
+ *	加密rec和control后作为一帧发送，调用时需要持有machtab的锁。
+ */
+int
+rep_send_frame(fd, c, rec, control)
+	socket_t fd;
+	rep_cipher_t *c;
+	const DBT *rec, *control;
+{
+	unsigned char iv[REP_IV_LEN];
+	unsigned char *p;
+	size_t plain;
+	u_int32_t len, nlen;
+	int outl;
+
+	plain = 8 + (size_t)rec->size + control->size;
+	if (plain + REP_TAG_LEN > REP_MAX_FRAME)
+		return (DB_REP_UNAVAIL);
+	len = (u_int32_t)(plain + REP_TAG_LEN);
+	if (rep_cipher_reserve(c, 4 + len) != 0)
+		return (DB_REP_UNAVAIL);
+
+	nlen = htonl(len);
+	memcpy(c->buf, &nlen, 4);
+	p = c->buf + 4;
+	nlen = htonl(rec->size);
+	memcpy(p, &nlen, 4);
+	if (rec->size > 0)
+		memcpy(p + 4, rec->data, rec->size);
+	p += 4 + rec->size;
+	nlen = htonl(control->size);
+	memcpy(p, &nlen, 4);
+	if (control->size > 0)
+		memcpy(p + 4, control->data, control->size);
+
+	rep_cipher_iv(c, iv);
+	p = c->buf + 4;
+	if (EVP_EncryptInit_ex(c->ctx, EVP_aes_256_gcm(), NULL, c->key, iv) != 1 ||
+	    EVP_EncryptUpdate(c->ctx, NULL, &outl, c->buf, 4) != 1 ||
+	    EVP_EncryptUpdate(c->ctx, p, &outl, p, (int)plain) != 1 ||
+	    EVP_EncryptFinal_ex(c->ctx, p + outl, &outl) != 1 ||
+	    EVP_CIPHER_CTX_ctrl(c->ctx,
+	    EVP_CTRL_GCM_GET_TAG, REP_TAG_LEN, p + plain) != 1)
+		return (DB_REP_UNAVAIL);
+	c->seq++;
+
+	if (writen(fd, c->buf, 4 + len) != 0)
+		return (DB_REP_UNAVAIL);
+	return (0);
+}
+
+/* rep_copy_dbt 和get_next_message一样，按需要扩大dbt->data */
+static int
+rep_copy_dbt(dbt, data, size)
+	DBT *dbt;
+	const unsigned char *data;
+	u_int32_t size;
+{
+	void *buf;
+
+	if (size == 0) {
+		free(dbt->data);
+		dbt->data = NULL;
+		dbt->size = 0;
+		return (0);
+	}
+	buf = dbt->data;
+	if (dbt->size < size)
+		buf = realloc(buf, size);
+	if (buf == NULL)
+		return (1);
+	memcpy(buf, data, size);
+	dbt->data = buf;
+	dbt->size = size;
+	return (0);
+}
+
+/*
+ * rep_recv_frame --
+ *	读取一帧并解密，认证失败或者格式不对时返回非0，调用方应该关闭连接。
+ */
+int
+rep_recv_frame(fd, c, rec, control)
+	socket_t fd;
+	rep_cipher_t *c;
+	DBT *rec, *control;
+{
+	unsigned char iv[REP_IV_LEN];
+	unsigned char hdr[4];
+	u_int32_t len, rsize, csize, plain;
+	int outl;
+
+	if (readn(fd, hdr, 4) != 4)
+		return (1);
+	memcpy(&len, hdr, 4);
+	len = ntohl(len);
+	if (len < 8 + REP_TAG_LEN || len > REP_MAX_FRAME)
+		return (1);
+	if (rep_cipher_reserve(c, len) != 0)
+		return (1);
+	if (readn(fd, c->buf, len) != (ssize_t)len)
+		return (1);
+	plain = len - REP_TAG_LEN;
+
+	rep_cipher_iv(c, iv);
+	if (EVP_DecryptInit_ex(c->ctx, EVP_aes_256_gcm(), NULL, c->key, iv) != 1 ||
+	    EVP_DecryptUpdate(c->ctx, NULL, &outl, hdr, 4) != 1 ||
+	    EVP_DecryptUpdate(c->ctx, c->buf, &outl, c->buf, (int)plain) != 1 ||
+	    EVP_CIPHER_CTX_ctrl(c->ctx,
+	    EVP_CTRL_GCM_SET_TAG, REP_TAG_LEN, c->buf + plain) != 1 ||
+	    EVP_DecryptFinal_ex(c->ctx, c->buf + outl, &outl) != 1) {
+		fprintf(stderr, "replication frame failed authentication\n");
+		return (1);
+	}
+	c->seq++;
+
+	memcpy(&rsize, c->buf, 4);
+	rsize = ntohl(rsize);
+	if ((u_int64_t)rsize + 8 > plain)
+		return (1);
+	memcpy(&csize, c->buf + 4 + rsize, 4);
+	csize = ntohl(csize);
+	if ((u_int64_t)rsize + csize + 8 != plain)
+		return (1);
+	if (rep_copy_dbt(rec, c->buf + 4, rsize) != 0 ||
+	    rep_copy_dbt(control, c->buf + 8 + rsize, csize) != 0)
+		return (1);
+	return (0);
+}
@@ -0,0 +1,164 @@
+#include <stdlib.h>
+#include <string.h>
+#include <db.h>
+#include "rep_common.h"
+#include "bdb.h"
+
+#define STAT_ADD(sec, n, v) do {        \
+    if (count < max) {                  \
+        items[count].section = (sec);   \
+        items[count].name = (n);        \
+        items[count].value = (long long)(v); \
+        ++count;                        \
+    }                                   \
+} while (0)
+
+/*
+ * env_stat 把bdb环境的统计信息填到items中，返回填写的个数
+ * 某一类统计取不到时(比如没有开启复制)，跳过这一类
+ */
+int
+env_stat(DB_ENV *dbenv, SHARED_DATA *shared_data, struct stat_item *items, int max) {
+    DB_MPOOL_STAT *mp;
+    DB_LOCK_STAT *lk;
+    DB_LOG_STAT *lg;
+    DB_TXN_STAT *tx;
+    DB_REP_STAT *rp;
+    struct expire_stat ex;
+    int ret, count;
+
+    count = 0;
+    if ((ret = dbenv->memp_stat(dbenv, &mp, NULL, 0)) == 0) {
+        STAT_ADD("memory", "bdb_cache_size", (long long)mp->st_gbytes * 1024 * 1024 * 1024 + mp->st_bytes);
+        STAT_ADD("memory", "bdb_cache_regions", mp->st_ncache);
+        STAT_ADD("memory", "bdb_cache_pages", mp->st_pages);
+        STAT_ADD("memory", "bdb_cache_pages_dirty", mp->st_page_dirty);
+        STAT_ADD("memory", "bdb_cache_pages_clean", mp->st_page_clean);
+        STAT_ADD("memory", "bdb_cache_hit", mp->st_cache_hit);
+        STAT_ADD("memory", "bdb_cache_miss", mp->st_cache_miss);
+        STAT_ADD("memory", "bdb_cache_page_in", mp->st_page_in);
+        STAT_ADD("memory", "bdb_cache_page_out", mp->st_page_out);
+        free(mp);
+    } else {
+        LOG_ERROR("memp_stat", ret);
+    }
+
+    if ((ret = dbenv->log_stat(dbenv, &lg, 0)) == 0) {
+        STAT_ADD("persistence", "log_bytes_written", (long long)lg->st_w_mbytes * 1024 * 1024 + lg->st_w_bytes);
+        STAT_ADD("persistence", "log_writes", lg->st_wcount);
+        STAT_ADD("persistence", "log_syncs", lg->st_scount);
+        STAT_ADD("persistence", "log_current_file", lg->st_cur_file);
+        STAT_ADD("persistence", "log_current_offset", lg->st_cur_offset);
+        STAT_ADD("persistence", "log_disk_file", lg->st_disk_file);
+        STAT_ADD("persistence", "log_disk_offset", lg->st_disk_offset);
+        free(lg);
+    } else {
+        LOG_ERROR("log_stat", ret);
+    }
+
+    if ((ret = dbenv->txn_stat(dbenv, &tx, 0)) == 0) {
+        STAT_ADD("persistence", "txn_begins", tx->st_nbegins);
+        STAT_ADD("persistence", "txn_commits", tx->st_ncommits);
+        STAT_ADD("persistence", "txn_aborts", tx->st_naborts);
+        STAT_ADD("persistence", "txn_active", tx->st_nactive);
+        STAT_ADD("persistence", "txn_max_active", tx->st_maxnactive);
+        STAT_ADD("persistence", "last_checkpoint_time", tx->st_time_ckp);
+        STAT_ADD("persistence", "last_checkpoint_file", tx->st_last_ckp.file);
+        STAT_ADD("persistence", "last_checkpoint_offset", tx->st_last_ckp.offset);
+        free(tx);
+    } else {
+        LOG_ERROR("txn_stat", ret);
+    }
+
+    STAT_ADD("replication", "is_master", shared_data->is_master);
+    STAT_ADD("replication", "in_client_sync", shared_data->in_client_sync);
+    STAT_ADD("replication", "is_repmgr", shared_data->is_repmgr);
+    if ((ret = dbenv->rep_stat(dbenv, &rp, 0)) == 0) {
+        STAT_ADD("replication", "rep_env_id", rp->st_env_id);
+        STAT_ADD("replication", "rep_master_id", rp->st_master);
+        STAT_ADD("replication", "rep_startup_complete", rp->st_startup_complete);
+        STAT_ADD("replication", "rep_generation", rp->st_gen);
+        STAT_ADD("replication", "rep_election_generation", rp->st_egen);
+        STAT_ADD("replication", "rep_nsites", rp->st_nsites);
+        STAT_ADD("replication", "rep_next_lsn_file", rp->st_next_lsn.file);
+        STAT_ADD("replication", "rep_next_lsn_offset", rp->st_next_lsn.offset);
+        STAT_ADD("replication", "rep_max_perm_lsn_file", rp->st_max_perm_lsn.file);
+        STAT_ADD("replication", "rep_max_perm_lsn_offset", rp->st_max_perm_lsn.offset);
+        STAT_ADD("replication", "rep_log_queued", rp->st_log_queued);
+        STAT_ADD("replication", "rep_txns_applied", rp->st_txns_applied);
+        STAT_ADD("replication", "rep_msgs_processed", rp->st_msgs_processed);
+        STAT_ADD("replication", "rep_msgs_sent", rp->st_msgs_sent);
+        STAT_ADD("replication", "rep_msgs_send_failures", rp->st_msgs_send_failures);
+        STAT_ADD("replication", "rep_master_changes", rp->st_master_changes);
+        STAT_ADD("replication", "rep_elections", rp->st_elections);
+        STAT_ADD("replication", "rep_elections_won", rp->st_elections_won);
+        free(rp);
+    } else {
+        LOG_ERROR("rep_stat", ret);
+    }
+
+    if ((ret = dbenv->lock_stat(dbenv, &lk, 0)) == 0) {
+        STAT_ADD("stats", "lock_count", lk->st_nlocks);
+        STAT_ADD("stats", "lock_max_count", lk->st_maxnlocks);
+        STAT_ADD("stats", "lock_lockers", lk->st_nlockers);
+        STAT_ADD("stats", "lock_requests", lk->st_nrequests);
+        STAT_ADD("stats", "lock_waits", lk->st_lock_wait);
+        STAT_ADD("stats", "lock_deadlocks", lk->st_ndeadlocks);
+        STAT_ADD("stats", "lock_timeouts", lk->st_nlocktimeouts);
+        STAT_ADD("stats", "lock_txn_timeouts", lk->st_ntxntimeouts);
+        free(lk);
+    } else {
+        LOG_ERROR("lock_stat", ret);
+    }
+
+    expire_get_stat(&ex);
+    STAT_ADD("stats", "expire_scanned", ex.scanned);
+    STAT_ADD("stats", "expired_keys", ex.expired);
+    STAT_ADD("stats", "expire_last_run", ex.last_run);
+    STAT_ADD("stats", "expire_last_due", ex.last_due);
+
+    return count;
+}
+
+/*
+ * db_count 统计表中的记录数，需要遍历整个表，
+ * 使用DB_READ_UNCOMMITTED，不会阻塞写操作
+ */
+int
+db_count(DB_ENV *dbenv, SHARED_DATA *shared_data, const char *name, unsigned long long *count) {
+    DB *dbp;
+    DBTYPE type;
+    void *sp;
+    int ret;
+
+    *count = 0;
+    if ((ret = open_db(dbenv, shared_data, name, DB_UNKNOWN, 0, &dbp)) != 0) {
+        return ret;
+    }
+    if ((ret = dbp->get_type(dbp, &type)) != 0) {
+        LOG_ERROR("get_type", ret);
+        goto end;
+    }
+    if ((ret = dbp->stat(dbp, NULL, &sp, DB_READ_UNCOMMITTED)) != 0) {
+        LOG_ERROR("stat", ret);
+        goto end;
+    }
+    switch (type) {
+    case DB_BTREE:
+    case DB_RECNO:
+        *count = ((DB_BTREE_STAT *)sp)->bt_ndata;
+        break;
+    case DB_HASH:
+        *count = ((DB_HASH_STAT *)sp)->hash_ndata;
+        break;
+    case DB_HEAP:
+        *count = ((DB_HEAP_STAT *)sp)->heap_nrecs;
+        break;
+    default:
+        break;
+    }
+    free(sp);
+end:
+    dbp->close(dbp, 0);
+    return ret;
+}
@@ -1,6 +1,8 @@
 package main
 
 import (
+	"crypto/tls"
+	"errors"
 	"github.com/BurntSushi/toml"
 	"github.com/nybuxtsui/bdbd/bdb"
 	"github.com/nybuxtsui/bdbd/server"
@@ -11,7 +13,11 @@ import (
 	"os"
 	"os/signal"
 	"runtime"
+	"strconv"
+	"strings"
+	"sync/atomic"
 	"syscall"
+	"time"
 )
 
 //var redisAddr = flag.String("l", ":2323", "redis listen port")
@@ -19,10 +25,8 @@ import (
 import "C"
 
 func main() {
-	runtime.GOMAXPROCS(runtime.NumCPU() * 4)
-
 	signalChan := make(chan os.Signal, 1)
-	signal.Notify(signalChan, syscall.SIGINT, syscall.SIGTERM)
+	signal.Notify(signalChan, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
 
 	// master
 	//go run main.go -h db1 -M -l 127.0.0.1:2345 -r 127.0.0.1:2346
@@ -42,10 +46,65 @@ func main() {
 		Bdb    bdb.BdbConfig        `toml:"bdb"`
 		Logger []mylog.LoggerDefine `toml:"logger"`
 		Server struct {
-			Listen string
+			// Listen和TLSListen可以是一个地址或者地址的数组，unix:开头的是unix socket
+			Listen         interface{}
+			UnixSocketPerm string `toml:"unix_socket_perm"`
+			Databases      int
+			Metrics        string
+			Requirepass    string
+
+			TLSListen          interface{} `toml:"tls_listen"`
+			TLSCertFile        string      `toml:"tls_cert_file"`
+			TLSKeyFile         string      `toml:"tls_key_file"`
+			TLSCACertFile      string      `toml:"tls_ca_cert_file"`
+			TLSAuthClients     string      `toml:"tls_auth_clients"`
+			TLSAuthClientsUser bool        `toml:"tls_auth_clients_user"`
+
+			SlowlogLogSlowerThan    int64 `toml:"slowlog_log_slower_than"`
+			SlowlogMaxLen           int   `toml:"slowlog_max_len"`
+			LatencyMonitorThreshold int64 `toml:"latency_monitor_threshold"`
+
+			MaxClients              int64 `toml:"maxclients"`
+			Timeout                 int64 `toml:"timeout"`
+			ProtoMaxBulkLen         int64 `toml:"proto_max_bulk_len"`
+			ClientOutputBufferLimit int64 `toml:"client_output_buffer_limit"`
+			ClientOutputTimeout     int64 `toml:"client_output_timeout"`
+
+			ShutdownTimeout int `toml:"shutdown_timeout"` // 秒
+
+			GoMaxProcs       int   `toml:"gomaxprocs"`
+			Workers          int   `toml:"workers"`
+			WorkersMax       int   `toml:"workers_max"`
+			WorkerScaleWait  int64 `toml:"worker_scale_wait"`
+			WorkQueueSize    int   `toml:"work_queue_size"`
+			WorkQueueTimeout int64 `toml:"work_queue_timeout"`
+			WorkerLockThread bool  `toml:"worker_lock_thread"`
+			RouteByKey       bool  `toml:"route_by_key"`
+
+			GroupCommit       bool  `toml:"group_commit"`
+			GroupCommitWindow int64 `toml:"group_commit_window"` // 微秒
+			GroupCommitMax    int64 `toml:"group_commit_max"`
 		} `toml:"server"`
 	}
 	config.Bdb.Flush = 1
+	config.Server.UnixSocketPerm = "0700"
+	config.Server.SlowlogLogSlowerThan = server.SlowlogSlowerThan
+	config.Server.SlowlogMaxLen = server.SlowlogMaxLen
+	config.Server.MaxClients = server.MaxClients
+	config.Server.Timeout = server.IdleTimeout
+	config.Server.ProtoMaxBulkLen = server.ProtoMaxBulkLen
+	config.Server.ClientOutputBufferLimit = server.OutputBufferLimit
+	config.Server.ClientOutputTimeout = server.OutputTimeout
+	config.Server.GoMaxProcs = runtime.NumCPU() * 4
+	config.Server.Workers = server.Workers
+	config.Server.WorkerScaleWait = server.WorkerScaleWait
+	config.Server.WorkQueueSize = server.WorkQueueSize
+	config.Server.WorkQueueTimeout = server.WorkQueueTimeout
+	config.Server.WorkerLockThread = server.WorkerLockThread
+	config.Server.RouteByKey = server.RouteByKey
+	config.Server.GroupCommit = server.GroupCommit
+	config.Server.GroupCommitWindow = server.GroupCommitWindow
+	config.Server.GroupCommitMax = server.GroupCommitMax
 	_, err = toml.Decode(string(configstr), &config)
 	if err != nil {
 		log.Println("ERROR: decode config failed:", err)
@@ -53,10 +112,72 @@ func main() {
 	}
 
 	mylog.Init(config.Logger)
+	server.ConfigFile = configFile
+	// loglevel 修改所有logger的级别
+	server.RegisterConfig("loglevel", "logger", "level", true,
+		func() string {
+			if len(config.Logger) == 0 {
+				return ""
+			}
+			return config.Logger[0].Level
+		},
+		func(value string) (func() error, error) {
+			value = strings.ToLower(value)
+			switch value {
+			case "debug", "info", "error", "fatal":
+			default:
+				return nil, errors.New("argument must be one of debug, info, error, fatal")
+			}
+			return func() error {
+				for i := range config.Logger {
+					config.Logger[i].Level = value
+				}
+				mylog.Init(config.Logger)
+				return nil
+			}, nil
+		})
+	if config.Server.Databases > 0 {
+		server.Databases = config.Server.Databases
+	}
+	server.SlowlogSlowerThan = config.Server.SlowlogLogSlowerThan
+	if err = server.SetSlowlogMaxLen(int64(config.Server.SlowlogMaxLen)); err != nil {
+		mylog.Fatal("slowlog_max_len|%s", err.Error())
+	}
+	server.LatencyThreshold = config.Server.LatencyMonitorThreshold
+	server.Requirepass = config.Server.Requirepass
+	server.MaxClients = config.Server.MaxClients
+	server.IdleTimeout = config.Server.Timeout
+	server.ProtoMaxBulkLen = config.Server.ProtoMaxBulkLen
+	server.OutputBufferLimit = config.Server.ClientOutputBufferLimit
+	server.OutputTimeout = config.Server.ClientOutputTimeout
+	if config.Server.GoMaxProcs > 0 {
+		runtime.GOMAXPROCS(config.Server.GoMaxProcs)
+	}
+	if config.Server.Workers <= 0 || config.Server.WorkQueueSize <= 0 {
+		mylog.Fatal("workers|invalid|%d|%d", config.Server.Workers, config.Server.WorkQueueSize)
+	}
+	server.Workers = config.Server.Workers
+	server.WorkersMax = config.Server.WorkersMax
+	server.WorkerScaleWait = config.Server.WorkerScaleWait
+	server.WorkQueueSize = config.Server.WorkQueueSize
+	server.WorkQueueTimeout = config.Server.WorkQueueTimeout
+	server.WorkerLockThread = config.Server.WorkerLockThread
+	server.RouteByKey = config.Server.RouteByKey
+	server.GroupCommit = config.Server.GroupCommit
+	server.GroupCommitWindow = config.Server.GroupCommitWindow
+	if config.Server.GroupCommitMax > 0 {
+		server.GroupCommitMax = config.Server.GroupCommitMax
+	}
+	if config.Server.ShutdownTimeout > 0 {
+		server.ShutdownTimeout = time.Duration(config.Server.ShutdownTimeout) * time.Second
+	}
 
 	mylog.Info("bdb|starting")
 	dbenv := bdb.Start(config.Bdb)
 	mylog.Info("bdb|started")
+	if err = server.LoadAcl(dbenv); err != nil {
+		mylog.Fatal("LoadAcl|%s", err.Error())
+	}
 
 	/*
 		db, err := dbenv.GetDb("test")
@@ -75,30 +196,149 @@ func main() {
 		mylog.Fatal("end")
 	*/
 
-	go func() {
-		addr, err := net.ResolveTCPAddr("tcp", config.Server.Listen)
-		if err != nil {
-			mylog.Fatal("ResolveTCPAddr|%s", err.Error())
-		}
-		listener, err := net.ListenTCP("tcp", addr)
+	// 先启动worker再接受连接
+	server.Start(dbenv)
+
+	perm, err := strconv.ParseUint(config.Server.UnixSocketPerm, 8, 32)
+	if err != nil {
+		mylog.Fatal("unix_socket_perm|%s", err.Error())
+	}
+	var listeners []net.Listener
+	for _, addr := range listenAddrs(config.Server.Listen) {
+		listener := listen(addr, os.FileMode(perm))
+		listeners = append(listeners, listener)
+		go serve(listener, dbenv, nil)
+	}
+	if addrs := listenAddrs(config.Server.TLSListen); len(addrs) > 0 {
+		tlsConfig, err := server.StartTLS(server.TLSConfig{
+			CertFile:        config.Server.TLSCertFile,
+			KeyFile:         config.Server.TLSKeyFile,
+			CACertFile:      config.Server.TLSCACertFile,
+			AuthClients:     config.Server.TLSAuthClients,
+			AuthClientsUser: config.Server.TLSAuthClientsUser,
+		})
 		if err != nil {
-			mylog.Fatal("Server|ListenTCP|%s", err.Error())
+			mylog.Fatal("StartTLS|%s", err.Error())
 		}
-		for {
-			client, err := listener.AcceptTCP()
-			if err != nil {
-				mylog.Error("Server|%s", err.Error())
-			}
-			client.SetKeepAlive(true)
-			conn := server.NewConn(client, dbenv)
-			go conn.Start()
+		for _, addr := range addrs {
+			listener := listen(addr, os.FileMode(perm))
+			listeners = append(listeners, listener)
+			go serve(listener, dbenv, tlsConfig)
 		}
-	}()
+	}
 
-	server.Start(dbenv)
+	if config.Server.Metrics != "" {
+		go server.StartMetrics(config.Server.Metrics, dbenv)
+	}
 	mylog.Info("start")
-	<-signalChan
+	save := waitShutdown(signalChan)
+
+	// 先停止接受新的连接，再等待已有的连接处理完
+	atomic.StoreInt32(&stopping, 1)
+	for _, listener := range listeners {
+		listener.Close()
+	}
 	server.Exit()
+	if save {
+		if err = dbenv.Checkpoint(); err != nil {
+			mylog.Error("Checkpoint|%s", err.Error())
+		}
+	}
 	dbenv.Exit()
 	mylog.Info("bye")
 }
+
+// stopping 退出时关闭listener，accept出错时不再重试
+var stopping int32
+
+// waitShutdown 等待退出的信号或者SHUTDOWN命令，返回退出前是否需要checkpoint
+func waitShutdown(signalChan chan os.Signal) bool {
+	for {
+		select {
+		case sig := <-signalChan:
+			if sig == syscall.SIGHUP {
+				server.ReloadTLS()
+				continue
+			}
+			mylog.Info("signal|%s", sig.String())
+			return true
+		case save := <-server.ShutdownChan:
+			return save
+		}
+	}
+}
+
+// listenAddrs 配置中的listen可以是字符串或者字符串数组
+func listenAddrs(v interface{}) []string {
+	switch v := v.(type) {
+	case string:
+		if v != "" {
+			return []string{v}
+		}
+	case []interface{}:
+		addrs := make([]string, 0, len(v))
+		for _, addr := range v {
+			s, ok := addr.(string)
+			if !ok {
+				mylog.Fatal("listen|invalid_addr|%v", addr)
+			}
+			addrs = append(addrs, s)
+		}
+		return addrs
+	}
+	return nil
+}
+
+// listen addr以unix:开头时监听unix socket，并把权限设为perm
+func listen(addr string, perm os.FileMode) net.Listener {
+	if strings.HasPrefix(addr, "unix:") {
+		path := addr[len("unix:"):]
+		// 上次没有正常退出时socket文件还在，不删掉的话bind会失败
+		if fi, err := os.Lstat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+			os.Remove(path)
+		}
+		// bind时按umask创建socket文件，先收紧umask，否则chmod之前其他用户就可以连接
+		umask := syscall.Umask(0777 &^ int(perm.Perm()))
+		listener, err := net.Listen("unix", path)
+		syscall.Umask(umask)
+		if err != nil {
+			mylog.Fatal("Server|ListenUnix|%s", err.Error())
+		}
+		if err = os.Chmod(path, perm); err != nil {
+			mylog.Fatal("Server|Chmod|%s", err.Error())
+		}
+		return listener
+	}
+	tcpAddr, err := net.ResolveTCPAddr("tcp", addr)
+	if err != nil {
+		mylog.Fatal("ResolveTCPAddr|%s", err.Error())
+	}
+	listener, err := net.ListenTCP("tcp", tcpAddr)
+	if err != nil {
+		mylog.Fatal("Server|ListenTCP|%s", err.Error())
+	}
+	return listener
+}
+
+// serve 接受连接，tlsConfig不为nil时使用TLS
+func serve(listener net.Listener, dbenv *bdb.DbEnv, tlsConfig *tls.Config) {
+	mylog.Info("Server|listen|%s|tls=%v", listener.Addr().String(), tlsConfig != nil)
+	for {
+		client, err := listener.Accept()
+		if err != nil {
+			if atomic.LoadInt32(&stopping) != 0 {
+				return
+			}
+			mylog.Error("Server|%s", err.Error())
+			continue
+		}
+		if tcp, ok := client.(*net.TCPConn); ok {
+			tcp.SetKeepAlive(true)
+		}
+		if tlsConfig != nil {
+			client = tls.Server(client, tlsConfig)
+		}
+		conn := server.NewConn(client, dbenv)
+		go conn.Start()
+	}
+}
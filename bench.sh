@@ -0,0 +1,16 @@
+#!/bin/sh
+# 用redis-benchmark比较不使用pipeline和使用pipeline(-P 16)时的吞吐量，需要先启动bdbd
+# ./bench.sh [host] [port] [requests]
+HOST=${1:-127.0.0.1}
+PORT=${2:-2323}
+REQUESTS=${3:-100000}
+TESTS=set,get,incr
+
+for P in 1 16; do
+    echo "== pipeline $P =="
+    redis-benchmark -h $HOST -p $PORT -n $REQUESTS -c 50 -r 100000 -P $P -t $TESTS -q
+done
+
+# 所有请求都是同一个key时只能由一个worker按顺序处理，和上面的随机key对比可以看出按key路由的影响
+echo "== pipeline 16, single key =="
+redis-benchmark -h $HOST -p $PORT -n $REQUESTS -c 50 -P 16 -t $TESTS -q
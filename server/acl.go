@@ -0,0 +1,671 @@
+package server
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/nybuxtsui/bdbd/bdb"
+	"github.com/nybuxtsui/log"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 用户保存在__acl表中，key为用户名，value为ACL LIST中用户名之后的规则，
+// 密码只保存sha256。__acl和普通的表一样复制到副本，副本上的缓存在ACL LOAD时重新读取，
+// AUTH时最多每秒重新读取一次。
+// 表中没有default用户时，default用户可以执行所有命令，配置了requirepass时需要密码
+
+const (
+	aclTable    = "__acl"
+	defaultUser = "default"
+)
+
+// Requirepass default用户的密码，__acl表中有default用户时不使用
+var Requirepass string
+
+var (
+	ErrNoAuth       = errors.New("Authentication required.")
+	ErrWrongPass    = errors.New("invalid username-password pair or user is disabled.")
+	ErrNoPermKey    = errors.New("this user has no permissions to access one of the keys used as arguments")
+	ErrNoDefaultPwd = errors.New("AUTH <password> called without any password configured for the default user. Are you sure your configuration is correct?")
+	ErrDelDefault   = errors.New("The 'default' user cannot be removed")
+	ErrHelloNoAuth  = errors.New("HELLO must be called with the client already authenticated, otherwise the HELLO <proto> AUTH <user> <pass> option can be used to authenticate the client and select the RESP protocol version at the same time")
+)
+
+// noAuthCmds 没有认证的连接可以执行的命令
+var noAuthCmds = map[string]bool{"auth": true, "hello": true, "ping": true, "quit": true, "reset": true}
+
+// aclAdminCmds +@admin和-@admin包括的命令
+var aclAdminCmds = []string{"acl", "client", "config", "latency", "monitor", "shutdown", "slowlog"}
+
+// tableCmds 参数中是表名而不是key的命令
+var tableCmds = map[string]bool{"idx.create": true, "idx.drop": true, "idx.list": true, "idx.get": true, "idx.range": true}
+
+type aclUser struct {
+	name      string
+	enabled   bool
+	nopass    bool
+	passwords []string // sha256的16进制
+	allCmds   bool
+	cmds      map[string]bool // 在allCmds之上单独允许或者禁止的命令
+	tables    []string        // 允许访问的表名，path.Match的格式
+}
+
+var acl = struct {
+	sync.RWMutex
+	users map[string]*aclUser
+}{users: make(map[string]*aclUser)}
+
+// aclWrite 保证ACL SETUSER/DELUSER的读-改-写和重新读取__acl表不会交叉
+var aclWrite sync.Mutex
+
+// aclReloadInterval AUTH时最多每隔这么久重新读取一次__acl表，避免大量AUTH请求占满worker
+const aclReloadInterval = time.Second
+
+// aclLoaded 上次读取__acl表的时间，持有aclWrite时访问
+var aclLoaded time.Time
+
+type bdbAclSetReq struct {
+	name  string
+	rules []byte // nil表示删除
+	resp  chan bdbSetResp
+}
+
+type bdbAclLoadReq struct {
+	resp chan bdbAclLoadResp
+}
+
+type bdbAclLoadResp struct {
+	users map[string]string
+	err   error
+}
+
+func newAclUser(name string) *aclUser {
+	return &aclUser{name: name, cmds: make(map[string]bool)}
+}
+
+func hashPassword(pass string) string {
+	sum := sha256.Sum256([]byte(pass))
+	return hex.EncodeToString(sum[:])
+}
+
+func isPasswordHash(s string) bool {
+	if len(s) != sha256.Size*2 {
+		return false
+	}
+	_, err := hex.DecodeString(s)
+	return err == nil
+}
+
+func (u *aclUser) clone() *aclUser {
+	n := *u
+	n.passwords = append([]string(nil), u.passwords...)
+	n.tables = append([]string(nil), u.tables...)
+	n.cmds = make(map[string]bool, len(u.cmds))
+	for k, v := range u.cmds {
+		n.cmds[k] = v
+	}
+	return &n
+}
+
+func (u *aclUser) addPassword(hash string) {
+	for _, p := range u.passwords {
+		if p == hash {
+			return
+		}
+	}
+	u.passwords = append(u.passwords, hash)
+	u.nopass = false
+}
+
+func (u *aclUser) delPassword(hash string) {
+	for i, p := range u.passwords {
+		if p == hash {
+			u.passwords = append(u.passwords[:i], u.passwords[i+1:]...)
+			return
+		}
+	}
+}
+
+// setRule 和redis的ACL规则一样，命令只支持@all和@admin两个分类
+func (u *aclUser) setRule(rule string) error {
+	lower := strings.ToLower(rule)
+	switch lower {
+	case "on":
+		u.enabled = true
+	case "off":
+		u.enabled = false
+	case "nopass":
+		u.nopass = true
+		u.passwords = nil
+	case "resetpass":
+		u.nopass = false
+		u.passwords = nil
+	case "allkeys":
+		u.tables = []string{"*"}
+	case "resetkeys":
+		u.tables = nil
+	case "allcommands", "+@all":
+		u.allCmds = true
+		u.cmds = make(map[string]bool)
+	case "nocommands", "-@all":
+		u.allCmds = false
+		u.cmds = make(map[string]bool)
+	case "+@admin", "-@admin":
+		for _, cmd := range aclAdminCmds {
+			u.cmds[cmd] = lower[0] == '+'
+		}
+	case "reset":
+		*u = *newAclUser(u.name)
+	default:
+		if rule == "" {
+			return ErrSyntax
+		}
+		switch rule[0] {
+		case '>':
+			u.addPassword(hashPassword(rule[1:]))
+		case '<':
+			u.delPassword(hashPassword(rule[1:]))
+		case '#', '!':
+			hash := strings.ToLower(rule[1:])
+			if !isPasswordHash(hash) {
+				return errors.New("The password hash must be exactly 64 characters and contain only lowercase hexadecimal characters")
+			}
+			if rule[0] == '#' {
+				u.addPassword(hash)
+			} else {
+				u.delPassword(hash)
+			}
+		case '~':
+			if _, err := path.Match(rule[1:], ""); err != nil {
+				return ErrSyntax
+			}
+			u.tables = append(u.tables, rule[1:])
+		case '+', '-':
+			// cmdStats和cmdMap中的命令一样，这里用cmdMap会造成初始化循环
+			if _, ok := cmdStats[lower[1:]]; !ok {
+				return fmt.Errorf("Unknown command or category name in ACL")
+			}
+			u.cmds[lower[1:]] = rule[0] == '+'
+		default:
+			return ErrSyntax
+		}
+	}
+	return nil
+}
+
+// rules ACL LIST中用户名之后的部分，也是保存在__acl表中的内容
+func (u *aclUser) rules() string {
+	parts := make([]string, 0, 4+len(u.passwords)+len(u.tables)+len(u.cmds))
+	if u.enabled {
+		parts = append(parts, "on")
+	} else {
+		parts = append(parts, "off")
+	}
+	if u.nopass {
+		parts = append(parts, "nopass")
+	}
+	for _, p := range u.passwords {
+		parts = append(parts, "#"+p)
+	}
+	if len(u.tables) == 0 {
+		parts = append(parts, "resetkeys")
+	}
+	for _, t := range u.tables {
+		parts = append(parts, "~"+t)
+	}
+	if u.allCmds {
+		parts = append(parts, "+@all")
+	} else {
+		parts = append(parts, "-@all")
+	}
+	cmds := make([]string, 0, len(u.cmds))
+	for cmd := range u.cmds {
+		cmds = append(cmds, cmd)
+	}
+	sort.Strings(cmds)
+	for _, cmd := range cmds {
+		if u.cmds[cmd] {
+			parts = append(parts, "+"+cmd)
+		} else {
+			parts = append(parts, "-"+cmd)
+		}
+	}
+	return strings.Join(parts, " ")
+}
+
+func (u *aclUser) checkPassword(pass string) bool {
+	if u.nopass {
+		return true
+	}
+	hash := []byte(hashPassword(pass))
+	for _, p := range u.passwords {
+		if subtle.ConstantTimeCompare(hash, []byte(p)) == 1 {
+			return true
+		}
+	}
+	return false
+}
+
+func (u *aclUser) canRun(cmd string) bool {
+	if allowed, ok := u.cmds[cmd]; ok {
+		return allowed
+	}
+	return u.allCmds
+}
+
+func (u *aclUser) canAccess(table string) bool {
+	if internalTable(table) {
+		return false
+	}
+	for _, pattern := range u.tables {
+		if ok, _ := path.Match(pattern, table); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// internalTable 内部使用的表不能通过普通的命令访问，例如__acl、__version、__expire，
+// 以及索引的<table>.idx.<name>.<n>表。__default和__db<n>是普通的key所在的表
+func internalTable(table string) bool {
+	if strings.Contains(table, ".idx.") {
+		return true
+	}
+	if !strings.HasPrefix(table, "__") || table == defaultTable {
+		return false
+	}
+	num := strings.TrimPrefix(table, "__db")
+	if num == table || num == "" {
+		return true
+	}
+	for i := 0; i < len(num); i++ {
+		if num[i] < '0' || num[i] > '9' {
+			return true
+		}
+	}
+	return false
+}
+
+// keyTable 和bdb.SplitKey取得的表名一样，但是不修改key
+func keyTable(key []byte) string {
+	if i := bytes.IndexByte(key, ':'); i > 0 {
+		return string(key[:i])
+	}
+	return defaultTable
+}
+
+// buildUsers 根据__acl表的内容生成用户，表中没有default用户时根据requirepass生成
+func buildUsers(table map[string]string) map[string]*aclUser {
+	users := make(map[string]*aclUser, len(table)+1)
+	for name, rules := range table {
+		u := newAclUser(name)
+		for _, rule := range strings.Fields(rules) {
+			if err := u.setRule(rule); err != nil {
+				log.Error("acl|setRule|%s|%s|%s", name, rule, err.Error())
+			}
+		}
+		users[name] = u
+	}
+	if users[defaultUser] == nil {
+		u := newAclUser(defaultUser)
+		u.enabled = true
+		u.allCmds = true
+		u.tables = []string{"*"}
+		if Requirepass == "" {
+			u.nopass = true
+		} else {
+			u.addPassword(hashPassword(Requirepass))
+		}
+		users[defaultUser] = u
+	}
+	return users
+}
+
+// readAclTable 读取__acl表中的所有用户，表不存在时返回空
+func readAclTable(dbenv *bdb.DbEnv) (map[string]string, error) {
+	db, err := dbenv.GetDb(aclTable, bdb.DBTYPE_UNKNOWN)
+	if err == bdb.ErrNotExist {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+	cur, err := db.Cursor(nil, bdb.DB_READ_COMMITTED)
+	if err != nil {
+		return nil, err
+	}
+	defer cur.Close()
+	table := make(map[string]string)
+	k, v, err := cur.Get(nil, bdb.DB_FIRST)
+	for ; err == nil; k, v, err = cur.Get(nil, bdb.DB_NEXT) {
+		table[string(k)] = string(v)
+	}
+	if err != bdb.ErrNotFound {
+		return nil, err
+	}
+	return table, nil
+}
+
+// LoadAcl 启动时读取用户，读取失败时不能启动，否则会以不需要密码的default用户运行
+func LoadAcl(dbenv *bdb.DbEnv) error {
+	table, err := readAclTable(dbenv)
+	if err != nil {
+		return err
+	}
+	users := buildUsers(table)
+	aclWrite.Lock()
+	acl.Lock()
+	acl.users = users
+	acl.Unlock()
+	aclLoaded = time.Now()
+	aclWrite.Unlock()
+	return nil
+}
+
+func (w *Worker) bdbAclLoad(req *bdbAclLoadReq) {
+	table, err := readAclTable(w.dbenv)
+	req.resp <- bdbAclLoadResp{table, err}
+}
+
+func (w *Worker) bdbAclSet(req *bdbAclSetReq) {
+	db, err := w.getdb(aclTable, bdb.DBTYPE_BTREE)
+	if err != nil {
+		req.resp <- bdbSetResp{err}
+		return
+	}
+	txn, err := w.dbenv.Begin(bdb.DB_READ_COMMITTED)
+	if err != nil {
+		req.resp <- bdbSetResp{err}
+		return
+	}
+	if req.rules == nil {
+		err = db.Del(txn, []byte(req.name), 0)
+		if err == bdb.ErrNotFound {
+			err = nil
+		}
+	} else {
+		err = db.Set(txn, []byte(req.name), req.rules, 0)
+	}
+	if err != nil {
+		w.checkerr(err, db)
+		txn.Abort()
+		req.resp <- bdbSetResp{err}
+		return
+	}
+	req.resp <- bdbSetResp{txn.Commit()}
+}
+
+// reloadAcl 通过worker重新读取__acl表，副本上主节点修改的用户在这之后生效。
+// force为false时距离上次读取不到aclReloadInterval就不再读取
+func reloadAcl(conn *Conn, force bool) error {
+	aclWrite.Lock()
+	defer aclWrite.Unlock()
+	if !force && time.Since(aclLoaded) < aclReloadInterval {
+		return nil
+	}
+	respChan := make(chan bdbAclLoadResp, 1)
+	if err := conn.send(bdbAclLoadReq{respChan}); err != nil {
+		return err
+	}
+	resp := <-respChan
+	if resp.err != nil {
+		return resp.err
+	}
+	users := buildUsers(resp.users)
+	acl.Lock()
+	acl.users = users
+	acl.Unlock()
+	aclLoaded = time.Now()
+	return nil
+}
+
+// loginUser 新连接自动登录的用户，default用户需要密码时为空
+func loginUser() string {
+	acl.RLock()
+	defer acl.RUnlock()
+	if u := acl.users[defaultUser]; u != nil && u.enabled && u.nopass {
+		return defaultUser
+	}
+	return ""
+}
+
+// authenticate 检查用户名和密码，成功后连接切换到这个用户
+func (c *Conn) authenticate(name string, pass string) error {
+	if err := reloadAcl(c, false); err != nil {
+		log.Error("authenticate|reloadAcl|%s", err.Error())
+	}
+	acl.RLock()
+	u := acl.users[name]
+	ok := u != nil && u.enabled && u.checkPassword(pass)
+	acl.RUnlock()
+	if !ok {
+		log.Info("authenticate|failed|%s|%s", c.addr, name)
+		return ErrWrongPass
+	}
+	c.mu.Lock()
+	c.user = name
+	c.mu.Unlock()
+	return nil
+}
+
+// checkPerm 检查当前用户能否执行cmd，返回错误码和错误
+func (c *Conn) checkPerm(cmd string, args [][]byte) (string, error) {
+	if c.user == "" {
+		if noAuthCmds[cmd] {
+			return "", nil
+		}
+		return "NOAUTH", ErrNoAuth
+	}
+	if cmd == "auth" || cmd == "hello" || cmd == "quit" || cmd == "reset" {
+		return "", nil
+	}
+	acl.RLock()
+	defer acl.RUnlock()
+	u := acl.users[c.user]
+	if u == nil || !u.enabled {
+		return "NOAUTH", ErrNoAuth
+	}
+	if !u.canRun(cmd) {
+		return "NOPERM", fmt.Errorf("this user has no permissions to run the '%s' command", cmd)
+	}
+	if tableCmds[cmd] {
+		if !u.canAccess(string(args[0])) {
+			return "NOPERM", ErrNoPermKey
+		}
+		return "", nil
+	}
+	spec, ok := cmdKeys[cmd]
+	if !ok {
+		return "", nil
+	}
+	last := spec.last
+	if last < 0 || last >= len(args) {
+		last = len(args) - 1
+	}
+	for i := spec.first; i <= last; i++ {
+		if !u.canAccess(keyTable(args[i])) {
+			return "NOPERM", ErrNoPermKey
+		}
+	}
+	return "", nil
+}
+
+// redactArgs MONITOR和slowlog中不显示密码
+func redactArgs(cmd string, req [][]byte) [][]byte {
+	redacted := []byte("(redacted)")
+	out := append([][]byte(nil), req...)
+	switch cmd {
+	case "auth":
+		for i := 1; i < len(out); i++ {
+			out[i] = redacted
+		}
+	case "hello":
+		for i := 2; i < len(out); i++ {
+			if strings.ToLower(string(out[i])) == "auth" && i+2 < len(out) {
+				out[i+2] = redacted
+				i += 2
+			}
+		}
+	case "acl":
+		if len(out) > 1 && strings.ToLower(string(out[1])) == "setuser" {
+			for i := 3; i < len(out); i++ {
+				out[i] = redacted
+			}
+		}
+	}
+	return out
+}
+
+var redactCmds = map[string]bool{"auth": true, "hello": true, "acl": true}
+
+// cmdAuth AUTH [username] password
+func cmdAuth(conn *Conn, args [][]byte) (err error) {
+	log.Debug("cmdAuth|%d", len(args))
+	name, pass := defaultUser, string(args[0])
+	if len(args) == 2 {
+		name, pass = string(args[0]), string(args[1])
+	} else {
+		acl.RLock()
+		u := acl.users[defaultUser]
+		nopass := u != nil && u.nopass
+		acl.RUnlock()
+		if nopass {
+			return conn.writeError(ErrNoDefaultPwd)
+		}
+	}
+	if err = conn.authenticate(name, pass); err != nil {
+		return conn.writeErrorCode("WRONGPASS", err)
+	}
+	_, err = conn.wb.WriteString("+OK\r\n")
+	return
+}
+
+// cmdAcl ACL SETUSER | DELUSER | LIST | USERS | WHOAMI | LOAD
+func cmdAcl(conn *Conn, args [][]byte) (err error) {
+	log.Debug("cmdAcl|%s", args[0])
+	sub := strings.ToLower(string(args[0]))
+	switch {
+	case sub == "whoami" && len(args) == 1:
+		return conn.writeBulk([]byte(conn.user))
+	case sub == "list" && len(args) == 1, sub == "users" && len(args) == 1:
+		acl.RLock()
+		names := make([]string, 0, len(acl.users))
+		for name := range acl.users {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		lines := make([]string, len(names))
+		for i, name := range names {
+			if sub == "list" {
+				lines[i] = "user " + name + " " + acl.users[name].rules()
+			} else {
+				lines[i] = name
+			}
+		}
+		acl.RUnlock()
+		conn.writeLen('*', len(lines))
+		for _, line := range lines {
+			err = conn.writeBulk([]byte(line))
+		}
+		return
+	case sub == "load" && len(args) == 1:
+		if err = reloadAcl(conn, true); err != nil {
+			return conn.writeError(err)
+		}
+		_, err = conn.wb.WriteString("+OK\r\n")
+		return
+	case sub == "setuser" && len(args) >= 2:
+		return aclSetUser(conn, string(args[1]), args[2:])
+	case sub == "deluser" && len(args) >= 2:
+		return aclDelUser(conn, args[1:])
+	}
+	return conn.writeError(fmt.Errorf("unknown subcommand or wrong number of arguments for '%s'", sub))
+}
+
+func aclSetUser(conn *Conn, name string, rules [][]byte) error {
+	if !checkClientName([]byte(name)) {
+		return conn.writeError(ErrSyntax)
+	}
+	aclWrite.Lock()
+	defer aclWrite.Unlock()
+	acl.RLock()
+	u := acl.users[name]
+	acl.RUnlock()
+	if u == nil {
+		u = newAclUser(name)
+	} else {
+		u = u.clone()
+	}
+	for _, rule := range rules {
+		if err := u.setRule(string(rule)); err != nil {
+			return conn.writeError(fmt.Errorf("Error in ACL SETUSER modifier '%s': %s", rule, err.Error()))
+		}
+	}
+	respChan := make(chan bdbSetResp, 1)
+	if ok, err := conn.sendOrBusy(bdbAclSetReq{name, []byte(u.rules()), respChan}); !ok {
+		return err
+	}
+	if resp := <-respChan; resp.err != nil {
+		return conn.writeError(resp.err)
+	}
+	acl.Lock()
+	acl.users[name] = u
+	acl.Unlock()
+	log.Info("acl|setuser|%s", name)
+	_, err := conn.wb.WriteString("+OK\r\n")
+	return err
+}
+
+// aclDelUser 删除用户并关闭以这些用户登录的连接
+func aclDelUser(conn *Conn, names [][]byte) error {
+	aclWrite.Lock()
+	defer aclWrite.Unlock()
+	for _, name := range names {
+		if string(name) == defaultUser {
+			return conn.writeError(ErrDelDefault)
+		}
+	}
+	deleted := make(map[string]bool)
+	for _, name := range names {
+		acl.RLock()
+		u := acl.users[string(name)]
+		acl.RUnlock()
+		if u == nil {
+			continue
+		}
+		respChan := make(chan bdbSetResp, 1)
+		if ok, err := conn.sendOrBusy(bdbAclSetReq{string(name), nil, respChan}); !ok {
+			return err
+		}
+		if resp := <-respChan; resp.err != nil {
+			return conn.writeError(resp.err)
+		}
+		acl.Lock()
+		delete(acl.users, string(name))
+		acl.Unlock()
+		deleted[string(name)] = true
+		log.Info("acl|deluser|%s", name)
+	}
+
+	var targets []*Conn
+	conns.Lock()
+	for _, c := range conns.m {
+		c.mu.Lock()
+		if deleted[c.user] {
+			targets = append(targets, c)
+		}
+		c.mu.Unlock()
+	}
+	conns.Unlock()
+	for _, c := range targets {
+		c.kill(conn)
+	}
+	return conn.writeInt(int64(len(deleted)))
+}
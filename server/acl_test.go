@@ -0,0 +1,130 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func testConn(t testing.TB) *Conn {
+	c1, c2 := net.Pipe()
+	t.Cleanup(func() {
+		c1.Close()
+		c2.Close()
+	})
+	return NewConn(c1, testEnv)
+}
+
+// AUTH时不是每次都重新读取__acl表
+func TestAclReloadInterval(t *testing.T) {
+	conn := testConn(t)
+	if err := reloadAcl(conn, true); err != nil {
+		t.Fatal(err)
+	}
+	aclWrite.Lock()
+	loaded := aclLoaded
+	aclWrite.Unlock()
+	for i := 0; i < 10; i++ {
+		if err := conn.authenticate("nobody", "x"); err != ErrWrongPass {
+			t.Fatalf("authenticate = %v, want %v", err, ErrWrongPass)
+		}
+	}
+	aclWrite.Lock()
+	reloaded := aclLoaded != loaded
+	aclWrite.Unlock()
+	if reloaded && time.Since(loaded) < aclReloadInterval {
+		t.Fatal("AUTH reloaded the acl table within aclReloadInterval")
+	}
+}
+
+// ACL LOAD和SETUSER同时执行时，SETUSER的结果不会被重新读取的旧数据覆盖
+func TestAclReloadWhileSetUser(t *testing.T) {
+	conn1, conn2 := testConn(t), testConn(t)
+	defer func() {
+		names := make([][]byte, 0, 20)
+		for i := 0; i < 20; i++ {
+			names = append(names, []byte("t041_"+strconv.Itoa(i)))
+		}
+		aclDelUser(conn1, names)
+	}()
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 20; i++ {
+			aclSetUser(conn1, "t041_"+strconv.Itoa(i), [][]byte{[]byte("on"), []byte("nopass")})
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 20; i++ {
+			if err := reloadAcl(conn2, true); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+	wg.Wait()
+	acl.RLock()
+	defer acl.RUnlock()
+	for i := 0; i < 20; i++ {
+		if acl.users["t041_"+strconv.Itoa(i)] == nil {
+			t.Fatalf("user t041_%d lost", i)
+		}
+	}
+}
+
+// testReply 在conn上执行一个命令，返回回复
+func testReply(t *testing.T, conn *Conn, args ...string) string {
+	var out bytes.Buffer
+	conn.wb = bufio.NewWriter(&out)
+	conn.rb = bufio.NewReader(bytes.NewReader(nil))
+	req := make([][]byte, len(args))
+	for i, arg := range args {
+		req[i] = []byte(arg)
+	}
+	if err := conn.execRequest(req); err != nil {
+		t.Fatal(err)
+	}
+	conn.wb.Flush()
+	return out.String()
+}
+
+// 没有登录的连接执行命令回复NOAUTH
+func TestAclNoAuth(t *testing.T) {
+	conn := testConn(t)
+	conn.user = ""
+	if reply := testReply(t, conn, "get", "t041:k"); !strings.HasPrefix(reply, "-NOAUTH ") {
+		t.Fatalf("reply = %q", reply)
+	}
+}
+
+// 不允许访问的表回复NOPERM，~*也不能访问内部使用的表
+func TestAclNoPerm(t *testing.T) {
+	conn := testConn(t)
+	defer aclDelUser(conn, [][]byte{[]byte("t041_limited")})
+	aclSetUser(conn, "t041_limited", [][]byte{[]byte("on"), []byte("nopass"), []byte("allcommands"), []byte("~t041*")})
+	conn.user = "t041_limited"
+	if reply := testReply(t, conn, "get", "other:k"); !strings.HasPrefix(reply, "-NOPERM ") {
+		t.Fatalf("reply = %q", reply)
+	}
+
+	conn.user = defaultUser
+	for _, key := range []string{"__acl:k", "__version:k", "__expire:k", "__expire.index:k", "__index:k", "__db1.t:k", "t041.idx.n.1:k"} {
+		if reply := testReply(t, conn, "get", key); !strings.HasPrefix(reply, "-NOPERM ") {
+			t.Fatalf("get %s = %q", key, reply)
+		}
+	}
+	u := newAclUser("t041_all")
+	u.setRule("allkeys")
+	for _, table := range []string{defaultTable, "__db1", "__db12", "t041"} {
+		if !u.canAccess(table) {
+			t.Fatalf("can't access %s", table)
+		}
+	}
+}
@@ -0,0 +1,835 @@
+package server
+
+import (
+	"errors"
+	"github.com/nybuxtsui/bdbd/bdb"
+	"github.com/nybuxtsui/log"
+	"math"
+	"math/bits"
+	"strconv"
+	"strings"
+)
+
+// redis的字符串最大为512MB，位偏移量不能超过这个范围
+const maxBitOffset = 512*1024*1024*8 - 1
+
+var (
+	ErrBitOffset     = errors.New("bit offset is not an integer or out of range")
+	ErrBitValue      = errors.New("bit is not an integer or out of range")
+	ErrBitfieldType  = errors.New("Invalid bitfield type. Use something like i16 u8. Note that u64 is not supported but i64 is.")
+	ErrOverflowType  = errors.New("Invalid OVERFLOW type specified")
+	ErrBitfieldRo    = errors.New("BITFIELD_RO only supports the GET subcommand")
+	ErrBitOpNotCount = errors.New("BITOP NOT must be called with a single source key.")
+	ErrBitPosValue   = errors.New("The bit argument must be 1 or 0.")
+)
+
+type bdbGetRangeReq struct {
+	key    []byte
+	off    uint32
+	length uint32
+	resp   chan bdbGetResp
+}
+
+type bdbSetBitReq struct {
+	key    []byte
+	offset uint32
+	bit    byte
+	resp   chan bdbIntResp
+}
+
+type bdbIntResp struct {
+	result int64
+	err    error
+}
+
+type bdbBitOpReq struct {
+	op   string
+	dest []byte
+	keys [][]byte
+	resp chan bdbIntResp
+}
+
+const (
+	bitfieldGet = iota
+	bitfieldSet
+	bitfieldIncrBy
+)
+
+const (
+	overflowWrap = iota
+	overflowSat
+	overflowFail
+)
+
+type bitfieldOp struct {
+	op       int
+	signed   bool
+	bits     uint
+	offset   uint64
+	value    int64
+	overflow int
+}
+
+type bitfieldResult struct {
+	value int64
+	isnil bool
+}
+
+type bdbBitFieldReq struct {
+	key  []byte
+	ops  []bitfieldOp
+	resp chan bdbBitFieldResp
+}
+
+type bdbBitFieldResp struct {
+	results []bitfieldResult
+	err     error
+}
+
+func (w *Worker) bdbGetRange(req *bdbGetRangeReq) {
+	table, name := bdb.SplitKey(req.key)
+	db, err := w.getdb(table, bdb.DBTYPE_BTREE)
+	if err != nil {
+		req.resp <- bdbGetResp{nil, err}
+		return
+	}
+	value, err := db.GetPartial(nil, name, req.off, req.length, &w.getbuff, 0)
+	if err != nil {
+		if err == bdb.ErrNotFound {
+			req.resp <- bdbGetResp{nil, nil}
+		} else {
+			w.checkerr(err, db)
+			req.resp <- bdbGetResp{nil, err}
+		}
+		return
+	}
+	req.resp <- bdbGetResp{value, nil}
+}
+
+// bdbSetBit 只读写偏移量所在的一个字节，不会重写整条记录
+func (w *Worker) bdbSetBit(req *bdbSetBitReq) {
+	key := append([]byte(nil), req.key...)
+	table, name := bdb.SplitKey(req.key)
+	db, err := w.getdb(table, bdb.DBTYPE_BTREE)
+	if err != nil {
+		req.resp <- bdbIntResp{0, err}
+		return
+	}
+	txn, err := w.dbenv.Begin(bdb.DB_READ_COMMITTED)
+	if err != nil {
+		req.resp <- bdbIntResp{0, err}
+		return
+	}
+	defer func() {
+		if txn != nil {
+			txn.Abort()
+		}
+	}()
+
+	off := req.offset >> 3
+	value, err := db.GetPartial(txn, name, off, 1, &w.getbuff, bdb.DB_RMW)
+	if err != nil && err != bdb.ErrNotFound {
+		w.checkerr(err, db)
+		req.resp <- bdbIntResp{0, err}
+		return
+	}
+	var b byte = 0
+	if len(value) > 0 {
+		b = value[0]
+	}
+	mask := byte(1) << (7 - (req.offset & 7))
+	var old int64 = 0
+	if b&mask != 0 {
+		old = 1
+	}
+	if req.bit == 1 {
+		b |= mask
+	} else {
+		b &^= mask
+	}
+	err = db.SetPartial(txn, name, off, 1, []byte{b}, 0)
+	if err != nil {
+		w.checkerr(err, db)
+		req.resp <- bdbIntResp{0, err}
+		return
+	}
+	if _, err = w.bumpVersion(txn, key); err != nil {
+		req.resp <- bdbIntResp{0, err}
+		return
+	}
+	err = txn.Commit()
+	txn = nil
+	if err != nil {
+		req.resp <- bdbIntResp{0, err}
+		return
+	}
+	req.resp <- bdbIntResp{old, nil}
+}
+
+func (w *Worker) bdbBitOp(req *bdbBitOpReq) {
+	txn, err := w.dbenv.Begin(bdb.DB_READ_COMMITTED)
+	if err != nil {
+		req.resp <- bdbIntResp{0, err}
+		return
+	}
+	defer func() {
+		if txn != nil {
+			txn.Abort()
+		}
+	}()
+
+	srcs := make([][]byte, len(req.keys))
+	for i, key := range req.keys {
+		table, name := bdb.SplitKey(key)
+		db, err := w.getdb(table, bdb.DBTYPE_BTREE)
+		if err != nil {
+			req.resp <- bdbIntResp{0, err}
+			return
+		}
+		srcs[i], err = db.Get(txn, name, &w.getbuff, 0)
+		if err != nil && err != bdb.ErrNotFound {
+			w.checkerr(err, db)
+			req.resp <- bdbIntResp{0, err}
+			return
+		}
+	}
+	result := bitop(req.op, srcs)
+
+	dest := append([]byte(nil), req.dest...)
+	table, name := bdb.SplitKey(req.dest)
+	db, err := w.getdb(table, bdb.DBTYPE_BTREE)
+	if err != nil {
+		req.resp <- bdbIntResp{0, err}
+		return
+	}
+	if len(result) == 0 {
+		err = db.Del(txn, name, 0)
+		if err == bdb.ErrNotFound {
+			err = nil
+		}
+	} else {
+		err = db.Set(txn, name, result, 0)
+	}
+	if err != nil {
+		w.checkerr(err, db)
+		req.resp <- bdbIntResp{0, err}
+		return
+	}
+	if _, err = w.bumpVersion(txn, dest); err != nil {
+		req.resp <- bdbIntResp{0, err}
+		return
+	}
+	err = txn.Commit()
+	txn = nil
+	if err != nil {
+		req.resp <- bdbIntResp{0, err}
+		return
+	}
+	req.resp <- bdbIntResp{int64(len(result)), nil}
+}
+
+// bdbBitField 只读取所有操作涉及的字节区间，并只写回被修改的部分
+func (w *Worker) bdbBitField(req *bdbBitFieldReq) {
+	key := append([]byte(nil), req.key...)
+	table, name := bdb.SplitKey(req.key)
+	db, err := w.getdb(table, bdb.DBTYPE_BTREE)
+	if err != nil {
+		req.resp <- bdbBitFieldResp{nil, err}
+		return
+	}
+
+	// 读取的区间包括所有操作，wmax是修改操作涉及的最后一个字节，写回时值可能需要变长
+	var start, end, wmax uint64 = math.MaxUint64, 0, 0
+	readonly := true
+	for i := range req.ops {
+		op := &req.ops[i]
+		e := (op.offset + uint64(op.bits) - 1) >> 3
+		if op.op != bitfieldGet {
+			readonly = false
+			if e > wmax {
+				wmax = e
+			}
+		}
+		if s := op.offset >> 3; s < start {
+			start = s
+		}
+		if e > end {
+			end = e
+		}
+	}
+
+	var txn *bdb.Txn
+	var flags uint32 = 0
+	if !readonly {
+		txn, err = w.dbenv.Begin(bdb.DB_READ_COMMITTED)
+		if err != nil {
+			req.resp <- bdbBitFieldResp{nil, err}
+			return
+		}
+		defer func() {
+			if txn != nil {
+				txn.Abort()
+			}
+		}()
+		flags = bdb.DB_RMW
+	}
+	value, err := db.GetPartial(txn, name, uint32(start), uint32(end-start+1), &w.getbuff, flags)
+	if err != nil && err != bdb.ErrNotFound {
+		w.checkerr(err, db)
+		req.resp <- bdbBitFieldResp{nil, err}
+		return
+	}
+	// 只为已有的字节和修改的字节分配内存，GET超出值的部分按0处理，大偏移量的GET不会分配大块内存
+	n := uint64(len(value))
+	if !readonly && wmax-start+1 > n {
+		n = wmax - start + 1
+	}
+	buf := make([]byte, n)
+	copy(buf, value)
+
+	base := start << 3
+	var wstart, wend uint64 = math.MaxUint64, 0
+	results := make([]bitfieldResult, 0, len(req.ops))
+	for i := range req.ops {
+		op := &req.ops[i]
+		off := op.offset - base
+		var old int64
+		if op.signed {
+			old = getSignedBitfield(buf, off, op.bits)
+		} else {
+			old = int64(getUnsignedBitfield(buf, off, op.bits))
+		}
+		if op.op == bitfieldGet {
+			results = append(results, bitfieldResult{old, false})
+			continue
+		}
+
+		var newval int64
+		var ok bool
+		if op.op == bitfieldSet {
+			newval, ok = checkBitfieldOverflow(op, op.value, 0)
+		} else {
+			newval, ok = checkBitfieldOverflow(op, old, op.value)
+		}
+		if !ok {
+			results = append(results, bitfieldResult{0, true})
+			continue
+		}
+		setBitfield(buf, off, op.bits, uint64(newval))
+		if op.op == bitfieldSet {
+			results = append(results, bitfieldResult{old, false})
+		} else {
+			results = append(results, bitfieldResult{newval, false})
+		}
+		if s := op.offset >> 3; s < wstart {
+			wstart = s
+		}
+		if e := (op.offset + uint64(op.bits) - 1) >> 3; e > wend {
+			wend = e
+		}
+	}
+
+	if wstart <= wend {
+		err = db.SetPartial(txn, name, uint32(wstart), uint32(wend-wstart+1), buf[wstart-start:wend-start+1], 0)
+		if err != nil {
+			w.checkerr(err, db)
+			req.resp <- bdbBitFieldResp{nil, err}
+			return
+		}
+		if _, err = w.bumpVersion(txn, key); err != nil {
+			req.resp <- bdbBitFieldResp{nil, err}
+			return
+		}
+	}
+	if txn != nil {
+		err = txn.Commit()
+		txn = nil
+		if err != nil {
+			req.resp <- bdbBitFieldResp{nil, err}
+			return
+		}
+	}
+	req.resp <- bdbBitFieldResp{results, nil}
+}
+
+func bitop(op string, srcs [][]byte) []byte {
+	maxlen := 0
+	for _, src := range srcs {
+		if len(src) > maxlen {
+			maxlen = len(src)
+		}
+	}
+	result := make([]byte, maxlen)
+	if op == "not" {
+		for i, b := range srcs[0] {
+			result[i] = ^b
+		}
+		return result
+	}
+	copy(result, srcs[0])
+	for _, src := range srcs[1:] {
+		for i := range result {
+			var b byte = 0
+			if i < len(src) {
+				b = src[i]
+			}
+			switch op {
+			case "and":
+				result[i] &= b
+			case "or":
+				result[i] |= b
+			case "xor":
+				result[i] ^= b
+			}
+		}
+	}
+	return result
+}
+
+// getUnsignedBitfield 超出buf的位按0处理
+func getUnsignedBitfield(buf []byte, offset uint64, bits uint) uint64 {
+	var value uint64 = 0
+	for j := uint(0); j < bits; j++ {
+		bit := 7 - uint(offset&7)
+		var b byte
+		if i := offset >> 3; i < uint64(len(buf)) {
+			b = buf[i]
+		}
+		value = value<<1 | uint64(b>>bit&1)
+		offset++
+	}
+	return value
+}
+
+func getSignedBitfield(buf []byte, offset uint64, bits uint) int64 {
+	value := getUnsignedBitfield(buf, offset, bits)
+	if bits < 64 && value&(uint64(1)<<(bits-1)) != 0 {
+		value |= ^uint64(0) << bits
+	}
+	return int64(value)
+}
+
+func setBitfield(buf []byte, offset uint64, bits uint, value uint64) {
+	for j := uint(0); j < bits; j++ {
+		bit := byte(1) << (7 - uint(offset&7))
+		if value>>(bits-1-j)&1 != 0 {
+			buf[offset>>3] |= bit
+		} else {
+			buf[offset>>3] &^= bit
+		}
+		offset++
+	}
+}
+
+// checkBitfieldOverflow 按照op的溢出策略计算value+incr，策略为FAIL且溢出时返回false
+func checkBitfieldOverflow(op *bitfieldOp, value int64, incr int64) (int64, bool) {
+	if op.signed {
+		return checkSignedOverflow(value, incr, op.bits, op.overflow)
+	}
+	return checkUnsignedOverflow(uint64(value), incr, op.bits, op.overflow)
+}
+
+func checkUnsignedOverflow(value uint64, incr int64, bits uint, overflow int) (int64, bool) {
+	max := uint64(1)<<bits - 1
+	maxincr := int64(max - value)
+	minincr := -int64(value)
+
+	var limit uint64
+	if value > max || (incr > 0 && incr > maxincr) {
+		limit = max
+	} else if incr < 0 && incr < minincr {
+		limit = 0
+	} else {
+		return int64(value + uint64(incr)), true
+	}
+	switch overflow {
+	case overflowWrap:
+		return int64((value + uint64(incr)) & max), true
+	case overflowSat:
+		return int64(limit), true
+	default:
+		return 0, false
+	}
+}
+
+func checkSignedOverflow(value int64, incr int64, bits uint, overflow int) (int64, bool) {
+	var max int64 = math.MaxInt64
+	if bits < 64 {
+		max = int64(1)<<(bits-1) - 1
+	}
+	min := -max - 1
+	maxincr := max - value
+	minincr := min - value
+
+	var limit int64
+	if value > max || (bits != 64 && incr > maxincr) || (value >= 0 && incr > 0 && incr > maxincr) {
+		limit = max
+	} else if value < min || (bits != 64 && incr < minincr) || (value < 0 && incr < 0 && incr < minincr) {
+		limit = min
+	} else {
+		return value + incr, true
+	}
+	switch overflow {
+	case overflowWrap:
+		c := uint64(value) + uint64(incr)
+		if bits < 64 {
+			mask := ^uint64(0) << bits
+			if c&(uint64(1)<<(bits-1)) != 0 {
+				c |= mask
+			} else {
+				c &^= mask
+			}
+		}
+		return int64(c), true
+	case overflowSat:
+		return limit, true
+	default:
+		return 0, false
+	}
+}
+
+func parseBitOffset(arg []byte) (uint32, error) {
+	offset, err := strconv.ParseUint(string(arg), 10, 64)
+	if err != nil || offset > maxBitOffset {
+		return 0, ErrBitOffset
+	}
+	return uint32(offset), nil
+}
+
+// parseBitRange 解析BITCOUNT/BITPOS的[start end [BYTE|BIT]]参数，
+// 负数表示从末尾开始计算，返回值已经限定在[0, totlen)之内
+func parseBitRange(args [][]byte, strlen int64) (start int64, end int64, isbit bool, err error) {
+	if len(args) == 3 {
+		switch strings.ToLower(string(args[2])) {
+		case "bit":
+			isbit = true
+		case "byte":
+		default:
+			return 0, 0, false, ErrSyntax
+		}
+	}
+	totlen := strlen
+	if isbit {
+		totlen = strlen * 8
+	}
+	start, end = 0, totlen-1
+	if len(args) > 0 {
+		if start, err = strconv.ParseInt(string(args[0]), 10, 64); err != nil {
+			return 0, 0, false, ErrNotInteger
+		}
+	}
+	if len(args) > 1 {
+		if end, err = strconv.ParseInt(string(args[1]), 10, 64); err != nil {
+			return 0, 0, false, ErrNotInteger
+		}
+	}
+	if start < 0 {
+		start = totlen + start
+	}
+	if end < 0 {
+		end = totlen + end
+	}
+	if start < 0 {
+		start = 0
+	}
+	if end < 0 {
+		end = 0
+	}
+	if end >= totlen {
+		end = totlen - 1
+	}
+	return start, end, isbit, nil
+}
+
+func bitAt(value []byte, pos int64) byte {
+	return value[pos>>3] >> (7 - uint(pos&7)) & 1
+}
+
+func bitcount(value []byte, start int64, end int64, isbit bool) int64 {
+	if start > end {
+		return 0
+	}
+	if !isbit {
+		start, end = start*8, end*8+7
+	}
+	var count int64 = 0
+	for pos := start; pos <= end; {
+		if pos&7 == 0 && pos+7 <= end {
+			count += int64(bits.OnesCount8(value[pos>>3]))
+			pos += 8
+		} else {
+			count += int64(bitAt(value, pos))
+			pos++
+		}
+	}
+	return count
+}
+
+func bitpos(value []byte, bit byte, start int64, end int64, isbit bool, endGiven bool) int64 {
+	if start > end {
+		return -1
+	}
+	if !isbit {
+		start, end = start*8, end*8+7
+	}
+	var skip byte = 0
+	if bit == 0 {
+		skip = 0xff
+	}
+	for pos := start; pos <= end; {
+		if pos&7 == 0 && pos+7 <= end && value[pos>>3] == skip {
+			pos += 8
+			continue
+		}
+		if bitAt(value, pos) == bit {
+			return pos
+		}
+		pos++
+	}
+	// 查找0但没有指定结束位置时，认为字符串右侧是无限个0
+	if bit == 0 && !endGiven {
+		return end + 1
+	}
+	return -1
+}
+
+func parseBitfieldType(arg []byte) (bool, uint, error) {
+	s := strings.ToLower(string(arg))
+	if len(s) < 2 || (s[0] != 'i' && s[0] != 'u') {
+		return false, 0, ErrBitfieldType
+	}
+	signed := s[0] == 'i'
+	n, err := strconv.ParseUint(s[1:], 10, 8)
+	if err != nil || n < 1 || (signed && n > 64) || (!signed && n > 63) {
+		return false, 0, ErrBitfieldType
+	}
+	return signed, uint(n), nil
+}
+
+// parseBitfieldOffset 解析位偏移量，"#N"表示第N个字段，即N*bits
+func parseBitfieldOffset(arg []byte, bits uint) (uint64, error) {
+	mul := false
+	if len(arg) > 0 && arg[0] == '#' {
+		mul = true
+		arg = arg[1:]
+	}
+	offset, err := strconv.ParseUint(string(arg), 10, 64)
+	if err != nil {
+		return 0, ErrBitOffset
+	}
+	if mul {
+		if offset > maxBitOffset/uint64(bits) {
+			return 0, ErrBitOffset
+		}
+		offset *= uint64(bits)
+	}
+	if offset > maxBitOffset {
+		return 0, ErrBitOffset
+	}
+	return offset, nil
+}
+
+func cmdSetBit(conn *Conn, args [][]byte) (err error) {
+	log.Debug("cmdSetBit|%s|%s|%s", args[0], args[1], args[2])
+	offset, err := parseBitOffset(args[1])
+	if err != nil {
+		return conn.writeError(err)
+	}
+	if len(args[2]) != 1 || (args[2][0] != '0' && args[2][0] != '1') {
+		return conn.writeError(ErrBitValue)
+	}
+	respChan := make(chan bdbIntResp, 1)
+	if ok, err := conn.sendOrBusy(bdbSetBitReq{args[0], offset, args[2][0] - '0', respChan}); !ok {
+		return err
+	}
+	resp := <-respChan
+	if resp.err != nil {
+		return conn.writeError(resp.err)
+	}
+	return conn.writeInt(resp.result)
+}
+
+func cmdGetBit(conn *Conn, args [][]byte) (err error) {
+	log.Debug("cmdGetBit|%s|%s", args[0], args[1])
+	offset, err := parseBitOffset(args[1])
+	if err != nil {
+		return conn.writeError(err)
+	}
+	respChan := make(chan bdbGetResp, 1)
+	if ok, err := conn.sendOrBusy(bdbGetRangeReq{args[0], offset >> 3, 1, respChan}); !ok {
+		return err
+	}
+	resp := <-respChan
+	if resp.err != nil {
+		return conn.writeError(resp.err)
+	}
+	if len(resp.value) == 0 {
+		return conn.writeInt(0)
+	}
+	return conn.writeInt(int64(bitAt(resp.value, int64(offset&7))))
+}
+
+func cmdBitCount(conn *Conn, args [][]byte) (err error) {
+	log.Debug("cmdBitCount|%s", args[0])
+	if len(args) == 2 {
+		return conn.writeError(ErrSyntax)
+	}
+	respChan := make(chan bdbGetResp, 1)
+	if ok, err := conn.sendOrBusy(bdbGetReq{args[0], respChan}); !ok {
+		return err
+	}
+	resp := <-respChan
+	if resp.err != nil {
+		return conn.writeError(resp.err)
+	}
+	start, end, isbit, err := parseBitRange(args[1:], int64(len(resp.value)))
+	if err != nil {
+		return conn.writeError(err)
+	}
+	return conn.writeInt(bitcount(resp.value, start, end, isbit))
+}
+
+func cmdBitPos(conn *Conn, args [][]byte) (err error) {
+	log.Debug("cmdBitPos|%s|%s", args[0], args[1])
+	if len(args[1]) != 1 || (args[1][0] != '0' && args[1][0] != '1') {
+		return conn.writeError(ErrBitPosValue)
+	}
+	bit := args[1][0] - '0'
+	respChan := make(chan bdbGetResp, 1)
+	if ok, err := conn.sendOrBusy(bdbGetReq{args[0], respChan}); !ok {
+		return err
+	}
+	resp := <-respChan
+	if resp.err != nil {
+		return conn.writeError(resp.err)
+	}
+	start, end, isbit, err := parseBitRange(args[2:], int64(len(resp.value)))
+	if err != nil {
+		return conn.writeError(err)
+	}
+	// key不存在或者值为空时，查找0返回0，查找1返回-1
+	if len(resp.value) == 0 {
+		if bit == 1 {
+			return conn.writeInt(-1)
+		}
+		return conn.writeInt(0)
+	}
+	return conn.writeInt(bitpos(resp.value, bit, start, end, isbit, len(args) > 3))
+}
+
+func cmdBitOp(conn *Conn, args [][]byte) (err error) {
+	log.Debug("cmdBitOp|%s|%s", args[0], args[1])
+	op := strings.ToLower(string(args[0]))
+	switch op {
+	case "and", "or", "xor":
+	case "not":
+		if len(args) != 3 {
+			return conn.writeError(ErrBitOpNotCount)
+		}
+	default:
+		return conn.writeError(ErrSyntax)
+	}
+	respChan := make(chan bdbIntResp, 1)
+	if ok, err := conn.sendOrBusy(bdbBitOpReq{op, args[1], args[2:], respChan}); !ok {
+		return err
+	}
+	resp := <-respChan
+	if resp.err != nil {
+		return conn.writeError(resp.err)
+	}
+	return conn.writeInt(resp.result)
+}
+
+func cmdBitField(conn *Conn, args [][]byte) error {
+	log.Debug("cmdBitField|%s", args[0])
+	return bitfield(conn, args, false)
+}
+
+func cmdBitFieldRo(conn *Conn, args [][]byte) error {
+	log.Debug("cmdBitFieldRo|%s", args[0])
+	return bitfield(conn, args, true)
+}
+
+func bitfield(conn *Conn, args [][]byte, readonly bool) (err error) {
+	ops := make([]bitfieldOp, 0, 4)
+	overflow := overflowWrap
+	for i := 1; i < len(args); {
+		sub := strings.ToLower(string(args[i]))
+		switch sub {
+		case "get":
+			if i+2 >= len(args) {
+				return conn.writeError(ErrSyntax)
+			}
+		case "set", "incrby":
+			if i+3 >= len(args) {
+				return conn.writeError(ErrSyntax)
+			}
+			if readonly {
+				return conn.writeError(ErrBitfieldRo)
+			}
+		case "overflow":
+			if i+1 >= len(args) {
+				return conn.writeError(ErrSyntax)
+			}
+			switch strings.ToLower(string(args[i+1])) {
+			case "wrap":
+				overflow = overflowWrap
+			case "sat":
+				overflow = overflowSat
+			case "fail":
+				overflow = overflowFail
+			default:
+				return conn.writeError(ErrOverflowType)
+			}
+			i += 2
+			continue
+		default:
+			return conn.writeError(ErrSyntax)
+		}
+
+		op := bitfieldOp{overflow: overflow}
+		if op.signed, op.bits, err = parseBitfieldType(args[i+1]); err != nil {
+			return conn.writeError(err)
+		}
+		if op.offset, err = parseBitfieldOffset(args[i+2], op.bits); err != nil {
+			return conn.writeError(err)
+		}
+		switch sub {
+		case "get":
+			op.op = bitfieldGet
+			i += 3
+		case "set", "incrby":
+			op.op = bitfieldSet
+			if sub == "incrby" {
+				op.op = bitfieldIncrBy
+			}
+			if op.value, err = strconv.ParseInt(string(args[i+3]), 10, 64); err != nil {
+				return conn.writeError(ErrNotInteger)
+			}
+			i += 4
+		}
+		ops = append(ops, op)
+	}
+	if len(ops) == 0 {
+		_, err = conn.wb.WriteString("*0\r\n")
+		return
+	}
+
+	respChan := make(chan bdbBitFieldResp, 1)
+	if ok, err := conn.sendOrBusy(bdbBitFieldReq{args[0], ops, respChan}); !ok {
+		return err
+	}
+	resp := <-respChan
+	if resp.err != nil {
+		return conn.writeError(resp.err)
+	}
+	conn.writeLen('*', len(resp.results))
+	for _, r := range resp.results {
+		if r.isnil {
+			err = conn.writeBulk(nil)
+		} else {
+			err = conn.writeInt(r.value)
+		}
+	}
+	return
+}
@@ -0,0 +1,47 @@
+package server
+
+import (
+	"testing"
+)
+
+func (w *Worker) testBitField(key string, ops ...bitfieldOp) ([]bitfieldResult, error) {
+	resp := make(chan bdbBitFieldResp, 1)
+	w.dispatch(bdbBitFieldReq{[]byte(key), ops, resp})
+	r := <-resp
+	return r.results, r.err
+}
+
+// 超出值长度的GET返回0，和前面已有的字节一起读取时结果不变，值的长度不变
+func TestBitfieldGetBeyondValue(t *testing.T) {
+	w := testWorker(t, 1010)
+	if err := w.testSet("t026:bf", "\xff"); err != nil {
+		t.Fatal(err)
+	}
+	results, err := w.testBitField("t026:bf",
+		bitfieldOp{op: bitfieldGet, bits: 8, offset: 0},
+		bitfieldOp{op: bitfieldGet, bits: 8, offset: maxBitOffset - 7},
+		bitfieldOp{op: bitfieldGet, signed: true, bits: 16, offset: 4})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []int64{0xff, 0, -0x1000}
+	for i, r := range results {
+		if r.isnil || r.value != want[i] {
+			t.Fatalf("result %d = %+v, want %d", i, r, want[i])
+		}
+	}
+	if v, err := w.testGet("t026:bf"); err != nil || string(v) != "\xff" {
+		t.Fatalf("value = %q, %v", v, err)
+	}
+
+	// 修改操作只写到涉及的字节
+	results, err = w.testBitField("t026:bf",
+		bitfieldOp{op: bitfieldSet, bits: 8, offset: 16, value: 1},
+		bitfieldOp{op: bitfieldGet, bits: 8, offset: 16})
+	if err != nil || results[0].value != 0 || results[1].value != 1 {
+		t.Fatalf("results = %+v, %v", results, err)
+	}
+	if v, err := w.testGet("t026:bf"); err != nil || string(v) != "\xff\x00\x01" {
+		t.Fatalf("value = %q, %v", v, err)
+	}
+}
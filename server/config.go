@@ -0,0 +1,358 @@
+package server
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/nybuxtsui/bdbd/bdb"
+	"github.com/nybuxtsui/log"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// ConfigFile 启动时读取的配置文件，CONFIG REWRITE写回这个文件
+var ConfigFile string
+
+var (
+	ErrNoConfigFile = errors.New("The server is running without a config file")
+	ErrConfigArgs   = errors.New("wrong number of arguments for CONFIG SET")
+)
+
+// math32 参数允许的最大值，超过的话转成C的int会溢出
+const math32 = 1<<31 - 1
+
+// configParam 一个可以通过CONFIG GET/SET访问的参数
+type configParam struct {
+	section string // 在配置文件中所在的节，[[logger]]这样的数组节会修改每一个
+	key     string // 配置文件中的名字，为空时不写回配置文件
+	quote   bool   // 写回配置文件时是否是字符串
+	get     func() string
+	set     ConfigSetter // 为nil表示只读
+}
+
+// ConfigSetter 检查CONFIG SET的值，合法时返回修改参数的函数。
+// CONFIG SET先检查所有的参数，都合法之后才开始修改
+type ConfigSetter func(value string) (apply func() error, err error)
+
+var configs = struct {
+	sync.Mutex
+	params  map[string]*configParam
+	changed map[string]bool // CONFIG SET修改过的参数，REWRITE时配置文件中没有的也要加上
+}{params: make(map[string]*configParam), changed: make(map[string]bool)}
+
+// RegisterConfig 注册一个参数，name为CONFIG GET/SET使用的名字，set为nil时只读
+func RegisterConfig(name string, section string, key string, quote bool, get func() string, set ConfigSetter) {
+	configs.Lock()
+	configs.params[name] = &configParam{section, key, quote, get, set}
+	configs.Unlock()
+}
+
+func parseConfigInt(value string, min int64, max int64) (int64, error) {
+	n, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || n < min || n > max {
+		return 0, fmt.Errorf("argument must be an integer between %d and %d", min, max)
+	}
+	return n, nil
+}
+
+func initConfig(dbenv *bdb.DbEnv) {
+	RegisterConfig("slowlog-log-slower-than", "server", "slowlog_log_slower_than", false,
+		func() string { return strconv.FormatInt(atomic.LoadInt64(&SlowlogSlowerThan), 10) },
+		intSetter(&SlowlogSlowerThan, -1, 1<<62))
+	RegisterConfig("slowlog-max-len", "server", "slowlog_max_len", false,
+		func() string {
+			slowlog.Lock()
+			defer slowlog.Unlock()
+			return strconv.Itoa(SlowlogMaxLen)
+		},
+		func(value string) (func() error, error) {
+			n, err := parseConfigInt(value, 0, math32)
+			if err != nil {
+				return nil, err
+			}
+			return func() error { return SetSlowlogMaxLen(n) }, nil
+		})
+	RegisterConfig("latency-monitor-threshold", "server", "latency_monitor_threshold", false,
+		func() string { return strconv.FormatInt(atomic.LoadInt64(&LatencyThreshold), 10) },
+		intSetter(&LatencyThreshold, 0, 1<<62))
+	RegisterConfig("databases", "server", "databases", false,
+		func() string { return strconv.Itoa(Databases) }, nil)
+	RegisterConfig("dir", "bdb", "homedir", true,
+		func() string { return dbenv.Home() }, nil)
+	initLimitsConfig()
+
+	RegisterConfig("flush", "bdb", "flush", false,
+		func() string {
+			flush, err := dbenv.GetFlush()
+			if err != nil {
+				return ""
+			}
+			return strconv.Itoa(flush)
+		},
+		func(value string) (func() error, error) {
+			n, err := parseConfigInt(value, 0, 2)
+			if err != nil {
+				return nil, err
+			}
+			return func() error { return dbenv.SetFlush(int(n)) }, nil
+		})
+	timeout := func(which int) (func() string, ConfigSetter) {
+		return func() string {
+				usec, err := dbenv.GetTimeout(which)
+				if err != nil {
+					return ""
+				}
+				return strconv.FormatUint(uint64(usec/1000), 10)
+			}, func(value string) (func() error, error) {
+				n, err := parseConfigInt(value, 0, math32/1000)
+				if err != nil {
+					return nil, err
+				}
+				return func() error { return dbenv.SetTimeout(which, uint32(n)*1000) }, nil
+			}
+	}
+	get, set := timeout(bdb.DB_SET_LOCK_TIMEOUT)
+	RegisterConfig("lock-timeout", "bdb", "locktimeout", false, get, set)
+	get, set = timeout(bdb.DB_SET_TXN_TIMEOUT)
+	RegisterConfig("txn-timeout", "bdb", "txntimeout", false, get, set)
+	RegisterConfig("checkpoint-interval", "bdb", "checkpointinterval", false,
+		func() string { return strconv.Itoa(bdb.CheckpointInterval()) },
+		func(value string) (func() error, error) {
+			n, err := parseConfigInt(value, 1, 86400)
+			if err != nil {
+				return nil, err
+			}
+			return func() error {
+				bdb.SetCheckpointInterval(int(n))
+				return nil
+			}, nil
+		})
+	RegisterConfig("expire-batch-size", "bdb", "expirebatch", false,
+		func() string { return strconv.Itoa(bdb.ExpireBatch()) },
+		func(value string) (func() error, error) {
+			n, err := parseConfigInt(value, 1, 1000000)
+			if err != nil {
+				return nil, err
+			}
+			return func() error {
+				bdb.SetExpireBatch(int(n))
+				return nil
+			}, nil
+		})
+}
+
+// cmdConfig CONFIG GET pattern [pattern ...] | SET name value [name value ...] | REWRITE
+func cmdConfig(conn *Conn, args [][]byte) (err error) {
+	log.Debug("cmdConfig|%s", args[0])
+	sub := strings.ToLower(string(args[0]))
+	switch {
+	case sub == "get" && len(args) > 1:
+		return configGet(conn, args[1:])
+	case sub == "set" && len(args) > 1:
+		return configSet(conn, args[1:])
+	case sub == "rewrite" && len(args) == 1:
+		if err = configRewrite(); err != nil {
+			log.Error("cmdConfig|rewrite|%s", err.Error())
+			return conn.writeError(fmt.Errorf("Rewriting config file: %s", err.Error()))
+		}
+		_, err = conn.wb.WriteString("+OK\r\n")
+		return
+	}
+	return conn.writeError(fmt.Errorf("unknown subcommand or wrong number of arguments for '%s'", sub))
+}
+
+func configGet(conn *Conn, patterns [][]byte) error {
+	configs.Lock()
+	names := make([]string, 0, len(configs.params))
+	for name := range configs.params {
+		for _, pattern := range patterns {
+			if ok, _ := path.Match(strings.ToLower(string(pattern)), name); ok {
+				names = append(names, name)
+				break
+			}
+		}
+	}
+	params := make([]*configParam, len(names))
+	sort.Strings(names)
+	for i, name := range names {
+		params[i] = configs.params[name]
+	}
+	configs.Unlock()
+
+	err := conn.writeMap(len(names))
+	for i, name := range names {
+		conn.writeBulk([]byte(name))
+		err = conn.writeBulk([]byte(params[i].get()))
+	}
+	return err
+}
+
+// configSet 和redis一样，先检查所有的参数名和值，有一个不合法时都不修改
+func configSet(conn *Conn, args [][]byte) error {
+	if len(args)%2 != 0 {
+		return conn.writeError(ErrConfigArgs)
+	}
+	configs.Lock()
+	applies := make([]func() error, 0, len(args)/2)
+	seen := make(map[string]bool, len(args)/2)
+	for i := 0; i < len(args); i += 2 {
+		name := strings.ToLower(string(args[i]))
+		param := configs.params[name]
+		if param == nil {
+			configs.Unlock()
+			return conn.writeError(fmt.Errorf("Unknown option or number of arguments for CONFIG SET - '%s'", name))
+		}
+		if seen[name] {
+			configs.Unlock()
+			return conn.writeError(fmt.Errorf("CONFIG SET failed (possibly related to argument '%s') - duplicate parameter", name))
+		}
+		seen[name] = true
+		if param.set == nil {
+			configs.Unlock()
+			return conn.writeError(fmt.Errorf("CONFIG SET failed (possibly related to argument '%s') - can't set immutable config", name))
+		}
+		apply, err := param.set(string(args[i+1]))
+		if err != nil {
+			configs.Unlock()
+			return conn.writeError(fmt.Errorf("CONFIG SET failed (possibly related to argument '%s') - %s", name, err.Error()))
+		}
+		applies = append(applies, apply)
+	}
+	// 检查通过后修改只会因为bdb或者读取文件出错而失败
+	for i, apply := range applies {
+		name := strings.ToLower(string(args[i*2]))
+		if err := apply(); err != nil {
+			configs.Unlock()
+			return conn.writeError(fmt.Errorf("CONFIG SET failed (possibly related to argument '%s') - %s", name, err.Error()))
+		}
+		configs.changed[name] = true
+		log.Info("config|set|%s|%s", name, args[i*2+1])
+	}
+	configs.Unlock()
+	_, err := conn.wb.WriteString("+OK\r\n")
+	return err
+}
+
+// configLine 配置文件中的一行，section为所在的节
+type configLine struct {
+	text    string
+	section string
+}
+
+// parseConfigLine 返回key = value中的key，comment表示是被注释掉的
+func parseConfigLine(text string) (key string, comment bool) {
+	text = strings.TrimSpace(text)
+	if strings.HasPrefix(text, "#") {
+		comment = true
+		text = strings.TrimSpace(text[1:])
+	}
+	i := strings.IndexByte(text, '=')
+	if i <= 0 {
+		return "", false
+	}
+	key = strings.TrimSpace(text[:i])
+	if strings.ContainsAny(key, " \t[\"") {
+		return "", false
+	}
+	return strings.ToLower(key), comment
+}
+
+func formatConfigValue(param *configParam, value string) string {
+	if param.quote {
+		return strconv.Quote(value)
+	}
+	return value
+}
+
+// configRewrite 只修改配置文件中对应的行，注释和其他内容保持不变。
+// 配置文件中已经有的参数改为当前值，没有的参数只有CONFIG SET修改过才加上，
+// 如果有被注释掉的同名参数就加在它后面，否则加在节的最后
+func configRewrite() error {
+	if ConfigFile == "" {
+		return ErrNoConfigFile
+	}
+	content, err := ioutil.ReadFile(ConfigFile)
+	if err != nil {
+		return err
+	}
+	var lines []configLine
+	section := ""
+	for _, text := range strings.Split(strings.TrimRight(string(content), "\n"), "\n") {
+		trimmed := strings.TrimSpace(text)
+		if strings.HasPrefix(trimmed, "[") {
+			section = strings.Trim(trimmed, "[] \t")
+		}
+		lines = append(lines, configLine{text, section})
+	}
+
+	configs.Lock()
+	names := make([]string, 0, len(configs.params))
+	for name := range configs.params {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		param := configs.params[name]
+		if param.key == "" || param.set == nil {
+			continue
+		}
+		value := param.key + " = " + formatConfigValue(param, param.get())
+		found := false
+		for i := range lines {
+			if key, comment := parseConfigLine(lines[i].text); lines[i].section == param.section && key == param.key && !comment {
+				lines[i].text = value
+				found = true
+			}
+		}
+		if found || !configs.changed[name] {
+			continue
+		}
+		lines = insertConfigLine(lines, param, configLine{value, param.section})
+	}
+	configs.Unlock()
+
+	var buf bytes.Buffer
+	for _, line := range lines {
+		buf.WriteString(line.text)
+		buf.WriteByte('\n')
+	}
+	info, err := os.Stat(ConfigFile)
+	if err != nil {
+		return err
+	}
+	tmp := ConfigFile + ".tmp"
+	if err = ioutil.WriteFile(tmp, buf.Bytes(), info.Mode()); err != nil {
+		return err
+	}
+	return os.Rename(tmp, ConfigFile)
+}
+
+func insertConfigLine(lines []configLine, param *configParam, line configLine) []configLine {
+	pos := -1
+	for i := range lines {
+		if lines[i].section != param.section {
+			continue
+		}
+		if key, comment := parseConfigLine(lines[i].text); key == param.key && comment {
+			pos = i + 1
+			break
+		}
+		if strings.TrimSpace(lines[i].text) != "" {
+			pos = i + 1
+		}
+	}
+	if pos < 0 {
+		lines = append(lines, configLine{"", ""}, configLine{"[" + param.section + "]", param.section})
+		pos = len(lines)
+	}
+	lines = append(lines, configLine{})
+	copy(lines[pos+1:], lines[pos:])
+	lines[pos] = line
+	return lines
+}
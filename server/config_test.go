@@ -0,0 +1,53 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func testConfigSet(t *testing.T, args ...string) string {
+	conn := testConn(t)
+	var out bytes.Buffer
+	conn.wb = bufio.NewWriter(&out)
+	req := make([][]byte, len(args))
+	for i, arg := range args {
+		req[i] = []byte(arg)
+	}
+	if err := configSet(conn, req); err != nil {
+		t.Fatal(err)
+	}
+	conn.wb.Flush()
+	return out.String()
+}
+
+// 一次修改多个参数时有一个不合法，所有参数都不修改
+func TestConfigSetAllOrNothing(t *testing.T) {
+	oldMax, oldTimeout := atomic.LoadInt64(&MaxClients), atomic.LoadInt64(&IdleTimeout)
+	defer func() {
+		atomic.StoreInt64(&MaxClients, oldMax)
+		atomic.StoreInt64(&IdleTimeout, oldTimeout)
+	}()
+
+	for _, args := range [][]string{
+		{"maxclients", "1234", "timeout", "x"},
+		{"maxclients", "1234", "databases", "4"},
+		{"maxclients", "1234", "maxclients", "5678"},
+	} {
+		if reply := testConfigSet(t, args...); !strings.HasPrefix(reply, "-ERR ") {
+			t.Fatalf("CONFIG SET %v = %q", args, reply)
+		}
+		if n := atomic.LoadInt64(&MaxClients); n != oldMax {
+			t.Fatalf("CONFIG SET %v changed maxclients to %d", args, n)
+		}
+	}
+
+	if reply := testConfigSet(t, "maxclients", "1234", "timeout", "77"); reply != "+OK\r\n" {
+		t.Fatalf("reply = %q", reply)
+	}
+	if n, timeout := atomic.LoadInt64(&MaxClients), atomic.LoadInt64(&IdleTimeout); n != 1234 || timeout != 77 {
+		t.Fatalf("maxclients = %d, timeout = %d", n, timeout)
+	}
+}
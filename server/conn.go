@@ -2,14 +2,20 @@ package server
 
 import (
 	"bufio"
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"github.com/nybuxtsui/bdbd/bdb"
 	"github.com/nybuxtsui/log"
 	"io"
+	"math"
 	"net"
 	"runtime"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 type Conn struct {
@@ -20,20 +26,73 @@ type Conn struct {
 
 	dbenv *bdb.DbEnv
 	dbmap map[string]*bdb.Db
+
+	id    int64
+	addr  string
+	ctime time.Time
+	proto int  // 2为RESP2，3为RESP3，由HELLO切换
+	quit  bool // 回复后关闭连接
+
+	monitor    bool  // 进入MONITOR模式后不检查空闲超时和回复长度
+	replyBytes int64 // 当前命令已经回复的字节数
+	lane       int   // 当前命令的请求放到哪个worker的队列中，-1为共享队列
+	lanes      []int // 当前命令的key所在的队列，多于一个时由coordinator协调
+
+	pending   []*pipelined  // 并发执行还没有回复的命令，按请求的顺序
+	pipeBytes int64         // pending的回复在内存中的字节数，见bufferWriter
+	sent      chan struct{} // 并发执行的命令的请求放进队列后关闭
+
+	// CLIENT LIST会在其他连接的goroutine中读取下面的字段，只在本连接中修改，修改时需要加锁
+	mu    sync.Mutex
+	name  string
+	user  string // 登录的用户，为空表示还没有认证
+	db    int
+	cmd   string
+	atime time.Time
+
+	worker int32 // 正在处理本连接请求的worker，-1表示没有
+
+	// 当前命令在workChan中等待的时间和worker开始处理的时间，由worker设置
+	waitNs    int64
+	execStart int64
+
+	// 当前命令参数的副本，用于slowlog
+	argbuf  []byte
+	argends []int
+	arglens []int
+	argc    int
 }
 
 var (
-	ErrRequest = errors.New("invalid request")
+	ErrRequest    = errors.New("invalid request")
+	ErrQuotes     = errors.New("unbalanced quotes in request")
+	ErrQuit       = errors.New("client quit")
+	ErrSyntax     = errors.New("syntax error")
+	ErrNotInteger = errors.New("value is not an integer or out of range")
 )
 
 func NewConn(c net.Conn, dbenv *bdb.DbEnv) *Conn {
-	return &Conn{
-		conn:  c,
-		rb:    bufio.NewReaderSize(c, 1024*1024),
-		wb:    bufio.NewWriterSize(c, 16*1024),
-		dbenv: dbenv,
-		dbmap: make(map[string]*bdb.Db),
+	addr := c.RemoteAddr().String()
+	if c.LocalAddr().Network() == "unix" {
+		// unix socket的客户端没有地址，和redis一样显示为path:0
+		addr = c.LocalAddr().String() + ":0"
+	}
+	conn := &Conn{
+		conn:   c,
+		dbenv:  dbenv,
+		dbmap:  make(map[string]*bdb.Db),
+		id:     nextConnId(),
+		addr:   addr,
+		ctime:  time.Now(),
+		atime:  time.Now(),
+		proto:  2,
+		user:   loginUser(),
+		worker: -1,
+		lane:   -1,
 	}
+	// 读缓存在Start中检查了MaxClients之后再分配
+	conn.wb = bufio.NewWriterSize(&connWriter{c: conn}, 16*1024)
+	return conn
 }
 
 func (c *Conn) readLine() ([]byte, error) {
@@ -96,36 +155,125 @@ func (c *Conn) readCount(tag byte) (int64, error) {
 	return count, nil
 }
 
+// processRequest 读取并执行一个命令。读缓存中还有请求时先不回复，
+// 一批请求处理完之后一起flush，只有一个key的命令可以并发执行，见pipeline.go
 func (c *Conn) processRequest() error {
 	req, err := c.readRequest()
 	if err != nil {
 		log.Error("processRequest|readRequest|%s", err.Error())
+		if re, ok := err.(replyError); ok {
+			c.writeError(re.error)
+			c.flush()
+		}
 		return err
 	}
-	cmd := strings.ToLower(string(req[0]))
-	if def, ok := cmdMap[cmd]; ok {
-		args := req[1:]
-		if len(args) < def.minArgs || len(args) > def.maxArgs {
-			c.wb.WriteString(fmt.Sprintf("-ERR wrong number of arguments for '%s' command\r\n", cmd))
-		} else {
-			err = def.fun(c, args)
-			if err != nil {
-				log.Error("processRequest|func|%s", err.Error())
-				return err
-			}
+	if len(req) != 0 { // 空的inline命令直接忽略
+		if err = c.execRequest(req); err != nil {
+			log.Error("processRequest|func|%s", err.Error())
+			return err
 		}
-	} else {
-		c.wb.WriteString(fmt.Sprintf("-ERR unknown command '%s'\r\n", cmd))
 	}
-	if err = c.wb.Flush(); err != nil {
+	if !c.quit && c.rb.Buffered() > 0 {
+		return nil
+	}
+	if err = c.flush(); err != nil {
 		log.Error("processRequest|Flush|%s", err.Error())
 		return err
+	} else if c.quit {
+		return ErrQuit
 	} else {
 		return nil
 	}
 }
 
+func (c *Conn) execRequest(req [][]byte) error {
+	cmd := strings.ToLower(string(req[0]))
+	args := req[1:]
+	c.mu.Lock()
+	c.cmd = cmd
+	c.atime = time.Now()
+	c.mu.Unlock()
+
+	var code string
+	var failErr error
+	def, ok := cmdMap[cmd]
+	switch {
+	case !ok:
+		failErr = fmt.Errorf("unknown command '%s'", cmd)
+	case len(args) < def.minArgs || len(args) > def.maxArgs:
+		failErr = fmt.Errorf("wrong number of arguments for '%s' command", cmd)
+	default:
+		code, failErr = c.checkPerm(cmd, args)
+	}
+	if failErr == nil && !beginCommand() {
+		code, failErr = "SHUTDOWN", ErrShutdown
+	}
+	if failErr != nil {
+		if err := c.waitPending(); err != nil {
+			return err
+		}
+		if code == "" {
+			code = "ERR"
+		}
+		return c.writeErrorCode(code, failErr)
+	}
+
+	logReq := req
+	if redactCmds[cmd] {
+		logReq = redactArgs(cmd, req)
+	}
+	if atomic.LoadInt32(&monitorCount) > 0 && !monitorExcluded[cmd] {
+		feedMonitors(c, logReq)
+	}
+	c.setRoute(cmd, args)
+	if c.lane >= 0 && c.rb.Buffered() > 0 {
+		return c.dispatch(def, cmd, args, logReq)
+	}
+	if err := c.waitPending(); err != nil {
+		endCommand()
+		return err
+	}
+	return c.runCommand(def, cmd, args, logReq)
+}
+
+// runCommand 执行命令并记录统计信息和slowlog，beginCommand之后调用。
+// logReq和args共用同一个数组，slowlog保存参数之后才改成实际保存的key
+func (c *Conn) runCommand(def cmdDef, cmd string, args [][]byte, logReq [][]byte) error {
+	if atomic.LoadInt64(&SlowlogSlowerThan) >= 0 {
+		c.saveArgs(logReq)
+	}
+	if c.db != 0 {
+		selectKeys(cmd, args, c.db)
+	}
+	c.replyBytes = 0
+	atomic.StoreInt64(&c.waitNs, 0)
+	atomic.StoreInt64(&c.execStart, 0)
+	start := time.Now()
+	err := def.fun(c, args)
+	endCommand()
+	end := time.Now()
+	recordCommand(cmd, end.Sub(start))
+	if cmd != "monitor" { // MONITOR会一直执行到客户端退出
+		c.recordSlow(start, end)
+	}
+	return err
+}
+
+// replyError 读取请求时发现的协议错误，需要回复给客户端后关闭连接。
+// readRequest自己不写回复，MONITOR时读取请求和写回复在不同的goroutine中
+type replyError struct {
+	error
+}
+
 func (c *Conn) readRequest() ([][]byte, error) {
+	tag, err := c.rb.Peek(1)
+	if err != nil {
+		log.Error("readRequest|Peek|%s", err.Error())
+		return nil, err
+	}
+	if tag[0] != '*' {
+		return c.readInline()
+	}
 	count, err := c.readCount('*')
 	if err != nil {
 		log.Error("readRequest|readCount|%s", err.Error())
@@ -135,7 +283,11 @@ func (c *Conn) readRequest() ([][]byte, error) {
 		log.Error("readRequest|invalid_count|%v", count)
 		return nil, ErrRequest
 	}
-	var r = make([][]byte, count)
+	if count > maxMultibulkLen {
+		return nil, c.queryLimit(ErrMultibulkLen)
+	}
+	// 参数个数由客户端决定，不按count一次分配
+	var r = make([][]byte, 0, minInt64(count, 1024))
 	var i int64
 	for i = 0; i < count; i++ {
 		length, err := c.readCount('$')
@@ -143,21 +295,220 @@ func (c *Conn) readRequest() ([][]byte, error) {
 			log.Error("readRequest|readCount|%s", err.Error())
 			return nil, err
 		}
-		buff := make([]byte, length+2)
-		_, err = io.ReadFull(c.rb, buff)
+		if length < 0 || length > atomic.LoadInt64(&ProtoMaxBulkLen) {
+			return nil, c.queryLimit(ErrBulkLen)
+		}
+		buff, err := c.readBulk(length + 2)
 		if err != nil {
-			log.Error("readRequest|ReadFull|%s", err.Error())
+			log.Error("readRequest|readBulk|%s", err.Error())
 			return nil, err
 		}
 		if buff[length+1] != '\n' || buff[length] != '\r' {
 			log.Error("readRequest|invalid_crlf|%v", buff)
 			return nil, ErrRequest
 		}
-		r[i] = buff[0:length]
+		r = append(r, buff[0:length])
 	}
 	return r, nil
 }
 
+func minInt64(a int64, b int64) int64 {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// readBulk 读取n个字节，超过bulkChunk时分段读取，避免客户端声明很大的长度后不发送数据占用内存
+func (c *Conn) readBulk(n int64) ([]byte, error) {
+	buff := make([]byte, 0, minInt64(n, bulkChunk))
+	for int64(len(buff)) < n {
+		size := minInt64(n-int64(len(buff)), bulkChunk)
+		if int64(cap(buff)-len(buff)) < size {
+			grow := make([]byte, len(buff), minInt64(int64(cap(buff))*2+size, n))
+			copy(grow, buff)
+			buff = grow
+		}
+		start := len(buff)
+		buff = buff[:start+int(size)]
+		if _, err := io.ReadFull(c.rb, buff[start:]); err != nil {
+			return nil, err
+		}
+	}
+	return buff, nil
+}
+
+// readInline 读取telnet方式发送的一行命令，参数以空白分隔，支持引号
+func (c *Conn) readInline() ([][]byte, error) {
+	line, err := c.rb.ReadSlice('\n')
+	if err == bufio.ErrBufferFull {
+		return nil, c.queryLimit(ErrInlineTooBig)
+	} else if err != nil {
+		log.Error("readInline|ReadSlice|%s", err.Error())
+		return nil, err
+	}
+	line = line[:len(line)-1]
+	if len(line) > 0 && line[len(line)-1] == '\r' {
+		line = line[:len(line)-1]
+	}
+	args, err := splitArgs(line)
+	if err != nil {
+		log.Error("readInline|splitArgs|%s", err.Error())
+		return nil, replyError{err}
+	}
+	return args, nil
+}
+
+func isSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\r' || c == '\n' || c == '\v' || c == '\f'
+}
+
+func hexValue(c byte) (byte, bool) {
+	switch {
+	case c >= '0' && c <= '9':
+		return c - '0', true
+	case c >= 'a' && c <= 'f':
+		return c - 'a' + 10, true
+	case c >= 'A' && c <= 'F':
+		return c - 'A' + 10, true
+	}
+	return 0, false
+}
+
+// splitArgs 和redis的sdssplitargs规则一致：
+// 双引号内支持\xHH和\n\r\t\b\a转义，单引号内只支持\'，引号结束后必须是空白
+func splitArgs(line []byte) ([][]byte, error) {
+	var args [][]byte
+	i := 0
+	for {
+		for i < len(line) && isSpace(line[i]) {
+			i++
+		}
+		if i == len(line) {
+			return args, nil
+		}
+		arg := make([]byte, 0, 16)
+		var quote byte
+		for done := false; !done; {
+			if quote == 0 {
+				if i == len(line) {
+					break
+				}
+				switch c := line[i]; {
+				case isSpace(c):
+					done = true
+				case c == '"' || c == '\'':
+					quote = c
+				default:
+					arg = append(arg, c)
+				}
+				i++
+				continue
+			}
+			if i == len(line) {
+				return nil, ErrQuotes
+			}
+			c := line[i]
+			switch {
+			case quote == '"' && c == '\\' && i+3 < len(line) && line[i+1] == 'x':
+				hi, ok1 := hexValue(line[i+2])
+				lo, ok2 := hexValue(line[i+3])
+				if ok1 && ok2 {
+					arg = append(arg, hi<<4|lo)
+					i += 3
+				} else {
+					arg = append(arg, c)
+				}
+			case quote == '"' && c == '\\' && i+1 < len(line):
+				i++
+				switch line[i] {
+				case 'n':
+					arg = append(arg, '\n')
+				case 'r':
+					arg = append(arg, '\r')
+				case 't':
+					arg = append(arg, '\t')
+				case 'b':
+					arg = append(arg, '\b')
+				case 'a':
+					arg = append(arg, '\a')
+				default:
+					arg = append(arg, line[i])
+				}
+			case quote == '\'' && c == '\\' && i+1 < len(line) && line[i+1] == '\'':
+				i++
+				arg = append(arg, '\'')
+			case c == quote:
+				// 引号结束后必须是空白或者行尾
+				if i+1 < len(line) && !isSpace(line[i+1]) {
+					return nil, ErrQuotes
+				}
+				quote = 0
+				done = true
+			default:
+				arg = append(arg, c)
+			}
+			i++
+		}
+		args = append(args, arg)
+	}
+}
+
+// send 把请求交给worker，队列满时最多等待WorkQueueTimeout，超时返回ErrBusy
+func (c *Conn) send(req interface{}) error {
+	if len(c.lanes) > 1 {
+		return c.sendCoordinated(req)
+	}
+	ch, counter := workChan, &routedShared
+	if c.lane >= 0 {
+		ch, counter = pool.lanes[c.lane], &routedKey
+	}
+	if enqueue(ch, workItem{c, req, time.Now()}) {
+		atomic.AddInt64(counter, 1)
+		c.markSent()
+		return nil
+	}
+	atomic.AddInt64(&queueFull, 1)
+	log.Error("send|busy|%s|%d|%d", c.addr, c.lane, len(ch))
+	return ErrBusy
+}
+
+// enqueue 把请求放入队列，队列满时最多等待WorkQueueTimeout，超时返回false
+func enqueue(ch chan workItem, item workItem) bool {
+	select {
+	case ch <- item:
+		return true
+	default:
+	}
+	if timeout := atomic.LoadInt64(&WorkQueueTimeout); timeout > 0 {
+		timer := time.NewTimer(time.Duration(timeout) * time.Millisecond)
+		defer timer.Stop()
+		select {
+		case ch <- item:
+			return true
+		case <-timer.C:
+		}
+	}
+	return false
+}
+
+// sendOrBusy 把请求交给worker，队列满时回复BUSY错误并返回false，调用者直接返回err
+func (c *Conn) sendOrBusy(req interface{}) (bool, error) {
+	if err := c.send(req); err != nil {
+		return false, c.writeErrorCode("BUSY", err)
+	}
+	return true, nil
+}
+
+func (c *Conn) setWorker(id int32) {
+	atomic.StoreInt32(&c.worker, id)
+}
+
+// clearWorker 连接可能已经把下一个请求交给了其他worker，只清除自己设置的值
+func (c *Conn) clearWorker(id int32) {
+	atomic.CompareAndSwapInt32(&c.worker, id, -1)
+}
+
 func (conn *Conn) writeLen(prefix byte, n int) error {
 	var buff [64]byte
 	buff[len(buff)-1] = '\n'
@@ -176,6 +527,87 @@ func (conn *Conn) writeLen(prefix byte, n int) error {
 	return err
 }
 
+func (c *Conn) writeInt(n int64) error {
+	var buf [64]byte
+	c.wb.WriteByte(':')
+	c.wb.Write(strconv.AppendInt(buf[:0], n, 10))
+	_, err := c.wb.WriteString("\r\n")
+	return err
+}
+
+func (c *Conn) writeBulk(value []byte) error {
+	if value == nil {
+		return c.writeNull()
+	}
+	c.writeLen('$', len(value))
+	c.wb.Write(value)
+	_, err := c.wb.WriteString("\r\n")
+	return err
+}
+
+// writeNull RESP2下是空的bulk string
+func (c *Conn) writeNull() (err error) {
+	if c.proto == 3 {
+		_, err = c.wb.WriteString("_\r\n")
+	} else {
+		_, err = c.wb.WriteString("$-1\r\n")
+	}
+	return
+}
+
+// writeNullArray RESP2下是空的multibulk
+func (c *Conn) writeNullArray() (err error) {
+	if c.proto == 3 {
+		_, err = c.wb.WriteString("_\r\n")
+	} else {
+		_, err = c.wb.WriteString("*-1\r\n")
+	}
+	return
+}
+
+// writeMap 写入n个键值对的map头，RESP2下是2n个元素的数组
+func (c *Conn) writeMap(n int) error {
+	if c.proto == 3 {
+		return c.writeLen('%', n)
+	}
+	return c.writeLen('*', n*2)
+}
+
+// writeDouble RESP2下是bulk string
+func (c *Conn) writeDouble(value float64) error {
+	var buf [64]byte
+	if c.proto != 3 {
+		return c.writeBulk(strconv.AppendFloat(buf[:0], value, 'f', -1, 64))
+	}
+	c.wb.WriteByte(',')
+	switch {
+	case math.IsInf(value, 1):
+		c.wb.WriteString("inf")
+	case math.IsInf(value, -1):
+		c.wb.WriteString("-inf")
+	case math.IsNaN(value):
+		c.wb.WriteString("nan")
+	default:
+		c.wb.Write(strconv.AppendFloat(buf[:0], value, 'f', -1, 64))
+	}
+	_, err := c.wb.WriteString("\r\n")
+	return err
+}
+
+func (c *Conn) writeError(err error) error {
+	return c.writeErrorCode("ERR", err)
+}
+
+// writeErrorCode 以code代替ERR作为错误的前缀，例如NOAUTH、NOPERM
+func (c *Conn) writeErrorCode(code string, err error) error {
+	c.wb.WriteString("-")
+	c.wb.WriteString(code)
+	c.wb.WriteString(" ")
+	c.wb.WriteString(err.Error())
+	_, err = c.wb.WriteString("\r\n")
+	return err
+}
+
 func (c *Conn) Close() {
 	c.conn.Close()
 }
@@ -194,7 +626,13 @@ func PrintPanic(err interface{}) {
 }
 
 func (c *Conn) Start() {
+	if err := addConn(c); err != nil {
+		c.reject(err)
+		return
+	}
 	defer func() {
+		c.dropPending()
+		delConn(c)
 		c.Close()
 		for _, v := range c.dbmap {
 			v.Close()
@@ -203,9 +641,18 @@ func (c *Conn) Start() {
 			PrintPanic(err)
 		}
 	}()
+	if tc, ok := c.conn.(*tls.Conn); ok {
+		if err := c.tlsHandshake(tc); err != nil {
+			log.Error("Start|tlsHandshake|%s|%s", c.addr, err.Error())
+			return
+		}
+	}
+	c.rb = bufio.NewReaderSize(&connReader{c: c}, readBufferSize)
 	for {
 		err := c.processRequest()
-		if err != nil {
+		if err == ErrQuit {
+			break
+		} else if err != nil {
 			log.Error("Start|processRequest|%s", err.Error())
 			break
 		}
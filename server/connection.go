@@ -0,0 +1,455 @@
+package server
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/nybuxtsui/log"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Version 服务器版本，HELLO命令返回
+const Version = "0.1.0"
+
+// Databases SELECT可以选择的库的个数
+var Databases = 16
+
+var (
+	ErrNoProto    = errors.New("unsupported protocol version")
+	ErrDbIndex    = errors.New("DB index is out of range")
+	ErrClientName = errors.New("Client names cannot contain spaces, newlines or special characters.")
+	ErrNoClient   = errors.New("No such client")
+)
+
+// connId 连接编号，从1开始递增
+var connId int64
+
+func nextConnId() int64 {
+	return atomic.AddInt64(&connId, 1)
+}
+
+// conns 所有活动的连接，CLIENT LIST/KILL使用
+var conns = struct {
+	sync.Mutex
+	m      map[int64]*Conn
+	closed bool           // 退出时关闭所有连接之后不再接受新的连接
+	wait   sync.WaitGroup // 等待所有连接的goroutine结束
+}{m: make(map[int64]*Conn)}
+
+// addConn 连接数已经达到MaxClients或者正在退出时返回错误
+func addConn(c *Conn) error {
+	atomic.AddInt64(&totalConnections, 1)
+	max := atomic.LoadInt64(&MaxClients)
+	conns.Lock()
+	defer conns.Unlock()
+	if conns.closed {
+		return ErrShutdown
+	}
+	if max > 0 && int64(len(conns.m)) >= max {
+		return ErrMaxClients
+	}
+	conns.m[c.id] = c
+	conns.wait.Add(1)
+	return nil
+}
+
+func delConn(c *Conn) {
+	conns.Lock()
+	delete(conns.m, c.id)
+	conns.Unlock()
+	conns.wait.Done()
+}
+
+// cmdKeys 命令中作为key的参数下标范围，last为-1表示到最后一个参数
+var cmdKeys = map[string]struct{ first, last int }{
+	"get":         {0, 0},
+	"set":         {0, 0},
+	"setex":       {0, 0},
+	"setnx":       {0, 0},
+	"incrby":      {0, 0},
+	"incr":        {0, 0},
+	"decrby":      {0, 0},
+	"decr":        {0, 0},
+	"incrbyfloat": {0, 0},
+	"setbit":      {0, 0},
+	"getbit":      {0, 0},
+	"bitcount":    {0, 0},
+	"bitpos":      {0, 0},
+	"bitop":       {1, -1},
+	"bitfield":    {0, 0},
+	"bitfield_ro": {0, 0},
+	"append":      {0, 0},
+	"strlen":      {0, 0},
+	"getrange":    {0, 0},
+	"substr":      {0, 0},
+	"setrange":    {0, 0},
+	"getset":      {0, 0},
+	"getdel":      {0, 0},
+	"getex":       {0, 0},
+	"pfadd":       {0, 0},
+	"pfcount":     {0, -1},
+	"pfmerge":     {0, -1},
+	"geoadd":      {0, 0},
+	"geopos":      {0, 0},
+	"geodist":     {0, 0},
+	"geosearch":   {0, 0},
+
+	"json.set":       {0, 0},
+	"json.get":       {0, 0},
+	"json.del":       {0, 0},
+	"json.forget":    {0, 0},
+	"json.numincrby": {0, 0},
+	"json.arrappend": {0, 0},
+
+	"getv": {0, 0},
+	"cas":  {0, 0},
+}
+
+// selectKeys 把非0的库中的key改成实际保存的key，见dbKey
+func selectKeys(cmd string, args [][]byte, db int) {
+	spec, ok := cmdKeys[cmd]
+	if !ok {
+		return
+	}
+	last := spec.last
+	if last < 0 || last >= len(args) {
+		last = len(args) - 1
+	}
+	for i := spec.first; i <= last; i++ {
+		args[i] = dbKey(args[i], db)
+	}
+}
+
+// dbKey 非0的库中带表名的key保存在__db<n>.<table>表中，
+// 其他key保存在__db<n>表中，原来的key整个作为记录名
+func dbKey(key []byte, db int) []byte {
+	if i := bytes.IndexByte(key, ':'); i > 0 {
+		return append([]byte(dbTable(db)+"."), key...)
+	}
+	return append([]byte(dbTable(db)+":"), key...)
+}
+
+// dbTable 库中实际使用的表，table为__default时是__db<n>
+func dbTable(db int) string {
+	return "__db" + strconv.Itoa(db)
+}
+
+// indexTable IDX命令中的表在库中实际使用的表
+func indexTable(table string, db int) string {
+	if db == 0 {
+		return table
+	}
+	if table == defaultTable {
+		return dbTable(db)
+	}
+	return dbTable(db) + "." + table
+}
+
+func checkClientName(name []byte) bool {
+	for _, c := range name {
+		if c < '!' || c > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+// cmdHello HELLO [protover [AUTH username password] [SETNAME clientname]]
+func cmdHello(conn *Conn, args [][]byte) (err error) {
+	log.Debug("cmdHello|%d", len(args))
+	proto := conn.proto
+	if len(args) > 0 {
+		ver, err := strconv.ParseInt(string(args[0]), 10, 32)
+		if err != nil {
+			return conn.writeError(errors.New("Protocol version is not an integer or out of range"))
+		}
+		if ver != 2 && ver != 3 {
+			return conn.writeErrorCode("NOPROTO", ErrNoProto)
+		}
+		proto = int(ver)
+	}
+	var name []byte
+	var user, pass string
+	auth := false
+	for i := 1; i < len(args); i++ {
+		switch strings.ToLower(string(args[i])) {
+		case "auth":
+			if i+2 >= len(args) {
+				return conn.writeError(ErrSyntax)
+			}
+			user, pass = string(args[i+1]), string(args[i+2])
+			auth = true
+			i += 2
+		case "setname":
+			if i+1 >= len(args) {
+				return conn.writeError(ErrSyntax)
+			}
+			i++
+			name = args[i]
+		default:
+			return conn.writeError(ErrSyntax)
+		}
+	}
+	if name != nil && !checkClientName(name) {
+		return conn.writeError(ErrClientName)
+	}
+	if auth {
+		if err = conn.authenticate(user, pass); err != nil {
+			return conn.writeErrorCode("WRONGPASS", err)
+		}
+	} else if conn.user == "" {
+		return conn.writeErrorCode("NOAUTH", ErrHelloNoAuth)
+	}
+	conn.proto = proto
+	if name != nil {
+		conn.mu.Lock()
+		conn.name = string(name)
+		conn.mu.Unlock()
+	}
+
+	role := "replica"
+	if conn.dbenv.IsMaster() {
+		role = "master"
+	}
+	conn.writeMap(7)
+	conn.writeBulk([]byte("server"))
+	conn.writeBulk([]byte("bdbd"))
+	conn.writeBulk([]byte("version"))
+	conn.writeBulk([]byte(Version))
+	conn.writeBulk([]byte("proto"))
+	conn.writeInt(int64(conn.proto))
+	conn.writeBulk([]byte("id"))
+	conn.writeInt(conn.id)
+	conn.writeBulk([]byte("mode"))
+	conn.writeBulk([]byte("standalone"))
+	conn.writeBulk([]byte("role"))
+	conn.writeBulk([]byte(role))
+	conn.writeBulk([]byte("modules"))
+	return conn.writeLen('*', 0)
+}
+
+func cmdPing(conn *Conn, args [][]byte) (err error) {
+	if len(args) == 0 {
+		_, err = conn.wb.WriteString("+PONG\r\n")
+		return
+	}
+	return conn.writeBulk(args[0])
+}
+
+func cmdEcho(conn *Conn, args [][]byte) (err error) {
+	return conn.writeBulk(args[0])
+}
+
+func cmdQuit(conn *Conn, args [][]byte) (err error) {
+	log.Debug("cmdQuit|%d", conn.id)
+	conn.quit = true
+	_, err = conn.wb.WriteString("+OK\r\n")
+	return
+}
+
+func cmdSelect(conn *Conn, args [][]byte) (err error) {
+	log.Debug("cmdSelect|%s", args[0])
+	db, err := strconv.ParseInt(string(args[0]), 10, 32)
+	if err != nil {
+		return conn.writeError(ErrNotInteger)
+	}
+	if db < 0 || db >= int64(Databases) {
+		return conn.writeError(ErrDbIndex)
+	}
+	conn.mu.Lock()
+	conn.db = int(db)
+	conn.mu.Unlock()
+	_, err = conn.wb.WriteString("+OK\r\n")
+	return
+}
+
+// cmdReset 恢复连接的初始状态
+func cmdReset(conn *Conn, args [][]byte) (err error) {
+	log.Debug("cmdReset|%d", conn.id)
+	conn.proto = 2
+	conn.mu.Lock()
+	conn.db = 0
+	conn.name = ""
+	conn.user = loginUser()
+	conn.mu.Unlock()
+	_, err = conn.wb.WriteString("+RESET\r\n")
+	return
+}
+
+// info CLIENT LIST中的一行
+func (c *Conn) info(now time.Time) string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return fmt.Sprintf("id=%d addr=%s name=%s age=%d idle=%d db=%d resp=%d user=%s cmd=%s worker=%d\n",
+		c.id,
+		c.addr,
+		c.name,
+		int64(now.Sub(c.ctime)/time.Second),
+		int64(now.Sub(c.atime)/time.Second),
+		c.db,
+		c.proto,
+		c.user,
+		c.cmd,
+		atomic.LoadInt32(&c.worker),
+	)
+}
+
+// kill 关闭连接，如果是当前连接则在回复之后关闭
+func (c *Conn) kill(self *Conn) {
+	if c == self {
+		c.quit = true
+	} else {
+		c.conn.Close()
+	}
+}
+
+func cmdClient(conn *Conn, args [][]byte) (err error) {
+	log.Debug("cmdClient|%s", args[0])
+	sub := strings.ToLower(string(args[0]))
+	args = args[1:]
+	switch sub {
+	case "id":
+		if len(args) != 0 {
+			return conn.writeError(ErrSyntax)
+		}
+		return conn.writeInt(conn.id)
+	case "getname":
+		if len(args) != 0 {
+			return conn.writeError(ErrSyntax)
+		}
+		conn.mu.Lock()
+		name := conn.name
+		conn.mu.Unlock()
+		if name == "" {
+			return conn.writeNull()
+		}
+		return conn.writeBulk([]byte(name))
+	case "setname":
+		if len(args) != 1 {
+			return conn.writeError(ErrSyntax)
+		}
+		if !checkClientName(args[0]) {
+			return conn.writeError(ErrClientName)
+		}
+		conn.mu.Lock()
+		conn.name = string(args[0])
+		conn.mu.Unlock()
+		_, err = conn.wb.WriteString("+OK\r\n")
+		return
+	case "list":
+		return clientList(conn, args)
+	case "kill":
+		return clientKill(conn, args)
+	}
+	return conn.writeError(fmt.Errorf("unknown subcommand '%s'", sub))
+}
+
+// clientList CLIENT LIST [ID id [id ...]]
+func clientList(conn *Conn, args [][]byte) error {
+	var ids map[int64]bool
+	if len(args) > 0 {
+		if strings.ToLower(string(args[0])) != "id" || len(args) == 1 {
+			return conn.writeError(ErrSyntax)
+		}
+		ids = make(map[int64]bool)
+		for _, arg := range args[1:] {
+			id, err := strconv.ParseInt(string(arg), 10, 64)
+			if err != nil {
+				return conn.writeError(ErrNotInteger)
+			}
+			ids[id] = true
+		}
+	}
+	conns.Lock()
+	list := make([]*Conn, 0, len(conns.m))
+	for id, c := range conns.m {
+		if ids == nil || ids[id] {
+			list = append(list, c)
+		}
+	}
+	conns.Unlock()
+
+	now := time.Now()
+	var buf bytes.Buffer
+	for _, c := range list {
+		buf.WriteString(c.info(now))
+	}
+	return conn.writeBulk(buf.Bytes())
+}
+
+// clientKill CLIENT KILL addr 或者 CLIENT KILL [ID id] [ADDR addr] [USER username] [SKIPME yes|no]
+func clientKill(conn *Conn, args [][]byte) (err error) {
+	if len(args) == 1 {
+		addr := string(args[0])
+		var target *Conn
+		conns.Lock()
+		for _, c := range conns.m {
+			if c.addr == addr {
+				target = c
+				break
+			}
+		}
+		conns.Unlock()
+		if target == nil {
+			return conn.writeError(ErrNoClient)
+		}
+		target.kill(conn)
+		_, err = conn.wb.WriteString("+OK\r\n")
+		return
+	}
+	if len(args) == 0 || len(args)%2 != 0 {
+		return conn.writeError(ErrSyntax)
+	}
+	var id int64 = -1
+	var addr, user string
+	skipme := true
+	for i := 0; i < len(args); i += 2 {
+		switch strings.ToLower(string(args[i])) {
+		case "id":
+			id, err = strconv.ParseInt(string(args[i+1]), 10, 64)
+			if err != nil {
+				return conn.writeError(ErrNotInteger)
+			}
+		case "addr":
+			addr = string(args[i+1])
+		case "user":
+			user = string(args[i+1])
+		case "skipme":
+			switch strings.ToLower(string(args[i+1])) {
+			case "yes":
+				skipme = true
+			case "no":
+				skipme = false
+			default:
+				return conn.writeError(ErrSyntax)
+			}
+		default:
+			return conn.writeError(ErrSyntax)
+		}
+	}
+	var targets []*Conn
+	conns.Lock()
+	for _, c := range conns.m {
+		if id >= 0 && c.id != id || addr != "" && c.addr != addr || skipme && c == conn {
+			continue
+		}
+		if user != "" {
+			c.mu.Lock()
+			match := c.user == user
+			c.mu.Unlock()
+			if !match {
+				continue
+			}
+		}
+		targets = append(targets, c)
+	}
+	conns.Unlock()
+	for _, c := range targets {
+		c.kill(conn)
+	}
+	return conn.writeInt(int64(len(targets)))
+}
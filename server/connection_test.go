@@ -0,0 +1,26 @@
+package server
+
+import (
+	"github.com/nybuxtsui/bdbd/bdb"
+	"testing"
+)
+
+// SELECT之后key和IDX命令中的表要对应到同一个表
+func TestDbKeyIndexTable(t *testing.T) {
+	tests := []struct {
+		key, table, name string
+	}{
+		{"users:1", "users", "1"},
+		{"k", defaultTable, "k"},
+		{":k", defaultTable, ":k"},
+	}
+	for _, tt := range tests {
+		table, name := bdb.SplitKey(dbKey([]byte(tt.key), 2))
+		if want := indexTable(tt.table, 2); table != want || string(name) != tt.name {
+			t.Errorf("dbKey(%q) = %s, %s, want %s, %s", tt.key, table, name, want, tt.name)
+		}
+	}
+	if table := indexTable("users", 0); table != "users" {
+		t.Errorf("indexTable(users, 0) = %s", table)
+	}
+}
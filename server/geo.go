@@ -0,0 +1,611 @@
+package server
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/nybuxtsui/bdbd/bdb"
+	"github.com/nybuxtsui/log"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// 每个geo key使用两张表:
+//
+//	<table>.geo      prefix+member -> hash(8字节) + 经度 + 纬度
+//	<table>.geoindex prefix+hash+member -> 经度 + 纬度
+//
+// prefix为4字节的name长度加上name，hash按大端序保存，
+// 这样同一个key在index表中的记录按geohash排序，可以用游标做范围扫描
+const (
+	geoSortNone = iota
+	geoSortAsc
+	geoSortDesc
+)
+
+var (
+	ErrGeoAddSyntax  = errors.New("syntax error. Try GEOADD key [x1] [y1] [name1] [x2] [y2] [name2] ... ")
+	ErrGeoNxXx       = errors.New("XX and NX options at the same time are not compatible")
+	ErrGeoUnit       = errors.New("unsupported unit provided. please use M, KM, FT, MI")
+	ErrGeoMember     = errors.New("could not decode requested zset member")
+	ErrGeoFrom       = errors.New("exactly one of FROMMEMBER or FROMLONLAT can be specified for GEOSEARCH")
+	ErrGeoBy         = errors.New("exactly one of BYRADIUS and BYBOX can be specified for GEOSEARCH")
+	ErrGeoCount      = errors.New("COUNT must be > 0")
+	ErrGeoAny        = errors.New("the ANY argument requires COUNT argument")
+	ErrGeoRadius     = errors.New("radius cannot be negative")
+	ErrGeoBox        = errors.New("height or width cannot be negative")
+	ErrGeoNotFloat   = errors.New("value is not a valid float")
+	ErrGeoCoordinate = errors.New("invalid longitude,latitude pair")
+)
+
+type geoPoint struct {
+	lon    float64
+	lat    float64
+	member []byte
+}
+
+type geoResult struct {
+	member []byte
+	dist   float64
+	hash   uint64
+	lon    float64
+	lat    float64
+}
+
+type bdbGeoAddReq struct {
+	key    []byte
+	nx     bool
+	xx     bool
+	ch     bool
+	points []geoPoint
+	resp   chan bdbIntResp
+}
+
+type bdbGeoPosReq struct {
+	key     []byte
+	members [][]byte
+	resp    chan bdbGeoPosResp
+}
+
+type bdbGeoPosResp struct {
+	points []*geoPoint
+	err    error
+}
+
+type bdbGeoSearchReq struct {
+	key        []byte
+	fromMember []byte
+	shape      geoShape
+	sort       int
+	count      int
+	any        bool
+	resp       chan bdbGeoSearchResp
+}
+
+type bdbGeoSearchResp struct {
+	results []geoResult
+	err     error
+}
+
+func geoPrefix(name []byte) []byte {
+	prefix := make([]byte, 4, 4+len(name))
+	binary.BigEndian.PutUint32(prefix, uint32(len(name)))
+	return append(prefix, name...)
+}
+
+func geoIndexKey(prefix []byte, hash uint64, member []byte) []byte {
+	key := make([]byte, len(prefix)+8, len(prefix)+8+len(member))
+	copy(key, prefix)
+	binary.BigEndian.PutUint64(key[len(prefix):], hash)
+	return append(key, member...)
+}
+
+func encodeLonLat(buf []byte, lon float64, lat float64) {
+	binary.BigEndian.PutUint64(buf, math.Float64bits(lon))
+	binary.BigEndian.PutUint64(buf[8:], math.Float64bits(lat))
+}
+
+func decodeLonLat(buf []byte) (float64, float64) {
+	return math.Float64frombits(binary.BigEndian.Uint64(buf)), math.Float64frombits(binary.BigEndian.Uint64(buf[8:]))
+}
+
+func (w *Worker) getGeoDb(table string) (*bdb.Db, *bdb.Db, error) {
+	coord, err := w.getdb(table+".geo", bdb.DBTYPE_BTREE)
+	if err != nil {
+		return nil, nil, err
+	}
+	index, err := w.getdb(table+".geoindex", bdb.DBTYPE_BTREE)
+	if err != nil {
+		return nil, nil, err
+	}
+	return coord, index, nil
+}
+
+// getGeoCoord 读取member的坐标，返回值为hash, 经度, 纬度
+func (w *Worker) getGeoCoord(coord *bdb.Db, txn *bdb.Txn, prefix []byte, member []byte, flags uint32) (uint64, float64, float64, error) {
+	key := append(prefix[:len(prefix):len(prefix)], member...)
+	value, err := coord.Get(txn, key, &w.getbuff, flags)
+	if err != nil {
+		if err != bdb.ErrNotFound {
+			w.checkerr(err, coord)
+		}
+		return 0, 0, 0, err
+	}
+	if len(value) != 24 {
+		return 0, 0, 0, ErrGeoMember
+	}
+	lon, lat := decodeLonLat(value[8:])
+	return binary.BigEndian.Uint64(value), lon, lat, nil
+}
+
+func (w *Worker) bdbGeoAdd(req *bdbGeoAddReq) {
+	key := append([]byte(nil), req.key...)
+	table, name := bdb.SplitKey(req.key)
+	coord, index, err := w.getGeoDb(table)
+	if err != nil {
+		req.resp <- bdbIntResp{0, err}
+		return
+	}
+	txn, err := w.dbenv.Begin(bdb.DB_READ_COMMITTED)
+	if err != nil {
+		req.resp <- bdbIntResp{0, err}
+		return
+	}
+	defer func() {
+		if txn != nil {
+			txn.Abort()
+		}
+	}()
+
+	prefix := geoPrefix(name)
+	var added, changed int64 = 0, 0
+	var value [24]byte
+	for _, p := range req.points {
+		oldhash, oldlon, oldlat, err := w.getGeoCoord(coord, txn, prefix, p.member, bdb.DB_RMW)
+		exists := err == nil
+		if err != nil && err != bdb.ErrNotFound {
+			req.resp <- bdbIntResp{0, err}
+			return
+		}
+		if (exists && req.nx) || (!exists && req.xx) {
+			continue
+		}
+		if exists && oldlon == p.lon && oldlat == p.lat {
+			continue
+		}
+		if exists {
+			err = index.Del(txn, geoIndexKey(prefix, oldhash, p.member), 0)
+			if err != nil && err != bdb.ErrNotFound {
+				w.checkerr(err, index)
+				req.resp <- bdbIntResp{0, err}
+				return
+			}
+		}
+		hash := geohashEncode(p.lon, p.lat, geoStepMax).bits
+		binary.BigEndian.PutUint64(value[:], hash)
+		encodeLonLat(value[8:], p.lon, p.lat)
+		err = coord.Set(txn, append(prefix[:len(prefix):len(prefix)], p.member...), value[:], 0)
+		if err != nil {
+			w.checkerr(err, coord)
+			req.resp <- bdbIntResp{0, err}
+			return
+		}
+		err = index.Set(txn, geoIndexKey(prefix, hash, p.member), value[8:], 0)
+		if err != nil {
+			w.checkerr(err, index)
+			req.resp <- bdbIntResp{0, err}
+			return
+		}
+		if exists {
+			changed++
+		} else {
+			added++
+		}
+	}
+	if added+changed > 0 {
+		if _, err = w.bumpVersion(txn, key); err != nil {
+			req.resp <- bdbIntResp{0, err}
+			return
+		}
+	}
+	err = txn.Commit()
+	txn = nil
+	if err != nil {
+		req.resp <- bdbIntResp{0, err}
+		return
+	}
+	if req.ch {
+		added += changed
+	}
+	req.resp <- bdbIntResp{added, nil}
+}
+
+func (w *Worker) bdbGeoPos(req *bdbGeoPosReq) {
+	table, name := bdb.SplitKey(req.key)
+	coord, _, err := w.getGeoDb(table)
+	if err != nil {
+		req.resp <- bdbGeoPosResp{nil, err}
+		return
+	}
+	prefix := geoPrefix(name)
+	points := make([]*geoPoint, len(req.members))
+	for i, member := range req.members {
+		_, lon, lat, err := w.getGeoCoord(coord, nil, prefix, member, 0)
+		if err == bdb.ErrNotFound {
+			continue
+		} else if err != nil {
+			req.resp <- bdbGeoPosResp{nil, err}
+			return
+		}
+		points[i] = &geoPoint{lon, lat, member}
+	}
+	req.resp <- bdbGeoPosResp{points, nil}
+}
+
+func (w *Worker) bdbGeoSearch(req *bdbGeoSearchReq) {
+	table, name := bdb.SplitKey(req.key)
+	coord, index, err := w.getGeoDb(table)
+	if err != nil {
+		req.resp <- bdbGeoSearchResp{nil, err}
+		return
+	}
+	prefix := geoPrefix(name)
+	shape := req.shape
+	if req.fromMember != nil {
+		_, shape.lon, shape.lat, err = w.getGeoCoord(coord, nil, prefix, req.fromMember, 0)
+		if err == bdb.ErrNotFound {
+			req.resp <- bdbGeoSearchResp{nil, ErrGeoMember}
+			return
+		} else if err != nil {
+			req.resp <- bdbGeoSearchResp{nil, err}
+			return
+		}
+	}
+
+	limit := 0
+	if req.any {
+		limit = req.count
+	}
+	results, err := w.geoScan(index, prefix, &shape, limit)
+	if err != nil {
+		req.resp <- bdbGeoSearchResp{nil, err}
+		return
+	}
+	switch req.sort {
+	case geoSortAsc:
+		sort.Slice(results, func(i, j int) bool { return results[i].dist < results[j].dist })
+	case geoSortDesc:
+		sort.Slice(results, func(i, j int) bool { return results[i].dist > results[j].dist })
+	}
+	if req.count > 0 && len(results) > req.count {
+		results = results[:req.count]
+	}
+	req.resp <- bdbGeoSearchResp{results, nil}
+}
+
+// geoScan 用游标扫描中心及周围8个格子的hash区间，再按实际距离过滤，limit大于0时找到足够的结果就返回
+func (w *Worker) geoScan(index *bdb.Db, prefix []byte, shape *geoShape, limit int) ([]geoResult, error) {
+	cur, err := index.Cursor(nil, bdb.DB_READ_COMMITTED)
+	if err != nil {
+		w.checkerr(err, index)
+		return nil, err
+	}
+	defer cur.Close()
+
+	areas := geohashSearchAreas(shape)
+	results := make([]geoResult, 0, 16)
+	for i, area := range areas {
+		if area.step == 0 {
+			continue
+		}
+		dup := false
+		for _, prev := range areas[:i] {
+			if prev == area {
+				dup = true
+				break
+			}
+		}
+		if dup {
+			continue
+		}
+		min, max := geohashScoreRange(area)
+		k, v, err := cur.Get(geoIndexKey(prefix, min, nil), bdb.DB_SET_RANGE)
+		for err == nil {
+			if len(k) < len(prefix)+8 || !bytes.HasPrefix(k, prefix) || len(v) != 16 {
+				break
+			}
+			hash := binary.BigEndian.Uint64(k[len(prefix):])
+			if hash >= max {
+				break
+			}
+			lon, lat := decodeLonLat(v)
+			if dist, ok := geoShapeDistance(shape, lon, lat); ok {
+				results = append(results, geoResult{k[len(prefix)+8:], dist, hash, lon, lat})
+				if limit > 0 && len(results) >= limit {
+					return results, nil
+				}
+			}
+			k, v, err = cur.Get(nil, bdb.DB_NEXT)
+		}
+		if err != nil && err != bdb.ErrNotFound {
+			w.checkerr(err, index)
+			return nil, err
+		}
+	}
+	return results, nil
+}
+
+func parseGeoUnit(arg []byte) (float64, error) {
+	switch strings.ToLower(string(arg)) {
+	case "m":
+		return 1, nil
+	case "km":
+		return 1000, nil
+	case "ft":
+		return 0.3048, nil
+	case "mi":
+		return 1609.34, nil
+	default:
+		return 0, ErrGeoUnit
+	}
+}
+
+func parseGeoFloat(arg []byte) (float64, error) {
+	value, err := strconv.ParseFloat(string(arg), 64)
+	if err != nil || math.IsNaN(value) {
+		return 0, ErrGeoNotFloat
+	}
+	return value, nil
+}
+
+func parseLonLat(lonArg []byte, latArg []byte) (float64, float64, error) {
+	lon, err := parseGeoFloat(lonArg)
+	if err != nil {
+		return 0, 0, err
+	}
+	lat, err := parseGeoFloat(latArg)
+	if err != nil {
+		return 0, 0, err
+	}
+	if !geoValid(lon, lat) {
+		return 0, 0, fmt.Errorf("%s %f,%f", ErrGeoCoordinate.Error(), lon, lat)
+	}
+	return lon, lat, nil
+}
+
+func (conn *Conn) writeGeoDist(dist float64, unit float64) error {
+	var buf [64]byte
+	return conn.writeBulk(strconv.AppendFloat(buf[:0], dist/unit, 'f', 4, 64))
+}
+
+func cmdGeoAdd(conn *Conn, args [][]byte) (err error) {
+	log.Debug("cmdGeoAdd|%s", args[0])
+	req := bdbGeoAddReq{key: args[0]}
+	i := 1
+	for ; i < len(args); i++ {
+		opt := strings.ToLower(string(args[i]))
+		if opt == "nx" {
+			req.nx = true
+		} else if opt == "xx" {
+			req.xx = true
+		} else if opt == "ch" {
+			req.ch = true
+		} else {
+			break
+		}
+	}
+	if (len(args)-i)%3 != 0 || len(args) == i {
+		return conn.writeError(ErrGeoAddSyntax)
+	}
+	if req.nx && req.xx {
+		return conn.writeError(ErrGeoNxXx)
+	}
+	req.points = make([]geoPoint, 0, (len(args)-i)/3)
+	for ; i < len(args); i += 3 {
+		lon, lat, err := parseLonLat(args[i], args[i+1])
+		if err != nil {
+			return conn.writeError(err)
+		}
+		req.points = append(req.points, geoPoint{lon, lat, args[i+2]})
+	}
+	respChan := make(chan bdbIntResp, 1)
+	req.resp = respChan
+	if ok, err := conn.sendOrBusy(req); !ok {
+		return err
+	}
+	resp := <-respChan
+	if resp.err != nil {
+		return conn.writeError(resp.err)
+	}
+	return conn.writeInt(resp.result)
+}
+
+func cmdGeoPos(conn *Conn, args [][]byte) (err error) {
+	log.Debug("cmdGeoPos|%s", args[0])
+	respChan := make(chan bdbGeoPosResp, 1)
+	if ok, err := conn.sendOrBusy(bdbGeoPosReq{args[0], args[1:], respChan}); !ok {
+		return err
+	}
+	resp := <-respChan
+	if resp.err != nil {
+		return conn.writeError(resp.err)
+	}
+	conn.writeLen('*', len(resp.points))
+	for _, p := range resp.points {
+		if p == nil {
+			err = conn.writeNullArray()
+		} else {
+			conn.writeLen('*', 2)
+			conn.writeDouble(p.lon)
+			err = conn.writeDouble(p.lat)
+		}
+	}
+	return
+}
+
+func cmdGeoDist(conn *Conn, args [][]byte) (err error) {
+	log.Debug("cmdGeoDist|%s|%s|%s", args[0], args[1], args[2])
+	var unit float64 = 1
+	if len(args) == 4 {
+		if unit, err = parseGeoUnit(args[3]); err != nil {
+			return conn.writeError(err)
+		}
+	}
+	respChan := make(chan bdbGeoPosResp, 1)
+	if ok, err := conn.sendOrBusy(bdbGeoPosReq{args[0], args[1:3], respChan}); !ok {
+		return err
+	}
+	resp := <-respChan
+	if resp.err != nil {
+		return conn.writeError(resp.err)
+	}
+	p1, p2 := resp.points[0], resp.points[1]
+	if p1 == nil || p2 == nil {
+		return conn.writeBulk(nil)
+	}
+	return conn.writeGeoDist(geohashGetDistance(p1.lon, p1.lat, p2.lon, p2.lat), unit)
+}
+
+func cmdGeoSearch(conn *Conn, args [][]byte) (err error) {
+	log.Debug("cmdGeoSearch|%s", args[0])
+	req := bdbGeoSearchReq{key: args[0]}
+	var unit float64 = 1
+	var fromLonLat, byRadius, byBox, withCoord, withDist, withHash bool
+	for i := 1; i < len(args); i++ {
+		left := len(args) - i - 1
+		switch strings.ToLower(string(args[i])) {
+		case "frommember":
+			if left < 1 || req.fromMember != nil || fromLonLat {
+				return conn.writeError(ErrGeoFrom)
+			}
+			req.fromMember = args[i+1]
+			i++
+		case "fromlonlat":
+			if left < 2 || req.fromMember != nil || fromLonLat {
+				return conn.writeError(ErrGeoFrom)
+			}
+			if req.shape.lon, req.shape.lat, err = parseLonLat(args[i+1], args[i+2]); err != nil {
+				return conn.writeError(err)
+			}
+			fromLonLat = true
+			i += 2
+		case "byradius":
+			if left < 2 || byRadius || byBox {
+				return conn.writeError(ErrGeoBy)
+			}
+			if req.shape.radius, err = parseGeoFloat(args[i+1]); err != nil {
+				return conn.writeError(err)
+			}
+			if req.shape.radius < 0 {
+				return conn.writeError(ErrGeoRadius)
+			}
+			if unit, err = parseGeoUnit(args[i+2]); err != nil {
+				return conn.writeError(err)
+			}
+			req.shape.circle = true
+			byRadius = true
+			i += 2
+		case "bybox":
+			if left < 3 || byRadius || byBox {
+				return conn.writeError(ErrGeoBy)
+			}
+			if req.shape.width, err = parseGeoFloat(args[i+1]); err != nil {
+				return conn.writeError(err)
+			}
+			if req.shape.height, err = parseGeoFloat(args[i+2]); err != nil {
+				return conn.writeError(err)
+			}
+			if req.shape.width < 0 || req.shape.height < 0 {
+				return conn.writeError(ErrGeoBox)
+			}
+			if unit, err = parseGeoUnit(args[i+3]); err != nil {
+				return conn.writeError(err)
+			}
+			byBox = true
+			i += 3
+		case "asc":
+			req.sort = geoSortAsc
+		case "desc":
+			req.sort = geoSortDesc
+		case "count":
+			if left < 1 {
+				return conn.writeError(ErrSyntax)
+			}
+			count, err := strconv.ParseInt(string(args[i+1]), 10, 32)
+			if err != nil {
+				return conn.writeError(ErrNotInteger)
+			}
+			if count <= 0 {
+				return conn.writeError(ErrGeoCount)
+			}
+			req.count = int(count)
+			i++
+			if left > 1 && strings.ToLower(string(args[i+1])) == "any" {
+				req.any = true
+				i++
+			}
+		case "withcoord":
+			withCoord = true
+		case "withdist":
+			withDist = true
+		case "withhash":
+			withHash = true
+		default:
+			return conn.writeError(ErrSyntax)
+		}
+	}
+	if req.fromMember == nil && !fromLonLat {
+		return conn.writeError(ErrGeoFrom)
+	}
+	if !byRadius && !byBox {
+		return conn.writeError(ErrGeoBy)
+	}
+	if req.any && req.count == 0 {
+		return conn.writeError(ErrGeoAny)
+	}
+	if req.count > 0 && req.sort == geoSortNone && !req.any {
+		req.sort = geoSortAsc
+	}
+	req.shape.radius *= unit
+	req.shape.width *= unit
+	req.shape.height *= unit
+
+	respChan := make(chan bdbGeoSearchResp, 1)
+	req.resp = respChan
+	if ok, err := conn.sendOrBusy(req); !ok {
+		return err
+	}
+	resp := <-respChan
+	if resp.err != nil {
+		return conn.writeError(resp.err)
+	}
+
+	fields := 1
+	for _, with := range []bool{withCoord, withDist, withHash} {
+		if with {
+			fields++
+		}
+	}
+	conn.writeLen('*', len(resp.results))
+	for _, r := range resp.results {
+		if fields > 1 {
+			conn.writeLen('*', fields)
+		}
+		err = conn.writeBulk(r.member)
+		if withDist {
+			err = conn.writeGeoDist(r.dist, unit)
+		}
+		if withHash {
+			err = conn.writeInt(int64(r.hash))
+		}
+		if withCoord {
+			conn.writeLen('*', 2)
+			conn.writeDouble(r.lon)
+			err = conn.writeDouble(r.lat)
+		}
+	}
+	return
+}
@@ -0,0 +1,21 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"testing"
+)
+
+// 和redis一样，RESP3下GEODIST的距离仍然是bulk string，GEOPOS的坐标是double
+func TestGeoReplyResp3(t *testing.T) {
+	conn := testConn(t)
+	var out bytes.Buffer
+	conn.wb = bufio.NewWriter(&out)
+	conn.proto = 3
+	conn.writeGeoDist(1500, 1000)
+	conn.writeDouble(1.5)
+	conn.wb.Flush()
+	if s := out.String(); s != "$6\r\n1.5000\r\n,1.5\r\n" {
+		t.Fatalf("reply = %q", s)
+	}
+}
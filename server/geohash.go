@@ -0,0 +1,298 @@
+package server
+
+import (
+	"math"
+)
+
+// geohash的计算方法与redis(geohash.c, geohash_helper.c)相同，
+// 52位的hash值按大端序保存，bdb btree的默认排序就是hash值的顺序
+const (
+	geoStepMax     = 26
+	geoLatMin      = -85.05112878
+	geoLatMax      = 85.05112878
+	geoLongMin     = -180.0
+	geoLongMax     = 180.0
+	earthRadius    = 6372797.560856
+	mercatorMax    = 20037726.37
+	geoHashBitsMax = geoStepMax * 2
+)
+
+type geoHashBits struct {
+	bits uint64
+	step uint
+}
+
+type geoHashRange struct {
+	min float64
+	max float64
+}
+
+type geoHashArea struct {
+	hash      geoHashBits
+	longitude geoHashRange
+	latitude  geoHashRange
+}
+
+// geoShape 描述GEOSEARCH的搜索范围，radius/width/height的单位都是米
+type geoShape struct {
+	lon    float64
+	lat    float64
+	circle bool
+	radius float64
+	width  float64
+	height float64
+}
+
+func degRad(ang float64) float64 {
+	return ang * (math.Pi / 180.0)
+}
+
+func radDeg(ang float64) float64 {
+	return ang / (math.Pi / 180.0)
+}
+
+func geoValid(lon float64, lat float64) bool {
+	return lon >= geoLongMin && lon <= geoLongMax && lat >= geoLatMin && lat <= geoLatMax
+}
+
+func interleave64(xlo uint32, ylo uint32) uint64 {
+	var b = [...]uint64{0x5555555555555555, 0x3333333333333333, 0x0F0F0F0F0F0F0F0F, 0x00FF00FF00FF00FF, 0x0000FFFF0000FFFF}
+	var s = [...]uint{1, 2, 4, 8, 16}
+	x := uint64(xlo)
+	y := uint64(ylo)
+
+	x = (x | (x << s[4])) & b[4]
+	y = (y | (y << s[4])) & b[4]
+	x = (x | (x << s[3])) & b[3]
+	y = (y | (y << s[3])) & b[3]
+	x = (x | (x << s[2])) & b[2]
+	y = (y | (y << s[2])) & b[2]
+	x = (x | (x << s[1])) & b[1]
+	y = (y | (y << s[1])) & b[1]
+	x = (x | (x << s[0])) & b[0]
+	y = (y | (y << s[0])) & b[0]
+
+	return x | (y << 1)
+}
+
+func deinterleave64(interleaved uint64) uint64 {
+	var b = [...]uint64{0x5555555555555555, 0x3333333333333333, 0x0F0F0F0F0F0F0F0F, 0x00FF00FF00FF00FF, 0x0000FFFF0000FFFF, 0x00000000FFFFFFFF}
+	var s = [...]uint{0, 1, 2, 4, 8, 16}
+	x := interleaved
+	y := interleaved >> 1
+
+	x = (x | (x >> s[0])) & b[0]
+	y = (y | (y >> s[0])) & b[0]
+	x = (x | (x >> s[1])) & b[1]
+	y = (y | (y >> s[1])) & b[1]
+	x = (x | (x >> s[2])) & b[2]
+	y = (y | (y >> s[2])) & b[2]
+	x = (x | (x >> s[3])) & b[3]
+	y = (y | (y >> s[3])) & b[3]
+	x = (x | (x >> s[4])) & b[4]
+	y = (y | (y >> s[4])) & b[4]
+	x = (x | (x >> s[5])) & b[5]
+	y = (y | (y >> s[5])) & b[5]
+
+	return x | (y << 32)
+}
+
+func geohashEncode(lon float64, lat float64, step uint) geoHashBits {
+	latOffset := (lat - geoLatMin) / (geoLatMax - geoLatMin)
+	lonOffset := (lon - geoLongMin) / (geoLongMax - geoLongMin)
+	latOffset *= float64(uint64(1) << step)
+	lonOffset *= float64(uint64(1) << step)
+	return geoHashBits{interleave64(uint32(latOffset), uint32(lonOffset)), step}
+}
+
+func geohashDecode(hash geoHashBits) geoHashArea {
+	area := geoHashArea{hash: hash}
+	hashSep := deinterleave64(hash.bits)
+	latScale := geoLatMax - geoLatMin
+	lonScale := geoLongMax - geoLongMin
+	ilato := uint32(hashSep)
+	ilono := uint32(hashSep >> 32)
+	unit := float64(uint64(1) << hash.step)
+
+	area.latitude.min = geoLatMin + (float64(ilato)/unit)*latScale
+	area.latitude.max = geoLatMin + ((float64(ilato)+1)/unit)*latScale
+	area.longitude.min = geoLongMin + (float64(ilono)/unit)*lonScale
+	area.longitude.max = geoLongMin + ((float64(ilono)+1)/unit)*lonScale
+	return area
+}
+
+func geohashMoveX(hash geoHashBits, d int) geoHashBits {
+	x := hash.bits & 0xaaaaaaaaaaaaaaaa
+	y := hash.bits & 0x5555555555555555
+	zz := uint64(0x5555555555555555) >> (64 - hash.step*2)
+	if d > 0 {
+		x = x + (zz + 1)
+	} else {
+		x = x | zz
+		x = x - (zz + 1)
+	}
+	x &= uint64(0xaaaaaaaaaaaaaaaa) >> (64 - hash.step*2)
+	return geoHashBits{x | y, hash.step}
+}
+
+func geohashMoveY(hash geoHashBits, d int) geoHashBits {
+	x := hash.bits & 0xaaaaaaaaaaaaaaaa
+	y := hash.bits & 0x5555555555555555
+	zz := uint64(0xaaaaaaaaaaaaaaaa) >> (64 - hash.step*2)
+	if d > 0 {
+		y = y + (zz + 1)
+	} else {
+		y = y | zz
+		y = y - (zz + 1)
+	}
+	y &= uint64(0x5555555555555555) >> (64 - hash.step*2)
+	return geoHashBits{x | y, hash.step}
+}
+
+// geohashNeighbors 返回中心格子及周围8个格子，顺序为中心、北、南、东、西、东北、西北、东南、西南
+func geohashNeighbors(hash geoHashBits) [9]geoHashBits {
+	return [9]geoHashBits{
+		hash,
+		geohashMoveY(hash, 1),
+		geohashMoveY(hash, -1),
+		geohashMoveX(hash, 1),
+		geohashMoveX(hash, -1),
+		geohashMoveY(geohashMoveX(hash, 1), 1),
+		geohashMoveY(geohashMoveX(hash, -1), 1),
+		geohashMoveY(geohashMoveX(hash, 1), -1),
+		geohashMoveY(geohashMoveX(hash, -1), -1),
+	}
+}
+
+func geohashEstimateStepsByRadius(rangeMeters float64, lat float64) uint {
+	if rangeMeters == 0 {
+		return geoStepMax
+	}
+	step := 1
+	for rangeMeters < mercatorMax {
+		rangeMeters *= 2
+		step++
+	}
+	step -= 2
+	// 靠近两极时格子在经度方向上更窄，需要更大的格子
+	if lat > 66 || lat < -66 {
+		step--
+		if lat > 80 || lat < -80 {
+			step--
+		}
+	}
+	if step < 1 {
+		step = 1
+	}
+	if step > geoStepMax {
+		step = geoStepMax
+	}
+	return uint(step)
+}
+
+// geohashBoundingBox 返回包含搜索范围的经纬度矩形: minlon, minlat, maxlon, maxlat
+func geohashBoundingBox(shape *geoShape) [4]float64 {
+	height, width := shape.radius, shape.radius
+	if !shape.circle {
+		height, width = shape.height/2, shape.width/2
+	}
+	latDelta := radDeg(height / earthRadius)
+	lonDeltaTop := radDeg(width / earthRadius / math.Cos(degRad(shape.lat+latDelta)))
+	lonDeltaBottom := radDeg(width / earthRadius / math.Cos(degRad(shape.lat-latDelta)))
+	var bounds [4]float64
+	if shape.lat < 0 {
+		bounds[0] = shape.lon - lonDeltaBottom
+		bounds[2] = shape.lon + lonDeltaBottom
+	} else {
+		bounds[0] = shape.lon - lonDeltaTop
+		bounds[2] = shape.lon + lonDeltaTop
+	}
+	bounds[1] = shape.lat - latDelta
+	bounds[3] = shape.lat + latDelta
+	return bounds
+}
+
+// geohashSearchAreas 计算需要扫描的格子，不需要扫描的格子bits和step都为0
+func geohashSearchAreas(shape *geoShape) [9]geoHashBits {
+	bounds := geohashBoundingBox(shape)
+	minLon, minLat, maxLon, maxLat := bounds[0], bounds[1], bounds[2], bounds[3]
+	radius := shape.radius
+	if !shape.circle {
+		radius = math.Sqrt((shape.width/2)*(shape.width/2) + (shape.height/2)*(shape.height/2))
+	}
+	steps := geohashEstimateStepsByRadius(radius, shape.lat)
+	hash := geohashEncode(shape.lon, shape.lat, steps)
+	neighbors := geohashNeighbors(hash)
+	area := geohashDecode(hash)
+
+	// 格子过小时周围8个格子可能无法覆盖整个搜索范围，此时使用更大的格子
+	decreaseStep := false
+	if north := geohashDecode(neighbors[1]); north.latitude.max < maxLat {
+		decreaseStep = true
+	}
+	if south := geohashDecode(neighbors[2]); south.latitude.min > minLat {
+		decreaseStep = true
+	}
+	if east := geohashDecode(neighbors[3]); east.longitude.max < maxLon {
+		decreaseStep = true
+	}
+	if west := geohashDecode(neighbors[4]); west.longitude.min > minLon {
+		decreaseStep = true
+	}
+	if steps > 1 && decreaseStep {
+		steps--
+		hash = geohashEncode(shape.lon, shape.lat, steps)
+		neighbors = geohashNeighbors(hash)
+		area = geohashDecode(hash)
+	}
+
+	// 排除不可能有结果的格子
+	if steps >= 2 {
+		if area.latitude.min < minLat {
+			neighbors[2], neighbors[7], neighbors[8] = geoHashBits{}, geoHashBits{}, geoHashBits{}
+		}
+		if area.latitude.max > maxLat {
+			neighbors[1], neighbors[5], neighbors[6] = geoHashBits{}, geoHashBits{}, geoHashBits{}
+		}
+		if area.longitude.min < minLon {
+			neighbors[4], neighbors[6], neighbors[8] = geoHashBits{}, geoHashBits{}, geoHashBits{}
+		}
+		if area.longitude.max > maxLon {
+			neighbors[3], neighbors[5], neighbors[7] = geoHashBits{}, geoHashBits{}, geoHashBits{}
+		}
+	}
+	return neighbors
+}
+
+// geohashScoreRange 返回格子对应的52位hash区间[min, max)
+func geohashScoreRange(hash geoHashBits) (uint64, uint64) {
+	shift := geoHashBitsMax - hash.step*2
+	return hash.bits << shift, (hash.bits + 1) << shift
+}
+
+func geohashGetDistance(lon1d float64, lat1d float64, lon2d float64, lat2d float64) float64 {
+	lat1r := degRad(lat1d)
+	lon1r := degRad(lon1d)
+	lat2r := degRad(lat2d)
+	lon2r := degRad(lon2d)
+	u := math.Sin((lat2r - lat1r) / 2)
+	v := math.Sin((lon2r - lon1r) / 2)
+	return 2.0 * earthRadius * math.Asin(math.Sqrt(u*u+math.Cos(lat1r)*math.Cos(lat2r)*v*v))
+}
+
+// geoShapeDistance 返回点到搜索中心的距离，点不在搜索范围内时返回false
+func geoShapeDistance(shape *geoShape, lon float64, lat float64) (float64, bool) {
+	if shape.circle {
+		dist := geohashGetDistance(shape.lon, shape.lat, lon, lat)
+		return dist, dist <= shape.radius
+	}
+	latDistance := earthRadius * math.Abs(degRad(lat)-degRad(shape.lat))
+	if latDistance > shape.height/2 {
+		return 0, false
+	}
+	lonDistance := geohashGetDistance(lon, lat, shape.lon, lat)
+	if lonDistance > shape.width/2 {
+		return 0, false
+	}
+	return geohashGetDistance(shape.lon, shape.lat, lon, lat), true
+}
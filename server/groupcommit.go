@@ -0,0 +1,178 @@
+package server
+
+import (
+	"github.com/nybuxtsui/bdbd/bdb"
+	"github.com/nybuxtsui/log"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	// GroupCommit worker取到SET/SETEX/SETNX请求后，继续从队列中取写请求，在一个事务中写入后只提交一次
+	GroupCommit = false
+	// GroupCommitWindow 收集写请求最多等待的时间(微秒)，0表示只合并已经在队列中的请求
+	GroupCommitWindow int64 = 0
+	// GroupCommitMax 一次最多合并的写请求数
+	GroupCommitMax int64 = 64
+)
+
+var (
+	groupCommits         int64 // 合并提交的事务数
+	groupCommitWrites    int64 // 合并提交的写请求数
+	groupCommitFallbacks int64 // 死锁等原因回滚后逐个重新执行的次数
+)
+
+// receive 从worker的两个队列中取一个请求，队列关闭时设置为nil。timeout为nil时不等待
+func receive(shared, lane *chan workItem, timeout <-chan time.Time) (workItem, bool) {
+	for *shared != nil || *lane != nil {
+		var item workItem
+		var ok bool
+		if timeout == nil {
+			select {
+			case item, ok = <-*lane:
+				if !ok {
+					*lane = nil
+					continue
+				}
+			case item, ok = <-*shared:
+				if !ok {
+					*shared = nil
+					continue
+				}
+			default:
+				return item, false
+			}
+		} else {
+			select {
+			case item, ok = <-*lane:
+				if !ok {
+					*lane = nil
+					continue
+				}
+			case item, ok = <-*shared:
+				if !ok {
+					*shared = nil
+					continue
+				}
+			case <-timeout:
+				return item, false
+			}
+		}
+		return item, true
+	}
+	return workItem{}, false
+}
+
+// groupCommit 从first开始收集写请求，到GroupCommitMax个或者超过GroupCommitWindow后一起提交。
+// 取到的不是写请求时停止收集，返回给调用者在提交之后处理，保证同一个队列中的请求按顺序执行
+func (w *Worker) groupCommit(first workItem, shared, lane *chan workItem) *workItem {
+	batch := []workItem{first}
+	max := int(atomic.LoadInt64(&GroupCommitMax))
+	var timeout <-chan time.Time
+	if window := atomic.LoadInt64(&GroupCommitWindow); window > 0 {
+		timer := time.NewTimer(time.Duration(window) * time.Microsecond)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	var next *workItem
+	for len(batch) < max {
+		item, ok := receive(shared, lane, timeout)
+		if !ok {
+			break
+		}
+		if _, ok := item.req.(bdbSetReq); !ok {
+			next = &item
+			break
+		}
+		batch = append(batch, item)
+	}
+
+	start := time.Now()
+	for _, item := range batch {
+		item.conn.setWorker(int32(w.id))
+		wait := start.Sub(item.enqueued)
+		recordQueueWait(wait)
+		item.conn.workerStart(start, wait)
+	}
+	if len(batch) == 1 {
+		w.dispatch(first.req)
+	} else if errs, ok := w.txnBatch(batch); ok {
+		atomic.AddInt64(&groupCommits, 1)
+		atomic.AddInt64(&groupCommitWrites, int64(len(batch)))
+		for i, item := range batch {
+			item.req.(bdbSetReq).resp <- bdbSetResp{errs[i]}
+		}
+	} else {
+		atomic.AddInt64(&groupCommitFallbacks, 1)
+		for _, item := range batch {
+			w.dispatch(item.req)
+		}
+	}
+	atomic.AddInt64(&w.busy, int64(time.Since(start)))
+	for _, item := range batch {
+		item.conn.clearWorker(int32(w.id))
+	}
+	return next
+}
+
+// txnBatch 在一个事务中执行所有写请求，每个请求使用一个子事务，
+// 一个请求失败(比如SETNX的key已经存在)时只回滚它自己的子事务，不影响其他请求。
+// 死锁等错误需要回滚整个事务，返回false，由调用者逐个重新执行
+func (w *Worker) txnBatch(batch []workItem) ([]error, bool) {
+	txn, err := w.dbenv.Begin(bdb.DB_READ_COMMITTED)
+	if err != nil {
+		log.Error("txnBatch|Begin|%s", err.Error())
+		return nil, false
+	}
+	errs := make([]error, len(batch))
+	for i, item := range batch {
+		req := item.req.(bdbSetReq)
+		// SplitKey会修改key，回滚后逐个重新执行时还要使用原来的key
+		req.key = append([]byte(nil), req.key...)
+		child, err := w.dbenv.BeginChild(txn, 0)
+		if err != nil {
+			log.Error("txnBatch|BeginChild|%s", err.Error())
+			txn.Abort()
+			return nil, false
+		}
+		if req.sec == 0 {
+			err = w.txnSet(child, &req)
+		} else {
+			err = w.txnSetEx(child, &req)
+		}
+		if err != nil {
+			child.Abort()
+		} else {
+			err = child.Commit()
+		}
+		switch err {
+		case bdb.ErrDeadLock, bdb.ErrRepDead, bdb.ErrLockout:
+			log.Error("txnBatch|child|%s", err.Error())
+			txn.Abort()
+			return nil, false
+		}
+		errs[i] = err
+	}
+	// 提交失败时所有子事务的写入都没有生效
+	if err = txn.Commit(); err != nil {
+		log.Error("txnBatch|Commit|%s", err.Error())
+		for i := range errs {
+			if errs[i] == nil {
+				errs[i] = err
+			}
+		}
+	}
+	return errs, true
+}
+
+func initGroupCommitConfig() {
+	RegisterConfig("group-commit", "server", "group_commit", false,
+		func() string { return strconv.FormatBool(GroupCommit) }, nil)
+	RegisterConfig("group-commit-window", "server", "group_commit_window", false,
+		func() string { return strconv.FormatInt(atomic.LoadInt64(&GroupCommitWindow), 10) },
+		intSetter(&GroupCommitWindow, 0, 1000000))
+	RegisterConfig("group-commit-max", "server", "group_commit_max", false,
+		func() string { return strconv.FormatInt(atomic.LoadInt64(&GroupCommitMax), 10) },
+		intSetter(&GroupCommitMax, 1, 10000))
+}
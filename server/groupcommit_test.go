@@ -0,0 +1,31 @@
+package server
+
+import (
+	"github.com/nybuxtsui/bdbd/bdb"
+	"testing"
+)
+
+// 合并提交时SETNX的key已经存在只让它自己失败，同一批的其他写入正常提交
+func TestTxnBatchSetNx(t *testing.T) {
+	w := testWorker(t, 1009)
+	if err := w.testSet("t050:a", "old"); err != nil {
+		t.Fatal(err)
+	}
+	batch := []workItem{
+		{req: bdbSetReq{key: []byte("t050:b"), value: []byte("1")}},
+		{req: bdbSetReq{key: []byte("t050:a"), value: []byte("new"), nooverwrite: true}},
+		{req: bdbSetReq{key: []byte("t050:c"), value: []byte("2"), sec: 60}},
+	}
+	errs, ok := w.txnBatch(batch)
+	if !ok {
+		t.Fatal("txnBatch fell back")
+	}
+	if errs[0] != nil || errs[1] != bdb.ErrKeyExist || errs[2] != nil {
+		t.Fatalf("errs = %v", errs)
+	}
+	for key, want := range map[string]string{"t050:a": "old", "t050:b": "1", "t050:c": "2"} {
+		if v, err := w.testGet(key); err != nil || string(v) != want {
+			t.Fatalf("%s = %q, %v, want %q", key, v, err, want)
+		}
+	}
+}
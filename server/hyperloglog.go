@@ -0,0 +1,621 @@
+package server
+
+import (
+	"encoding/binary"
+	"errors"
+	"github.com/nybuxtsui/bdbd/bdb"
+	"github.com/nybuxtsui/log"
+	"math"
+)
+
+// HyperLogLog的存储格式与redis完全相同(hyperloglog.c)，
+// 16字节的头部之后是dense或者sparse编码的寄存器
+const (
+	hllP          = 14
+	hllQ          = 64 - hllP
+	hllRegisters  = 1 << hllP
+	hllBits       = 6
+	hllRegMax     = 1<<hllBits - 1
+	hllHdrSize    = 16
+	hllDenseSize  = hllHdrSize + (hllRegisters*hllBits+7)/8
+	hllDense      = 0
+	hllSparse     = 1
+	hllAlphaInf   = 0.721347520444481703680
+	hllHashSeed   = 0xadc83b19
+	hllSparseMax  = 3000 // 对应redis的hll-sparse-max-bytes
+	hllSparseVMax = 32
+
+	hllOpZero    = 0x00
+	hllOpXZero   = 0x40
+	hllOpVal     = 0x80
+	hllZeroMax   = 64
+	hllXZeroMax  = 16384
+	hllValRunMax = 4
+)
+
+var (
+	ErrHllWrongType = errors.New("Key is not a valid HyperLogLog string value.")
+)
+
+type hll struct {
+	regs  [hllRegisters]uint8
+	dense bool
+}
+
+type bdbPfAddReq struct {
+	key      []byte
+	elements [][]byte
+	resp     chan bdbIntResp
+}
+
+type bdbPfCountReq struct {
+	keys [][]byte
+	resp chan bdbIntResp
+}
+
+type bdbPfMergeReq struct {
+	dest []byte
+	keys [][]byte
+	resp chan bdbIntResp
+}
+
+func murmurHash64A(key []byte, seed uint64) uint64 {
+	const m = 0xc6a4a7935bd1e995
+	const r = 47
+	h := seed ^ (uint64(len(key)) * m)
+
+	n := len(key) / 8
+	for i := 0; i < n; i++ {
+		k := binary.LittleEndian.Uint64(key[i*8:])
+		k *= m
+		k ^= k >> r
+		k *= m
+		h ^= k
+		h *= m
+	}
+
+	tail := key[n*8:]
+	switch len(tail) {
+	case 7:
+		h ^= uint64(tail[6]) << 48
+		fallthrough
+	case 6:
+		h ^= uint64(tail[5]) << 40
+		fallthrough
+	case 5:
+		h ^= uint64(tail[4]) << 32
+		fallthrough
+	case 4:
+		h ^= uint64(tail[3]) << 24
+		fallthrough
+	case 3:
+		h ^= uint64(tail[2]) << 16
+		fallthrough
+	case 2:
+		h ^= uint64(tail[1]) << 8
+		fallthrough
+	case 1:
+		h ^= uint64(tail[0])
+		h *= m
+	}
+
+	h ^= h >> r
+	h *= m
+	h ^= h >> r
+	return h
+}
+
+// hllPatLen 返回元素对应的寄存器下标，以及哈希值中第一个1出现的位置
+func hllPatLen(element []byte) (int, uint8) {
+	hash := murmurHash64A(element, hllHashSeed)
+	index := int(hash & (hllRegisters - 1))
+	hash >>= hllP
+	hash |= uint64(1) << hllQ
+	var bit uint64 = 1
+	var count uint8 = 1
+	for hash&bit == 0 {
+		count++
+		bit <<= 1
+	}
+	return index, count
+}
+
+func isHll(value []byte) bool {
+	return len(value) >= hllHdrSize && string(value[:4]) == "HYLL"
+}
+
+// decodeHll 解析redis格式的HyperLogLog，格式不正确时返回ErrHllWrongType
+func decodeHll(value []byte) (*hll, error) {
+	if !isHll(value) {
+		return nil, ErrHllWrongType
+	}
+	h := new(hll)
+	switch value[4] {
+	case hllDense:
+		if len(value) != hllDenseSize {
+			return nil, ErrHllWrongType
+		}
+		h.dense = true
+		regs := value[hllHdrSize:]
+		for i := 0; i < hllRegisters; i++ {
+			pos := i * hllBits
+			b := uint(regs[pos/8]) >> uint(pos&7)
+			if pos/8+1 < len(regs) {
+				b |= uint(regs[pos/8+1]) << (8 - uint(pos&7))
+			}
+			h.regs[i] = uint8(b & hllRegMax)
+		}
+	case hllSparse:
+		idx := 0
+		p := value[hllHdrSize:]
+		for i := 0; i < len(p); i++ {
+			op := p[i]
+			var runlen int
+			var val uint8 = 0
+			switch op & 0xc0 {
+			case hllOpZero:
+				runlen = int(op&0x3f) + 1
+			case hllOpXZero:
+				if i+1 >= len(p) {
+					return nil, ErrHllWrongType
+				}
+				runlen = (int(op&0x3f)<<8 | int(p[i+1])) + 1
+				i++
+			default:
+				val = (op>>2)&0x1f + 1
+				runlen = int(op&0x3) + 1
+			}
+			if idx+runlen > hllRegisters {
+				return nil, ErrHllWrongType
+			}
+			for j := 0; j < runlen; j++ {
+				h.regs[idx+j] = val
+			}
+			idx += runlen
+		}
+		if idx != hllRegisters {
+			return nil, ErrHllWrongType
+		}
+	default:
+		return nil, ErrHllWrongType
+	}
+	return h, nil
+}
+
+// encodeSparse 按sparse格式编码，寄存器的值超过32或者长度超过hllSparseMax时返回nil
+func (h *hll) encodeSparse() []byte {
+	out := make([]byte, hllHdrSize, 64)
+	for i := 0; i < hllRegisters; {
+		val := h.regs[i]
+		if val > hllSparseVMax {
+			return nil
+		}
+		run := 1
+		for i+run < hllRegisters && h.regs[i+run] == val {
+			run++
+		}
+		i += run
+		for run > 0 {
+			var n int
+			if val == 0 {
+				if run > hllZeroMax {
+					n = run
+					if n > hllXZeroMax {
+						n = hllXZeroMax
+					}
+					out = append(out, hllOpXZero|byte((n-1)>>8), byte(n-1))
+				} else {
+					n = run
+					out = append(out, hllOpZero|byte(n-1))
+				}
+			} else {
+				n = run
+				if n > hllValRunMax {
+					n = hllValRunMax
+				}
+				out = append(out, hllOpVal|(val-1)<<2|byte(n-1))
+			}
+			run -= n
+		}
+		if len(out) > hllSparseMax {
+			return nil
+		}
+	}
+	return out
+}
+
+func (h *hll) encodeDense() []byte {
+	out := make([]byte, hllDenseSize)
+	regs := out[hllHdrSize:]
+	for i := 0; i < hllRegisters; i++ {
+		pos := i * hllBits
+		fb := uint(pos & 7)
+		v := uint(h.regs[i])
+		regs[pos/8] |= byte(v << fb)
+		if pos/8+1 < len(regs) {
+			regs[pos/8+1] |= byte(v >> (8 - fb))
+		}
+	}
+	return out
+}
+
+// encode 生成完整的记录，sparse放不下时自动转为dense，dense不会再转回sparse。
+// card小于0表示缓存的基数无效
+func (h *hll) encode(card int64) []byte {
+	var out []byte
+	if !h.dense {
+		out = h.encodeSparse()
+		if out == nil {
+			h.dense = true
+		}
+	}
+	if h.dense {
+		out = h.encodeDense()
+		out[4] = hllDense
+	} else {
+		out[4] = hllSparse
+	}
+	copy(out, "HYLL")
+	setHllCard(out, card)
+	return out
+}
+
+func setHllCard(value []byte, card int64) {
+	if card < 0 {
+		value[15] |= 1 << 7
+	} else {
+		binary.LittleEndian.PutUint64(value[8:16], uint64(card))
+	}
+}
+
+// hllCachedCard 返回头部缓存的基数，最高位为1表示缓存已失效
+func hllCachedCard(value []byte) (int64, bool) {
+	if value[15]&(1<<7) != 0 {
+		return 0, false
+	}
+	return int64(binary.LittleEndian.Uint64(value[8:16])), true
+}
+
+func (h *hll) add(element []byte) bool {
+	index, count := hllPatLen(element)
+	if count > h.regs[index] {
+		h.regs[index] = count
+		return true
+	}
+	return false
+}
+
+func (h *hll) merge(other *hll) {
+	for i, v := range other.regs {
+		if v > h.regs[i] {
+			h.regs[i] = v
+		}
+	}
+	if other.dense {
+		h.dense = true
+	}
+}
+
+func hllSigma(x float64) float64 {
+	if x == 1 {
+		return math.Inf(1)
+	}
+	var zPrime float64
+	y := 1.0
+	z := x
+	for {
+		x *= x
+		zPrime = z
+		z += x * y
+		y += y
+		if zPrime == z {
+			break
+		}
+	}
+	return z
+}
+
+func hllTau(x float64) float64 {
+	if x == 0 || x == 1 {
+		return 0
+	}
+	var zPrime float64
+	y := 1.0
+	z := 1 - x
+	for {
+		x = math.Sqrt(x)
+		zPrime = z
+		y *= 0.5
+		z -= math.Pow(1-x, 2) * y
+		if zPrime == z {
+			break
+		}
+	}
+	return z / 3
+}
+
+// count 使用Otmar Ertl的改进算法估算基数，与redis 5之后的实现一致
+func (h *hll) count() int64 {
+	var reghisto [64]int
+	for _, v := range h.regs {
+		reghisto[v]++
+	}
+	m := float64(hllRegisters)
+	z := m * hllTau((m-float64(reghisto[hllQ+1]))/m)
+	for j := hllQ; j >= 1; j-- {
+		z += float64(reghisto[j])
+		z *= 0.5
+	}
+	z += m * hllSigma(float64(reghisto[0])/m)
+	return int64(math.Round(hllAlphaInf * m * m / z))
+}
+
+func (w *Worker) bdbPfAdd(req *bdbPfAddReq) {
+	key := append([]byte(nil), req.key...)
+	table, name := bdb.SplitKey(req.key)
+	db, err := w.getdb(table, bdb.DBTYPE_BTREE)
+	if err != nil {
+		req.resp <- bdbIntResp{0, err}
+		return
+	}
+	txn, err := w.dbenv.Begin(bdb.DB_READ_COMMITTED)
+	if err != nil {
+		req.resp <- bdbIntResp{0, err}
+		return
+	}
+	defer func() {
+		if txn != nil {
+			txn.Abort()
+		}
+	}()
+
+	value, err := db.Get(txn, name, &w.getbuff, bdb.DB_RMW)
+	var h *hll
+	var updated bool
+	var card int64 = -1
+	if err == bdb.ErrNotFound {
+		h = new(hll)
+		updated = true
+		card = 0
+	} else if err != nil {
+		w.checkerr(err, db)
+		req.resp <- bdbIntResp{0, err}
+		return
+	} else {
+		h, err = decodeHll(value)
+		if err != nil {
+			req.resp <- bdbIntResp{0, err}
+			return
+		}
+	}
+	for _, element := range req.elements {
+		if h.add(element) {
+			updated = true
+			card = -1
+		}
+	}
+	if !updated {
+		req.resp <- bdbIntResp{0, nil}
+		return
+	}
+	err = db.Set(txn, name, h.encode(card), 0)
+	if err != nil {
+		w.checkerr(err, db)
+		req.resp <- bdbIntResp{0, err}
+		return
+	}
+	if _, err = w.bumpVersion(txn, key); err != nil {
+		req.resp <- bdbIntResp{0, err}
+		return
+	}
+	err = txn.Commit()
+	txn = nil
+	if err != nil {
+		req.resp <- bdbIntResp{0, err}
+		return
+	}
+	req.resp <- bdbIntResp{1, nil}
+}
+
+// bdbPfCount 单个key时优先使用头部缓存的基数，缓存失效时重新计算并只写回头部的8个字节
+func (w *Worker) bdbPfCount(req *bdbPfCountReq) {
+	if len(req.keys) > 1 {
+		merged := new(hll)
+		for _, key := range req.keys {
+			table, name := bdb.SplitKey(key)
+			db, err := w.getdb(table, bdb.DBTYPE_BTREE)
+			if err != nil {
+				req.resp <- bdbIntResp{0, err}
+				return
+			}
+			value, err := db.Get(nil, name, &w.getbuff, 0)
+			if err == bdb.ErrNotFound {
+				continue
+			} else if err != nil {
+				w.checkerr(err, db)
+				req.resp <- bdbIntResp{0, err}
+				return
+			}
+			h, err := decodeHll(value)
+			if err != nil {
+				req.resp <- bdbIntResp{0, err}
+				return
+			}
+			merged.merge(h)
+		}
+		req.resp <- bdbIntResp{merged.count(), nil}
+		return
+	}
+
+	table, name := bdb.SplitKey(req.keys[0])
+	db, err := w.getdb(table, bdb.DBTYPE_BTREE)
+	if err != nil {
+		req.resp <- bdbIntResp{0, err}
+		return
+	}
+	txn, err := w.dbenv.Begin(bdb.DB_READ_COMMITTED)
+	if err != nil {
+		req.resp <- bdbIntResp{0, err}
+		return
+	}
+	defer func() {
+		if txn != nil {
+			txn.Abort()
+		}
+	}()
+
+	value, err := db.Get(txn, name, &w.getbuff, bdb.DB_RMW)
+	if err == bdb.ErrNotFound {
+		req.resp <- bdbIntResp{0, nil}
+		return
+	} else if err != nil {
+		w.checkerr(err, db)
+		req.resp <- bdbIntResp{0, err}
+		return
+	}
+	h, err := decodeHll(value)
+	if err != nil {
+		req.resp <- bdbIntResp{0, err}
+		return
+	}
+	if card, ok := hllCachedCard(value); ok {
+		req.resp <- bdbIntResp{card, nil}
+		return
+	}
+	card := h.count()
+	var buf [8]byte
+	binary.LittleEndian.PutUint64(buf[:], uint64(card))
+	// 缓存写入失败(例如在slave上执行)不影响结果
+	if err = db.SetPartial(txn, name, 8, 8, buf[:], 0); err == nil {
+		if err = txn.Commit(); err != nil {
+			log.Error("bdbPfCount|Commit|%s", err.Error())
+		}
+		txn = nil
+	} else {
+		w.checkerr(err, db)
+	}
+	req.resp <- bdbIntResp{card, nil}
+}
+
+func (w *Worker) bdbPfMerge(req *bdbPfMergeReq) {
+	txn, err := w.dbenv.Begin(bdb.DB_READ_COMMITTED)
+	if err != nil {
+		req.resp <- bdbIntResp{0, err}
+		return
+	}
+	defer func() {
+		if txn != nil {
+			txn.Abort()
+		}
+	}()
+
+	dest := append([]byte(nil), req.dest...)
+	table, name := bdb.SplitKey(req.dest)
+	db, err := w.getdb(table, bdb.DBTYPE_BTREE)
+	if err != nil {
+		req.resp <- bdbIntResp{0, err}
+		return
+	}
+	merged := new(hll)
+	value, err := db.Get(txn, name, &w.getbuff, bdb.DB_RMW)
+	if err == nil {
+		merged, err = decodeHll(value)
+		if err != nil {
+			req.resp <- bdbIntResp{0, err}
+			return
+		}
+	} else if err != bdb.ErrNotFound {
+		w.checkerr(err, db)
+		req.resp <- bdbIntResp{0, err}
+		return
+	}
+
+	for _, key := range req.keys {
+		srctable, srcname := bdb.SplitKey(key)
+		srcdb, err := w.getdb(srctable, bdb.DBTYPE_BTREE)
+		if err != nil {
+			req.resp <- bdbIntResp{0, err}
+			return
+		}
+		value, err := srcdb.Get(txn, srcname, &w.getbuff, 0)
+		if err == bdb.ErrNotFound {
+			continue
+		} else if err != nil {
+			w.checkerr(err, srcdb)
+			req.resp <- bdbIntResp{0, err}
+			return
+		}
+		h, err := decodeHll(value)
+		if err != nil {
+			req.resp <- bdbIntResp{0, err}
+			return
+		}
+		merged.merge(h)
+	}
+
+	err = db.Set(txn, name, merged.encode(-1), 0)
+	if err != nil {
+		w.checkerr(err, db)
+		req.resp <- bdbIntResp{0, err}
+		return
+	}
+	if _, err = w.bumpVersion(txn, dest); err != nil {
+		req.resp <- bdbIntResp{0, err}
+		return
+	}
+	err = txn.Commit()
+	txn = nil
+	if err != nil {
+		req.resp <- bdbIntResp{0, err}
+		return
+	}
+	req.resp <- bdbIntResp{0, nil}
+}
+
+func (conn *Conn) writeHllError(err error) error {
+	if err == ErrHllWrongType {
+		_, err = conn.wb.WriteString("-WRONGTYPE Key is not a valid HyperLogLog string value.\r\n")
+		return err
+	}
+	return conn.writeError(err)
+}
+
+func cmdPfAdd(conn *Conn, args [][]byte) (err error) {
+	log.Debug("cmdPfAdd|%s", args[0])
+	respChan := make(chan bdbIntResp, 1)
+	if ok, err := conn.sendOrBusy(bdbPfAddReq{args[0], args[1:], respChan}); !ok {
+		return err
+	}
+	resp := <-respChan
+	if resp.err != nil {
+		return conn.writeHllError(resp.err)
+	}
+	return conn.writeInt(resp.result)
+}
+
+func cmdPfCount(conn *Conn, args [][]byte) (err error) {
+	log.Debug("cmdPfCount|%s", args[0])
+	respChan := make(chan bdbIntResp, 1)
+	if ok, err := conn.sendOrBusy(bdbPfCountReq{args, respChan}); !ok {
+		return err
+	}
+	resp := <-respChan
+	if resp.err != nil {
+		return conn.writeHllError(resp.err)
+	}
+	return conn.writeInt(resp.result)
+}
+
+func cmdPfMerge(conn *Conn, args [][]byte) (err error) {
+	log.Debug("cmdPfMerge|%s", args[0])
+	respChan := make(chan bdbIntResp, 1)
+	if ok, err := conn.sendOrBusy(bdbPfMergeReq{args[0], args[1:], respChan}); !ok {
+		return err
+	}
+	resp := <-respChan
+	if resp.err != nil {
+		return conn.writeHllError(resp.err)
+	}
+	_, err = conn.wb.WriteString("+OK\r\n")
+	return
+}
@@ -0,0 +1,330 @@
+package server
+
+import (
+	"bytes"
+	"errors"
+	"github.com/nybuxtsui/bdbd/bdb"
+	"github.com/nybuxtsui/log"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// 二级索引的定义和维护在bdb/index.c中，这里只负责命令解析和查询
+//
+//	IDX.CREATE table index JSON|MSGPACK path [STRING|NUMBER]
+//	IDX.DROP table index
+//	IDX.LIST table
+//	IDX.GET table index value [LIMIT count]
+//	IDX.RANGE table index min max [LIMIT count]
+//
+// path为点分隔的字段路径，数组元素用下标表示，如user.tags.0
+// min/max包含边界，"-"和"+"表示不限
+const defaultTable = "__default"
+
+var (
+	ErrIndexExist    = errors.New("index already exists")
+	ErrIndexNotExist = errors.New("no such index")
+	ErrIndexFormat   = errors.New("index format must be JSON or MSGPACK")
+	ErrIndexType     = errors.New("index type must be STRING or NUMBER")
+	ErrIndexName     = errors.New("invalid table or index name")
+	ErrIndexBound    = errors.New("min or max is not a float")
+	ErrIndexLimit    = errors.New("LIMIT must be > 0")
+)
+
+type bdbIndexCreateReq struct {
+	table  string
+	name   string
+	format int
+	typ    int
+	path   string
+	resp   chan bdbSetResp
+}
+
+type bdbIndexDropReq struct {
+	table string
+	name  string
+	resp  chan bdbIntResp
+}
+
+type bdbIndexListReq struct {
+	table string
+	resp  chan bdbIndexListResp
+}
+
+type bdbIndexListResp struct {
+	indexes []bdb.IndexInfo
+	err     error
+}
+
+type bdbIndexRangeReq struct {
+	table string
+	name  string
+	min   []byte
+	max   []byte
+	exact bool
+	limit int
+	resp  chan bdbIndexRangeResp
+}
+
+type bdbIndexRangeResp struct {
+	keys [][]byte // 主表中的记录名，不包含表名
+	err  error
+}
+
+func (w *Worker) bdbIndexCreate(req *bdbIndexCreateReq) {
+	err := w.dbenv.CreateIndex(req.table, req.name, req.format, req.typ, req.path)
+	if err == bdb.ErrKeyExist {
+		err = ErrIndexExist
+	}
+	req.resp <- bdbSetResp{err}
+}
+
+// indexPurgeTimeout 删除索引后等待所有句柄关闭的最长时间，过期线程每秒关闭一次已删除的索引
+const indexPurgeTimeout = 5 * time.Second
+
+// purgeIndex 删除已经删除的索引留下的文件，还有句柄没有关闭时重试到indexPurgeTimeout
+func purgeIndex(dbenv *bdb.DbEnv) error {
+	deadline := time.Now().Add(indexPurgeTimeout)
+	for {
+		err := dbenv.PurgeIndex()
+		if err != bdb.ErrNotGranted || time.Now().After(deadline) {
+			return err
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+func (w *Worker) bdbIndexDrop(req *bdbIndexDropReq) {
+	err := w.dbenv.DropIndex(req.table, req.name)
+	if err == bdb.ErrNotFound {
+		req.resp <- bdbIntResp{0, nil}
+	} else if err != nil {
+		req.resp <- bdbIntResp{0, err}
+	} else {
+		req.resp <- bdbIntResp{1, nil}
+	}
+}
+
+func (w *Worker) bdbIndexList(req *bdbIndexListReq) {
+	indexes, err := w.dbenv.ListIndex(req.table)
+	req.resp <- bdbIndexListResp{indexes, err}
+}
+
+// encodeIndexBound 把查询边界编码为索引中的格式，范围查询时"-"和"+"返回nil
+func encodeIndexBound(bound []byte, typ int, exact bool) ([]byte, error) {
+	if !exact && len(bound) == 1 && (bound[0] == '-' || bound[0] == '+') {
+		return nil, nil
+	}
+	if typ != bdb.INDEX_NUMBER {
+		return bound, nil
+	}
+	v, err := strconv.ParseFloat(string(bound), 64)
+	if err != nil {
+		return nil, ErrIndexBound
+	}
+	return bdb.EncodeIndexNumber(v), nil
+}
+
+func (w *Worker) bdbIndexRange(req *bdbIndexRangeReq) {
+	db, err := w.getdb(req.table, bdb.DBTYPE_BTREE)
+	if err != nil {
+		req.resp <- bdbIndexRangeResp{nil, err}
+		return
+	}
+	// IndexCursor会按__index.db中的版本重新挂载索引
+	cur, typ, err := db.IndexCursor(nil, req.name, bdb.DB_READ_COMMITTED)
+	if err == bdb.ErrNotExist {
+		req.resp <- bdbIndexRangeResp{nil, ErrIndexNotExist}
+		return
+	} else if err != nil {
+		w.checkerr(err, db)
+		req.resp <- bdbIndexRangeResp{nil, err}
+		return
+	}
+	defer cur.Close()
+
+	min, err := encodeIndexBound(req.min, typ, req.exact)
+	if err != nil {
+		req.resp <- bdbIndexRangeResp{nil, err}
+		return
+	}
+	max, err := encodeIndexBound(req.max, typ, req.exact)
+	if err != nil {
+		req.resp <- bdbIndexRangeResp{nil, err}
+		return
+	}
+
+	keys := make([][]byte, 0, 16)
+	var skey, pkey []byte
+	if min == nil {
+		skey, pkey, err = cur.PGet(nil, bdb.DB_FIRST)
+	} else {
+		skey, pkey, err = cur.PGet(min, bdb.DB_SET_RANGE)
+	}
+	for err == nil {
+		if max != nil && bytes.Compare(skey, max) > 0 {
+			break
+		}
+		keys = append(keys, pkey)
+		if req.limit > 0 && len(keys) >= req.limit {
+			break
+		}
+		skey, pkey, err = cur.PGet(nil, bdb.DB_NEXT)
+	}
+	if err != nil && err != bdb.ErrNotFound {
+		w.checkerr(err, db)
+		req.resp <- bdbIndexRangeResp{nil, err}
+		return
+	}
+	req.resp <- bdbIndexRangeResp{keys, nil}
+}
+
+func checkIndexName(args ...[]byte) bool {
+	for _, arg := range args {
+		if len(arg) == 0 || bytes.IndexByte(arg, 0) >= 0 || bytes.IndexByte(arg, ':') >= 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func cmdIndexCreate(conn *Conn, args [][]byte) (err error) {
+	log.Debug("cmdIndexCreate|%s|%s|%s|%s", args[0], args[1], args[2], args[3])
+	if !checkIndexName(args[0], args[1]) || strings.HasPrefix(string(args[0]), "__") && string(args[0]) != defaultTable {
+		return conn.writeError(ErrIndexName)
+	}
+	req := bdbIndexCreateReq{table: indexTable(string(args[0]), conn.db), name: string(args[1]), path: string(args[3]), typ: bdb.INDEX_STRING}
+	switch strings.ToLower(string(args[2])) {
+	case "json":
+		req.format = bdb.INDEX_JSON
+	case "msgpack":
+		req.format = bdb.INDEX_MSGPACK
+	default:
+		return conn.writeError(ErrIndexFormat)
+	}
+	if len(args) == 5 {
+		switch strings.ToLower(string(args[4])) {
+		case "string":
+			req.typ = bdb.INDEX_STRING
+		case "number":
+			req.typ = bdb.INDEX_NUMBER
+		default:
+			return conn.writeError(ErrIndexType)
+		}
+	}
+	respChan := make(chan bdbSetResp, 1)
+	req.resp = respChan
+	if ok, err := conn.sendOrBusy(req); !ok {
+		return err
+	}
+	resp := <-respChan
+	if resp.err != nil {
+		return conn.writeError(resp.err)
+	}
+	_, err = conn.wb.WriteString("+OK\r\n")
+	return
+}
+
+func cmdIndexDrop(conn *Conn, args [][]byte) (err error) {
+	log.Debug("cmdIndexDrop|%s|%s", args[0], args[1])
+	if !checkIndexName(args[0], args[1]) {
+		return conn.writeError(ErrIndexName)
+	}
+	table := indexTable(string(args[0]), conn.db)
+	respChan := make(chan bdbIntResp, 1)
+	if ok, err := conn.sendOrBusy(bdbIndexDropReq{table, string(args[1]), respChan}); !ok {
+		return err
+	}
+	resp := <-respChan
+	if resp.err != nil {
+		return conn.writeError(resp.err)
+	}
+	// 所有worker关闭表之后索引文件才能删除，上次没有删除的文件也在这里删除
+	closeTable(table)
+	if err := purgeIndex(conn.dbenv); err != nil {
+		log.Error("cmdIndexDrop|purgeIndex|%s", err.Error())
+		return conn.writeError(err)
+	}
+	return conn.writeInt(resp.result)
+}
+
+func cmdIndexList(conn *Conn, args [][]byte) (err error) {
+	log.Debug("cmdIndexList|%s", args[0])
+	if !checkIndexName(args[0]) {
+		return conn.writeError(ErrIndexName)
+	}
+	respChan := make(chan bdbIndexListResp, 1)
+	if ok, err := conn.sendOrBusy(bdbIndexListReq{indexTable(string(args[0]), conn.db), respChan}); !ok {
+		return err
+	}
+	resp := <-respChan
+	if resp.err != nil {
+		return conn.writeError(resp.err)
+	}
+	conn.writeLen('*', len(resp.indexes))
+	for _, index := range resp.indexes {
+		format, typ := "json", "string"
+		if index.Format == bdb.INDEX_MSGPACK {
+			format = "msgpack"
+		}
+		if index.Type == bdb.INDEX_NUMBER {
+			typ = "number"
+		}
+		conn.writeLen('*', 4)
+		conn.writeBulk([]byte(index.Name))
+		conn.writeBulk([]byte(format))
+		conn.writeBulk([]byte(index.Path))
+		err = conn.writeBulk([]byte(typ))
+	}
+	return
+}
+
+func indexRange(conn *Conn, table []byte, name []byte, min []byte, max []byte, exact bool, opts [][]byte) (err error) {
+	if !checkIndexName(table, name) {
+		return conn.writeError(ErrIndexName)
+	}
+	req := bdbIndexRangeReq{table: indexTable(string(table), conn.db), name: string(name), min: min, max: max, exact: exact}
+	if len(opts) != 0 {
+		if len(opts) != 2 || strings.ToLower(string(opts[0])) != "limit" {
+			return conn.writeError(ErrSyntax)
+		}
+		limit, err := strconv.ParseInt(string(opts[1]), 10, 32)
+		if err != nil {
+			return conn.writeError(ErrNotInteger)
+		}
+		if limit <= 0 {
+			return conn.writeError(ErrIndexLimit)
+		}
+		req.limit = int(limit)
+	}
+	respChan := make(chan bdbIndexRangeResp, 1)
+	req.resp = respChan
+	if ok, err := conn.sendOrBusy(req); !ok {
+		return err
+	}
+	resp := <-respChan
+	if resp.err != nil {
+		return conn.writeError(resp.err)
+	}
+	// 回复中的key和客户端写入时使用的key相同
+	var prefix []byte
+	if string(table) != defaultTable {
+		prefix = append(append([]byte(nil), table...), ':')
+	}
+	err = conn.writeLen('*', len(resp.keys))
+	for _, key := range resp.keys {
+		err = conn.writeBulk(append(prefix[:len(prefix):len(prefix)], key...))
+	}
+	return
+}
+
+func cmdIndexGet(conn *Conn, args [][]byte) (err error) {
+	log.Debug("cmdIndexGet|%s|%s|%s", args[0], args[1], args[2])
+	return indexRange(conn, args[0], args[1], args[2], args[2], true, args[3:])
+}
+
+func cmdIndexRange(conn *Conn, args [][]byte) (err error) {
+	log.Debug("cmdIndexRange|%s|%s|%s|%s", args[0], args[1], args[2], args[3])
+	return indexRange(conn, args[0], args[1], args[2], args[3], false, args[4:])
+}
@@ -0,0 +1,85 @@
+package server
+
+import (
+	"github.com/nybuxtsui/bdbd/bdb"
+	"path/filepath"
+	"testing"
+)
+
+func (w *Worker) testIndexGet(table string, name string, value string) ([][]byte, error) {
+	resp := make(chan bdbIndexRangeResp, 1)
+	w.dispatch(bdbIndexRangeReq{table: table, name: name, min: []byte(value), max: []byte(value), exact: true, resp: resp})
+	r := <-resp
+	return r.keys, r.err
+}
+
+// 创建索引时已有的记录加入索引，一个worker创建索引后，另一个已经打开了表的worker写入时也要更新索引，
+// 删除索引后所有worker都关闭了句柄，索引文件被删除
+func TestIndexCreateWriteDrop(t *testing.T) {
+	w1, w2 := testWorker(t, 1001), testWorker(t, 1002)
+	if err := w2.testSet("t031:a", `{"n":"x"}`); err != nil {
+		t.Fatal(err)
+	}
+
+	resp := make(chan bdbSetResp, 1)
+	w1.dispatch(bdbIndexCreateReq{table: "t031", name: "n", format: bdb.INDEX_JSON, typ: bdb.INDEX_STRING, path: "n", resp: resp})
+	if err := (<-resp).err; err != nil {
+		t.Fatal(err)
+	}
+	// 创建索引时已有的记录也要加入索引
+	for _, w := range []*Worker{w1, w2} {
+		keys, err := w.testIndexGet("t031", "n", "x")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(keys) != 1 || string(keys[0]) != "a" {
+			t.Fatalf("worker %d: keys = %q, want [a]", w.id, keys)
+		}
+	}
+	if err := w2.testSet("t031:b", `{"n":"y"}`); err != nil {
+		t.Fatal(err)
+	}
+	for _, w := range []*Worker{w1, w2} {
+		keys, err := w.testIndexGet("t031", "n", "y")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(keys) != 1 || string(keys[0]) != "b" {
+			t.Fatalf("worker %d: keys = %q, want [b]", w.id, keys)
+		}
+	}
+	files, _ := filepath.Glob(filepath.Join(testEnv.Home(), "t031.idx.n.*"))
+	if len(files) != 1 {
+		t.Fatalf("index files = %v", files)
+	}
+
+	dropResp := make(chan bdbIntResp, 1)
+	w1.dispatch(bdbIndexDropReq{"t031", "n", dropResp})
+	if r := <-dropResp; r.err != nil || r.result != 1 {
+		t.Fatalf("drop = %d, %v", r.result, r.err)
+	}
+	// worker关闭句柄之前文件不能删除
+	if err := testEnv.PurgeIndex(); err != bdb.ErrNotGranted {
+		t.Fatalf("PurgeIndex = %v, want %v", err, bdb.ErrNotGranted)
+	}
+	for _, w := range []*Worker{w1, w2} {
+		done := make(chan struct{}, 1)
+		w.dispatch(bdbCloseTableReq{"t031", done})
+		<-done
+	}
+	closeTable("t031")
+	if err := purgeIndex(testEnv); err != nil {
+		t.Fatal(err)
+	}
+	if files, _ = filepath.Glob(filepath.Join(testEnv.Home(), "t031.idx.n.*")); len(files) != 0 {
+		t.Fatalf("index files not removed: %v", files)
+	}
+
+	// 删除后写入不再使用索引
+	if err := w2.testSet("t031:c", `{"n":"y"}`); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w2.testIndexGet("t031", "n", "y"); err != ErrIndexNotExist {
+		t.Fatalf("err = %v, want %v", err, ErrIndexNotExist)
+	}
+}
@@ -0,0 +1,268 @@
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/nybuxtsui/bdbd/bdb"
+	"github.com/nybuxtsui/log"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// startTime 进程启动时间，用于计算uptime
+var startTime = time.Now()
+
+var (
+	totalConnections int64
+	totalCommands    int64
+)
+
+// cmdStat 每个命令的调用次数和耗时，INFO commandstats和/metrics使用
+type cmdStat struct {
+	calls   int64
+	usec    int64
+	buckets []int64 // 按latencyBuckets分段的次数，不累加
+}
+
+// cmdStats 在init中根据cmdMap生成，之后只读，不需要加锁
+var cmdStats map[string]*cmdStat
+
+func init() {
+	cmdStats = make(map[string]*cmdStat, len(cmdMap))
+	for name := range cmdMap {
+		cmdStats[name] = &cmdStat{buckets: make([]int64, len(latencyBuckets))}
+	}
+}
+
+func recordCommand(cmd string, d time.Duration) {
+	atomic.AddInt64(&totalCommands, 1)
+	if stat := cmdStats[cmd]; stat != nil {
+		atomic.AddInt64(&stat.calls, 1)
+		atomic.AddInt64(&stat.usec, int64(d/time.Microsecond))
+		if i := sort.SearchFloat64s(latencyBuckets, d.Seconds()); i < len(latencyBuckets) {
+			atomic.AddInt64(&stat.buckets[i], 1)
+		}
+	}
+}
+
+// infoSections 不带参数时输出的部分
+// keyspace需要遍历所有的表，只在明确指定或者all/everything时输出
+var infoSections = []string{"server", "clients", "memory", "persistence", "replication", "stats"}
+
+var allSections = []string{"server", "clients", "memory", "persistence", "replication", "stats", "commandstats", "keyspace"}
+
+func humanBytes(n uint64) string {
+	switch {
+	case n >= 1<<30:
+		return fmt.Sprintf("%.2fG", float64(n)/(1<<30))
+	case n >= 1<<20:
+		return fmt.Sprintf("%.2fM", float64(n)/(1<<20))
+	case n >= 1<<10:
+		return fmt.Sprintf("%.2fK", float64(n)/(1<<10))
+	}
+	return fmt.Sprintf("%dB", n)
+}
+
+// writeStat 输出bdb统计信息中属于section的部分
+func writeStat(buf *bytes.Buffer, stats []bdb.StatItem, section string) {
+	for _, item := range stats {
+		if item.Section == section {
+			fmt.Fprintf(buf, "%s:%d\r\n", item.Name, item.Value)
+		}
+	}
+}
+
+func infoServer(conn *Conn, buf *bytes.Buffer) {
+	uptime := int64(time.Since(startTime) / time.Second)
+	fmt.Fprintf(buf, "bdbd_version:%s\r\n", Version)
+	fmt.Fprintf(buf, "redis_mode:standalone\r\n")
+	fmt.Fprintf(buf, "os:%s %s\r\n", runtime.GOOS, runtime.GOARCH)
+	fmt.Fprintf(buf, "go_version:%s\r\n", runtime.Version())
+	fmt.Fprintf(buf, "process_id:%d\r\n", os.Getpid())
+	fmt.Fprintf(buf, "uptime_in_seconds:%d\r\n", uptime)
+	fmt.Fprintf(buf, "uptime_in_days:%d\r\n", uptime/86400)
+	fmt.Fprintf(buf, "workers:%d\r\n", workerCount())
+	fmt.Fprintf(buf, "databases:%d\r\n", Databases)
+	fmt.Fprintf(buf, "home_dir:%s\r\n", conn.dbenv.Home())
+}
+
+func infoClients(conn *Conn, buf *bytes.Buffer) {
+	conns.Lock()
+	n := len(conns.m)
+	conns.Unlock()
+	fmt.Fprintf(buf, "connected_clients:%d\r\n", n)
+	fmt.Fprintf(buf, "maxclients:%d\r\n", atomic.LoadInt64(&MaxClients))
+}
+
+func infoMemory(conn *Conn, buf *bytes.Buffer, stats []bdb.StatItem) {
+	var m runtime.MemStats
+	runtime.ReadMemStats(&m)
+	fmt.Fprintf(buf, "used_memory:%d\r\n", m.HeapAlloc)
+	fmt.Fprintf(buf, "used_memory_human:%s\r\n", humanBytes(m.HeapAlloc))
+	fmt.Fprintf(buf, "go_sys:%d\r\n", m.Sys)
+	fmt.Fprintf(buf, "go_heap_objects:%d\r\n", m.HeapObjects)
+	fmt.Fprintf(buf, "go_gc_count:%d\r\n", m.NumGC)
+	fmt.Fprintf(buf, "go_goroutines:%d\r\n", runtime.NumGoroutine())
+	writeStat(buf, stats, "memory")
+}
+
+func infoReplication(conn *Conn, buf *bytes.Buffer, stats []bdb.StatItem) {
+	if conn.dbenv.IsMaster() {
+		fmt.Fprintf(buf, "role:master\r\n")
+	} else {
+		fmt.Fprintf(buf, "role:slave\r\n")
+	}
+	writeStat(buf, stats, "replication")
+}
+
+func infoStats(conn *Conn, buf *bytes.Buffer, stats []bdb.StatItem) {
+	fmt.Fprintf(buf, "total_connections_received:%d\r\n", atomic.LoadInt64(&totalConnections))
+	fmt.Fprintf(buf, "total_commands_processed:%d\r\n", atomic.LoadInt64(&totalCommands))
+	fmt.Fprintf(buf, "rejected_connections:%d\r\n", atomic.LoadInt64(&rejectedConnections))
+	fmt.Fprintf(buf, "client_query_buffer_limit_disconnections:%d\r\n", atomic.LoadInt64(&queryLimitClients))
+	fmt.Fprintf(buf, "client_output_buffer_limit_disconnections:%d\r\n", atomic.LoadInt64(&outputLimitClients))
+	fmt.Fprintf(buf, "client_idle_timeout_disconnections:%d\r\n", atomic.LoadInt64(&idleTimeoutClients))
+	fmt.Fprintf(buf, "work_queue_length:%d\r\n", queueLength())
+	fmt.Fprintf(buf, "work_queue_capacity:%d\r\n", cap(workChan))
+	fmt.Fprintf(buf, "work_queue_rejected:%d\r\n", atomic.LoadInt64(&queueFull))
+	fmt.Fprintf(buf, "work_routed_by_key:%d\r\n", atomic.LoadInt64(&routedKey))
+	fmt.Fprintf(buf, "work_routed_shared:%d\r\n", atomic.LoadInt64(&routedShared))
+	fmt.Fprintf(buf, "work_routed_multi:%d\r\n", atomic.LoadInt64(&routedMulti))
+	fmt.Fprintf(buf, "group_commits:%d\r\n", atomic.LoadInt64(&groupCommits))
+	fmt.Fprintf(buf, "group_commit_writes:%d\r\n", atomic.LoadInt64(&groupCommitWrites))
+	fmt.Fprintf(buf, "group_commit_fallbacks:%d\r\n", atomic.LoadInt64(&groupCommitFallbacks))
+	fmt.Fprintf(buf, "monitor_clients:%d\r\n", atomic.LoadInt32(&monitorCount))
+	fmt.Fprintf(buf, "monitor_dropped_lines:%d\r\n", atomic.LoadInt64(&monitorDropped))
+	writeStat(buf, stats, "stats")
+}
+
+func infoCommandStats(conn *Conn, buf *bytes.Buffer) {
+	names := make([]string, 0, len(cmdStats))
+	for name := range cmdStats {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		calls := atomic.LoadInt64(&cmdStats[name].calls)
+		if calls == 0 {
+			continue
+		}
+		usec := atomic.LoadInt64(&cmdStats[name].usec)
+		fmt.Fprintf(buf, "cmdstat_%s:calls=%d,usec=%d,usec_per_call=%.2f\r\n",
+			name, calls, usec, float64(usec)/float64(calls))
+	}
+}
+
+// infoKeyspace 统计每个库的记录数，0号库包括__default和所有用户表，
+// 其他库在__db<n>和__db<n>.<table>表中。内部表和二级索引文件不统计
+func infoKeyspace(conn *Conn, buf *bytes.Buffer) {
+	files, err := filepath.Glob(filepath.Join(conn.dbenv.Home(), "*.db"))
+	if err != nil {
+		log.Error("infoKeyspace|Glob|%s", err.Error())
+		return
+	}
+	keys := make(map[int]uint64)
+	for _, file := range files {
+		table := strings.TrimSuffix(filepath.Base(file), ".db")
+		if strings.Contains(table, ".idx.") {
+			continue
+		}
+		db := 0
+		if strings.HasPrefix(table, "__db") {
+			num := table[4:]
+			if i := strings.IndexByte(num, '.'); i >= 0 {
+				num = num[:i]
+			}
+			n, err := strconv.Atoi(num)
+			if err != nil {
+				continue
+			}
+			db = n
+		} else if strings.HasPrefix(table, "__") && table != defaultTable {
+			continue
+		}
+		count, err := conn.dbenv.Count(table)
+		if err != nil {
+			log.Error("infoKeyspace|Count|%s|%s", table, err.Error())
+			continue
+		}
+		keys[db] += count
+	}
+	dbs := make([]int, 0, len(keys))
+	for db := range keys {
+		dbs = append(dbs, db)
+	}
+	sort.Ints(dbs)
+	for _, db := range dbs {
+		if keys[db] != 0 {
+			fmt.Fprintf(buf, "db%d:keys=%d\r\n", db, keys[db])
+		}
+	}
+}
+
+func cmdInfo(conn *Conn, args [][]byte) (err error) {
+	log.Debug("cmdInfo|%d", len(args))
+	sections := infoSections
+	if len(args) > 0 {
+		sections = make([]string, 0, len(args))
+		for _, arg := range args {
+			section := strings.ToLower(string(arg))
+			switch section {
+			case "all", "everything":
+				sections = append(sections, allSections...)
+			case "default":
+				sections = append(sections, infoSections...)
+			default:
+				sections = append(sections, section)
+			}
+		}
+	}
+
+	var stats []bdb.StatItem
+	var buf bytes.Buffer
+	done := make(map[string]bool)
+	for _, section := range sections {
+		if section == "" || done[section] {
+			continue
+		}
+		done[section] = true
+		switch section {
+		case "memory", "persistence", "replication", "stats":
+			if stats == nil {
+				stats = conn.dbenv.Stat()
+			}
+		}
+		start := buf.Len()
+		if start != 0 {
+			buf.WriteString("\r\n")
+		}
+		buf.WriteString("# " + strings.ToUpper(section[:1]) + section[1:] + "\r\n")
+		switch section {
+		case "server":
+			infoServer(conn, &buf)
+		case "clients":
+			infoClients(conn, &buf)
+		case "memory":
+			infoMemory(conn, &buf, stats)
+		case "persistence":
+			writeStat(&buf, stats, "persistence")
+		case "replication":
+			infoReplication(conn, &buf, stats)
+		case "stats":
+			infoStats(conn, &buf, stats)
+		case "commandstats":
+			infoCommandStats(conn, &buf)
+		case "keyspace":
+			infoKeyspace(conn, &buf)
+		default:
+			buf.Truncate(start)
+		}
+	}
+	return conn.writeBulk([]byte(buf.String()))
+}
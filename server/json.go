@@ -0,0 +1,485 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/nybuxtsui/bdbd/bdb"
+	"github.com/nybuxtsui/log"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// JSON.* 命令在worker中完成读取、修改、写回，写操作使用DB_RMW在同一个事务内完成，
+// 并发修改同一个文档的不同字段不会丢失更新
+const (
+	jsonOpSet = iota
+	jsonOpGet
+	jsonOpDel
+	jsonOpNumIncrBy
+	jsonOpArrAppend
+)
+
+var (
+	ErrJsonNoKey     = errors.New("could not perform this operation on a key that doesn't exist")
+	ErrJsonNewRoot   = errors.New("new objects must be created at the root")
+	ErrJsonNotJson   = errors.New("existing key is not a valid JSON document")
+	ErrJsonNotNumber = errors.New("wrong type of path value - expected a number")
+	ErrJsonNotArray  = errors.New("wrong type of path value - expected an array")
+	ErrJsonOverflow  = errors.New("result is not a finite number")
+)
+
+type bdbJsonReq struct {
+	key    []byte
+	op     int
+	paths  []*jsonPath
+	values []interface{}
+	nx     bool
+	xx     bool
+	format jsonFormat
+	resp   chan bdbJsonResp
+}
+
+// bdbJsonResp.reply 可以是nil, string(状态), []byte, int64, []interface{}
+type bdbJsonResp struct {
+	reply interface{}
+	err   error
+}
+
+func errJsonPathNotExist(path *jsonPath) error {
+	return fmt.Errorf("Path '%s' does not exist", path.text)
+}
+
+func formatJSONFloat(v float64) string {
+	abs := math.Abs(v)
+	if abs != 0 && (abs >= 1e21 || abs < 1e-6) {
+		return strconv.FormatFloat(v, 'e', -1, 64)
+	}
+	s := strconv.FormatFloat(v, 'f', -1, 64)
+	if !strings.Contains(s, ".") {
+		s += ".0"
+	}
+	return s
+}
+
+// addJSONNumber 两个整数相加且不溢出时结果仍为整数，否则按浮点数计算
+func addJSONNumber(a json.Number, b json.Number) (json.Number, error) {
+	ia, erra := strconv.ParseInt(string(a), 10, 64)
+	ib, errb := strconv.ParseInt(string(b), 10, 64)
+	if erra == nil && errb == nil {
+		if (ib > 0 && ia <= math.MaxInt64-ib) || (ib <= 0 && ia >= math.MinInt64-ib) {
+			return json.Number(strconv.FormatInt(ia+ib, 10)), nil
+		}
+	}
+	fa, err := a.Float64()
+	if err != nil {
+		return "", ErrJsonNotNumber
+	}
+	fb, err := b.Float64()
+	if err != nil {
+		return "", ErrJsonNotNumber
+	}
+	r := fa + fb
+	if math.IsInf(r, 0) || math.IsNaN(r) {
+		return "", ErrJsonOverflow
+	}
+	return json.Number(formatJSONFloat(r)), nil
+}
+
+// apply 在文档上执行操作，返回回复内容以及文档是否需要写回或删除
+func (req *bdbJsonReq) apply(doc *jsonDoc, exists bool) (reply interface{}, write bool, del bool, err error) {
+	switch req.op {
+	case jsonOpSet:
+		return req.applySet(doc, exists)
+	case jsonOpGet:
+		reply, err = req.applyGet(doc, exists)
+		return reply, false, false, err
+	case jsonOpDel:
+		if !exists {
+			return int64(0), false, false, nil
+		}
+		refs := req.paths[0].eval(doc)
+		for _, ref := range refs {
+			if ref.isRoot() {
+				return int64(1), false, true, nil
+			}
+		}
+		count := deleteJSONRefs(refs)
+		return int64(count), count > 0, false, nil
+	case jsonOpNumIncrBy:
+		return req.applyNumIncrBy(doc, exists)
+	case jsonOpArrAppend:
+		return req.applyArrAppend(doc, exists)
+	}
+	return nil, false, false, ErrSyntax
+}
+
+func (req *bdbJsonReq) applySet(doc *jsonDoc, exists bool) (interface{}, bool, bool, error) {
+	path := req.paths[0]
+	value := req.values[0]
+	if len(path.segs) == 0 {
+		if (req.nx && exists) || (req.xx && !exists) {
+			return nil, false, false, nil
+		}
+		doc.root = value
+		return "OK", true, false, nil
+	}
+	if !exists {
+		return nil, false, false, ErrJsonNewRoot
+	}
+	refs := path.eval(doc)
+	if len(refs) > 0 {
+		if req.nx {
+			return nil, false, false, nil
+		}
+		for _, ref := range refs {
+			ref.set(value)
+		}
+		return "OK", true, false, nil
+	}
+	if req.xx {
+		return nil, false, false, nil
+	}
+	parents := path.parents(doc)
+	if len(parents) == 0 {
+		if path.legacy {
+			return nil, false, false, errJsonPathNotExist(path)
+		}
+		return nil, false, false, nil
+	}
+	key := path.segs[len(path.segs)-1].key
+	for _, obj := range parents {
+		obj.set(key, value)
+	}
+	return "OK", true, false, nil
+}
+
+func (req *bdbJsonReq) applyGet(doc *jsonDoc, exists bool) (interface{}, error) {
+	if !exists {
+		return nil, nil
+	}
+	if len(req.paths) == 1 {
+		path := req.paths[0]
+		refs := path.eval(doc)
+		if path.legacy {
+			if len(refs) == 0 {
+				return nil, errJsonPathNotExist(path)
+			}
+			return req.format.marshal(refs[0].get()), nil
+		}
+		arr := &jsonArray{items: make([]interface{}, 0, len(refs))}
+		for _, ref := range refs {
+			arr.items = append(arr.items, ref.get())
+		}
+		return req.format.marshal(arr), nil
+	}
+
+	legacy := true
+	for _, path := range req.paths {
+		legacy = legacy && path.legacy
+	}
+	obj := newJSONObject()
+	for _, path := range req.paths {
+		refs := path.eval(doc)
+		if legacy {
+			if len(refs) == 0 {
+				return nil, errJsonPathNotExist(path)
+			}
+			obj.set(path.text, refs[0].get())
+			continue
+		}
+		arr := &jsonArray{items: make([]interface{}, 0, len(refs))}
+		for _, ref := range refs {
+			arr.items = append(arr.items, ref.get())
+		}
+		obj.set(path.text, arr)
+	}
+	return req.format.marshal(obj), nil
+}
+
+func (req *bdbJsonReq) applyNumIncrBy(doc *jsonDoc, exists bool) (interface{}, bool, bool, error) {
+	if !exists {
+		return nil, false, false, ErrJsonNoKey
+	}
+	path := req.paths[0]
+	inc := req.values[0].(json.Number)
+	refs := path.eval(doc)
+	if path.legacy && len(refs) == 0 {
+		return nil, false, false, errJsonPathNotExist(path)
+	}
+	results := &jsonArray{items: make([]interface{}, 0, len(refs))}
+	write := false
+	for _, ref := range refs {
+		n, ok := ref.get().(json.Number)
+		if !ok {
+			if path.legacy {
+				return nil, false, false, ErrJsonNotNumber
+			}
+			results.items = append(results.items, nil)
+			continue
+		}
+		r, err := addJSONNumber(n, inc)
+		if err != nil {
+			return nil, false, false, err
+		}
+		ref.set(r)
+		results.items = append(results.items, r)
+		write = true
+	}
+	if path.legacy {
+		return []byte(results.items[0].(json.Number)), write, false, nil
+	}
+	return req.format.marshal(results), write, false, nil
+}
+
+func (req *bdbJsonReq) applyArrAppend(doc *jsonDoc, exists bool) (interface{}, bool, bool, error) {
+	if !exists {
+		return nil, false, false, ErrJsonNoKey
+	}
+	path := req.paths[0]
+	refs := path.eval(doc)
+	if path.legacy && len(refs) == 0 {
+		return nil, false, false, errJsonPathNotExist(path)
+	}
+	results := make([]interface{}, 0, len(refs))
+	write := false
+	for _, ref := range refs {
+		arr, ok := ref.get().(*jsonArray)
+		if !ok {
+			if path.legacy {
+				return nil, false, false, ErrJsonNotArray
+			}
+			results = append(results, nil)
+			continue
+		}
+		arr.items = append(arr.items, req.values...)
+		results = append(results, int64(len(arr.items)))
+		write = true
+	}
+	if path.legacy {
+		return results[0], write, false, nil
+	}
+	return results, write, false, nil
+}
+
+func (w *Worker) bdbJson(req *bdbJsonReq) {
+	if req.op == jsonOpDel {
+		if err := w.openExpire(); err != nil {
+			req.resp <- bdbJsonResp{nil, err}
+			return
+		}
+	}
+	key := append([]byte(nil), req.key...)
+	table, name := bdb.SplitKey(req.key)
+	db, err := w.getdb(table, bdb.DBTYPE_BTREE)
+	if err != nil {
+		req.resp <- bdbJsonResp{nil, err}
+		return
+	}
+
+	var txn *bdb.Txn
+	var flags uint32 = 0
+	if req.op != jsonOpGet {
+		txn, err = w.dbenv.Begin(bdb.DB_READ_COMMITTED)
+		if err != nil {
+			req.resp <- bdbJsonResp{nil, err}
+			return
+		}
+		defer func() {
+			if txn != nil {
+				txn.Abort()
+			}
+		}()
+		flags = bdb.DB_RMW
+	}
+
+	doc := &jsonDoc{}
+	exists := true
+	value, err := db.Get(txn, name, &w.getbuff, flags)
+	if err == bdb.ErrNotFound {
+		exists = false
+	} else if err != nil {
+		w.checkerr(err, db)
+		req.resp <- bdbJsonResp{nil, err}
+		return
+	} else if doc.root, err = parseJSON(value); err != nil {
+		req.resp <- bdbJsonResp{nil, ErrJsonNotJson}
+		return
+	}
+
+	reply, write, del, err := req.apply(doc, exists)
+	if err != nil || txn == nil || (!write && !del) {
+		req.resp <- bdbJsonResp{reply, err}
+		return
+	}
+	if del {
+		err = db.Del(txn, name, 0)
+		if err == nil {
+			err = w.persist(txn, key)
+		}
+	} else {
+		err = db.Set(txn, name, (&jsonFormat{}).marshal(doc.root), 0)
+	}
+	if err != nil {
+		w.checkerr(err, db)
+		req.resp <- bdbJsonResp{nil, err}
+		return
+	}
+	if _, err = w.bumpVersion(txn, key); err != nil {
+		req.resp <- bdbJsonResp{nil, err}
+		return
+	}
+	err = txn.Commit()
+	txn = nil
+	if err != nil {
+		req.resp <- bdbJsonResp{nil, err}
+		return
+	}
+	req.resp <- bdbJsonResp{reply, nil}
+}
+
+func (conn *Conn) writeJsonReply(reply interface{}) (err error) {
+	switch r := reply.(type) {
+	case nil:
+		return conn.writeBulk(nil)
+	case string:
+		_, err = conn.wb.WriteString("+" + r + "\r\n")
+		return
+	case []byte:
+		return conn.writeBulk(r)
+	case int64:
+		return conn.writeInt(r)
+	case []interface{}:
+		err = conn.writeLen('*', len(r))
+		for _, item := range r {
+			err = conn.writeJsonReply(item)
+		}
+		return
+	}
+	return
+}
+
+func jsonCommand(conn *Conn, req bdbJsonReq) error {
+	respChan := make(chan bdbJsonResp, 1)
+	req.resp = respChan
+	if ok, err := conn.sendOrBusy(req); !ok {
+		return err
+	}
+	resp := <-respChan
+	if resp.err != nil {
+		return conn.writeError(resp.err)
+	}
+	return conn.writeJsonReply(resp.reply)
+}
+
+func parseJSONPaths(args [][]byte) ([]*jsonPath, error) {
+	paths := make([]*jsonPath, len(args))
+	for i, arg := range args {
+		path, err := parseJSONPath(string(arg))
+		if err != nil {
+			return nil, err
+		}
+		paths[i] = path
+	}
+	return paths, nil
+}
+
+func cmdJsonSet(conn *Conn, args [][]byte) (err error) {
+	log.Debug("cmdJsonSet|%s|%s", args[0], args[1])
+	req := bdbJsonReq{key: args[0], op: jsonOpSet}
+	if req.paths, err = parseJSONPaths(args[1:2]); err != nil {
+		return conn.writeError(err)
+	}
+	value, err := parseJSON(args[2])
+	if err != nil {
+		return conn.writeError(err)
+	}
+	req.values = []interface{}{value}
+	if len(args) == 4 {
+		switch strings.ToLower(string(args[3])) {
+		case "nx":
+			req.nx = true
+		case "xx":
+			req.xx = true
+		default:
+			return conn.writeError(ErrSyntax)
+		}
+	}
+	return jsonCommand(conn, req)
+}
+
+func cmdJsonGet(conn *Conn, args [][]byte) (err error) {
+	log.Debug("cmdJsonGet|%s", args[0])
+	req := bdbJsonReq{key: args[0], op: jsonOpGet}
+	i := 1
+	for ; i+1 < len(args); i += 2 {
+		opt := strings.ToLower(string(args[i]))
+		if opt == "indent" {
+			req.format.indent = string(args[i+1])
+		} else if opt == "newline" {
+			req.format.newline = string(args[i+1])
+		} else if opt == "space" {
+			req.format.space = string(args[i+1])
+		} else {
+			break
+		}
+	}
+	if i == len(args) {
+		req.paths, err = parseJSONPaths([][]byte{[]byte(".")})
+	} else {
+		req.paths, err = parseJSONPaths(args[i:])
+	}
+	if err != nil {
+		return conn.writeError(err)
+	}
+	return jsonCommand(conn, req)
+}
+
+func cmdJsonDel(conn *Conn, args [][]byte) (err error) {
+	log.Debug("cmdJsonDel|%s", args[0])
+	req := bdbJsonReq{key: args[0], op: jsonOpDel}
+	if len(args) == 1 {
+		req.paths, err = parseJSONPaths([][]byte{[]byte(".")})
+	} else {
+		req.paths, err = parseJSONPaths(args[1:2])
+	}
+	if err != nil {
+		return conn.writeError(err)
+	}
+	return jsonCommand(conn, req)
+}
+
+func cmdJsonNumIncrBy(conn *Conn, args [][]byte) (err error) {
+	log.Debug("cmdJsonNumIncrBy|%s|%s|%s", args[0], args[1], args[2])
+	req := bdbJsonReq{key: args[0], op: jsonOpNumIncrBy}
+	if req.paths, err = parseJSONPaths(args[1:2]); err != nil {
+		return conn.writeError(err)
+	}
+	value, err := parseJSON(args[2])
+	if err != nil {
+		return conn.writeError(err)
+	}
+	if _, ok := value.(json.Number); !ok {
+		return conn.writeError(ErrJsonNotNumber)
+	}
+	req.values = []interface{}{value}
+	return jsonCommand(conn, req)
+}
+
+func cmdJsonArrAppend(conn *Conn, args [][]byte) (err error) {
+	log.Debug("cmdJsonArrAppend|%s|%s", args[0], args[1])
+	req := bdbJsonReq{key: args[0], op: jsonOpArrAppend}
+	if req.paths, err = parseJSONPaths(args[1:2]); err != nil {
+		return conn.writeError(err)
+	}
+	req.values = make([]interface{}, 0, len(args)-2)
+	for _, arg := range args[2:] {
+		value, err := parseJSON(arg)
+		if err != nil {
+			return conn.writeError(err)
+		}
+		req.values = append(req.values, value)
+	}
+	return jsonCommand(conn, req)
+}
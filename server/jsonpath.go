@@ -0,0 +1,478 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// JSON文档在内存中的表示:
+// nil, bool, json.Number, string, *jsonArray, *jsonObject
+// 对象保留key的顺序，数字保留原始文本，和RedisJSON的输出保持一致
+var (
+	ErrJsonSyntax = errors.New("invalid JSON value")
+	ErrJsonPath   = errors.New("invalid JSON path")
+)
+
+type jsonObject struct {
+	keys []string
+	vals map[string]interface{}
+}
+
+type jsonArray struct {
+	items []interface{}
+}
+
+func newJSONObject() *jsonObject {
+	return &jsonObject{vals: make(map[string]interface{})}
+}
+
+func (obj *jsonObject) set(key string, value interface{}) {
+	if _, ok := obj.vals[key]; !ok {
+		obj.keys = append(obj.keys, key)
+	}
+	obj.vals[key] = value
+}
+
+func (obj *jsonObject) del(key string) bool {
+	if _, ok := obj.vals[key]; !ok {
+		return false
+	}
+	delete(obj.vals, key)
+	for i, k := range obj.keys {
+		if k == key {
+			obj.keys = append(obj.keys[:i], obj.keys[i+1:]...)
+			break
+		}
+	}
+	return true
+}
+
+func parseJSON(data []byte) (interface{}, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	v, err := parseJSONValue(dec)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = dec.Token(); err != io.EOF {
+		return nil, ErrJsonSyntax
+	}
+	return v, nil
+}
+
+func parseJSONValue(dec *json.Decoder) (interface{}, error) {
+	tok, err := dec.Token()
+	if err != nil {
+		return nil, ErrJsonSyntax
+	}
+	delim, ok := tok.(json.Delim)
+	if !ok {
+		return tok, nil
+	}
+	switch delim {
+	case '{':
+		obj := newJSONObject()
+		for dec.More() {
+			tok, err = dec.Token()
+			if err != nil {
+				return nil, ErrJsonSyntax
+			}
+			key, ok := tok.(string)
+			if !ok {
+				return nil, ErrJsonSyntax
+			}
+			value, err := parseJSONValue(dec)
+			if err != nil {
+				return nil, err
+			}
+			obj.set(key, value)
+		}
+		if _, err = dec.Token(); err != nil {
+			return nil, ErrJsonSyntax
+		}
+		return obj, nil
+	case '[':
+		arr := &jsonArray{items: make([]interface{}, 0, 4)}
+		for dec.More() {
+			value, err := parseJSONValue(dec)
+			if err != nil {
+				return nil, err
+			}
+			arr.items = append(arr.items, value)
+		}
+		if _, err = dec.Token(); err != nil {
+			return nil, ErrJsonSyntax
+		}
+		return arr, nil
+	default:
+		return nil, ErrJsonSyntax
+	}
+}
+
+// jsonFormat 对应JSON.GET的INDENT/NEWLINE/SPACE参数，全部为空时输出紧凑格式
+type jsonFormat struct {
+	indent  string
+	newline string
+	space   string
+}
+
+func writeJSONString(buf *bytes.Buffer, s string) {
+	const hex = "0123456789abcdef"
+	buf.WriteByte('"')
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch c {
+		case '"':
+			buf.WriteString(`\"`)
+		case '\\':
+			buf.WriteString(`\\`)
+		case '\n':
+			buf.WriteString(`\n`)
+		case '\r':
+			buf.WriteString(`\r`)
+		case '\t':
+			buf.WriteString(`\t`)
+		case '\b':
+			buf.WriteString(`\b`)
+		case '\f':
+			buf.WriteString(`\f`)
+		default:
+			if c < 0x20 {
+				buf.WriteString(`\u00`)
+				buf.WriteByte(hex[c>>4])
+				buf.WriteByte(hex[c&0xf])
+			} else {
+				buf.WriteByte(c)
+			}
+		}
+	}
+	buf.WriteByte('"')
+}
+
+func (f *jsonFormat) newlineIndent(buf *bytes.Buffer, level int) {
+	buf.WriteString(f.newline)
+	for i := 0; i < level; i++ {
+		buf.WriteString(f.indent)
+	}
+}
+
+func (f *jsonFormat) write(buf *bytes.Buffer, v interface{}, level int) {
+	switch v := v.(type) {
+	case nil:
+		buf.WriteString("null")
+	case bool:
+		if v {
+			buf.WriteString("true")
+		} else {
+			buf.WriteString("false")
+		}
+	case json.Number:
+		buf.WriteString(string(v))
+	case string:
+		writeJSONString(buf, v)
+	case *jsonArray:
+		buf.WriteByte('[')
+		for i, item := range v.items {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			f.newlineIndent(buf, level+1)
+			f.write(buf, item, level+1)
+		}
+		if len(v.items) > 0 {
+			f.newlineIndent(buf, level)
+		}
+		buf.WriteByte(']')
+	case *jsonObject:
+		buf.WriteByte('{')
+		for i, key := range v.keys {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			f.newlineIndent(buf, level+1)
+			writeJSONString(buf, key)
+			buf.WriteByte(':')
+			buf.WriteString(f.space)
+			f.write(buf, v.vals[key], level+1)
+		}
+		if len(v.keys) > 0 {
+			f.newlineIndent(buf, level)
+		}
+		buf.WriteByte('}')
+	}
+}
+
+func (f *jsonFormat) marshal(v interface{}) []byte {
+	var buf bytes.Buffer
+	f.write(&buf, v, 0)
+	return buf.Bytes()
+}
+
+const (
+	jsonSegKey = iota
+	jsonSegIndex
+	jsonSegWildcard
+)
+
+type jsonPathSeg struct {
+	kind      int
+	key       string
+	index     int
+	recursive bool
+}
+
+// jsonPath 支持JSONPath的子集: $ .key ['key'] [n] [*] .* ..key
+// 不以$开头的是旧格式路径(.a.b)，旧格式只返回第一个匹配的值
+type jsonPath struct {
+	text   string
+	legacy bool
+	segs   []jsonPathSeg
+}
+
+func parseJSONPath(text string) (*jsonPath, error) {
+	path := &jsonPath{text: text}
+	s := text
+	if strings.HasPrefix(s, "$") {
+		s = s[1:]
+	} else {
+		path.legacy = true
+		if s == "." {
+			s = ""
+		} else if s != "" && s[0] != '.' && s[0] != '[' {
+			s = "." + s
+		}
+	}
+	for len(s) > 0 {
+		var seg jsonPathSeg
+		if strings.HasPrefix(s, "..") {
+			seg.recursive = true
+			s = s[2:]
+		} else if s[0] == '.' {
+			s = s[1:]
+		} else if s[0] != '[' {
+			return nil, ErrJsonPath
+		}
+		if s == "" {
+			return nil, ErrJsonPath
+		}
+		if s[0] == '[' {
+			if len(s) > 1 && (s[1] == '\'' || s[1] == '"') {
+				// 引号内可以包含.和]
+				end := strings.IndexByte(s[2:], s[1])
+				if end < 0 || len(s) < end+4 || s[end+3] != ']' {
+					return nil, ErrJsonPath
+				}
+				seg.kind = jsonSegKey
+				seg.key = s[2 : end+2]
+				s = s[end+4:]
+			} else {
+				end := strings.IndexByte(s, ']')
+				if end < 0 {
+					return nil, ErrJsonPath
+				}
+				inner := strings.TrimSpace(s[1:end])
+				if inner == "*" {
+					seg.kind = jsonSegWildcard
+				} else {
+					index, err := strconv.Atoi(inner)
+					if err != nil {
+						return nil, ErrJsonPath
+					}
+					seg.kind = jsonSegIndex
+					seg.index = index
+				}
+				s = s[end+1:]
+			}
+		} else {
+			end := strings.IndexAny(s, ".[")
+			if end < 0 {
+				end = len(s)
+			}
+			if end == 0 {
+				return nil, ErrJsonPath
+			}
+			if s[:end] == "*" {
+				seg.kind = jsonSegWildcard
+			} else {
+				seg.kind = jsonSegKey
+				seg.key = s[:end]
+			}
+			s = s[end:]
+		}
+		path.segs = append(path.segs, seg)
+	}
+	return path, nil
+}
+
+// jsonDoc 保存文档的根，jsonRef指向文档中的一个位置，用于原地修改
+type jsonDoc struct {
+	root interface{}
+}
+
+type jsonRef struct {
+	doc    *jsonDoc
+	parent interface{}
+	key    string
+	index  int
+}
+
+func (ref jsonRef) get() interface{} {
+	switch p := ref.parent.(type) {
+	case *jsonObject:
+		return p.vals[ref.key]
+	case *jsonArray:
+		return p.items[ref.index]
+	default:
+		return ref.doc.root
+	}
+}
+
+func (ref jsonRef) set(v interface{}) {
+	switch p := ref.parent.(type) {
+	case *jsonObject:
+		p.set(ref.key, v)
+	case *jsonArray:
+		p.items[ref.index] = v
+	default:
+		ref.doc.root = v
+	}
+}
+
+func (ref jsonRef) isRoot() bool {
+	return ref.parent == nil
+}
+
+func (seg *jsonPathSeg) apply(ref jsonRef, out []jsonRef) []jsonRef {
+	switch v := ref.get().(type) {
+	case *jsonObject:
+		if seg.kind == jsonSegKey {
+			if _, ok := v.vals[seg.key]; ok {
+				out = append(out, jsonRef{ref.doc, v, seg.key, 0})
+			}
+		} else if seg.kind == jsonSegWildcard {
+			for _, key := range v.keys {
+				out = append(out, jsonRef{ref.doc, v, key, 0})
+			}
+		}
+	case *jsonArray:
+		if seg.kind == jsonSegIndex {
+			index := seg.index
+			if index < 0 {
+				index += len(v.items)
+			}
+			if index >= 0 && index < len(v.items) {
+				out = append(out, jsonRef{ref.doc, v, "", index})
+			}
+		} else if seg.kind == jsonSegWildcard {
+			for i := range v.items {
+				out = append(out, jsonRef{ref.doc, v, "", i})
+			}
+		}
+	}
+	return out
+}
+
+// descendants 返回ref及其所有子孙节点
+func descendants(ref jsonRef, out []jsonRef) []jsonRef {
+	out = append(out, ref)
+	switch v := ref.get().(type) {
+	case *jsonObject:
+		for _, key := range v.keys {
+			out = descendants(jsonRef{ref.doc, v, key, 0}, out)
+		}
+	case *jsonArray:
+		for i := range v.items {
+			out = descendants(jsonRef{ref.doc, v, "", i}, out)
+		}
+	}
+	return out
+}
+
+func evalJSONSegs(doc *jsonDoc, segs []jsonPathSeg) []jsonRef {
+	refs := []jsonRef{{doc: doc}}
+	for i := range segs {
+		seg := &segs[i]
+		next := make([]jsonRef, 0, len(refs))
+		for _, ref := range refs {
+			if seg.recursive {
+				for _, d := range descendants(ref, nil) {
+					next = seg.apply(d, next)
+				}
+			} else {
+				next = seg.apply(ref, next)
+			}
+		}
+		refs = next
+	}
+	return refs
+}
+
+func (path *jsonPath) eval(doc *jsonDoc) []jsonRef {
+	refs := evalJSONSegs(doc, path.segs)
+	if path.legacy && len(refs) > 1 {
+		refs = refs[:1]
+	}
+	return refs
+}
+
+// parents 返回可以新建最后一个key的对象，用于JSON.SET创建不存在的字段
+func (path *jsonPath) parents(doc *jsonDoc) []*jsonObject {
+	if len(path.segs) == 0 {
+		return nil
+	}
+	last := path.segs[len(path.segs)-1]
+	if last.kind != jsonSegKey || last.recursive {
+		return nil
+	}
+	var objs []*jsonObject
+	for _, ref := range evalJSONSegs(doc, path.segs[:len(path.segs)-1]) {
+		if obj, ok := ref.get().(*jsonObject); ok {
+			if _, exists := obj.vals[last.key]; !exists {
+				objs = append(objs, obj)
+			}
+		}
+		if path.legacy {
+			break
+		}
+	}
+	return objs
+}
+
+// deleteJSONRefs 删除refs指向的值，同一个数组中的多个元素一起删除，避免下标变化
+func deleteJSONRefs(refs []jsonRef) int {
+	count := 0
+	arrays := make(map[*jsonArray]map[int]bool)
+	for _, ref := range refs {
+		switch p := ref.parent.(type) {
+		case *jsonObject:
+			if p.del(ref.key) {
+				count++
+			}
+		case *jsonArray:
+			if arrays[p] == nil {
+				arrays[p] = make(map[int]bool)
+			}
+			if !arrays[p][ref.index] {
+				arrays[p][ref.index] = true
+				count++
+			}
+		}
+	}
+	for arr, indexes := range arrays {
+		items := arr.items[:0]
+		for i, item := range arr.items {
+			if !indexes[i] {
+				items = append(items, item)
+			}
+		}
+		for i := len(items); i < len(arr.items); i++ {
+			arr.items[i] = nil
+		}
+		arr.items = items
+	}
+	return count
+}
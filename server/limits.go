@@ -0,0 +1,186 @@
+package server
+
+import (
+	"bytes"
+	"errors"
+	"github.com/nybuxtsui/log"
+	"net"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	// MaxClients 最多同时连接的客户端数，0不限制
+	MaxClients int64 = 10000
+	// IdleTimeout 客户端空闲超过这个时间(秒)后关闭连接，0不超时。MONITOR的连接不受影响
+	IdleTimeout int64 = 0
+	// ProtoMaxBulkLen 请求中一个参数的最大长度
+	ProtoMaxBulkLen int64 = 512 * 1024 * 1024
+	// OutputBufferLimit 一个命令的回复，或者pipeline中并发执行还没有写出的回复合计超过这个字节数时关闭连接，0不限制
+	OutputBufferLimit int64 = 0
+	// OutputTimeout 客户端在这个时间(秒)内没有读走回复时关闭连接，0不超时
+	OutputTimeout int64 = 60
+)
+
+const (
+	// readBufferSize 每个连接的读缓存，也是inline命令的最大长度，和redis一致
+	readBufferSize = 64 * 1024
+	// maxMultibulkLen 一个请求最多的参数个数，和redis一致
+	maxMultibulkLen = 1024 * 1024
+	// bulkChunk 大的参数按这个大小分段读取，收到多少数据才分配多少内存
+	bulkChunk = 1024 * 1024
+)
+
+var (
+	ErrMaxClients   = errors.New("max number of clients reached")
+	ErrMultibulkLen = errors.New("Protocol error: invalid multibulk length")
+	ErrBulkLen      = errors.New("Protocol error: invalid bulk length")
+	ErrInlineTooBig = errors.New("Protocol error: too big inline request")
+	ErrOutputLimit  = errors.New("client output buffer limit reached")
+)
+
+var (
+	rejectedConnections int64 // 超过MaxClients被拒绝的连接
+	queryLimitClients   int64 // 请求超过长度限制被关闭的连接
+	outputLimitClients  int64 // 回复超过OutputBufferLimit或者OutputTimeout被关闭的连接
+	idleTimeoutClients  int64 // 空闲超时被关闭的连接
+)
+
+func initLimitsConfig() {
+	RegisterConfig("maxclients", "server", "maxclients", false,
+		func() string { return strconv.FormatInt(atomic.LoadInt64(&MaxClients), 10) },
+		intSetter(&MaxClients, 0, math32))
+	RegisterConfig("timeout", "server", "timeout", false,
+		func() string { return strconv.FormatInt(atomic.LoadInt64(&IdleTimeout), 10) },
+		intSetter(&IdleTimeout, 0, math32))
+	RegisterConfig("proto-max-bulk-len", "server", "proto_max_bulk_len", false,
+		func() string { return strconv.FormatInt(atomic.LoadInt64(&ProtoMaxBulkLen), 10) },
+		intSetter(&ProtoMaxBulkLen, 1024*1024, 1<<40))
+	RegisterConfig("client-output-buffer-limit", "server", "client_output_buffer_limit", false,
+		func() string { return strconv.FormatInt(atomic.LoadInt64(&OutputBufferLimit), 10) },
+		intSetter(&OutputBufferLimit, 0, 1<<62))
+	RegisterConfig("client-output-timeout", "server", "client_output_timeout", false,
+		func() string { return strconv.FormatInt(atomic.LoadInt64(&OutputTimeout), 10) },
+		intSetter(&OutputTimeout, 0, math32))
+}
+
+// intSetter 返回CONFIG SET使用的函数，检查范围，修改时原子地写入p
+func intSetter(p *int64, min int64, max int64) ConfigSetter {
+	return func(value string) (func() error, error) {
+		n, err := parseConfigInt(value, min, max)
+		if err != nil {
+			return nil, err
+		}
+		return func() error {
+			atomic.StoreInt64(p, n)
+			return nil
+		}, nil
+	}
+}
+
+// reject 超过MaxClients或者正在退出时回复错误后关闭，不分配读缓存
+func (c *Conn) reject(err error) {
+	code := "ERR"
+	if err == ErrMaxClients {
+		atomic.AddInt64(&rejectedConnections, 1)
+	} else {
+		code = "SHUTDOWN"
+	}
+	log.Info("reject|%s|%s", c.addr, err.Error())
+	c.conn.SetDeadline(time.Now().Add(time.Second))
+	c.writeErrorCode(code, err)
+	c.wb.Flush()
+	c.Close()
+}
+
+// queryLimit 请求超过限制时返回协议错误，回复之后连接会被关闭
+func (c *Conn) queryLimit(err error) error {
+	atomic.AddInt64(&queryLimitClients, 1)
+	log.Error("queryLimit|%s|%s", c.addr, err.Error())
+	return replyError{err}
+}
+
+// connReader 每次读取前设置空闲超时
+type connReader struct {
+	c        *Conn
+	deadline bool // 是否设置过超时，IdleTimeout改为0后需要清除
+}
+
+func (r *connReader) Read(p []byte) (int, error) {
+	c := r.c
+	// 读缓存中只有半个请求，等待剩下的数据之前先把已经处理的命令回复给客户端。
+	// MONITOR时由单独的goroutine读取，不能在这里写
+	if !c.monitor && (len(c.pending) > 0 || c.wb.Buffered() > 0) {
+		if err := c.flush(); err != nil {
+			return 0, err
+		}
+	}
+	if timeout := atomic.LoadInt64(&IdleTimeout); timeout > 0 && !c.monitor {
+		c.conn.SetReadDeadline(time.Now().Add(time.Duration(timeout) * time.Second))
+		r.deadline = true
+	} else if r.deadline {
+		c.conn.SetReadDeadline(time.Time{})
+		r.deadline = false
+	}
+	n, err := c.conn.Read(p)
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		atomic.AddInt64(&idleTimeoutClients, 1)
+		log.Info("connReader|idle_timeout|%s", c.addr)
+	}
+	return n, err
+}
+
+// connWriter 写回复时检查OutputBufferLimit，并设置写超时。
+// 回复经过16K的bufio.Writer直接写到socket，不会在内存中积累，
+// 所以限制的是一个命令回复的总长度和客户端不读取时等待的时间
+type connWriter struct {
+	c        *Conn
+	deadline bool
+}
+
+func (w *connWriter) Write(p []byte) (int, error) {
+	c := w.c
+	if !c.monitor {
+		if limit := atomic.LoadInt64(&OutputBufferLimit); limit > 0 {
+			c.replyBytes += int64(len(p))
+			if c.replyBytes > limit {
+				atomic.AddInt64(&outputLimitClients, 1)
+				log.Error("connWriter|limit|%s|%d", c.addr, c.replyBytes)
+				return 0, ErrOutputLimit
+			}
+		}
+	}
+	if timeout := atomic.LoadInt64(&OutputTimeout); timeout > 0 {
+		c.conn.SetWriteDeadline(time.Now().Add(time.Duration(timeout) * time.Second))
+		w.deadline = true
+	} else if w.deadline {
+		c.conn.SetWriteDeadline(time.Time{})
+		w.deadline = false
+	}
+	n, err := c.conn.Write(p)
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		atomic.AddInt64(&outputLimitClients, 1)
+		log.Error("connWriter|timeout|%s", c.addr)
+	}
+	return n, err
+}
+
+// bufferWriter 并发执行的命令的回复先写在内存中，等前面的命令回复后才写到socket，
+// 不经过connWriter。一个连接中所有还没有写出的回复合计按OutputBufferLimit限制
+type bufferWriter struct {
+	c       *Conn
+	buf     *bytes.Buffer
+	pending *int64 // 连接中并发执行的命令还没有写出的字节数
+}
+
+func (w *bufferWriter) Write(p []byte) (int, error) {
+	n := atomic.AddInt64(w.pending, int64(len(p)))
+	if limit := atomic.LoadInt64(&OutputBufferLimit); limit > 0 && n > limit {
+		atomic.AddInt64(w.pending, -int64(len(p)))
+		atomic.AddInt64(&outputLimitClients, 1)
+		log.Error("bufferWriter|limit|%s|%d", w.c.addr, n)
+		return 0, ErrOutputLimit
+	}
+	return w.buf.Write(p)
+}
@@ -0,0 +1,76 @@
+package server
+
+import (
+	"fmt"
+	"github.com/nybuxtsui/bdbd/bdb"
+	"io/ioutil"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+// testEnv 所有测试共用的单节点环境，在临时目录中以主节点启动
+var testEnv *bdb.DbEnv
+
+func TestMain(m *testing.M) {
+	dir, err := ioutil.TempDir("", "bdbd-test")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	addr := l.Addr().String()
+	l.Close()
+
+	testEnv = bdb.Start(bdb.BdbConfig{
+		Master:          true,
+		HomeDir:         dir,
+		LocalAddr:       addr,
+		DisableElection: true,
+	})
+	for deadline := time.Now().Add(10 * time.Second); !testEnv.IsMaster(); {
+		if time.Now().After(deadline) {
+			fmt.Fprintln(os.Stderr, "bdb|not_master")
+			os.Exit(1)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	Start(testEnv)
+
+	code := m.Run()
+
+	Exit()
+	testEnv.Exit()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+// testWorker 不在pool中的worker，测试在自己的goroutine中调用dispatch
+func testWorker(t *testing.T, id int) *Worker {
+	w := NewWorker(id, testEnv)
+	t.Cleanup(func() {
+		for _, db := range w.dbmap {
+			db.Close()
+		}
+		w.dbmap = map[string]*bdb.Db{}
+	})
+	return w
+}
+
+func (w *Worker) testSet(key string, value string) error {
+	resp := make(chan bdbSetResp, 1)
+	w.dispatch(bdbSetReq{key: []byte(key), value: []byte(value), resp: resp})
+	return (<-resp).err
+}
+
+func (w *Worker) testGet(key string) ([]byte, error) {
+	resp := make(chan bdbGetResp, 1)
+	w.dispatch(bdbGetReq{key: []byte(key), resp: resp})
+	r := <-resp
+	return r.value, r.err
+}
@@ -0,0 +1,184 @@
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/nybuxtsui/bdbd/bdb"
+	"github.com/nybuxtsui/log"
+	"net/http"
+	"runtime"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// latencyBuckets 命令耗时直方图的上界，单位秒
+var latencyBuckets = []float64{0.0001, 0.00025, 0.0005, 0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5}
+
+// expireBacklogLimit 统计过期积压时最多遍历的记录数
+const expireBacklogLimit = 100000
+
+// dbErrors 按错误类型统计的bdb错误次数
+var dbErrors = struct {
+	sync.Mutex
+	m map[string]int64
+}{m: make(map[string]int64)}
+
+func countError(err error) {
+	if err == nil {
+		return
+	}
+	dbErrors.Lock()
+	dbErrors.m[err.Error()]++
+	dbErrors.Unlock()
+}
+
+// StartMetrics 在addr上提供prometheus格式的/metrics
+func StartMetrics(addr string, dbenv *bdb.DbEnv) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		// 退出时数据库环境会被关闭，不再读取统计信息
+		if !beginCommand() {
+			http.Error(w, ErrShutdown.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		defer endCommand()
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		w.Write(metrics(dbenv))
+	})
+	log.Info("metrics|listen|%s", addr)
+	if err := http.ListenAndServe(addr, mux); err != nil {
+		log.Error("metrics|ListenAndServe|%s", err.Error())
+	}
+}
+
+type metricWriter struct {
+	bytes.Buffer
+}
+
+func (m *metricWriter) header(name string, typ string, help string) {
+	fmt.Fprintf(m, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+func (m *metricWriter) value(name string, typ string, help string, v interface{}) {
+	m.header(name, typ, help)
+	fmt.Fprintf(m, "%s %v\n", name, v)
+}
+
+func metrics(dbenv *bdb.DbEnv) []byte {
+	var m metricWriter
+	now := time.Now()
+
+	m.value("bdbd_uptime_seconds", "gauge", "Seconds since the server started.", int64(now.Sub(startTime)/time.Second))
+	conns.Lock()
+	connected := len(conns.m)
+	conns.Unlock()
+	m.value("bdbd_connected_clients", "gauge", "Number of client connections.", connected)
+	m.value("bdbd_connections_received_total", "counter", "Total number of accepted connections.", atomic.LoadInt64(&totalConnections))
+	m.value("bdbd_rejected_connections_total", "counter", "Connections rejected because maxclients was reached.", atomic.LoadInt64(&rejectedConnections))
+	m.header("bdbd_client_disconnections_total", "counter", "Clients closed by the server because a limit was exceeded.")
+	fmt.Fprintf(&m, "bdbd_client_disconnections_total{reason=\"query_limit\"} %d\n", atomic.LoadInt64(&queryLimitClients))
+	fmt.Fprintf(&m, "bdbd_client_disconnections_total{reason=\"output_limit\"} %d\n", atomic.LoadInt64(&outputLimitClients))
+	fmt.Fprintf(&m, "bdbd_client_disconnections_total{reason=\"idle_timeout\"} %d\n", atomic.LoadInt64(&idleTimeoutClients))
+	m.value("bdbd_commands_processed_total", "counter", "Total number of commands processed.", atomic.LoadInt64(&totalCommands))
+	m.value("bdbd_work_queue_length", "gauge", "Requests waiting in the worker queues.", queueLength())
+	m.value("bdbd_work_queue_capacity", "gauge", "Capacity of the worker queue.", cap(workChan))
+	m.value("bdbd_work_queue_rejected_total", "counter", "Requests rejected with BUSY because the worker queue was full.", atomic.LoadInt64(&queueFull))
+	m.value("bdbd_workers", "gauge", "Number of workers.", workerCount())
+	m.header("bdbd_work_routed_total", "counter", "Requests sent to the workers, by queue.")
+	fmt.Fprintf(&m, "bdbd_work_routed_total{queue=\"key\"} %d\n", atomic.LoadInt64(&routedKey))
+	fmt.Fprintf(&m, "bdbd_work_routed_total{queue=\"shared\"} %d\n", atomic.LoadInt64(&routedShared))
+	fmt.Fprintf(&m, "bdbd_work_routed_total{queue=\"multi\"} %d\n", atomic.LoadInt64(&routedMulti))
+	m.value("bdbd_group_commits_total", "counter", "Transactions that committed several writes at once.", atomic.LoadInt64(&groupCommits))
+	m.value("bdbd_group_commit_writes_total", "counter", "Writes committed by group commit.", atomic.LoadInt64(&groupCommitWrites))
+	m.value("bdbd_group_commit_fallbacks_total", "counter", "Group commits rolled back and retried one write at a time.", atomic.LoadInt64(&groupCommitFallbacks))
+
+	m.header("bdbd_worker_busy_seconds_total", "counter", "Time each worker spent processing requests.")
+	for _, w := range currentWorkers() {
+		fmt.Fprintf(&m, "bdbd_worker_busy_seconds_total{worker=\"%d\"} %g\n", w.id, time.Duration(atomic.LoadInt64(&w.busy)).Seconds())
+	}
+
+	names := make([]string, 0, len(cmdStats))
+	for name := range cmdStats {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	m.header("bdbd_command_duration_seconds", "histogram", "Command latency including time spent in the worker queue.")
+	for _, name := range names {
+		stat := cmdStats[name]
+		calls := atomic.LoadInt64(&stat.calls)
+		if calls == 0 {
+			continue
+		}
+		var cumulative int64
+		for i, le := range latencyBuckets {
+			cumulative += atomic.LoadInt64(&stat.buckets[i])
+			fmt.Fprintf(&m, "bdbd_command_duration_seconds_bucket{cmd=\"%s\",le=\"%g\"} %d\n", name, le, cumulative)
+		}
+		fmt.Fprintf(&m, "bdbd_command_duration_seconds_bucket{cmd=\"%s\",le=\"+Inf\"} %d\n", name, calls)
+		fmt.Fprintf(&m, "bdbd_command_duration_seconds_sum{cmd=\"%s\"} %g\n", name, float64(atomic.LoadInt64(&stat.usec))/1e6)
+		fmt.Fprintf(&m, "bdbd_command_duration_seconds_count{cmd=\"%s\"} %d\n", name, calls)
+	}
+
+	m.header("bdbd_db_errors_total", "counter", "Berkeley DB errors seen by the workers, by type.")
+	dbErrors.Lock()
+	errs := make([]string, 0, len(dbErrors.m))
+	for name := range dbErrors.m {
+		errs = append(errs, name)
+	}
+	sort.Strings(errs)
+	for _, name := range errs {
+		fmt.Fprintf(&m, "bdbd_db_errors_total{type=\"%s\"} %d\n", name, dbErrors.m[name])
+	}
+	dbErrors.Unlock()
+
+	stats := make(map[string]int64)
+	for _, item := range dbenv.Stat() {
+		stats[item.Name] = item.Value
+	}
+	if hit, miss := stats["bdb_cache_hit"], stats["bdb_cache_miss"]; hit+miss > 0 {
+		m.value("bdbd_bdb_cache_hit_ratio", "gauge", "Ratio of pages found in the bdb cache.", float64(hit)/float64(hit+miss))
+	}
+	m.value("bdbd_bdb_cache_size_bytes", "gauge", "Size of the bdb cache.", stats["bdb_cache_size"])
+	m.value("bdbd_bdb_cache_pages_dirty", "gauge", "Dirty pages in the bdb cache.", stats["bdb_cache_pages_dirty"])
+	m.value("bdbd_bdb_lock_waits_total", "counter", "Lock requests that had to wait.", stats["lock_waits"])
+	m.value("bdbd_bdb_lock_deadlocks_total", "counter", "Deadlocks detected by bdb.", stats["lock_deadlocks"])
+	m.value("bdbd_bdb_lock_timeouts_total", "counter", "Lock requests that timed out.", stats["lock_timeouts"])
+	m.value("bdbd_bdb_log_written_bytes_total", "counter", "Bytes written to the transaction log.", stats["log_bytes_written"])
+	m.value("bdbd_bdb_log_syncs_total", "counter", "Transaction log fsyncs.", stats["log_syncs"])
+	m.value("bdbd_bdb_txn_commits_total", "counter", "Committed transactions.", stats["txn_commits"])
+	m.value("bdbd_bdb_txn_aborts_total", "counter", "Aborted transactions.", stats["txn_aborts"])
+	m.value("bdbd_bdb_txn_active", "gauge", "Active transactions.", stats["txn_active"])
+	if ckp := stats["last_checkpoint_time"]; ckp > 0 {
+		m.value("bdbd_bdb_checkpoint_age_seconds", "gauge", "Seconds since the last checkpoint.", now.Unix()-ckp)
+	}
+
+	m.value("bdbd_replication_is_master", "gauge", "1 if this node is the replication master.", stats["is_master"])
+	m.value("bdbd_replication_in_client_sync", "gauge", "1 while a replica is synchronizing with the master.", stats["in_client_sync"])
+	m.value("bdbd_replication_log_queued", "gauge", "Log records received out of order and queued on this replica.", stats["rep_log_queued"])
+	m.value("bdbd_replication_generation", "gauge", "Replication generation number.", stats["rep_generation"])
+	m.value("bdbd_replication_next_lsn_file", "gauge", "Log file of the next LSN expected from the master.", stats["rep_next_lsn_file"])
+	m.value("bdbd_replication_next_lsn_offset", "gauge", "Log offset of the next LSN expected from the master.", stats["rep_next_lsn_offset"])
+	m.value("bdbd_replication_log_file", "gauge", "Current log file of this node.", stats["log_current_file"])
+	m.value("bdbd_replication_log_offset", "gauge", "Current log offset of this node.", stats["log_current_offset"])
+	m.value("bdbd_replication_master_changes_total", "counter", "Master changes seen by this node.", stats["rep_master_changes"])
+
+	m.value("bdbd_expired_keys_total", "counter", "Keys removed by the expire thread.", stats["expired_keys"])
+	if last := stats["expire_last_run"]; last > 0 {
+		m.value("bdbd_expire_last_run_age_seconds", "gauge", "Seconds since the expire thread last ran.", now.Unix()-last)
+	}
+	if backlog, err := dbenv.ExpireBacklog(expireBacklogLimit); err == nil {
+		m.value("bdbd_expire_backlog", "gauge", "Keys past their expire time that are not deleted yet, capped at 100000.", backlog)
+	}
+
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+	m.value("go_goroutines", "gauge", "Number of goroutines.", runtime.NumGoroutine())
+	m.value("go_memstats_alloc_bytes", "gauge", "Bytes allocated and still in use.", ms.Alloc)
+	m.value("go_memstats_sys_bytes", "gauge", "Bytes obtained from the system.", ms.Sys)
+	m.value("go_memstats_heap_objects", "gauge", "Number of allocated objects.", ms.HeapObjects)
+	m.value("go_gc_count_total", "counter", "Number of completed GC cycles.", ms.NumGC)
+	m.value("go_gc_pause_seconds_total", "counter", "Total GC pause time.", time.Duration(ms.PauseTotalNs).Seconds())
+	return m.Bytes()
+}
@@ -0,0 +1,176 @@
+package server
+
+import (
+	"github.com/nybuxtsui/log"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// monitorBuffer 每个MONITOR连接缓存的行数，写不过来时丢弃
+const monitorBuffer = 4096
+
+type monitor struct {
+	conn *Conn
+	ch   chan []byte
+}
+
+var monitors = struct {
+	sync.Mutex
+	m map[int64]*monitor
+}{m: make(map[int64]*monitor)}
+
+var (
+	// monitorCount 没有MONITOR连接时processRequest不需要格式化命令
+	monitorCount    int32
+	monitorDropped  int64
+	monitorExcluded = map[string]bool{"monitor": true}
+)
+
+func addMonitor(c *Conn) *monitor {
+	m := &monitor{c, make(chan []byte, monitorBuffer)}
+	monitors.Lock()
+	monitors.m[c.id] = m
+	atomic.StoreInt32(&monitorCount, int32(len(monitors.m)))
+	monitors.Unlock()
+	return m
+}
+
+func delMonitor(m *monitor) {
+	monitors.Lock()
+	delete(monitors.m, m.conn.id)
+	atomic.StoreInt32(&monitorCount, int32(len(monitors.m)))
+	monitors.Unlock()
+}
+
+// appendRepr 和redis的sdscatrepr一样，加上引号并转义不可见字符
+func appendRepr(buf []byte, arg []byte) []byte {
+	buf = append(buf, '"')
+	for _, c := range arg {
+		switch c {
+		case '\\', '"':
+			buf = append(buf, '\\', c)
+		case '\n':
+			buf = append(buf, '\\', 'n')
+		case '\r':
+			buf = append(buf, '\\', 'r')
+		case '\t':
+			buf = append(buf, '\\', 't')
+		case '\a':
+			buf = append(buf, '\\', 'a')
+		case '\b':
+			buf = append(buf, '\\', 'b')
+		default:
+			if c < ' ' || c > '~' {
+				buf = append(buf, '\\', 'x', "0123456789abcdef"[c>>4], "0123456789abcdef"[c&15])
+			} else {
+				buf = append(buf, c)
+			}
+		}
+	}
+	return append(buf, '"')
+}
+
+// feedMonitors 把要执行的命令发给所有MONITOR连接，必须在执行前调用，执行时key会被修改
+func feedMonitors(c *Conn, req [][]byte) {
+	now := time.Now()
+	line := make([]byte, 0, 128)
+	line = append(line, '+')
+	line = strconv.AppendInt(line, now.Unix(), 10)
+	line = append(line, '.')
+	usec := strconv.AppendInt(nil, int64(now.Nanosecond()/1000), 10)
+	for i := len(usec); i < 6; i++ {
+		line = append(line, '0')
+	}
+	line = append(line, usec...)
+	line = append(line, " ["...)
+	line = strconv.AppendInt(line, int64(c.db), 10)
+	line = append(line, ' ')
+	line = append(line, c.addr...)
+	line = append(line, ']')
+	for _, arg := range req {
+		line = append(line, ' ')
+		line = appendRepr(line, arg)
+	}
+	line = append(line, "\r\n"...)
+
+	monitors.Lock()
+	for _, m := range monitors.m {
+		select {
+		case m.ch <- line:
+		default:
+			atomic.AddInt64(&monitorDropped, 1)
+		}
+	}
+	monitors.Unlock()
+}
+
+// cmdMonitor 进入MONITOR模式后只接受QUIT和RESET，其他命令被忽略
+func cmdMonitor(conn *Conn, args [][]byte) (err error) {
+	log.Debug("cmdMonitor|%d", conn.id)
+	conn.wb.WriteString("+OK\r\n")
+	if err = conn.wb.Flush(); err != nil {
+		return
+	}
+	m := addMonitor(conn)
+	defer delMonitor(m)
+	conn.monitor = true
+	defer func() { conn.monitor = false }()
+
+	// 由单独的goroutine读取客户端的命令，本goroutine负责写，读取的goroutine不能使用wb
+	type exit struct {
+		cmd string
+		err error
+	}
+	done := make(chan exit, 1)
+	go func() {
+		for {
+			req, err := conn.readRequest()
+			if err != nil {
+				done <- exit{err: err}
+				return
+			}
+			if len(req) == 0 {
+				continue
+			}
+			switch cmd := strings.ToLower(string(req[0])); cmd {
+			case "quit", "reset":
+				done <- exit{cmd: cmd}
+				return
+			}
+		}
+	}()
+
+	for {
+		select {
+		case line := <-m.ch:
+			conn.wb.Write(line)
+			if len(m.ch) == 0 {
+				if err = conn.wb.Flush(); err != nil {
+					log.Error("cmdMonitor|Flush|%s", err.Error())
+					conn.conn.Close()
+					<-done
+					return
+				}
+			}
+		case <-shutdown.ch:
+			conn.conn.Close()
+			<-done
+			return ErrQuit
+		case e := <-done:
+			switch e.cmd {
+			case "quit":
+				return cmdQuit(conn, nil)
+			case "reset":
+				return cmdReset(conn, nil)
+			}
+			if re, ok := e.err.(replyError); ok {
+				conn.writeError(re.error)
+				conn.wb.Flush()
+			}
+			return ErrQuit
+		}
+	}
+}
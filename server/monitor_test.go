@@ -0,0 +1,34 @@
+package server
+
+import (
+	"bufio"
+	"net"
+	"testing"
+	"time"
+)
+
+// MONITOR时客户端发送错误的请求，由写回复的goroutine回复错误后关闭连接
+func TestMonitorProtocolError(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c2.Close()
+	go NewConn(c1, testEnv).Start()
+	c2.SetDeadline(time.Now().Add(10 * time.Second))
+	r := bufio.NewReader(c2)
+
+	if _, err := c2.Write([]byte("MONITOR\r\n")); err != nil {
+		t.Fatal(err)
+	}
+	if line, err := r.ReadString('\n'); err != nil || line != "+OK\r\n" {
+		t.Fatalf("monitor = %q, %v", line, err)
+	}
+	if _, err := c2.Write([]byte("GET \"t039\r\n")); err != nil {
+		t.Fatal(err)
+	}
+	want := "-ERR " + ErrQuotes.Error() + "\r\n"
+	if line, err := r.ReadString('\n'); err != nil || line != want {
+		t.Fatalf("reply = %q, %v, want %q", line, err, want)
+	}
+	if _, err := r.ReadString('\n'); err == nil {
+		t.Fatal("connection not closed")
+	}
+}
@@ -0,0 +1,124 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"sync/atomic"
+)
+
+// pipelineMax 一个连接最多同时执行的命令数，超过后等前面的命令完成
+const pipelineMax = 128
+
+// pipelined 并发执行的命令，回复先写在out中，由连接按请求的顺序写回
+type pipelined struct {
+	sub  *Conn
+	out  bytes.Buffer
+	done chan error
+}
+
+// dispatch 客户端一次发送了多个命令时，只有一个key的命令在单独的goroutine中执行。
+// 按key路由时同一个key的请求进入同一个worker的队列，所以只要按顺序放进队列，
+// 同一个key上的命令仍然按顺序执行，不同key的命令可以由不同的worker同时处理
+func (c *Conn) dispatch(def cmdDef, cmd string, args [][]byte, logReq [][]byte) error {
+	if len(c.pending) >= pipelineMax {
+		if err := c.waitPending(); err != nil {
+			endCommand()
+			return err
+		}
+	}
+	c.mu.Lock()
+	name := c.name
+	c.mu.Unlock()
+	p := &pipelined{done: make(chan error, 1)}
+	sub := &Conn{
+		conn:   c.conn,
+		dbenv:  c.dbenv,
+		id:     c.id,
+		addr:   c.addr,
+		ctime:  c.ctime,
+		atime:  c.atime,
+		proto:  c.proto,
+		name:   name,
+		user:   c.user,
+		db:     c.db,
+		cmd:    cmd,
+		worker: -1,
+		lane:   c.lane,
+		sent:   make(chan struct{}),
+	}
+	sub.wb = bufio.NewWriterSize(&bufferWriter{sub, &p.out, &c.pipeBytes}, 512)
+	p.sub = sub
+	sent := sub.sent
+	go func() {
+		defer func() {
+			if r := recover(); r != nil {
+				PrintPanic(r)
+				p.done <- fmt.Errorf("panic in %s: %v", cmd, r)
+			}
+		}()
+		err := sub.runCommand(def, cmd, args, logReq)
+		if err == nil {
+			err = sub.wb.Flush()
+		}
+		p.done <- err
+	}()
+	// 请求放进worker的队列之后再处理下一个命令，没有发给worker的命令等它执行完
+	select {
+	case <-sent:
+	case err := <-p.done:
+		p.done <- err
+	}
+	c.pending = append(c.pending, p)
+	return nil
+}
+
+// markSent 通知dispatch请求已经放进队列
+func (c *Conn) markSent() {
+	if c.sent == nil {
+		return
+	}
+	select {
+	case <-c.sent:
+	default:
+		close(c.sent)
+	}
+}
+
+// waitPending 按顺序等待并发执行的命令，把回复写到连接。出错后剩下的命令只等待不回复
+func (c *Conn) waitPending() (err error) {
+	for i, p := range c.pending {
+		c.pending[i] = nil
+		perr := <-p.done
+		atomic.AddInt64(&c.pipeBytes, -int64(p.out.Len()))
+		if err != nil {
+			continue
+		}
+		if perr != nil {
+			err = perr
+			continue
+		}
+		c.replyBytes = 0
+		_, err = c.wb.Write(p.out.Bytes())
+	}
+	c.pending = c.pending[:0]
+	return
+}
+
+// dropPending 连接关闭时等待并发执行的命令结束，不再回复。
+// 退出时要等所有连接结束后才关闭workChan，所以不能留下还在发送请求的goroutine
+func (c *Conn) dropPending() {
+	for _, p := range c.pending {
+		<-p.done
+		atomic.AddInt64(&c.pipeBytes, -int64(p.out.Len()))
+	}
+	c.pending = nil
+}
+
+// flush 等待并发执行的命令后把回复发给客户端
+func (c *Conn) flush() error {
+	if err := c.waitPending(); err != nil {
+		return err
+	}
+	return c.wb.Flush()
+}
@@ -0,0 +1,121 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+// 非0的库中slowlog记录的是客户端发送的key，不是实际保存的key
+func TestSlowlogArgsSelectDb(t *testing.T) {
+	old := atomic.LoadInt64(&SlowlogSlowerThan)
+	defer atomic.StoreInt64(&SlowlogSlowerThan, old)
+	atomic.StoreInt64(&SlowlogSlowerThan, 0)
+
+	conn := testConn(t)
+	conn.rb = bufio.NewReader(bytes.NewReader(nil))
+	conn.db = 1
+	if err := conn.execRequest([][]byte{[]byte("set"), []byte("t049:k"), []byte("v")}); err != nil {
+		t.Fatal(err)
+	}
+	slowlog.Lock()
+	args := slowlog.entries[len(slowlog.entries)-1].args
+	slowlog.Unlock()
+	if s := fmt.Sprintf("%q", args); s != `["set" "t049:k" "v"]` {
+		t.Fatalf("slowlog args = %s", s)
+	}
+	if v, err := testWorker(t, 1007).testGet("__db1.t049:k"); err != nil || string(v) != "v" {
+		t.Fatalf("value in db 1 = %q, %v", v, err)
+	}
+}
+
+// pipeline中并发执行的命令的回复在内存中合计超过OutputBufferLimit时关闭连接
+func TestPipelineOutputLimit(t *testing.T) {
+	if len(pool.lanes) == 0 {
+		t.Skip("route_by_key is off")
+	}
+	if err := testWorker(t, 1008).testSet("t049:big", strings.Repeat("x", 1000)); err != nil {
+		t.Fatal(err)
+	}
+	old := atomic.LoadInt64(&OutputBufferLimit)
+	defer atomic.StoreInt64(&OutputBufferLimit, old)
+	atomic.StoreInt64(&OutputBufferLimit, 2500)
+
+	conn := testConn(t)
+	// 读缓存中还有数据时按pipeline并发执行
+	conn.rb = bufio.NewReader(strings.NewReader("x"))
+	conn.rb.Peek(1)
+	for i := 0; i < 5; i++ {
+		if err := conn.execRequest([][]byte{[]byte("get"), []byte("t049:big")}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(conn.pending) == 0 {
+		t.Fatal("get not pipelined")
+	}
+	if err := conn.waitPending(); err != ErrOutputLimit {
+		t.Fatalf("waitPending = %v, want %v", err, ErrOutputLimit)
+	}
+	if n := atomic.LoadInt64(&conn.pipeBytes); n != 0 {
+		t.Fatalf("pipeBytes = %d after waitPending", n)
+	}
+}
+
+// benchPipeline 和redis-benchmark -P一样，每个连接一次发送p个SET/INCR，再读取p个回复
+func benchPipeline(b *testing.B, p int) {
+	b.SetParallelism(8)
+	var next int64
+	b.RunParallel(func(pb *testing.PB) {
+		c1, c2 := net.Pipe()
+		defer c2.Close()
+		go NewConn(c1, testEnv).Start()
+		r := bufio.NewReader(c2)
+		var batch bytes.Buffer
+		for {
+			batch.Reset()
+			n := 0
+			for ; n < p && pb.Next(); n++ {
+				key := "t049:bench:" + strconv.FormatInt(atomic.AddInt64(&next, 1)%100000, 10)
+				if n%2 == 0 {
+					fmt.Fprintf(&batch, "*3\r\n$3\r\nSET\r\n$%d\r\n%s\r\n$1\r\n1\r\n", len(key), key)
+				} else {
+					fmt.Fprintf(&batch, "*2\r\n$4\r\nINCR\r\n$%d\r\n%s\r\n", len(key), key)
+				}
+			}
+			if n == 0 {
+				return
+			}
+			if _, err := c2.Write(batch.Bytes()); err != nil {
+				b.Error(err)
+				return
+			}
+			for i := 0; i < n; i++ {
+				line, err := r.ReadString('\n')
+				if err != nil {
+					b.Error(err)
+					return
+				}
+				if line[0] == '-' {
+					b.Error(line)
+					return
+				}
+			}
+		}
+	})
+}
+
+// 对比不使用pipeline和-P 16时的吞吐量，和bench.sh的负载相同，不需要启动bdbd。
+//
+//	go test -run NONE -bench Pipeline ./server
+func BenchmarkPipeline(b *testing.B) {
+	for _, p := range []int{1, 16} {
+		b.Run("P"+strconv.Itoa(p), func(b *testing.B) {
+			benchPipeline(b, p)
+		})
+	}
+}
@@ -1,16 +1,25 @@
 package server
 
 import (
+	"errors"
 	"github.com/nybuxtsui/bdbd/bdb"
 	"github.com/nybuxtsui/log"
+	"math"
+	"runtime"
 	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 	"unsafe"
 )
 
 //#include <stdlib.h>
 import "C"
 
+// argsUnlimited 用于参数个数不固定的命令
+const argsUnlimited = math.MaxInt32
+
 type cmdDef struct {
 	fun     func(*Conn, [][]byte) error
 	minArgs int
@@ -50,27 +59,124 @@ type bdbIncrByResp struct {
 	err    error
 }
 
+type bdbIncrByFloatReq struct {
+	key  []byte
+	inc  float64
+	resp chan bdbGetResp
+}
+
+var (
+	ErrIncrOverflow  = errors.New("increment or decrement would overflow")
+	ErrDecrOverflow  = errors.New("decrement would overflow")
+	ErrNotFloat      = errors.New("value is not a valid float")
+	ErrFloatOverflow = errors.New("increment would produce NaN or Infinity")
+)
+
 var cmdMap = map[string]cmdDef{
+	"hello":    cmdDef{cmdHello, 0, argsUnlimited},
+	"auth":     cmdDef{cmdAuth, 1, 2},
+	"acl":      cmdDef{cmdAcl, 1, argsUnlimited},
+	"ping":     cmdDef{cmdPing, 0, 1},
+	"echo":     cmdDef{cmdEcho, 1, 1},
+	"quit":     cmdDef{cmdQuit, 0, 0},
+	"select":   cmdDef{cmdSelect, 1, 1},
+	"client":   cmdDef{cmdClient, 1, argsUnlimited},
+	"reset":    cmdDef{cmdReset, 0, 0},
+	"info":     cmdDef{cmdInfo, 0, argsUnlimited},
+	"slowlog":  cmdDef{cmdSlowlog, 1, 2},
+	"latency":  cmdDef{cmdLatency, 1, argsUnlimited},
+	"monitor":  cmdDef{cmdMonitor, 0, 0},
+	"config":   cmdDef{cmdConfig, 1, argsUnlimited},
+	"shutdown": cmdDef{cmdShutdown, 0, 1},
+
 	"get":    cmdDef{cmdGet, 1, 1},
 	"set":    cmdDef{cmdSet, 2, 2},
 	"setex":  cmdDef{cmdSetEx, 3, 3},
 	"setnx":  cmdDef{cmdSetNx, 2, 2},
 	"incrby": cmdDef{cmdIncrBy, 2, 2},
 	"incr":   cmdDef{cmdIncr, 1, 1},
+
+	"decrby":      cmdDef{cmdDecrBy, 2, 2},
+	"decr":        cmdDef{cmdDecr, 1, 1},
+	"incrbyfloat": cmdDef{cmdIncrByFloat, 2, 2},
+
+	"setbit":      cmdDef{cmdSetBit, 3, 3},
+	"getbit":      cmdDef{cmdGetBit, 2, 2},
+	"bitcount":    cmdDef{cmdBitCount, 1, 4},
+	"bitpos":      cmdDef{cmdBitPos, 2, 5},
+	"bitop":       cmdDef{cmdBitOp, 3, argsUnlimited},
+	"bitfield":    cmdDef{cmdBitField, 1, argsUnlimited},
+	"bitfield_ro": cmdDef{cmdBitFieldRo, 1, argsUnlimited},
+
+	"append":   cmdDef{cmdAppend, 2, 2},
+	"strlen":   cmdDef{cmdStrLen, 1, 1},
+	"getrange": cmdDef{cmdGetRange, 3, 3},
+	"substr":   cmdDef{cmdGetRange, 3, 3},
+	"setrange": cmdDef{cmdSetRange, 3, 3},
+	"getset":   cmdDef{cmdGetSet, 2, 2},
+	"getdel":   cmdDef{cmdGetDel, 1, 1},
+	"getex":    cmdDef{cmdGetEx, 1, 3},
+
+	"pfadd":   cmdDef{cmdPfAdd, 1, argsUnlimited},
+	"pfcount": cmdDef{cmdPfCount, 1, argsUnlimited},
+	"pfmerge": cmdDef{cmdPfMerge, 1, argsUnlimited},
+
+	"geoadd":    cmdDef{cmdGeoAdd, 4, argsUnlimited},
+	"geopos":    cmdDef{cmdGeoPos, 1, argsUnlimited},
+	"geodist":   cmdDef{cmdGeoDist, 3, 4},
+	"geosearch": cmdDef{cmdGeoSearch, 5, argsUnlimited},
+
+	"idx.create": cmdDef{cmdIndexCreate, 4, 5},
+	"idx.drop":   cmdDef{cmdIndexDrop, 2, 2},
+	"idx.list":   cmdDef{cmdIndexList, 1, 1},
+	"idx.get":    cmdDef{cmdIndexGet, 3, 5},
+	"idx.range":  cmdDef{cmdIndexRange, 4, 6},
+
+	"json.set":       cmdDef{cmdJsonSet, 3, 4},
+	"json.get":       cmdDef{cmdJsonGet, 1, argsUnlimited},
+	"json.del":       cmdDef{cmdJsonDel, 1, 2},
+	"json.forget":    cmdDef{cmdJsonDel, 1, 2},
+	"json.numincrby": cmdDef{cmdJsonNumIncrBy, 3, 3},
+	"json.arrappend": cmdDef{cmdJsonArrAppend, 3, argsUnlimited},
+
+	"getv": cmdDef{cmdGetV, 1, 1},
+	"cas":  cmdDef{cmdCas, 3, 3},
 }
 
 var workWait sync.WaitGroup
-var workChan = make(chan interface{}, 10000)
 
+// workChan 在Start中按WorkQueueSize创建
+var workChan chan workItem
+
+// workItem 发给worker的请求，conn用于记录连接当前由哪个worker处理以及排队时间
+type workItem struct {
+	conn     *Conn
+	req      interface{}
+	enqueued time.Time
+}
+
+// Start 需要在接受连接之前调用
 func Start(dbenv *bdb.DbEnv) {
-	for i := 0; i < 4; i++ {
-		w := NewWorker(i, dbenv)
-		go w.start()
+	workChan = make(chan workItem, WorkQueueSize)
+	initConfig(dbenv)
+	initWorkerConfig(dbenv)
+	initGroupCommitConfig()
+	for i := 0; i < Workers; i++ {
+		var lane chan workItem
+		if RouteByKey {
+			lane = make(chan workItem, WorkQueueSize)
+			pool.lanes = append(pool.lanes, lane)
+		}
+		startWorker(dbenv, lane)
 	}
+	go scaleWorkers(dbenv)
 }
 
 func (w *Worker) start() {
-	workWait.Add(1)
+	if WorkerLockThread {
+		runtime.LockOSThread()
+		defer runtime.UnlockOSThread()
+	}
 	defer func() {
 		for _, db := range w.dbmap {
 			db.Close()
@@ -78,38 +184,144 @@ func (w *Worker) start() {
 		if w.getbuff != 0 {
 			C.free(unsafe.Pointer(w.getbuff))
 		}
+		removeWorker(w)
+		close(w.quit)
 		log.Info("server|close|work|%d", w.id)
 		workWait.Done()
 	}()
-	for req := range workChan {
-		switch req := req.(type) {
-		case bdbSetReq:
-			if req.sec == 0 {
-				w.bdbSet(&req)
-			} else {
-				w.bdbSetEx(&req)
+	// 有自己队列的worker不参与自动伸缩，两个队列都关闭后退出
+	shared, lane, retire := workChan, w.lane, pool.retire
+	if lane != nil {
+		retire = nil
+	}
+	for shared != nil || lane != nil {
+		var item workItem
+		var ok bool
+		select {
+		case item, ok = <-lane:
+			if !ok {
+				lane = nil
+				continue
+			}
+		case item, ok = <-shared:
+			if !ok {
+				shared = nil
+				continue
 			}
-		case bdbGetReq:
-			w.bdbGet(&req)
-		case bdbIncrByReq:
-			w.bdbIncrBy(&req)
+		case req := <-w.ctrl:
+			w.dispatch(req)
+			continue
+		case <-retire:
+			return
+		}
+		if _, ok := item.req.(bdbSetReq); ok && GroupCommit {
+			next := w.groupCommit(item, &shared, &lane)
+			if next == nil {
+				continue
+			}
+			item = *next
 		}
+		if b, ok := item.req.(laneBarrier); ok {
+			b.wait()
+			continue
+		}
+		item.conn.setWorker(int32(w.id))
+		start := time.Now()
+		wait := start.Sub(item.enqueued)
+		recordQueueWait(wait)
+		item.conn.workerStart(start, wait)
+		w.dispatch(item.req)
+		atomic.AddInt64(&w.busy, int64(time.Since(start)))
+		item.conn.clearWorker(int32(w.id))
 	}
 }
 
-func Exit() {
-	close(workChan)
-	workWait.Wait()
+func (w *Worker) dispatch(req interface{}) {
+	switch req := req.(type) {
+	case bdbCloseTableReq:
+		w.bdbCloseTable(&req)
+	case coordinatedReq:
+		req.run(w)
+	case bdbSetReq:
+		if req.sec == 0 {
+			w.bdbSet(&req)
+		} else {
+			w.bdbSetEx(&req)
+		}
+	case bdbGetReq:
+		w.bdbGet(&req)
+	case bdbIncrByReq:
+		w.bdbIncrBy(&req)
+	case bdbIncrByFloatReq:
+		w.bdbIncrByFloat(&req)
+	case bdbGetRangeReq:
+		w.bdbGetRange(&req)
+	case bdbSetBitReq:
+		w.bdbSetBit(&req)
+	case bdbBitOpReq:
+		w.bdbBitOp(&req)
+	case bdbBitFieldReq:
+		w.bdbBitField(&req)
+	case bdbAppendReq:
+		w.bdbAppend(&req)
+	case bdbStrLenReq:
+		w.bdbStrLen(&req)
+	case bdbStrRangeReq:
+		w.bdbStrRange(&req)
+	case bdbSetRangeReq:
+		w.bdbSetRange(&req)
+	case bdbGetSetReq:
+		w.bdbGetSet(&req)
+	case bdbGetDelReq:
+		w.bdbGetDel(&req)
+	case bdbGetExReq:
+		w.bdbGetEx(&req)
+	case bdbPfAddReq:
+		w.bdbPfAdd(&req)
+	case bdbPfCountReq:
+		w.bdbPfCount(&req)
+	case bdbPfMergeReq:
+		w.bdbPfMerge(&req)
+	case bdbGeoAddReq:
+		w.bdbGeoAdd(&req)
+	case bdbGeoPosReq:
+		w.bdbGeoPos(&req)
+	case bdbGeoSearchReq:
+		w.bdbGeoSearch(&req)
+	case bdbIndexCreateReq:
+		w.bdbIndexCreate(&req)
+	case bdbIndexDropReq:
+		w.bdbIndexDrop(&req)
+	case bdbIndexListReq:
+		w.bdbIndexList(&req)
+	case bdbIndexRangeReq:
+		w.bdbIndexRange(&req)
+	case bdbJsonReq:
+		w.bdbJson(&req)
+	case bdbGetVReq:
+		w.bdbGetV(&req)
+	case bdbCasReq:
+		w.bdbCas(&req)
+	case bdbAclSetReq:
+		w.bdbAclSet(&req)
+	case bdbAclLoadReq:
+		w.bdbAclLoad(&req)
+	}
 }
 
 type Worker struct {
 	dbmap       map[string]*bdb.Db
 	expiredb    *bdb.Db
 	expireindex *bdb.Db
+	versiondb   *bdb.Db
 	dbenv       *bdb.DbEnv
 	id          uint32
 	seq         uint32
 	getbuff     uintptr
+	busy        int64            // 处理请求的累计时间，纳秒
+	lane        chan workItem    // 按key分配给这个worker的请求，为nil时只处理共享队列
+	ctrl        chan interface{} // 发给每个worker的请求，比如删除索引后关闭表
+	quit        chan struct{}    // worker退出时关闭
 }
 
 func NewWorker(id int, dbenv *bdb.DbEnv) *Worker {
@@ -118,6 +330,8 @@ func NewWorker(id int, dbenv *bdb.DbEnv) *Worker {
 		dbenv:   dbenv,
 		id:      uint32(id),
 		getbuff: 0,
+		ctrl:    make(chan interface{}),
+		quit:    make(chan struct{}),
 	}
 }
 
@@ -136,6 +350,7 @@ func (w *Worker) getdb(table string, dbtype int) (*bdb.Db, error) {
 }
 
 func (w *Worker) checkerr(err error, db *bdb.Db) {
+	countError(err)
 	if err == bdb.ErrRepDead {
 		delete(w.dbmap, db.Name)
 		db.Close()
@@ -143,74 +358,103 @@ func (w *Worker) checkerr(err error, db *bdb.Db) {
 }
 
 func (w *Worker) bdbSet(req *bdbSetReq) {
+	txn, err := w.dbenv.Begin(bdb.DB_READ_COMMITTED)
+	if err != nil {
+		req.resp <- bdbSetResp{err}
+		return
+	}
+	if err = w.txnSet(txn, req); err != nil {
+		txn.Abort()
+		req.resp <- bdbSetResp{err}
+		return
+	}
+	req.resp <- bdbSetResp{txn.Commit()}
+}
+
+// txnSet 在txn中写入但不提交，组提交时txn是子事务
+func (w *Worker) txnSet(txn *bdb.Txn, req *bdbSetReq) error {
+	key := append([]byte(nil), req.key...)
 	table, name := bdb.SplitKey(req.key)
 	db, err := w.getdb(table, bdb.DBTYPE_BTREE)
 	if err != nil {
-		req.resp <- bdbSetResp{err}
-	} else {
-		var flags uint32 = 0
-		if req.nooverwrite {
-			flags = flags | bdb.DB_NOOVERWRITE
-		}
-		err := db.Set(nil, name, req.value, flags)
-		if err != nil {
-			w.checkerr(err, db)
-			req.resp <- bdbSetResp{err}
-		} else {
-			req.resp <- bdbSetResp{nil}
-		}
+		return err
+	}
+	var flags uint32 = 0
+	if req.nooverwrite {
+		flags = flags | bdb.DB_NOOVERWRITE
 	}
+	err = db.Set(txn, name, req.value, flags)
+	if err != nil {
+		w.checkerr(err, db)
+		return err
+	}
+	_, err = w.bumpVersion(txn, key)
+	return err
 }
 
-func (w *Worker) bdbSetEx(req *bdbSetReq) {
+func (w *Worker) openExpire() error {
 	var err error
 	if w.expiredb == nil {
 		w.expiredb, err = w.dbenv.GetDb("__expire", bdb.DBTYPE_BTREE)
 		if err != nil {
 			log.Error("worker|GetDb|%s", err.Error())
-			req.resp <- bdbSetResp{err}
-			return
+			return err
 		}
 	}
 	if w.expireindex == nil {
 		w.expireindex, err = w.dbenv.GetDb("__expire.index", bdb.DBTYPE_BTREE)
 		if err != nil {
 			log.Error("worker|GetDb|%s", err.Error())
-			req.resp <- bdbSetResp{err}
-			return
+			return err
 		}
 	}
+	return nil
+}
+
+func (w *Worker) checkExpireErr(err error) {
+	countError(err)
+	if err == bdb.ErrRepDead {
+		w.expiredb.Close()
+		w.expiredb = nil
+		w.expireindex.Close()
+		w.expireindex = nil
+	}
+}
 
+func (w *Worker) bdbSetEx(req *bdbSetReq) {
 	txn, err := w.dbenv.Begin(bdb.DB_READ_UNCOMMITTED)
 	if err != nil {
 		req.resp <- bdbSetResp{err}
 		return
 	}
-	defer func() {
-		if txn != nil {
-			txn.Abort()
-		}
-	}()
+	if err = w.txnSetEx(txn, req); err != nil {
+		txn.Abort()
+		req.resp <- bdbSetResp{err}
+		return
+	}
+	req.resp <- bdbSetResp{txn.Commit()}
+}
+
+// txnSetEx 在txn中写入并设置过期时间，不提交
+func (w *Worker) txnSetEx(txn *bdb.Txn, req *bdbSetReq) error {
+	err := w.openExpire()
+	if err != nil {
+		return err
+	}
 	w.seq++
 	err = bdb.SetExpire(w.expiredb, w.expireindex, txn, req.key, req.sec, w.seq, w.id)
 	if err != nil {
-		if err == bdb.ErrRepDead {
-			w.expiredb.Close()
-			w.expiredb = nil
-			w.expireindex.Close()
-			w.expireindex = nil
-		}
+		w.checkExpireErr(err)
 		log.Error("worker|SetExpire|%s", err.Error())
-		req.resp <- bdbSetResp{err}
-		return
+		return err
 	}
 
+	key := append([]byte(nil), req.key...)
 	table, name := bdb.SplitKey(req.key)
 	db, err := w.getdb(table, bdb.DBTYPE_BTREE)
 	if err != nil {
 		w.checkerr(err, db)
-		req.resp <- bdbSetResp{err}
-		return
+		return err
 	}
 	var flags uint32 = 0
 	if req.nooverwrite {
@@ -219,13 +463,10 @@ func (w *Worker) bdbSetEx(req *bdbSetReq) {
 	err = db.Set(txn, name, req.value, flags)
 	if err != nil {
 		w.checkerr(err, db)
-		req.resp <- bdbSetResp{err}
-		return
+		return err
 	}
-
-	txn.Commit()
-	txn = nil
-	req.resp <- bdbSetResp{nil}
+	_, err = w.bumpVersion(txn, key)
+	return err
 }
 
 func (w *Worker) bdbGet(req *bdbGetReq) {
@@ -249,6 +490,7 @@ func (w *Worker) bdbGet(req *bdbGetReq) {
 }
 
 func (w *Worker) bdbIncrBy(req *bdbIncrByReq) {
+	key := append([]byte(nil), req.key...)
 	table, name := bdb.SplitKey(req.key)
 	db, err := w.getdb(table, bdb.DBTYPE_BTREE)
 	if err != nil {
@@ -274,12 +516,16 @@ func (w *Worker) bdbIncrBy(req *bdbIncrByReq) {
 				return
 			}
 		} else {
-			value, err = readNumber(_value)
+			value, err = strconv.ParseInt(string(_value), 10, 64)
 			if err != nil {
-				req.resp <- bdbIncrByResp{0, err}
+				req.resp <- bdbIncrByResp{0, ErrNotInteger}
 				return
 			}
 		}
+		if (req.inc > 0 && value > math.MaxInt64-req.inc) || (req.inc < 0 && value < math.MinInt64-req.inc) {
+			req.resp <- bdbIncrByResp{0, ErrIncrOverflow}
+			return
+		}
 		value += req.inc
 		var buf [64]byte
 		err = db.Set(txn, name, strconv.AppendInt(buf[:0], value, 10), 0)
@@ -287,6 +533,10 @@ func (w *Worker) bdbIncrBy(req *bdbIncrByReq) {
 			req.resp <- bdbIncrByResp{0, err}
 			return
 		}
+		if _, err = w.bumpVersion(txn, key); err != nil {
+			req.resp <- bdbIncrByResp{0, err}
+			return
+		}
 		err = txn.Commit()
 		if err != nil {
 			req.resp <- bdbIncrByResp{0, err}
@@ -298,15 +548,95 @@ func (w *Worker) bdbIncrBy(req *bdbIncrByReq) {
 	}
 }
 
+func (w *Worker) bdbIncrByFloat(req *bdbIncrByFloatReq) {
+	key := append([]byte(nil), req.key...)
+	table, name := bdb.SplitKey(req.key)
+	db, err := w.getdb(table, bdb.DBTYPE_BTREE)
+	if err != nil {
+		req.resp <- bdbGetResp{nil, err}
+		return
+	}
+	txn, err := w.dbenv.Begin(bdb.DB_READ_COMMITTED)
+	if err != nil {
+		req.resp <- bdbGetResp{nil, err}
+		return
+	}
+	defer func() {
+		if txn != nil {
+			txn.Abort()
+		}
+	}()
+
+	_value, err := db.Get(txn, name, &w.getbuff, bdb.DB_RMW)
+	var value float64 = 0
+	if err != nil {
+		if err != bdb.ErrNotFound {
+			w.checkerr(err, db)
+			req.resp <- bdbGetResp{nil, err}
+			return
+		}
+	} else {
+		value, err = parseFloat(_value)
+		if err != nil {
+			req.resp <- bdbGetResp{nil, err}
+			return
+		}
+	}
+	value += req.inc
+	if math.IsNaN(value) || math.IsInf(value, 0) {
+		req.resp <- bdbGetResp{nil, ErrFloatOverflow}
+		return
+	}
+	out := formatFloat(value)
+	err = db.Set(txn, name, out, 0)
+	if err != nil {
+		w.checkerr(err, db)
+		req.resp <- bdbGetResp{nil, err}
+		return
+	}
+	if _, err = w.bumpVersion(txn, key); err != nil {
+		req.resp <- bdbGetResp{nil, err}
+		return
+	}
+	err = txn.Commit()
+	txn = nil
+	if err != nil {
+		req.resp <- bdbGetResp{nil, err}
+		return
+	}
+	req.resp <- bdbGetResp{out, nil}
+}
+
+// parseFloat 与redis一致，不接受前后空白、NaN和Infinity
+func parseFloat(buff []byte) (float64, error) {
+	s := string(buff)
+	if len(s) == 0 || strings.TrimSpace(s) != s {
+		return 0, ErrNotFloat
+	}
+	value, err := strconv.ParseFloat(s, 64)
+	if err != nil || math.IsNaN(value) || math.IsInf(value, 0) {
+		return 0, ErrNotFloat
+	}
+	return value, nil
+}
+
+// formatFloat 输出不带指数的最短表示，与redis的INCRBYFLOAT结果格式相同
+func formatFloat(value float64) []byte {
+	var buf [64]byte
+	return strconv.AppendFloat(buf[:0], value, 'f', -1, 64)
+}
+
 func cmdGet(conn *Conn, args [][]byte) (err error) {
 	log.Debug("cmdGet|%s", args[0])
 	respChan := make(chan bdbGetResp, 1)
-	workChan <- bdbGetReq{args[0], respChan}
+	if ok, err := conn.sendOrBusy(bdbGetReq{args[0], respChan}); !ok {
+		return err
+	}
 	resp := <-respChan
 	if resp.err != nil {
 		_, err = conn.wb.WriteString("-ERR dberr\r\n")
 	} else if resp.value == nil {
-		_, err = conn.wb.WriteString("$-1\r\n")
+		err = conn.writeNull()
 	} else {
 		conn.writeLen('$', len(resp.value))
 		conn.wb.Write(resp.value)
@@ -318,7 +648,9 @@ func cmdGet(conn *Conn, args [][]byte) (err error) {
 func cmdSet(conn *Conn, args [][]byte) (err error) {
 	log.Debug("cmdSet|%s|%v", args[0], args[1])
 	respChan := make(chan bdbSetResp, 1)
-	workChan <- bdbSetReq{args[0], args[1], 0, false, respChan}
+	if ok, err := conn.sendOrBusy(bdbSetReq{args[0], args[1], 0, false, respChan}); !ok {
+		return err
+	}
 	resp := <-respChan
 	if resp.err != nil {
 		conn.wb.WriteString("-ERR ")
@@ -334,7 +666,9 @@ func cmdSetEx(conn *Conn, args [][]byte) (err error) {
 	log.Debug("cmdSetEx|%s|%s|%s", args[0], args[1], args[2])
 	if sec, err := strconv.ParseUint(string(args[1]), 10, 32); err == nil {
 		respChan := make(chan bdbSetResp, 1)
-		workChan <- bdbSetReq{args[0], args[2], uint32(sec), false, respChan}
+		if ok, err := conn.sendOrBusy(bdbSetReq{args[0], args[2], uint32(sec), false, respChan}); !ok {
+			return err
+		}
 		resp := <-respChan
 		if resp.err != nil {
 			conn.wb.WriteString("-ERR ")
@@ -352,7 +686,9 @@ func cmdSetEx(conn *Conn, args [][]byte) (err error) {
 func cmdSetNx(conn *Conn, args [][]byte) (err error) {
 	log.Debug("cmdSetNx|%s|%v", args[0], args[1])
 	respChan := make(chan bdbSetResp, 1)
-	workChan <- bdbSetReq{args[0], args[1], 0, true, respChan}
+	if ok, err := conn.sendOrBusy(bdbSetReq{args[0], args[1], 0, true, respChan}); !ok {
+		return err
+	}
 	resp := <-respChan
 	if resp.err != nil {
 		if resp.err == bdb.ErrKeyExist {
@@ -370,46 +706,60 @@ func cmdSetNx(conn *Conn, args [][]byte) (err error) {
 
 func cmdIncrBy(conn *Conn, args [][]byte) (err error) {
 	log.Debug("cmdIncrBy|%s|%v", args[0], args[1])
-	if inc, err := strconv.ParseInt(string(args[1]), 10, 64); err == nil {
-		respChan := make(chan bdbIncrByResp, 1)
-		workChan <- bdbIncrByReq{args[0], inc, respChan}
-		resp := <-respChan
-		if resp.err != nil {
-			if resp.err == ErrRequest {
-				_, err = conn.wb.WriteString("-ERR value is not an integer or out of range\r\n")
-			} else {
-				conn.wb.WriteString("-ERR ")
-				conn.wb.WriteString(resp.err.Error())
-				_, err = conn.wb.WriteString("\r\n")
-			}
-		} else {
-			var buf [64]byte
-			out := strconv.AppendInt(buf[:0], resp.result, 10)
-			conn.wb.WriteString(":")
-			conn.wb.Write(out)
-			_, err = conn.wb.WriteString("\r\n")
-		}
-	} else {
-		_, err = conn.wb.WriteString("-ERR argument err")
+	inc, err := strconv.ParseInt(string(args[1]), 10, 64)
+	if err != nil {
+		return conn.writeError(ErrNotInteger)
 	}
-	return
+	return incrBy(conn, args[0], inc)
 }
 
 func cmdIncr(conn *Conn, args [][]byte) (err error) {
 	log.Debug("cmdIncr|%s", args[0])
+	return incrBy(conn, args[0], 1)
+}
+
+func cmdDecrBy(conn *Conn, args [][]byte) (err error) {
+	log.Debug("cmdDecrBy|%s|%v", args[0], args[1])
+	dec, err := strconv.ParseInt(string(args[1]), 10, 64)
+	if err != nil {
+		return conn.writeError(ErrNotInteger)
+	}
+	if dec == math.MinInt64 {
+		return conn.writeError(ErrDecrOverflow)
+	}
+	return incrBy(conn, args[0], -dec)
+}
+
+func cmdDecr(conn *Conn, args [][]byte) (err error) {
+	log.Debug("cmdDecr|%s", args[0])
+	return incrBy(conn, args[0], -1)
+}
+
+func incrBy(conn *Conn, key []byte, inc int64) error {
 	respChan := make(chan bdbIncrByResp, 1)
-	workChan <- bdbIncrByReq{args[0], 1, respChan}
+	if ok, err := conn.sendOrBusy(bdbIncrByReq{key, inc, respChan}); !ok {
+		return err
+	}
 	resp := <-respChan
 	if resp.err != nil {
-		if resp.err == ErrRequest {
-			_, err = conn.wb.WriteString("-ERR value is not an integer or out of range\r\n")
-		} else {
-			conn.wb.WriteString("-ERR ")
-			conn.wb.WriteString(resp.err.Error())
-			_, err = conn.wb.WriteString("\r\n")
-		}
-	} else {
-		_, err = conn.wb.WriteString("+OK\r\n")
+		return conn.writeError(resp.err)
 	}
-	return
+	return conn.writeInt(resp.result)
+}
+
+func cmdIncrByFloat(conn *Conn, args [][]byte) (err error) {
+	log.Debug("cmdIncrByFloat|%s|%v", args[0], args[1])
+	inc, err := parseFloat(args[1])
+	if err != nil {
+		return conn.writeError(err)
+	}
+	respChan := make(chan bdbGetResp, 1)
+	if ok, err := conn.sendOrBusy(bdbIncrByFloatReq{args[0], inc, respChan}); !ok {
+		return err
+	}
+	resp := <-respChan
+	if resp.err != nil {
+		return conn.writeError(resp.err)
+	}
+	return conn.writeBulk(resp.value)
 }
@@ -0,0 +1,109 @@
+package server
+
+import (
+	"errors"
+	"github.com/nybuxtsui/log"
+	"strings"
+	"sync"
+	"time"
+)
+
+var ErrShutdown = errors.New("Server is shutting down")
+
+// ShutdownTimeout 退出时等待正在执行的命令的时间，超过后直接关闭客户端连接
+var ShutdownTimeout = 10 * time.Second
+
+// ShutdownChan SHUTDOWN命令通知main退出，值表示是否需要checkpoint
+var ShutdownChan = make(chan bool, 1)
+
+// shutdown closing之后不再接受新的命令，inflight为正在执行的命令
+var shutdown = struct {
+	sync.RWMutex
+	closing  bool
+	ch       chan struct{} // closing时关闭，通知MONITOR这样一直执行的命令退出
+	inflight sync.WaitGroup
+}{ch: make(chan struct{})}
+
+// beginCommand 返回false表示正在退出，不能再执行命令
+func beginCommand() bool {
+	shutdown.RLock()
+	defer shutdown.RUnlock()
+	if shutdown.closing {
+		return false
+	}
+	shutdown.inflight.Add(1)
+	return true
+}
+
+func endCommand() {
+	shutdown.inflight.Done()
+}
+
+// Exit 按顺序退出: 拒绝新的命令，等待正在执行的命令，关闭客户端连接，
+// 连接和worker退出时会关闭各自打开的表。调用之前应该已经停止接受新的连接
+func Exit() {
+	log.Info("Exit|closing")
+	shutdown.Lock()
+	shutdown.closing = true
+	close(shutdown.ch)
+	shutdown.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		shutdown.inflight.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(ShutdownTimeout):
+		log.Error("Exit|inflight_timeout|%s", ShutdownTimeout)
+	}
+
+	// 关闭连接后正在等待worker的命令还会等到结果，
+	// 所有连接的goroutine结束之后workChan中不会再有新的请求
+	conns.Lock()
+	conns.closed = true
+	for _, c := range conns.m {
+		c.Close()
+	}
+	conns.Unlock()
+	// 连接的goroutine卡在写回复等操作时不再等待，继续关闭worker和环境
+	done = make(chan struct{})
+	go func() {
+		conns.wait.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		log.Info("Exit|clients_closed")
+	case <-time.After(ShutdownTimeout):
+		log.Error("Exit|conns_timeout|%s", ShutdownTimeout)
+	}
+
+	stopWorkers()
+	log.Info("Exit|workers_closed")
+}
+
+// cmdShutdown SHUTDOWN [NOSAVE|SAVE]，NOSAVE时退出前不做checkpoint。成功时不回复，直接关闭连接
+func cmdShutdown(conn *Conn, args [][]byte) (err error) {
+	log.Debug("cmdShutdown|%d", len(args))
+	save := true
+	for _, arg := range args {
+		switch strings.ToLower(string(arg)) {
+		case "nosave":
+			save = false
+		case "save":
+			save = true
+		default:
+			return conn.writeError(ErrSyntax)
+		}
+	}
+	log.Info("cmdShutdown|%s|save=%v", conn.addr, save)
+	select {
+	case ShutdownChan <- save:
+	default:
+		return conn.writeErrorCode("SHUTDOWN", ErrShutdown)
+	}
+	conn.quit = true
+	return nil
+}
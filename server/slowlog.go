@@ -0,0 +1,311 @@
+package server
+
+import (
+	"fmt"
+	"github.com/nybuxtsui/log"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	// SlowlogSlowerThan 执行时间超过这个值(微秒)的命令记录到slowlog，0记录所有命令，负数关闭
+	SlowlogSlowerThan int64 = 10000
+	// SlowlogMaxLen slowlog最多保存的条数，运行时修改需要持有slowlog的锁
+	SlowlogMaxLen = 128
+	// LatencyThreshold 耗时超过这个值(毫秒)时记录到LATENCY，0关闭
+	LatencyThreshold int64 = 0
+)
+
+const (
+	slowlogMaxArgc   = 32
+	slowlogMaxArgLen = 128
+	latencyMaxSample = 160
+)
+
+// 记录到LATENCY的事件
+const (
+	latencyCommand    = "command"     // 整个命令的耗时
+	latencyQueueWait  = "queue-wait"  // 在workChan中等待的时间
+	latencyWorkerExec = "worker-exec" // worker开始处理到命令结束的时间
+)
+
+// SetSlowlogMaxLen 修改slowlog最多保存的条数，启动时和CONFIG SET使用同样的范围检查
+func SetSlowlogMaxLen(n int64) error {
+	if n < 0 || n > math32 {
+		return fmt.Errorf("argument must be an integer between %d and %d", 0, math32)
+	}
+	slowlog.Lock()
+	SlowlogMaxLen = int(n)
+	slowlog.Unlock()
+	return nil
+}
+
+type slowlogEntry struct {
+	id       int64
+	time     int64
+	duration int64 // 微秒，下同
+	wait     int64
+	exec     int64
+	args     [][]byte
+	addr     string
+	name     string
+}
+
+// slowlog 按时间顺序保存，最新的在最后
+var slowlog = struct {
+	sync.Mutex
+	entries []*slowlogEntry
+	nextId  int64
+}{}
+
+type latencySample struct {
+	time int64
+	ms   int64
+}
+
+type latencyEvent struct {
+	samples []latencySample
+	max     int64
+}
+
+var latency = struct {
+	sync.Mutex
+	events map[string]*latencyEvent
+}{events: make(map[string]*latencyEvent)}
+
+// saveArgs 保存截断后的参数，worker中的SplitKey会修改key，执行之后就取不到原来的参数了
+func (c *Conn) saveArgs(req [][]byte) {
+	c.argbuf = c.argbuf[:0]
+	c.argends = c.argends[:0]
+	c.arglens = c.arglens[:0]
+	c.argc = len(req)
+	for i, arg := range req {
+		if i == slowlogMaxArgc {
+			break
+		}
+		c.arglens = append(c.arglens, len(arg))
+		if len(arg) > slowlogMaxArgLen {
+			arg = arg[:slowlogMaxArgLen]
+		}
+		c.argbuf = append(c.argbuf, arg...)
+		c.argends = append(c.argends, len(c.argbuf))
+	}
+}
+
+// slowArgs 和redis一样，超过的参数个数和长度以说明代替
+func (c *Conn) slowArgs() [][]byte {
+	n := len(c.argends)
+	if c.argc > n {
+		n--
+	}
+	args := make([][]byte, 0, len(c.argends))
+	start := 0
+	for i := 0; i < n; i++ {
+		arg := append([]byte(nil), c.argbuf[start:c.argends[i]]...)
+		if c.arglens[i] > slowlogMaxArgLen {
+			arg = append(arg, fmt.Sprintf("... (%d more bytes)", c.arglens[i]-slowlogMaxArgLen)...)
+		}
+		args = append(args, arg)
+		start = c.argends[i]
+	}
+	if c.argc > n {
+		args = append(args, []byte(fmt.Sprintf("... (%d more arguments)", c.argc-n)))
+	}
+	return args
+}
+
+// workerStart worker开始处理本连接的请求，在回复之前调用
+func (c *Conn) workerStart(start time.Time, wait time.Duration) {
+	atomic.AddInt64(&c.waitNs, int64(wait))
+	atomic.CompareAndSwapInt64(&c.execStart, 0, start.UnixNano())
+}
+
+// recordSlow 命令执行结束后记录slowlog和latency
+func (c *Conn) recordSlow(start time.Time, end time.Time) {
+	duration := end.Sub(start)
+	wait := time.Duration(atomic.LoadInt64(&c.waitNs))
+	var exec time.Duration
+	if execStart := atomic.LoadInt64(&c.execStart); execStart != 0 {
+		exec = time.Duration(end.UnixNano() - execStart)
+	}
+
+	if threshold := atomic.LoadInt64(&LatencyThreshold); threshold > 0 {
+		latencyAdd(latencyCommand, end, duration, threshold)
+		latencyAdd(latencyQueueWait, end, wait, threshold)
+		latencyAdd(latencyWorkerExec, end, exec, threshold)
+	}
+
+	slower := atomic.LoadInt64(&SlowlogSlowerThan)
+	if slower < 0 || int64(duration/time.Microsecond) < slower {
+		return
+	}
+	c.mu.Lock()
+	name := c.name
+	c.mu.Unlock()
+	entry := &slowlogEntry{
+		time:     start.Unix(),
+		duration: int64(duration / time.Microsecond),
+		wait:     int64(wait / time.Microsecond),
+		exec:     int64(exec / time.Microsecond),
+		args:     c.slowArgs(),
+		addr:     c.addr,
+		name:     name,
+	}
+	slowlog.Lock()
+	entry.id = slowlog.nextId
+	slowlog.nextId++
+	slowlog.entries = append(slowlog.entries, entry)
+	if n := len(slowlog.entries) - SlowlogMaxLen; n > 0 {
+		slowlog.entries = append(slowlog.entries[:0], slowlog.entries[n:]...)
+	}
+	slowlog.Unlock()
+}
+
+// latencyAdd 同一秒内的多次记录只保留最大值
+func latencyAdd(event string, now time.Time, d time.Duration, threshold int64) {
+	ms := int64(d / time.Millisecond)
+	if ms < threshold {
+		return
+	}
+	ts := now.Unix()
+	latency.Lock()
+	defer latency.Unlock()
+	e := latency.events[event]
+	if e == nil {
+		e = &latencyEvent{}
+		latency.events[event] = e
+	}
+	if ms > e.max {
+		e.max = ms
+	}
+	if n := len(e.samples); n > 0 && e.samples[n-1].time == ts {
+		if ms > e.samples[n-1].ms {
+			e.samples[n-1].ms = ms
+		}
+		return
+	}
+	e.samples = append(e.samples, latencySample{ts, ms})
+	if n := len(e.samples) - latencyMaxSample; n > 0 {
+		e.samples = append(e.samples[:0], e.samples[n:]...)
+	}
+}
+
+// cmdSlowlog SLOWLOG GET [count] | LEN | RESET
+// GET的每一项在redis的6个字段之后增加了排队时间和worker处理时间(微秒)
+func cmdSlowlog(conn *Conn, args [][]byte) (err error) {
+	log.Debug("cmdSlowlog|%s", args[0])
+	sub := strings.ToLower(string(args[0]))
+	switch {
+	case sub == "len" && len(args) == 1:
+		slowlog.Lock()
+		n := len(slowlog.entries)
+		slowlog.Unlock()
+		return conn.writeInt(int64(n))
+	case sub == "reset" && len(args) == 1:
+		slowlog.Lock()
+		slowlog.entries = nil
+		slowlog.Unlock()
+		_, err = conn.wb.WriteString("+OK\r\n")
+		return
+	case sub == "get":
+		count := 10
+		if len(args) == 2 {
+			n, err := strconv.ParseInt(string(args[1]), 10, 32)
+			if err != nil || n < -1 {
+				return conn.writeError(ErrNotInteger)
+			}
+			count = int(n)
+		}
+		slowlog.Lock()
+		entries := slowlog.entries
+		if count < 0 || count > len(entries) {
+			count = len(entries)
+		}
+		list := make([]*slowlogEntry, count)
+		for i := 0; i < count; i++ {
+			list[i] = entries[len(entries)-1-i]
+		}
+		slowlog.Unlock()
+
+		conn.writeLen('*', len(list))
+		for _, e := range list {
+			conn.writeLen('*', 8)
+			conn.writeInt(e.id)
+			conn.writeInt(e.time)
+			conn.writeInt(e.duration)
+			conn.writeLen('*', len(e.args))
+			for _, arg := range e.args {
+				conn.writeBulk(arg)
+			}
+			conn.writeBulk([]byte(e.addr))
+			conn.writeBulk([]byte(e.name))
+			conn.writeInt(e.wait)
+			err = conn.writeInt(e.exec)
+		}
+		return
+	}
+	return conn.writeError(fmt.Errorf("unknown subcommand or wrong number of arguments for '%s'", sub))
+}
+
+// cmdLatency LATENCY LATEST | HISTORY event | RESET [event ...]
+func cmdLatency(conn *Conn, args [][]byte) (err error) {
+	log.Debug("cmdLatency|%s", args[0])
+	sub := strings.ToLower(string(args[0]))
+	switch {
+	case sub == "latest" && len(args) == 1:
+		latency.Lock()
+		names := make([]string, 0, len(latency.events))
+		for name := range latency.events {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		conn.writeLen('*', len(names))
+		for _, name := range names {
+			e := latency.events[name]
+			last := e.samples[len(e.samples)-1]
+			conn.writeLen('*', 4)
+			conn.writeBulk([]byte(name))
+			conn.writeInt(last.time)
+			conn.writeInt(last.ms)
+			err = conn.writeInt(e.max)
+		}
+		latency.Unlock()
+		return
+	case sub == "history" && len(args) == 2:
+		latency.Lock()
+		defer latency.Unlock()
+		e := latency.events[strings.ToLower(string(args[1]))]
+		if e == nil {
+			return conn.writeLen('*', 0)
+		}
+		conn.writeLen('*', len(e.samples))
+		for _, s := range e.samples {
+			conn.writeLen('*', 2)
+			conn.writeInt(s.time)
+			err = conn.writeInt(s.ms)
+		}
+		return
+	case sub == "reset":
+		latency.Lock()
+		n := 0
+		if len(args) == 1 {
+			n = len(latency.events)
+			latency.events = make(map[string]*latencyEvent)
+		} else {
+			for _, arg := range args[1:] {
+				name := strings.ToLower(string(arg))
+				if latency.events[name] != nil {
+					delete(latency.events, name)
+					n++
+				}
+			}
+		}
+		latency.Unlock()
+		return conn.writeInt(int64(n))
+	}
+	return conn.writeError(fmt.Errorf("unknown subcommand or wrong number of arguments for '%s'", sub))
+}
@@ -0,0 +1,45 @@
+package server
+
+import (
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// 配置文件中slowlog_max_len为负数时启动失败，不能等到记录slowlog时panic
+func TestSetSlowlogMaxLen(t *testing.T) {
+	oldLen, oldSlower := SlowlogMaxLen, atomic.LoadInt64(&SlowlogSlowerThan)
+	defer func() {
+		SetSlowlogMaxLen(int64(oldLen))
+		atomic.StoreInt64(&SlowlogSlowerThan, oldSlower)
+	}()
+
+	if err := SetSlowlogMaxLen(-1); err == nil {
+		t.Fatal("SetSlowlogMaxLen(-1) succeeded")
+	}
+	if SlowlogMaxLen != oldLen {
+		t.Fatalf("SlowlogMaxLen = %d, want %d", SlowlogMaxLen, oldLen)
+	}
+
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+	conn := NewConn(c1, testEnv)
+	atomic.StoreInt64(&SlowlogSlowerThan, 0)
+	for _, max := range []int64{0, 2} {
+		if err := SetSlowlogMaxLen(max); err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 3; i++ {
+			now := time.Now()
+			conn.recordSlow(now, now)
+		}
+		slowlog.Lock()
+		n := len(slowlog.entries)
+		slowlog.Unlock()
+		if int64(n) != max {
+			t.Fatalf("slowlog len = %d, want %d", n, max)
+		}
+	}
+}
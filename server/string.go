@@ -0,0 +1,610 @@
+package server
+
+import (
+	"errors"
+	"github.com/nybuxtsui/bdbd/bdb"
+	"github.com/nybuxtsui/log"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// redis的字符串最大为512MB
+const maxStringSize = 512 * 1024 * 1024
+
+var (
+	ErrOffsetRange = errors.New("offset is out of range")
+	ErrStringSize  = errors.New("string exceeds maximum allowed size (proto-max-bulk-len)")
+	ErrGetExExpire = errors.New("invalid expire time in 'getex' command")
+)
+
+const (
+	expireKeep = iota
+	expireSet
+	expirePersist
+	expireDel
+)
+
+type bdbAppendReq struct {
+	key   []byte
+	value []byte
+	resp  chan bdbIntResp
+}
+
+type bdbStrLenReq struct {
+	key  []byte
+	resp chan bdbIntResp
+}
+
+type bdbStrRangeReq struct {
+	key   []byte
+	start int64
+	end   int64
+	resp  chan bdbGetResp
+}
+
+type bdbSetRangeReq struct {
+	key   []byte
+	off   uint32
+	value []byte
+	resp  chan bdbIntResp
+}
+
+type bdbGetSetReq struct {
+	key   []byte
+	value []byte
+	resp  chan bdbGetResp
+}
+
+type bdbGetDelReq struct {
+	key  []byte
+	resp chan bdbGetResp
+}
+
+type bdbGetExReq struct {
+	key  []byte
+	mode int
+	sec  uint32
+	resp chan bdbGetResp
+}
+
+// bdbAppend 先取得记录长度，再把value以partial put写到记录末尾
+func (w *Worker) bdbAppend(req *bdbAppendReq) {
+	key := append([]byte(nil), req.key...)
+	table, name := bdb.SplitKey(req.key)
+	db, err := w.getdb(table, bdb.DBTYPE_BTREE)
+	if err != nil {
+		req.resp <- bdbIntResp{0, err}
+		return
+	}
+	txn, err := w.dbenv.Begin(bdb.DB_READ_COMMITTED)
+	if err != nil {
+		req.resp <- bdbIntResp{0, err}
+		return
+	}
+	defer func() {
+		if txn != nil {
+			txn.Abort()
+		}
+	}()
+
+	size, err := db.Size(txn, name, bdb.DB_RMW)
+	if err != nil && err != bdb.ErrNotFound {
+		w.checkerr(err, db)
+		req.resp <- bdbIntResp{0, err}
+		return
+	}
+	if int64(size)+int64(len(req.value)) > maxStringSize {
+		req.resp <- bdbIntResp{0, ErrStringSize}
+		return
+	}
+	err = db.SetPartial(txn, name, size, 0, req.value, 0)
+	if err != nil {
+		w.checkerr(err, db)
+		req.resp <- bdbIntResp{0, err}
+		return
+	}
+	if _, err = w.bumpVersion(txn, key); err != nil {
+		req.resp <- bdbIntResp{0, err}
+		return
+	}
+	err = txn.Commit()
+	txn = nil
+	if err != nil {
+		req.resp <- bdbIntResp{0, err}
+		return
+	}
+	req.resp <- bdbIntResp{int64(size) + int64(len(req.value)), nil}
+}
+
+func (w *Worker) bdbStrLen(req *bdbStrLenReq) {
+	table, name := bdb.SplitKey(req.key)
+	db, err := w.getdb(table, bdb.DBTYPE_BTREE)
+	if err != nil {
+		req.resp <- bdbIntResp{0, err}
+		return
+	}
+	size, err := db.Size(nil, name, 0)
+	if err != nil && err != bdb.ErrNotFound {
+		w.checkerr(err, db)
+		req.resp <- bdbIntResp{0, err}
+		return
+	}
+	req.resp <- bdbIntResp{int64(size), nil}
+}
+
+func (w *Worker) bdbStrRange(req *bdbStrRangeReq) {
+	table, name := bdb.SplitKey(req.key)
+	db, err := w.getdb(table, bdb.DBTYPE_BTREE)
+	if err != nil {
+		req.resp <- bdbGetResp{nil, err}
+		return
+	}
+	start, end := req.start, req.end
+	if start < 0 && end < 0 && start > end {
+		req.resp <- bdbGetResp{[]byte{}, nil}
+		return
+	}
+	// 只有下标为负数时才需要知道字符串的长度
+	if start < 0 || end < 0 {
+		size, err := db.Size(nil, name, 0)
+		if err != nil && err != bdb.ErrNotFound {
+			w.checkerr(err, db)
+			req.resp <- bdbGetResp{nil, err}
+			return
+		}
+		strlen := int64(size)
+		if start < 0 {
+			start = strlen + start
+		}
+		if end < 0 {
+			end = strlen + end
+		}
+		if start < 0 {
+			start = 0
+		}
+		if end < 0 {
+			end = 0
+		}
+		if end >= strlen {
+			end = strlen - 1
+		}
+	}
+	if start > end || start >= maxStringSize {
+		req.resp <- bdbGetResp{[]byte{}, nil}
+		return
+	}
+	if end >= maxStringSize {
+		end = maxStringSize - 1
+	}
+	value, err := db.GetPartial(nil, name, uint32(start), uint32(end-start+1), &w.getbuff, 0)
+	if err != nil {
+		if err == bdb.ErrNotFound {
+			req.resp <- bdbGetResp{[]byte{}, nil}
+		} else {
+			w.checkerr(err, db)
+			req.resp <- bdbGetResp{nil, err}
+		}
+		return
+	}
+	req.resp <- bdbGetResp{value, nil}
+}
+
+func (w *Worker) bdbSetRange(req *bdbSetRangeReq) {
+	key := append([]byte(nil), req.key...)
+	table, name := bdb.SplitKey(req.key)
+	db, err := w.getdb(table, bdb.DBTYPE_BTREE)
+	if err != nil {
+		req.resp <- bdbIntResp{0, err}
+		return
+	}
+	txn, err := w.dbenv.Begin(bdb.DB_READ_COMMITTED)
+	if err != nil {
+		req.resp <- bdbIntResp{0, err}
+		return
+	}
+	defer func() {
+		if txn != nil {
+			txn.Abort()
+		}
+	}()
+
+	size, err := db.Size(txn, name, bdb.DB_RMW)
+	if err != nil && err != bdb.ErrNotFound {
+		w.checkerr(err, db)
+		req.resp <- bdbIntResp{0, err}
+		return
+	}
+	// value为空时不修改也不创建记录，只返回当前长度
+	if len(req.value) == 0 {
+		req.resp <- bdbIntResp{int64(size), nil}
+		return
+	}
+	err = db.SetPartial(txn, name, req.off, uint32(len(req.value)), req.value, 0)
+	if err != nil {
+		w.checkerr(err, db)
+		req.resp <- bdbIntResp{0, err}
+		return
+	}
+	if _, err = w.bumpVersion(txn, key); err != nil {
+		req.resp <- bdbIntResp{0, err}
+		return
+	}
+	err = txn.Commit()
+	txn = nil
+	if err != nil {
+		req.resp <- bdbIntResp{0, err}
+		return
+	}
+	newlen := int64(req.off) + int64(len(req.value))
+	if int64(size) > newlen {
+		newlen = int64(size)
+	}
+	req.resp <- bdbIntResp{newlen, nil}
+}
+
+// bdbGetSet 和redis一样，写入新值后key不再过期
+func (w *Worker) bdbGetSet(req *bdbGetSetReq) {
+	err := w.openExpire()
+	if err != nil {
+		req.resp <- bdbGetResp{nil, err}
+		return
+	}
+	key := append([]byte(nil), req.key...)
+	table, name := bdb.SplitKey(req.key)
+	db, err := w.getdb(table, bdb.DBTYPE_BTREE)
+	if err != nil {
+		req.resp <- bdbGetResp{nil, err}
+		return
+	}
+	txn, err := w.dbenv.Begin(bdb.DB_READ_COMMITTED)
+	if err != nil {
+		req.resp <- bdbGetResp{nil, err}
+		return
+	}
+	defer func() {
+		if txn != nil {
+			txn.Abort()
+		}
+	}()
+
+	value, err := db.Get(txn, name, &w.getbuff, bdb.DB_RMW)
+	if err != nil && err != bdb.ErrNotFound {
+		w.checkerr(err, db)
+		req.resp <- bdbGetResp{nil, err}
+		return
+	}
+	err = db.Set(txn, name, req.value, 0)
+	if err != nil {
+		w.checkerr(err, db)
+		req.resp <- bdbGetResp{nil, err}
+		return
+	}
+	err = w.persist(txn, key)
+	if err != nil {
+		req.resp <- bdbGetResp{nil, err}
+		return
+	}
+	if _, err = w.bumpVersion(txn, key); err != nil {
+		req.resp <- bdbGetResp{nil, err}
+		return
+	}
+	err = txn.Commit()
+	txn = nil
+	if err != nil {
+		req.resp <- bdbGetResp{nil, err}
+		return
+	}
+	req.resp <- bdbGetResp{value, nil}
+}
+
+func (w *Worker) bdbGetDel(req *bdbGetDelReq) {
+	err := w.openExpire()
+	if err != nil {
+		req.resp <- bdbGetResp{nil, err}
+		return
+	}
+	key := append([]byte(nil), req.key...)
+	table, name := bdb.SplitKey(req.key)
+	db, err := w.getdb(table, bdb.DBTYPE_BTREE)
+	if err != nil {
+		req.resp <- bdbGetResp{nil, err}
+		return
+	}
+	txn, err := w.dbenv.Begin(bdb.DB_READ_COMMITTED)
+	if err != nil {
+		req.resp <- bdbGetResp{nil, err}
+		return
+	}
+	defer func() {
+		if txn != nil {
+			txn.Abort()
+		}
+	}()
+
+	value, err := db.Get(txn, name, &w.getbuff, bdb.DB_RMW)
+	if err != nil {
+		if err == bdb.ErrNotFound {
+			req.resp <- bdbGetResp{nil, nil}
+		} else {
+			w.checkerr(err, db)
+			req.resp <- bdbGetResp{nil, err}
+		}
+		return
+	}
+	err = db.Del(txn, name, 0)
+	if err != nil {
+		w.checkerr(err, db)
+		req.resp <- bdbGetResp{nil, err}
+		return
+	}
+	err = w.persist(txn, key)
+	if err != nil {
+		req.resp <- bdbGetResp{nil, err}
+		return
+	}
+	if _, err = w.bumpVersion(txn, key); err != nil {
+		req.resp <- bdbGetResp{nil, err}
+		return
+	}
+	err = txn.Commit()
+	txn = nil
+	if err != nil {
+		req.resp <- bdbGetResp{nil, err}
+		return
+	}
+	req.resp <- bdbGetResp{value, nil}
+}
+
+func (w *Worker) bdbGetEx(req *bdbGetExReq) {
+	if req.mode != expireKeep {
+		err := w.openExpire()
+		if err != nil {
+			req.resp <- bdbGetResp{nil, err}
+			return
+		}
+	}
+	key := append([]byte(nil), req.key...)
+	table, name := bdb.SplitKey(req.key)
+	db, err := w.getdb(table, bdb.DBTYPE_BTREE)
+	if err != nil {
+		req.resp <- bdbGetResp{nil, err}
+		return
+	}
+	if req.mode == expireKeep {
+		value, err := db.Get(nil, name, &w.getbuff, 0)
+		if err != nil && err != bdb.ErrNotFound {
+			w.checkerr(err, db)
+			req.resp <- bdbGetResp{nil, err}
+			return
+		}
+		req.resp <- bdbGetResp{value, nil}
+		return
+	}
+
+	txn, err := w.dbenv.Begin(bdb.DB_READ_COMMITTED)
+	if err != nil {
+		req.resp <- bdbGetResp{nil, err}
+		return
+	}
+	defer func() {
+		if txn != nil {
+			txn.Abort()
+		}
+	}()
+
+	value, err := db.Get(txn, name, &w.getbuff, bdb.DB_RMW)
+	if err != nil {
+		if err == bdb.ErrNotFound {
+			req.resp <- bdbGetResp{nil, nil}
+		} else {
+			w.checkerr(err, db)
+			req.resp <- bdbGetResp{nil, err}
+		}
+		return
+	}
+	switch req.mode {
+	case expireSet:
+		w.seq++
+		err = bdb.SetExpire(w.expiredb, w.expireindex, txn, key, req.sec, w.seq, w.id)
+		w.checkExpireErr(err)
+	case expirePersist:
+		err = w.persist(txn, key)
+	case expireDel:
+		err = db.Del(txn, name, 0)
+		if err != nil {
+			w.checkerr(err, db)
+		} else if err = w.persist(txn, key); err == nil {
+			_, err = w.bumpVersion(txn, key)
+		}
+	}
+	if err != nil {
+		req.resp <- bdbGetResp{nil, err}
+		return
+	}
+	err = txn.Commit()
+	txn = nil
+	if err != nil {
+		req.resp <- bdbGetResp{nil, err}
+		return
+	}
+	req.resp <- bdbGetResp{value, nil}
+}
+
+// persist 删除key的过期索引，过期线程发现索引不存在时会跳过对应的过期记录
+func (w *Worker) persist(txn *bdb.Txn, key []byte) error {
+	err := w.expireindex.Del(txn, key, 0)
+	if err == bdb.ErrNotFound {
+		return nil
+	}
+	w.checkExpireErr(err)
+	return err
+}
+
+func cmdAppend(conn *Conn, args [][]byte) (err error) {
+	log.Debug("cmdAppend|%s|%v", args[0], args[1])
+	respChan := make(chan bdbIntResp, 1)
+	if ok, err := conn.sendOrBusy(bdbAppendReq{args[0], args[1], respChan}); !ok {
+		return err
+	}
+	resp := <-respChan
+	if resp.err != nil {
+		return conn.writeError(resp.err)
+	}
+	return conn.writeInt(resp.result)
+}
+
+func cmdStrLen(conn *Conn, args [][]byte) (err error) {
+	log.Debug("cmdStrLen|%s", args[0])
+	respChan := make(chan bdbIntResp, 1)
+	if ok, err := conn.sendOrBusy(bdbStrLenReq{args[0], respChan}); !ok {
+		return err
+	}
+	resp := <-respChan
+	if resp.err != nil {
+		return conn.writeError(resp.err)
+	}
+	return conn.writeInt(resp.result)
+}
+
+func cmdGetRange(conn *Conn, args [][]byte) (err error) {
+	log.Debug("cmdGetRange|%s|%s|%s", args[0], args[1], args[2])
+	start, err := strconv.ParseInt(string(args[1]), 10, 64)
+	if err != nil {
+		return conn.writeError(ErrNotInteger)
+	}
+	end, err := strconv.ParseInt(string(args[2]), 10, 64)
+	if err != nil {
+		return conn.writeError(ErrNotInteger)
+	}
+	respChan := make(chan bdbGetResp, 1)
+	if ok, err := conn.sendOrBusy(bdbStrRangeReq{args[0], start, end, respChan}); !ok {
+		return err
+	}
+	resp := <-respChan
+	if resp.err != nil {
+		return conn.writeError(resp.err)
+	}
+	if resp.value == nil {
+		resp.value = []byte{}
+	}
+	return conn.writeBulk(resp.value)
+}
+
+func cmdSetRange(conn *Conn, args [][]byte) (err error) {
+	log.Debug("cmdSetRange|%s|%s|%v", args[0], args[1], args[2])
+	off, err := strconv.ParseInt(string(args[1]), 10, 64)
+	if err != nil {
+		return conn.writeError(ErrNotInteger)
+	}
+	if off < 0 {
+		return conn.writeError(ErrOffsetRange)
+	}
+	if off+int64(len(args[2])) > maxStringSize {
+		return conn.writeError(ErrStringSize)
+	}
+	respChan := make(chan bdbIntResp, 1)
+	if ok, err := conn.sendOrBusy(bdbSetRangeReq{args[0], uint32(off), args[2], respChan}); !ok {
+		return err
+	}
+	resp := <-respChan
+	if resp.err != nil {
+		return conn.writeError(resp.err)
+	}
+	return conn.writeInt(resp.result)
+}
+
+func cmdGetSet(conn *Conn, args [][]byte) (err error) {
+	log.Debug("cmdGetSet|%s|%v", args[0], args[1])
+	respChan := make(chan bdbGetResp, 1)
+	if ok, err := conn.sendOrBusy(bdbGetSetReq{args[0], args[1], respChan}); !ok {
+		return err
+	}
+	resp := <-respChan
+	if resp.err != nil {
+		return conn.writeError(resp.err)
+	}
+	return conn.writeBulk(resp.value)
+}
+
+func cmdGetDel(conn *Conn, args [][]byte) (err error) {
+	log.Debug("cmdGetDel|%s", args[0])
+	respChan := make(chan bdbGetResp, 1)
+	if ok, err := conn.sendOrBusy(bdbGetDelReq{args[0], respChan}); !ok {
+		return err
+	}
+	resp := <-respChan
+	if resp.err != nil {
+		return conn.writeError(resp.err)
+	}
+	return conn.writeBulk(resp.value)
+}
+
+// parseGetExOption 解析GETEX的过期参数，过期时间以秒为单位，不足一秒的部分向上取整
+func parseGetExOption(args [][]byte) (int, uint32, error) {
+	if len(args) == 0 {
+		return expireKeep, 0, nil
+	}
+	opt := strings.ToLower(string(args[0]))
+	if opt == "persist" {
+		if len(args) != 1 {
+			return 0, 0, ErrSyntax
+		}
+		return expirePersist, 0, nil
+	}
+	if len(args) != 2 {
+		return 0, 0, ErrSyntax
+	}
+	n, err := strconv.ParseInt(string(args[1]), 10, 64)
+	if err != nil {
+		return 0, 0, ErrNotInteger
+	}
+	if n <= 0 {
+		return 0, 0, ErrGetExExpire
+	}
+	var ms int64
+	switch opt {
+	case "ex":
+		if n > math.MaxInt64/1000 {
+			return 0, 0, ErrGetExExpire
+		}
+		ms = n * 1000
+	case "px":
+		ms = n
+	case "exat":
+		if n > math.MaxInt64/1000 {
+			return 0, 0, ErrGetExExpire
+		}
+		ms = n*1000 - time.Now().UnixNano()/int64(time.Millisecond)
+	case "pxat":
+		ms = n - time.Now().UnixNano()/int64(time.Millisecond)
+	default:
+		return 0, 0, ErrSyntax
+	}
+	if ms <= 0 {
+		return expireDel, 0, nil
+	}
+	sec := (ms + 999) / 1000
+	if sec > math.MaxUint32 {
+		return 0, 0, ErrGetExExpire
+	}
+	return expireSet, uint32(sec), nil
+}
+
+func cmdGetEx(conn *Conn, args [][]byte) (err error) {
+	log.Debug("cmdGetEx|%s", args[0])
+	mode, sec, err := parseGetExOption(args[1:])
+	if err != nil {
+		return conn.writeError(err)
+	}
+	respChan := make(chan bdbGetResp, 1)
+	if ok, err := conn.sendOrBusy(bdbGetExReq{args[0], mode, sec, respChan}); !ok {
+		return err
+	}
+	resp := <-respChan
+	if resp.err != nil {
+		return conn.writeError(resp.err)
+	}
+	return conn.writeBulk(resp.value)
+}
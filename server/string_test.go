@@ -0,0 +1,31 @@
+package server
+
+import (
+	"github.com/nybuxtsui/bdbd/bdb"
+	"testing"
+)
+
+// GETSET之后key不再过期
+func TestGetSetPersist(t *testing.T) {
+	w := testWorker(t, 1011)
+	resp := make(chan bdbSetResp, 1)
+	w.dispatch(bdbSetReq{key: []byte("t027:k"), value: []byte("a"), sec: 60, resp: resp})
+	if err := (<-resp).err; err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.expireindex.Get(nil, []byte("t027:k"), &w.getbuff, 0); err != nil {
+		t.Fatalf("expire index after SETEX: %v", err)
+	}
+
+	getResp := make(chan bdbGetResp, 1)
+	w.dispatch(bdbGetSetReq{[]byte("t027:k"), []byte("b"), getResp})
+	if r := <-getResp; r.err != nil || string(r.value) != "a" {
+		t.Fatalf("getset = %q, %v", r.value, r.err)
+	}
+	if _, err := w.expireindex.Get(nil, []byte("t027:k"), &w.getbuff, 0); err != bdb.ErrNotFound {
+		t.Fatalf("expire index after GETSET: %v, want %v", err, bdb.ErrNotFound)
+	}
+	if v, err := w.testGet("t027:k"); err != nil || string(v) != "b" {
+		t.Fatalf("value = %q, %v", v, err)
+	}
+}
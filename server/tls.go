@@ -0,0 +1,181 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"github.com/nybuxtsui/log"
+	"io/ioutil"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TLSConfig 客户端连接的TLS配置
+type TLSConfig struct {
+	CertFile   string
+	KeyFile    string
+	CACertFile string
+	// AuthClients no: 不要求客户端证书，optional: 有证书时验证，yes: 必须有证书
+	AuthClients string
+	// AuthClientsUser 为true时以客户端证书的CN作为ACL用户登录，用户不存在时和普通连接一样
+	AuthClientsUser bool
+}
+
+// tlsHandshakeTimeout 握手超过这个时间关闭连接，避免占用goroutine
+const tlsHandshakeTimeout = 10 * time.Second
+
+var ErrNoCert = errors.New("tls cert and key are required")
+
+// tlsState 当前使用的证书，重新加载时替换，已经建立的连接不受影响
+var tlsState = struct {
+	sync.RWMutex
+	cfg    TLSConfig
+	config *tls.Config
+}{}
+
+func buildTLSConfig(cfg TLSConfig) (*tls.Config, error) {
+	if cfg.CertFile == "" || cfg.KeyFile == "" {
+		return nil, ErrNoCert
+	}
+	cert, err := tls.LoadX509KeyPair(cfg.CertFile, cfg.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+	config := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+	switch strings.ToLower(cfg.AuthClients) {
+	case "", "no":
+		config.ClientAuth = tls.NoClientCert
+	case "optional":
+		config.ClientAuth = tls.VerifyClientCertIfGiven
+	case "yes":
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	default:
+		return nil, fmt.Errorf("invalid tls_auth_clients: %s", cfg.AuthClients)
+	}
+	if config.ClientAuth != tls.NoClientCert {
+		if cfg.CACertFile == "" {
+			return nil, errors.New("tls_ca_cert_file is required to verify client certificates")
+		}
+		pem, err := ioutil.ReadFile(cfg.CACertFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificate found in %s", cfg.CACertFile)
+		}
+		config.ClientCAs = pool
+	}
+	return config, nil
+}
+
+// StartTLS 读取证书，返回给tls.Server使用的配置，每次握手时取当前的证书
+func StartTLS(cfg TLSConfig) (*tls.Config, error) {
+	config, err := buildTLSConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
+	tlsState.Lock()
+	tlsState.cfg = cfg
+	tlsState.config = config
+	tlsState.Unlock()
+
+	RegisterConfig("tls-cert-file", "server", "tls_cert_file", true,
+		func() string { return tlsCfg().CertFile },
+		tlsSetter(func(cfg *TLSConfig, value string) { cfg.CertFile = value }))
+	RegisterConfig("tls-key-file", "server", "tls_key_file", true,
+		func() string { return tlsCfg().KeyFile },
+		tlsSetter(func(cfg *TLSConfig, value string) { cfg.KeyFile = value }))
+	RegisterConfig("tls-ca-cert-file", "server", "tls_ca_cert_file", true,
+		func() string { return tlsCfg().CACertFile },
+		tlsSetter(func(cfg *TLSConfig, value string) { cfg.CACertFile = value }))
+
+	return &tls.Config{
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			tlsState.RLock()
+			defer tlsState.RUnlock()
+			return tlsState.config, nil
+		},
+	}, nil
+}
+
+func tlsCfg() TLSConfig {
+	tlsState.RLock()
+	defer tlsState.RUnlock()
+	return tlsState.cfg
+}
+
+// tlsSetter CONFIG SET修改证书路径，检查时按当前的配置加载一次新的证书
+func tlsSetter(set func(*TLSConfig, string)) ConfigSetter {
+	return func(value string) (func() error, error) {
+		cfg := tlsCfg()
+		set(&cfg, value)
+		if _, err := buildTLSConfig(cfg); err != nil {
+			return nil, err
+		}
+		return func() error {
+			return setTLSFile(func(cfg *TLSConfig) { set(cfg, value) })
+		}, nil
+	}
+}
+
+// setTLSFile 修改证书路径并重新加载，加载失败时不修改
+func setTLSFile(change func(*TLSConfig)) error {
+	tlsState.Lock()
+	defer tlsState.Unlock()
+	cfg := tlsState.cfg
+	change(&cfg)
+	config, err := buildTLSConfig(cfg)
+	if err != nil {
+		return err
+	}
+	tlsState.cfg = cfg
+	tlsState.config = config
+	return nil
+}
+
+// ReloadTLS 重新读取证书文件，证书更新后由SIGHUP触发
+func ReloadTLS() error {
+	if tlsCfg().CertFile == "" {
+		return nil
+	}
+	if err := setTLSFile(func(*TLSConfig) {}); err != nil {
+		log.Error("ReloadTLS|%s", err.Error())
+		return err
+	}
+	log.Info("ReloadTLS|ok")
+	return nil
+}
+
+// tlsHandshake 在读取命令之前完成握手，根据客户端证书切换ACL用户
+func (c *Conn) tlsHandshake(tc *tls.Conn) error {
+	tc.SetDeadline(time.Now().Add(tlsHandshakeTimeout))
+	if err := tc.Handshake(); err != nil {
+		return err
+	}
+	tc.SetDeadline(time.Time{})
+	if !tlsCfg().AuthClientsUser {
+		return nil
+	}
+	state := tc.ConnectionState()
+	if len(state.VerifiedChains) == 0 || len(state.PeerCertificates) == 0 {
+		return nil
+	}
+	name := state.PeerCertificates[0].Subject.CommonName
+	acl.RLock()
+	u := acl.users[name]
+	ok := u != nil && u.enabled
+	acl.RUnlock()
+	if ok {
+		log.Debug("tlsHandshake|user|%s|%s", c.addr, name)
+		c.mu.Lock()
+		c.user = name
+		c.mu.Unlock()
+	}
+	return nil
+}
@@ -0,0 +1,218 @@
+package server
+
+import (
+	"encoding/binary"
+	"github.com/nybuxtsui/bdbd/bdb"
+	"github.com/nybuxtsui/log"
+	"strconv"
+)
+
+// 每个key的版本号保存在__version表中，key为完整的key，value为8字节大端序的版本号。
+// 所有修改key的命令都在同一个事务内把版本号加1，删除key时保留版本号，
+// key删除后重新创建版本号也不会回退，过期线程删除key时同样加1。
+// __version和普通的表一样随复制同步到副本，切换主节点后版本号不变。
+// 同一个事务中先锁数据再锁版本号。
+
+type bdbGetVReq struct {
+	key  []byte
+	resp chan bdbGetVResp
+}
+
+type bdbGetVResp struct {
+	value   []byte
+	version uint64
+	err     error
+}
+
+type bdbCasReq struct {
+	key      []byte
+	expected uint64
+	value    []byte
+	resp     chan bdbCasResp
+}
+
+type bdbCasResp struct {
+	ok      bool
+	version uint64
+	err     error
+}
+
+func (w *Worker) openVersion() error {
+	if w.versiondb == nil {
+		var err error
+		w.versiondb, err = w.dbenv.GetDb("__version", bdb.DBTYPE_BTREE)
+		if err != nil {
+			log.Error("worker|GetDb|%s", err.Error())
+			return err
+		}
+	}
+	return nil
+}
+
+func (w *Worker) checkVersionErr(err error) {
+	countError(err)
+	if err == bdb.ErrRepDead {
+		w.versiondb.Close()
+		w.versiondb = nil
+	}
+}
+
+// getVersion 返回key的版本号，没有记录时为0
+func (w *Worker) getVersion(txn *bdb.Txn, key []byte, flags uint32) (uint64, error) {
+	if err := w.openVersion(); err != nil {
+		return 0, err
+	}
+	value, err := w.versiondb.Get(txn, key, &w.getbuff, flags)
+	if err == bdb.ErrNotFound {
+		return 0, nil
+	} else if err != nil {
+		w.checkVersionErr(err)
+		return 0, err
+	}
+	if len(value) != 8 {
+		return 0, nil
+	}
+	return binary.BigEndian.Uint64(value), nil
+}
+
+func (w *Worker) setVersion(txn *bdb.Txn, key []byte, version uint64) error {
+	var buf [8]byte
+	binary.BigEndian.PutUint64(buf[:], version)
+	err := w.versiondb.Set(txn, key, buf[:], 0)
+	if err != nil {
+		w.checkVersionErr(err)
+	}
+	return err
+}
+
+// bumpVersion 在txn中把key的版本号加1，key必须是SplitKey之前的完整key
+func (w *Worker) bumpVersion(txn *bdb.Txn, key []byte) (uint64, error) {
+	version, err := w.getVersion(txn, key, bdb.DB_RMW)
+	if err != nil {
+		return 0, err
+	}
+	version++
+	return version, w.setVersion(txn, key, version)
+}
+
+func (w *Worker) bdbGetV(req *bdbGetVReq) {
+	key := append([]byte(nil), req.key...)
+	table, name := bdb.SplitKey(req.key)
+	db, err := w.getdb(table, bdb.DBTYPE_BTREE)
+	if err != nil {
+		req.resp <- bdbGetVResp{nil, 0, err}
+		return
+	}
+	// 在同一个事务内读取，保证值和版本号是一致的
+	txn, err := w.dbenv.Begin(bdb.DB_READ_COMMITTED)
+	if err != nil {
+		req.resp <- bdbGetVResp{nil, 0, err}
+		return
+	}
+	defer txn.Abort()
+	value, err := db.Get(txn, name, &w.getbuff, 0)
+	if err == bdb.ErrNotFound {
+		value = nil
+	} else if err != nil {
+		w.checkerr(err, db)
+		req.resp <- bdbGetVResp{nil, 0, err}
+		return
+	}
+	version, err := w.getVersion(txn, key, 0)
+	if err != nil {
+		req.resp <- bdbGetVResp{nil, 0, err}
+		return
+	}
+	req.resp <- bdbGetVResp{value, version, nil}
+}
+
+func (w *Worker) bdbCas(req *bdbCasReq) {
+	key := append([]byte(nil), req.key...)
+	table, name := bdb.SplitKey(req.key)
+	db, err := w.getdb(table, bdb.DBTYPE_BTREE)
+	if err != nil {
+		req.resp <- bdbCasResp{false, 0, err}
+		return
+	}
+	txn, err := w.dbenv.Begin(bdb.DB_READ_COMMITTED)
+	if err != nil {
+		req.resp <- bdbCasResp{false, 0, err}
+		return
+	}
+	defer func() {
+		if txn != nil {
+			txn.Abort()
+		}
+	}()
+
+	// 和SET一样先锁数据再锁版本号，加锁顺序不同时会死锁
+	if _, err = db.Get(txn, name, &w.getbuff, bdb.DB_RMW); err != nil && err != bdb.ErrNotFound {
+		w.checkerr(err, db)
+		req.resp <- bdbCasResp{false, 0, err}
+		return
+	}
+	version, err := w.getVersion(txn, key, bdb.DB_RMW)
+	if err != nil {
+		req.resp <- bdbCasResp{false, 0, err}
+		return
+	}
+	if version != req.expected {
+		req.resp <- bdbCasResp{false, version, nil}
+		return
+	}
+	err = db.Set(txn, name, req.value, 0)
+	if err != nil {
+		w.checkerr(err, db)
+		req.resp <- bdbCasResp{false, 0, err}
+		return
+	}
+	version++
+	if err = w.setVersion(txn, key, version); err != nil {
+		req.resp <- bdbCasResp{false, 0, err}
+		return
+	}
+	err = txn.Commit()
+	txn = nil
+	if err != nil {
+		req.resp <- bdbCasResp{false, 0, err}
+		return
+	}
+	req.resp <- bdbCasResp{true, version, nil}
+}
+
+// cmdGetV 返回[value, version]，key不存在时value为nil，version为最后一次的版本号
+func cmdGetV(conn *Conn, args [][]byte) (err error) {
+	log.Debug("cmdGetV|%s", args[0])
+	respChan := make(chan bdbGetVResp, 1)
+	if ok, err := conn.sendOrBusy(bdbGetVReq{args[0], respChan}); !ok {
+		return err
+	}
+	resp := <-respChan
+	if resp.err != nil {
+		return conn.writeError(resp.err)
+	}
+	conn.writeLen('*', 2)
+	conn.writeBulk(resp.value)
+	return conn.writeInt(int64(resp.version))
+}
+
+// cmdCas 版本号等于expected_version时写入value，成功时返回新的版本号，失败时返回nil
+func cmdCas(conn *Conn, args [][]byte) (err error) {
+	log.Debug("cmdCas|%s|%s", args[0], args[1])
+	expected, err := strconv.ParseUint(string(args[1]), 10, 64)
+	if err != nil {
+		return conn.writeError(ErrNotInteger)
+	}
+	respChan := make(chan bdbCasResp, 1)
+	if ok, err := conn.sendOrBusy(bdbCasReq{args[0], expected, args[2], respChan}); !ok {
+		return err
+	}
+	resp := <-respChan
+	if resp.err != nil {
+		return conn.writeError(resp.err)
+	}
+	if !resp.ok {
+		return conn.writeBulk(nil)
+	}
+	return conn.writeInt(int64(resp.version))
+}
@@ -0,0 +1,99 @@
+package server
+
+import (
+	"github.com/nybuxtsui/bdbd/bdb"
+	"sync"
+	"testing"
+	"time"
+)
+
+func (w *Worker) testGetV(key string) (bdbGetVResp, error) {
+	resp := make(chan bdbGetVResp, 1)
+	w.dispatch(bdbGetVReq{[]byte(key), resp})
+	r := <-resp
+	return r, r.err
+}
+
+func (w *Worker) testCas(key string, expected uint64, value string) (bdbCasResp, error) {
+	resp := make(chan bdbCasResp, 1)
+	w.dispatch(bdbCasReq{[]byte(key), expected, []byte(value), resp})
+	r := <-resp
+	return r, r.err
+}
+
+// key过期后重新写入同样的值，之前读到的版本号不能再CAS成功
+func TestCasAcrossExpiry(t *testing.T) {
+	w := testWorker(t, 1003)
+	resp := make(chan bdbSetResp, 1)
+	w.dispatch(bdbSetReq{key: []byte("t033:k"), value: []byte("a"), sec: 1, resp: resp})
+	if err := (<-resp).err; err != nil {
+		t.Fatal(err)
+	}
+	before, err := w.testGetV("t033:k")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		r, err := w.testGetV("t033:k")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if r.value == nil {
+			if r.version <= before.version {
+				t.Fatalf("version after expiry = %d, want > %d", r.version, before.version)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("key not expired")
+		}
+		time.Sleep(200 * time.Millisecond)
+	}
+
+	if r, err := w.testCas("t033:k", before.version, "b"); err != nil || r.ok {
+		t.Fatalf("cas with version before expiry = %v, %v", r.ok, err)
+	}
+}
+
+// CAS和SET同时修改同一个key时加锁顺序相同，不会死锁
+func TestCasSetLockOrder(t *testing.T) {
+	w1, w2 := testWorker(t, 1004), testWorker(t, 1005)
+	if err := w1.testSet("t033:lock", "0"); err != nil {
+		t.Fatal(err)
+	}
+	var wg sync.WaitGroup
+	errs := make(chan error, 2)
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 500; i++ {
+			if err := w1.testSet("t033:lock", "set"); err != nil {
+				errs <- err
+				return
+			}
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 500; i++ {
+			r, err := w2.testGetV("t033:lock")
+			if err == nil {
+				_, err = w2.testCas("t033:lock", r.version, "cas")
+			}
+			if err != nil {
+				errs <- err
+				return
+			}
+		}
+	}()
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err == bdb.ErrDeadLock {
+			t.Fatal("deadlock between CAS and SET")
+		}
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,393 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"github.com/nybuxtsui/bdbd/bdb"
+	"github.com/nybuxtsui/log"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	// Workers 启动时worker的个数，开启自动伸缩时是最少的个数
+	Workers = 4
+	// WorkersMax 大于Workers时开启自动伸缩，排队时间超过WorkerScaleWait时增加worker，最多到这个数
+	WorkersMax = 0
+	// WorkerScaleWait 请求在队列中平均等待超过这个时间(毫秒)时增加worker
+	WorkerScaleWait int64 = 5
+	// WorkQueueSize 等待worker处理的请求队列的长度
+	WorkQueueSize = 10000
+	// WorkQueueTimeout 队列满时最多等待的时间(毫秒)，超过后返回BUSY错误，0表示不等待
+	WorkQueueTimeout int64 = 1000
+	// WorkerLockThread worker固定在一个系统线程上，bdb的锁和日志缓存按线程分配，固定后效率更高
+	WorkerLockThread = true
+	// RouteByKey 启动时的Workers个worker各有一个队列，只有一个key的命令按key的hash放到固定的队列中，
+	// 同一个key的操作按顺序执行，不会在worker之间争用锁。多个key的命令由coordinator协调涉及的队列，
+	// 没有key的请求放在共享队列中，由任意一个worker处理。自动伸缩增加的worker只处理共享队列
+	RouteByKey = true
+)
+
+// workerScaleInterval 自动伸缩检查的间隔
+const workerScaleInterval = time.Second
+
+// workerIdleTicks 连续这么多次检查排队时间都很短时减少一个worker
+const workerIdleTicks = 10
+
+var ErrBusy = errors.New("server is busy, work queue is full")
+
+// queueFull 队列满被拒绝的请求数
+var queueFull int64
+
+var (
+	routedKey    int64 // 按key放到worker自己的队列中的请求数
+	routedShared int64 // 放到共享队列中的请求数
+	routedMulti  int64 // 多个key分布在几个队列中，由coordinator协调的请求数
+)
+
+// pool 所有的worker，/metrics读取忙碌时间。worker的id不重复使用，过期数据的key中包含id
+var pool = struct {
+	sync.Mutex
+	workers []*Worker
+	lanes   []chan workItem // 按key分配的队列，Start之后不再修改，不需要加锁
+	nextId  int
+	stopped bool          // 退出时关闭workChan之前设置，不再增加worker
+	retire  chan struct{} // 收到的worker处理完当前请求后退出
+	waitNs  int64         // 上次检查以来请求在队列中等待的总时间
+	waitN   int64         // 上次检查以来处理的请求数
+}{retire: make(chan struct{}, 1)}
+
+// workerCount 当前worker的个数
+func workerCount() int {
+	pool.Lock()
+	defer pool.Unlock()
+	return len(pool.workers)
+}
+
+// currentWorkers 当前所有worker的副本
+func currentWorkers() []*Worker {
+	pool.Lock()
+	defer pool.Unlock()
+	return append([]*Worker(nil), pool.workers...)
+}
+
+// queueLength 共享队列和所有按key分配的队列中的请求数
+func queueLength() int {
+	n := len(workChan)
+	for _, lane := range pool.lanes {
+		n += len(lane)
+	}
+	return n
+}
+
+// startWorker 增加一个worker，lane不为nil时同时处理这个队列，并且不会被自动伸缩减少。退出时返回false
+func startWorker(dbenv *bdb.DbEnv, lane chan workItem) bool {
+	pool.Lock()
+	defer pool.Unlock()
+	if pool.stopped {
+		return false
+	}
+	w := NewWorker(pool.nextId, dbenv)
+	w.lane = lane
+	pool.nextId++
+	pool.workers = append(pool.workers, w)
+	workWait.Add(1)
+	go w.start()
+	log.Info("worker|start|%d|%d", w.id, len(pool.workers))
+	return true
+}
+
+// removeWorker worker退出时调用
+func removeWorker(w *Worker) {
+	pool.Lock()
+	defer pool.Unlock()
+	for i, v := range pool.workers {
+		if v == w {
+			pool.workers = append(pool.workers[:i], pool.workers[i+1:]...)
+			break
+		}
+	}
+}
+
+// retireWorker 让一个worker处理完当前请求后退出，上一个还没有退出时返回false
+func retireWorker() bool {
+	select {
+	case pool.retire <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+// checkWorkers 有自己队列的worker不能减少
+func checkWorkers(n int) error {
+	if n < len(pool.lanes) {
+		return fmt.Errorf("can't be less than the %d workers used by route-by-key", len(pool.lanes))
+	}
+	return nil
+}
+
+// setWorkers CONFIG SET workers，立即增加或减少到n个，自动伸缩时作为最小值
+func setWorkers(dbenv *bdb.DbEnv, n int) error {
+	if err := checkWorkers(n); err != nil {
+		return err
+	}
+	pool.Lock()
+	Workers = n
+	pool.Unlock()
+	for workerCount() < n {
+		if !startWorker(dbenv, nil) {
+			return nil
+		}
+	}
+	// 减少的时候每次只能通知一个，剩下的由scaleWorkers继续处理
+	if workerCount() > n {
+		retireWorker()
+	}
+	return nil
+}
+
+// keyLane 按key的hash(FNV-1a)选择队列
+func keyLane(key []byte) int {
+	h := uint32(2166136261)
+	for _, b := range key {
+		h ^= uint32(b)
+		h *= 16777619
+	}
+	return int(h % uint32(len(pool.lanes)))
+}
+
+// setRoute processRequest在执行命令之前调用，决定这个命令的请求放到哪个队列。
+// 所有key都在同一个队列时放到这个队列，分布在几个队列中时由sendCoordinated处理
+func (c *Conn) setRoute(cmd string, args [][]byte) {
+	c.lane, c.lanes = -1, c.lanes[:0]
+	if len(pool.lanes) == 0 {
+		return
+	}
+	spec, ok := cmdKeys[cmd]
+	if !ok {
+		return
+	}
+	last := spec.last
+	if last < 0 || last >= len(args) {
+		last = len(args) - 1
+	}
+next:
+	for i := spec.first; i <= last; i++ {
+		lane := keyLane(args[i])
+		for _, v := range c.lanes {
+			if v == lane {
+				continue next
+			}
+		}
+		c.lanes = append(c.lanes, lane)
+	}
+	if len(c.lanes) == 1 {
+		c.lane = c.lanes[0]
+	}
+}
+
+// coordinator 多个key分布在几个队列中时，请求放到第一个key的队列，其他队列中各放一个laneBarrier，
+// 这些队列的worker处理到barrier时暂停，执行命令的worker等它们都暂停后才执行，
+// 所以命令执行时这些key上没有其他worker的操作。
+// 放入队列时加锁，保证任意两个协调的请求在它们共同的队列中先后顺序相同，不会互相等待
+var coordinator sync.Mutex
+
+// laneBarrier 放在其他队列中，worker处理到时通知ready，然后等待命令执行完
+type laneBarrier struct {
+	ready   chan struct{} // 缓冲大小是barrier的个数，取消时不会阻塞
+	release chan struct{}
+}
+
+func (b laneBarrier) wait() {
+	b.ready <- struct{}{}
+	<-b.release
+}
+
+// coordinatedReq 放在第一个key的队列中，n个barrier都到达后执行req
+type coordinatedReq struct {
+	req     interface{}
+	barrier laneBarrier
+	n       int
+}
+
+func (r *coordinatedReq) run(w *Worker) {
+	for i := 0; i < r.n; i++ {
+		<-r.barrier.ready
+	}
+	defer close(r.barrier.release)
+	w.dispatch(r.req)
+}
+
+// sendCoordinated 把多个key分布在几个队列中的请求交给worker，见coordinator。
+// 有队列满时取消已经放入的barrier，返回ErrBusy
+func (c *Conn) sendCoordinated(req interface{}) error {
+	n := len(c.lanes) - 1
+	barrier := laneBarrier{make(chan struct{}, n), make(chan struct{})}
+	coordinator.Lock()
+	defer coordinator.Unlock()
+	now := time.Now()
+	busy := func(lane int) error {
+		close(barrier.release)
+		atomic.AddInt64(&queueFull, 1)
+		log.Error("send|busy|%s|%d|%d", c.addr, lane, len(pool.lanes[lane]))
+		return ErrBusy
+	}
+	for _, lane := range c.lanes[1:] {
+		if !enqueue(pool.lanes[lane], workItem{c, barrier, now}) {
+			return busy(lane)
+		}
+	}
+	// 执行命令的请求最后放入，之前失败时不需要取消
+	if !enqueue(pool.lanes[c.lanes[0]], workItem{c, coordinatedReq{req, barrier, n}, now}) {
+		return busy(c.lanes[0])
+	}
+	atomic.AddInt64(&routedMulti, 1)
+	c.markSent()
+	return nil
+}
+
+// recordQueueWait worker取到请求时记录排队时间，用于自动伸缩
+func recordQueueWait(d time.Duration) {
+	atomic.AddInt64(&pool.waitNs, int64(d))
+	atomic.AddInt64(&pool.waitN, 1)
+}
+
+// scaleWorkers 定时检查请求的平均排队时间，排队时间长时增加worker，
+// 长时间空闲时减少到Workers个
+func scaleWorkers(dbenv *bdb.DbEnv) {
+	ticker := time.NewTicker(workerScaleInterval)
+	defer ticker.Stop()
+	idle := 0
+	for {
+		select {
+		case <-shutdown.ch:
+			return
+		case <-ticker.C:
+		}
+		waitNs := atomic.SwapInt64(&pool.waitNs, 0)
+		waitN := atomic.SwapInt64(&pool.waitN, 0)
+		pool.Lock()
+		min, max := Workers, WorkersMax
+		pool.Unlock()
+		n := workerCount()
+		threshold := time.Duration(atomic.LoadInt64(&WorkerScaleWait)) * time.Millisecond
+		var avg time.Duration
+		if waitN > 0 {
+			avg = time.Duration(waitNs / waitN)
+		}
+		switch {
+		case n < min:
+			startWorker(dbenv, nil)
+			idle = 0
+		case avg > threshold && n < max:
+			log.Info("worker|scale_up|%d|%s", n+1, avg)
+			startWorker(dbenv, nil)
+			idle = 0
+		case n > min && max <= min:
+			// 没有开启自动伸缩，CONFIG SET workers减少了个数
+			retireWorker()
+		case n > min && avg < threshold/2:
+			idle++
+			if idle >= workerIdleTicks && retireWorker() {
+				log.Info("worker|scale_down|%d|%s", n-1, avg)
+				idle = 0
+			}
+		default:
+			idle = 0
+		}
+	}
+}
+
+// bdbCloseTableReq 通过ctrl发给每个worker，关闭打开的表，下次使用时重新打开
+type bdbCloseTableReq struct {
+	table string
+	resp  chan struct{}
+}
+
+func (w *Worker) bdbCloseTable(req *bdbCloseTableReq) {
+	if db := w.dbmap[req.table]; db != nil {
+		delete(w.dbmap, req.table)
+		db.Close()
+	}
+	req.resp <- struct{}{}
+}
+
+// closeTable 让所有worker关闭table，等所有worker都处理完后返回。不能在worker中调用
+func closeTable(table string) {
+	for _, w := range currentWorkers() {
+		resp := make(chan struct{}, 1)
+		select {
+		case w.ctrl <- bdbCloseTableReq{table, resp}:
+		case <-w.quit:
+			continue
+		}
+		select {
+		case <-resp:
+		case <-w.quit:
+		}
+	}
+}
+
+// stopWorkers 所有连接关闭之后调用，等待worker处理完队列中的请求后退出
+func stopWorkers() {
+	pool.Lock()
+	pool.stopped = true
+	pool.Unlock()
+	close(workChan)
+	for _, lane := range pool.lanes {
+		close(lane)
+	}
+	workWait.Wait()
+}
+
+func initWorkerConfig(dbenv *bdb.DbEnv) {
+	RegisterConfig("workers", "server", "workers", false,
+		func() string {
+			pool.Lock()
+			defer pool.Unlock()
+			return strconv.Itoa(Workers)
+		},
+		func(value string) (func() error, error) {
+			n, err := parseConfigInt(value, 1, 1024)
+			if err == nil {
+				err = checkWorkers(int(n))
+			}
+			if err != nil {
+				return nil, err
+			}
+			return func() error { return setWorkers(dbenv, int(n)) }, nil
+		})
+	RegisterConfig("workers-max", "server", "workers_max", false,
+		func() string {
+			pool.Lock()
+			defer pool.Unlock()
+			return strconv.Itoa(WorkersMax)
+		},
+		func(value string) (func() error, error) {
+			n, err := parseConfigInt(value, 0, 1024)
+			if err != nil {
+				return nil, err
+			}
+			return func() error {
+				pool.Lock()
+				WorkersMax = int(n)
+				pool.Unlock()
+				return nil
+			}, nil
+		})
+	RegisterConfig("worker-scale-wait", "server", "worker_scale_wait", false,
+		func() string { return strconv.FormatInt(atomic.LoadInt64(&WorkerScaleWait), 10) },
+		intSetter(&WorkerScaleWait, 1, math32))
+	RegisterConfig("work-queue-size", "server", "work_queue_size", false,
+		func() string { return strconv.Itoa(cap(workChan)) }, nil)
+	RegisterConfig("work-queue-timeout", "server", "work_queue_timeout", false,
+		func() string { return strconv.FormatInt(atomic.LoadInt64(&WorkQueueTimeout), 10) },
+		intSetter(&WorkQueueTimeout, 0, math32))
+	RegisterConfig("worker-lock-thread", "server", "worker_lock_thread", false,
+		func() string { return strconv.FormatBool(WorkerLockThread) }, nil)
+	RegisterConfig("route-by-key", "server", "route_by_key", false,
+		func() string { return strconv.FormatBool(RouteByKey) }, nil)
+}
@@ -0,0 +1,120 @@
+package server
+
+import (
+	"github.com/nybuxtsui/bdbd/bdb"
+	"strconv"
+	"sync/atomic"
+	"testing"
+)
+
+func lockStat(name string) int64 {
+	for _, item := range testEnv.Stat() {
+		if item.Name == name {
+			return item.Value
+		}
+	}
+	return 0
+}
+
+// keysInLanes 返回n个分别在不同队列中的key
+func keysInLanes(t testing.TB, prefix string, n int) [][]byte {
+	if len(pool.lanes) < n {
+		t.Skipf("need %d lanes, have %d", n, len(pool.lanes))
+	}
+	keys := make([][]byte, 0, n)
+	used := map[int]bool{}
+	for i := 0; len(keys) < n; i++ {
+		key := []byte(prefix + strconv.Itoa(i))
+		if lane := keyLane(key); !used[lane] {
+			used[lane] = true
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+// 多个key在不同队列中的命令由coordinator执行，结果和在一个worker中执行相同
+func TestRouteMultiKey(t *testing.T) {
+	keys := keysInLanes(t, "t048:", 3)
+	w := testWorker(t, 1006)
+	if err := w.testSet(string(keys[1]), "a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.testSet(string(keys[2]), "b"); err != nil {
+		t.Fatal(err)
+	}
+
+	conn := testConn(t)
+	args := [][]byte{[]byte("or"), keys[0], keys[1], keys[2]}
+	conn.setRoute("bitop", args)
+	if conn.lane != -1 || len(conn.lanes) != 3 {
+		t.Fatalf("lane = %d, lanes = %v", conn.lane, conn.lanes)
+	}
+	multi := atomic.LoadInt64(&routedMulti)
+	resp := make(chan bdbIntResp, 1)
+	if err := conn.send(bdbBitOpReq{"or", keys[0], keys[1:], resp}); err != nil {
+		t.Fatal(err)
+	}
+	if r := <-resp; r.err != nil || r.result != 1 {
+		t.Fatalf("bitop = %d, %v", r.result, r.err)
+	}
+	if atomic.LoadInt64(&routedMulti) != multi+1 {
+		t.Fatal("bitop not coordinated")
+	}
+	if v, err := w.testGet(string(keys[0])); err != nil || string(v) != "c" {
+		t.Fatalf("dest = %q, %v", v, err)
+	}
+
+	// 所有key在同一个队列中时直接放到这个队列
+	conn.setRoute("pfcount", [][]byte{keys[1], keys[1]})
+	if conn.lane != keyLane(keys[1]) || len(conn.lanes) != 1 {
+		t.Fatalf("lane = %d, lanes = %v", conn.lane, conn.lanes)
+	}
+}
+
+// 多个连接同时修改少量key，对比共享队列和按key分配队列时bdb检测到的死锁。
+//
+//	go test -run NONE -bench RouteByKey ./server
+func BenchmarkRouteByKey(b *testing.B) {
+	for _, byKey := range []bool{false, true} {
+		name := "shared"
+		if byKey {
+			name = "by_key"
+		}
+		b.Run(name, func(b *testing.B) {
+			deadlocks, waits := lockStat("lock_deadlocks"), lockStat("lock_waits")
+			var errs int64
+			b.SetParallelism(8)
+			b.RunParallel(func(pb *testing.PB) {
+				conn := testConn(b)
+				setResp, incrResp := make(chan bdbSetResp, 1), make(chan bdbIncrByResp, 1)
+				for i := 0; pb.Next(); i++ {
+					key := []byte("t048:" + name + ":" + strconv.Itoa(i%16))
+					conn.setRoute("incrby", [][]byte{key})
+					if !byKey {
+						conn.lane, conn.lanes = -1, conn.lanes[:0]
+					}
+					var err error
+					if i%4 == 0 {
+						if err = conn.send(bdbSetReq{key: key, value: []byte("1"), sec: 60, resp: setResp}); err == nil {
+							err = (<-setResp).err
+						}
+					} else {
+						if err = conn.send(bdbIncrByReq{key, 1, incrResp}); err == nil {
+							err = (<-incrResp).err
+						}
+					}
+					if err == bdb.ErrDeadLock {
+						atomic.AddInt64(&errs, 1)
+					} else if err != nil {
+						b.Error(err)
+						return
+					}
+				}
+			})
+			b.ReportMetric(float64(atomic.LoadInt64(&errs)), "ErrDeadLock")
+			b.ReportMetric(float64(lockStat("lock_deadlocks")-deadlocks), "deadlocks")
+			b.ReportMetric(float64(lockStat("lock_waits")-waits), "lock_waits")
+		})
+	}
+}
@@ -0,0 +1,3 @@
+# go vet检查所有包，server的测试在临时目录中启动一个单节点的bdb环境，参数传给go test，比如 ./test.sh -bench Pipeline
+CGO_CXXFLAGS="-I$HOME/local/bdb/include" CGO_CFLAGS="-I$HOME/local/bdb/include" CGO_LDFLAGS="-L$HOME/local/bdb/lib" go vet github.com/nybuxtsui/bdbd/bdb github.com/nybuxtsui/bdbd/server github.com/nybuxtsui/bdbd/bdbd || exit 1
+CGO_CXXFLAGS="-I$HOME/local/bdb/include" CGO_CFLAGS="-I$HOME/local/bdb/include" CGO_LDFLAGS="-L$HOME/local/bdb/lib" go test github.com/nybuxtsui/bdbd/server "$@"